@@ -0,0 +1,314 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"debug/elf"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxArtifactBytes caps the base64 archive the sandbox prints in artifacts
+// mode (RLIMIT_FSIZE already bounds each file).
+const maxArtifactBytes = 16 << 20
+
+// maxELFSymbols caps the symbol table returned in the JSON result; the
+// symbol map inside the archive is complete.
+const maxELFSymbols = 2000
+
+// Artifacts is what the compiler left in the sandbox work dir: the archive
+// is downloadable from URL for artifactTTL, ELF describes ./out.
+type Artifacts struct {
+	ID    string         `json:"id,omitempty"`
+	URL   string         `json:"url,omitempty"`
+	Files []ArtifactFile `json:"files"`
+	ELF   *ELFInfo       `json:"elf,omitempty"`
+	Error string         `json:"error,omitempty"`
+}
+
+type ArtifactFile struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+}
+
+// ELFInfo is the metadata of the compiled binary read with debug/elf.
+type ELFInfo struct {
+	Size             int64        `json:"size"`
+	Class            string       `json:"class"`
+	Machine          string       `json:"machine"`
+	Type             string       `json:"type"`
+	Entry            uint64       `json:"entry"`
+	Sections         []ELFSection `json:"sections"`
+	Symbols          []ELFSymbol  `json:"symbols"`
+	SymbolsTruncated bool         `json:"symbols_truncated,omitempty"`
+}
+
+type ELFSection struct {
+	Name   string `json:"name"`
+	Type   string `json:"type"`
+	Flags  string `json:"flags,omitempty"`
+	Addr   uint64 `json:"addr"`
+	Offset uint64 `json:"offset"`
+	Size   uint64 `json:"size"`
+}
+
+type ELFSymbol struct {
+	Name    string `json:"name"`
+	Type    string `json:"type"`
+	Bind    string `json:"bind"`
+	Section string `json:"section,omitempty"`
+	Value   uint64 `json:"value"`
+	Size    uint64 `json:"size"`
+}
+
+// collectArtifacts decodes the base64 tar printed by the sandbox, reads the
+// ELF metadata of ./out and stores a .tar.gz (plus a generated out.map) for
+// download under a random ID.
+func collectArtifacts(encoded string) *Artifacts {
+	a := &Artifacts{Files: []ArtifactFile{}}
+	raw, err := io.ReadAll(base64.NewDecoder(base64.StdEncoding, strings.NewReader(encoded)))
+	if err != nil {
+		a.Error = fmt.Sprintf("decode artifacts: %v", err)
+		return a
+	}
+	var files []artifactEntry
+	tr := tar.NewReader(bytes.NewReader(raw))
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			a.Error = fmt.Sprintf("read artifacts: %v", err)
+			return a
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			a.Error = fmt.Sprintf("read artifact %s: %v", hdr.Name, err)
+			return a
+		}
+		files = append(files, artifactEntry{name: strings.TrimPrefix(hdr.Name, "./"), data: data})
+	}
+	for _, f := range files {
+		if f.name != "out" {
+			continue
+		}
+		info, symbolMap, err := readELF(f.data)
+		if err != nil {
+			a.Error = fmt.Sprintf("parse ELF: %v", err)
+			break
+		}
+		a.ELF = info
+		files = append(files, artifactEntry{name: "out.map", data: symbolMap})
+		break
+	}
+	for _, f := range files {
+		a.Files = append(a.Files, ArtifactFile{Name: f.name, Size: int64(len(f.data))})
+	}
+	if len(files) == 0 {
+		return a
+	}
+	archive, err := gzipArtifacts(files)
+	if err != nil {
+		a.Error = fmt.Sprintf("archive artifacts: %v", err)
+		return a
+	}
+	idBytes := make([]byte, 16)
+	if _, err := rand.Read(idBytes); err != nil {
+		a.Error = fmt.Sprintf("generate artifact id: %v", err)
+		return a
+	}
+	a.ID = fmt.Sprintf("%x", idBytes)
+	artifactsStore.put(a.ID, archive)
+	a.URL = "/artifacts/" + a.ID
+	return a
+}
+
+type artifactEntry struct {
+	name string
+	data []byte
+}
+
+func gzipArtifacts(files []artifactEntry) ([]byte, error) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	now := time.Now()
+	for _, f := range files {
+		hdr := &tar.Header{Name: f.name, Mode: 0o644, Size: int64(len(f.data)), ModTime: now}
+		if f.name == "out" {
+			hdr.Mode = 0o755
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return nil, err
+		}
+		if _, err := tw.Write(f.data); err != nil {
+			return nil, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// readELF returns the metadata of the binary and a symbol map sorted by
+// address ("<addr> <size> <type> <name>", like nm -S -n).
+func readELF(data []byte) (*ELFInfo, []byte, error) {
+	f, err := elf.NewFile(bytes.NewReader(data))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	info := &ELFInfo{
+		Size:     int64(len(data)),
+		Class:    f.Class.String(),
+		Machine:  f.Machine.String(),
+		Type:     f.Type.String(),
+		Entry:    f.Entry,
+		Sections: []ELFSection{},
+		Symbols:  []ELFSymbol{},
+	}
+	for _, s := range f.Sections {
+		if s.Type == elf.SHT_NULL {
+			continue
+		}
+		info.Sections = append(info.Sections, ELFSection{
+			Name:   s.Name,
+			Type:   s.Type.String(),
+			Flags:  sectionFlags(s.Flags),
+			Addr:   s.Addr,
+			Offset: s.Offset,
+			Size:   s.Size,
+		})
+	}
+	syms, err := f.Symbols()
+	if errors.Is(err, elf.ErrNoSymbols) {
+		// stripped binary: fall back to the dynamic symbols
+		syms, err = f.DynamicSymbols()
+	}
+	if err != nil && !errors.Is(err, elf.ErrNoSymbols) {
+		return nil, nil, err
+	}
+	sort.SliceStable(syms, func(i, j int) bool { return syms[i].Value < syms[j].Value })
+	var symbolMap bytes.Buffer
+	for _, s := range syms {
+		if s.Name == "" {
+			continue
+		}
+		sym := ELFSymbol{
+			Name:  s.Name,
+			Type:  elf.ST_TYPE(s.Info).String(),
+			Bind:  elf.ST_BIND(s.Info).String(),
+			Value: s.Value,
+			Size:  s.Size,
+		}
+		if int(s.Section) < len(f.Sections) && s.Section > elf.SHN_UNDEF {
+			sym.Section = f.Sections[s.Section].Name
+		}
+		fmt.Fprintf(&symbolMap, "%016x %08x %-12s %s\n", s.Value, s.Size, strings.TrimPrefix(sym.Type, "STT_"), s.Name)
+		if len(info.Symbols) < maxELFSymbols {
+			info.Symbols = append(info.Symbols, sym)
+		} else {
+			info.SymbolsTruncated = true
+		}
+	}
+	return info, symbolMap.Bytes(), nil
+}
+
+// sectionFlags renders SHF_ALLOC|SHF_EXECINSTR as "AX" (readelf style).
+func sectionFlags(fl elf.SectionFlag) string {
+	var b strings.Builder
+	if fl&elf.SHF_WRITE != 0 {
+		b.WriteByte('W')
+	}
+	if fl&elf.SHF_ALLOC != 0 {
+		b.WriteByte('A')
+	}
+	if fl&elf.SHF_EXECINSTR != 0 {
+		b.WriteByte('X')
+	}
+	return b.String()
+}
+
+// artifactTTL is how long an archive stays downloadable.
+const artifactTTL = 15 * time.Minute
+
+// maxStoredArtifacts bounds the memory held by archives waiting for download.
+const maxStoredArtifacts = 64
+
+// artifactStore keeps recent archives in memory; the oldest is dropped when full.
+type artifactStore struct {
+	mu      sync.Mutex
+	entries map[string]storedArtifact
+}
+
+type storedArtifact struct {
+	archive   []byte
+	createdAt time.Time
+}
+
+var artifactsStore = &artifactStore{entries: make(map[string]storedArtifact)}
+
+func (s *artifactStore) put(id string, archive []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	oldestID, oldest := "", now
+	for k, e := range s.entries {
+		if now.Sub(e.createdAt) > artifactTTL {
+			delete(s.entries, k)
+			continue
+		}
+		if e.createdAt.Before(oldest) {
+			oldestID, oldest = k, e.createdAt
+		}
+	}
+	if len(s.entries) >= maxStoredArtifacts && oldestID != "" {
+		delete(s.entries, oldestID)
+	}
+	s.entries[id] = storedArtifact{archive: archive, createdAt: now}
+}
+
+func (s *artifactStore) get(id string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.entries[id]
+	if !ok || time.Since(e.createdAt) > artifactTTL {
+		delete(s.entries, id)
+		return nil, false
+	}
+	return e.archive, true
+}
+
+// artifactsHandler serves GET /artifacts/<id> as <id>.tar.gz.
+func artifactsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id := strings.TrimPrefix(r.URL.Path, "/artifacts/")
+	archive, ok := artifactsStore.get(id)
+	if id == "" || !ok {
+		http.Error(w, "artifacts not found or expired", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", id+".tar.gz"))
+	_, _ = w.Write(archive)
+}
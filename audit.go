@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// AdminAuditEntry is one admin change in the audit trail (admin_audit).
+type AdminAuditEntry struct {
+	ID         int64     `json:"id"`
+	OccurredAt time.Time `json:"occurred_at"`
+	Admin      string    `json:"admin"`
+	IP         string    `json:"ip"`
+	Action     string    `json:"action"`
+	Target     string    `json:"target,omitempty"`
+	Success    bool      `json:"success"`
+	Detail     string    `json:"detail,omitempty"`
+}
+
+// adminName is the JWT subject of an admin request ("" if it has none).
+func adminName(r *http.Request) string {
+	claims, err := parseJWT(requestToken(r))
+	if err != nil {
+		return ""
+	}
+	sub, _ := claims["sub"].(string)
+	return sub
+}
+
+// auditAdminAction records action on target by the admin behind r; a non-nil
+// err marks the attempt as failed and becomes the detail.
+func auditAdminAction(r *http.Request, action, target, detail string, err error) {
+	e := AdminAuditEntry{
+		OccurredAt: time.Now(),
+		Admin:      adminName(r),
+		IP:         extractClientIP(r),
+		Action:     action,
+		Target:     target,
+		Success:    err == nil,
+		Detail:     detail,
+	}
+	if err != nil {
+		e.Detail = err.Error()
+	}
+	if dbErr := saveAdminAudit(e); dbErr != nil && logger != nil {
+		logger.Error("failed to persist admin audit entry", zap.String("action", action), zap.String("target", target), zap.Error(dbErr))
+	}
+}
+
+// adminAuditHandler is GET /admin/audit?limit=N, newest first.
+func adminAuditHandler(w http.ResponseWriter, r *http.Request) {
+	limit := 100
+	if ls := r.URL.Query().Get("limit"); ls != "" {
+		if v, err := strconv.Atoi(ls); err == nil {
+			limit = v
+		}
+	}
+	entries, err := listAdminAudit(limit)
+	if err != nil {
+		logger.Error("admin audit list", zap.Error(err))
+		http.Error(w, "error listing audit trail", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(struct {
+		Entries []AdminAuditEntry `json:"entries"`
+		Count   int               `json:"count"`
+	}{Entries: entries, Count: len(entries)})
+}
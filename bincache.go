@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// binaryCache keeps compiled ./out binaries on disk so that later runs of
+// the same source with the same toolchain skip the compiler: the sandbox
+// backends copy the file in through the helper (see putCachedBinary). Files are
+// named by binaryCacheKey and evicted oldest-used first (mtime is touched on
+// every hit) once the directory grows over maxBytes.
+type binaryCache struct {
+	dir      string
+	maxBytes int64
+
+	mu     sync.Mutex // serializes store/evict
+	hits   atomic.Uint64
+	misses atomic.Uint64
+	stored atomic.Uint64
+}
+
+// BinaryCacheStats is reported in /observability (see CacheStats).
+type BinaryCacheStats struct {
+	Files    int     `json:"files"`
+	Bytes    int64   `json:"bytes"`
+	MaxBytes int64   `json:"max_bytes"`
+	Hits     uint64  `json:"hits"`
+	Misses   uint64  `json:"misses"`
+	Stored   uint64  `json:"stored"`
+	HitRate  float64 `json:"hit_rate"`
+}
+
+// binariesCache is built in main from BINARY_CACHE_DIR/BINARY_CACHE_MB; nil
+// disables caching.
+var binariesCache *binaryCache
+
+// binaryCacheUsable reports whether sb can run a cached binary and return a
+// new one: not the remote backend, whose worker protocol carries neither
+// CachedBinary nor ReturnBinary.
+func binaryCacheUsable(sb Sandbox) bool {
+	_, remote := sb.(*remoteSandbox)
+	return !remote
+}
+
+// maxBinaryBytes caps the base64 ./out the sandbox prints for the cache.
+const maxBinaryBytes = 32 << 20
+
+// elfMagic starts every binary the compiler produces; anything else coming
+// back from the sandbox is not stored.
+var elfMagic = []byte{0x7f, 'E', 'L', 'F'}
+
+// binaryCacheKeyRe matches binaryCacheKey names; the backends join the name
+// to a host path.
+var binaryCacheKeyRe = regexp.MustCompile(`^[0-9a-f]{64}-[0-9a-f]+$`)
+
+func newBinaryCache(dir string, maxBytes int64) (*binaryCache, error) {
+	if dir == "" || maxBytes <= 0 {
+		return nil, nil
+	}
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, fmt.Errorf("resolve binary cache dir: %w", err)
+	}
+	if err := os.MkdirAll(abs, 0o755); err != nil {
+		return nil, fmt.Errorf("create binary cache dir: %w", err)
+	}
+	// the sandbox user only needs to read it
+	if err := os.Chmod(abs, 0o755); err != nil {
+		return nil, fmt.Errorf("chmod binary cache dir: %w", err)
+	}
+	return &binaryCache{dir: abs, maxBytes: maxBytes}, nil
+}
+
+// binaryCacheKey names the cached binary of code compiled by tc; "" when
+// the toolchain has no content hash to key on.
+func binaryCacheKey(code string, tc *Toolchain) string {
+	if tc == nil || tc.Hash == "" {
+		return ""
+	}
+	src := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(src[:]) + "-" + strings.TrimPrefix(tc.Hash, "sha256:")
+}
+
+// lookup reports whether a binary is cached under key and marks it used.
+// A hit here is only a hint: the sandbox falls back to compiling if the file
+// is evicted before the sandbox copies it, so hits are counted by record.
+func (c *binaryCache) lookup(key string) bool {
+	p := filepath.Join(c.dir, key)
+	if _, err := os.Stat(p); err != nil {
+		return false
+	}
+	now := time.Now()
+	_ = os.Chtimes(p, now, now)
+	return true
+}
+
+// record counts a run that used (hit) or could have used the cache.
+func (c *binaryCache) record(hit bool) {
+	if hit {
+		c.hits.Add(1)
+	} else {
+		c.misses.Add(1)
+	}
+}
+
+// store decodes the base64 binary printed by the sandbox and saves it under
+// key, then evicts the least recently used files over maxBytes.
+func (c *binaryCache) store(key, data string) error {
+	bin, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(data), ""))
+	if err != nil {
+		return fmt.Errorf("decode binary: %w", err)
+	}
+	if !bytes.HasPrefix(bin, elfMagic) {
+		return errors.New("not an ELF binary")
+	}
+	if int64(len(bin)) > c.maxBytes {
+		return fmt.Errorf("binary of %d bytes exceeds the cache size", len(bin))
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	tmp, err := os.CreateTemp(c.dir, ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(bin); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0o644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(c.dir, key)); err != nil {
+		return err
+	}
+	c.stored.Add(1)
+	return c.evictLocked()
+}
+
+type binaryCacheFile struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+func (c *binaryCache) files() ([]binaryCacheFile, error) {
+	entries, err := os.ReadDir(c.dir)
+	if err != nil {
+		return nil, err
+	}
+	var files []binaryCacheFile
+	for _, e := range entries {
+		if !e.Type().IsRegular() || strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		files = append(files, binaryCacheFile{path: filepath.Join(c.dir, e.Name()), size: info.Size(), modTime: info.ModTime()})
+	}
+	return files, nil
+}
+
+func (c *binaryCache) evictLocked() error {
+	files, err := c.files()
+	if err != nil {
+		return err
+	}
+	var total int64
+	for _, f := range files {
+		total += f.size
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].modTime.Before(files[j].modTime) })
+	for _, f := range files {
+		if total <= c.maxBytes {
+			break
+		}
+		if err := os.Remove(f.path); err == nil {
+			total -= f.size
+		}
+	}
+	return nil
+}
+
+func (c *binaryCache) stats() BinaryCacheStats {
+	s := BinaryCacheStats{MaxBytes: c.maxBytes, Hits: c.hits.Load(), Misses: c.misses.Load(), Stored: c.stored.Load()}
+	if files, err := c.files(); err == nil {
+		s.Files = len(files)
+		for _, f := range files {
+			s.Bytes += f.size
+		}
+	}
+	if total := s.Hits + s.Misses; total > 0 {
+		s.HitRate = float64(s.Hits) / float64(total)
+	}
+	return s
+}
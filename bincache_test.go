@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// elfBase64 is a fake ./out of n bytes that passes the ELF check, printed
+// the way the sandbox does (base64 in 76 column lines).
+func elfBase64(n int) string {
+	b := make([]byte, n)
+	copy(b, elfMagic)
+	s := base64.StdEncoding.EncodeToString(b)
+	var out strings.Builder
+	for len(s) > 76 {
+		out.WriteString(s[:76] + "\n")
+		s = s[76:]
+	}
+	return out.String() + s + "\n"
+}
+
+func TestBinaryCacheStore(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		size    int64 // of the stored file
+		wantErr string
+	}{
+		{name: "wrapped base64", data: elfBase64(300), size: 300},
+		{name: "not base64", data: "!!!", wantErr: "decode binary"},
+		{name: "not an ELF", data: base64.StdEncoding.EncodeToString([]byte("#!/bin/sh\n")), wantErr: "not an ELF binary"},
+		{name: "larger than the cache", data: elfBase64(1025), wantErr: "exceeds the cache size"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := newBinaryCache(t.TempDir(), 1024)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = c.store("key", tt.data)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("store error = %v, want %q", err, tt.wantErr)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if s := c.stats(); s.Bytes != tt.size || c.lookup("key") != (tt.size > 0) {
+				t.Errorf("cache holds %d bytes, want %d", s.Bytes, tt.size)
+			}
+			if entries, _ := os.ReadDir(c.dir); len(entries) > 1 {
+				t.Errorf("temp files left behind: %d entries", len(entries))
+			}
+		})
+	}
+}
+
+func TestBinaryCacheEviction(t *testing.T) {
+	tests := []struct {
+		name  string
+		ages  map[string]time.Duration // 40 byte files already cached
+		touch string                   // looked up before storing "new"
+		size  int                      // of "new"
+		want  []string
+	}{
+		{name: "fits", ages: map[string]time.Duration{"a": time.Hour}, size: 40, want: []string{"a", "new"}},
+		{name: "oldest goes first", ages: map[string]time.Duration{"a": 2 * time.Hour, "b": time.Hour}, size: 40, want: []string{"b", "new"}},
+		{name: "a lookup keeps a file", ages: map[string]time.Duration{"a": 2 * time.Hour, "b": time.Hour}, touch: "a", size: 40, want: []string{"a", "new"}},
+		{name: "as many as needed", ages: map[string]time.Duration{"a": 2 * time.Hour, "b": time.Hour}, size: 90, want: []string{"new"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := newBinaryCache(t.TempDir(), 100)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for name, age := range tt.ages {
+				p := filepath.Join(c.dir, name)
+				if err := os.WriteFile(p, make([]byte, 40), 0o644); err != nil {
+					t.Fatal(err)
+				}
+				old := time.Now().Add(-age)
+				os.Chtimes(p, old, old)
+			}
+			if tt.touch != "" && !c.lookup(tt.touch) {
+				t.Fatalf("lookup(%s) missed", tt.touch)
+			}
+			if err := c.store("new", elfBase64(tt.size)); err != nil {
+				t.Fatal(err)
+			}
+			files, _ := c.files()
+			var got []string
+			for _, f := range files {
+				got = append(got, filepath.Base(f.path))
+			}
+			sort.Strings(got)
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("cached %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBinaryCacheUsable(t *testing.T) {
+	tests := []struct {
+		sb   Sandbox
+		want bool
+	}{
+		{sb: newFakeSandbox(), want: true},
+		{sb: newRemoteSandbox()},
+	}
+	for _, tt := range tests {
+		if got := binaryCacheUsable(tt.sb); got != tt.want {
+			t.Errorf("binaryCacheUsable(%s) = %v, want %v", tt.sb.Name(), got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,320 @@
+// Command sandbox-init is the only program of the sandbox image besides the
+// toolchain: the idle PID 1 of every containerd sandbox and the file helper
+// the server execs next to the compiler and ./out (see containerdExecution).
+// Nothing in the sandbox needs a shell. It must be built static
+// (CGO_ENABLED=0): the image has no libc unless the toolchain brings one.
+//
+//	sandbox-init idle                       wait for SIGTERM, reaping orphans
+//	sandbox-init prepare <dir> <toolchain>  create dir, copy compiler, liblang/, *.lang
+//	sandbox-init put <path> <mode>          write stdin to a new file
+//	sandbox-init list <dir>                 print the names in dir, NUL terminated
+//	sandbox-init pack <dir> [name...]       write a tar of the names in dir to stdout
+//	sandbox-init cat <path>                 copy a file to stdout
+//	sandbox-init limit [NAME=value...] -- <prog> [arg...]
+//	                                        set rlimits, then exec prog
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+	args := os.Args[2:]
+	var err error
+	switch cmd := os.Args[1]; {
+	case cmd == "idle" && len(args) == 0:
+		idle()
+	case cmd == "prepare" && len(args) == 2:
+		err = prepare(args[0], args[1])
+	case cmd == "put" && len(args) == 2:
+		err = put(args[0], args[1])
+	case cmd == "list" && len(args) == 1:
+		err = list(args[0])
+	case cmd == "pack" && len(args) >= 1:
+		err = pack(args[0], args[1:])
+	case cmd == "cat" && len(args) == 1:
+		err = cat(args[0])
+	case cmd == "limit":
+		err = limit(args)
+	default:
+		usage()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "sandbox-init %s: %v\n", os.Args[1], err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: sandbox-init idle | prepare <dir> <toolchain> | put <path> <mode> | list <dir> | pack <dir> [name...] | cat <path> | limit [NAME=value...] -- <prog> [arg...]")
+	os.Exit(2)
+}
+
+// idle keeps the container alive until it is stopped. As PID 1 it inherits
+// whatever the exec'd processes leave behind, so it reaps them.
+func idle() {
+	sigC := make(chan os.Signal, 8)
+	signal.Notify(sigC, syscall.SIGTERM, syscall.SIGINT, syscall.SIGCHLD)
+	for sig := range sigC {
+		if sig != syscall.SIGCHLD {
+			os.Exit(0)
+		}
+		for {
+			var ws syscall.WaitStatus
+			if pid, err := syscall.Wait4(-1, &ws, syscall.WNOHANG, nil); pid <= 0 || err != nil {
+				break
+			}
+		}
+	}
+}
+
+// prepare creates the work directory with a copy of the toolchain, like the
+// cp -r of the old execution script: compiler, liblang/ (optional), *.lang.
+func prepare(dir, toolchain string) error {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+	names := []string{"compiler", "liblang"}
+	extra, err := filepath.Glob(filepath.Join(toolchain, "*.lang"))
+	if err != nil {
+		return err
+	}
+	for _, p := range extra {
+		names = append(names, filepath.Base(p))
+	}
+	for _, name := range names {
+		err := copyTree(filepath.Join(toolchain, name), filepath.Join(dir, name))
+		if errors.Is(err, fs.ErrNotExist) && name == "liblang" {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+	// the compiler must be executable by the sandbox user
+	return os.Chmod(filepath.Join(dir, "compiler"), 0o755)
+}
+
+// copyTree copies src to dst, recreating directories and symlinks.
+func copyTree(src, dst string) error {
+	return filepath.WalkDir(src, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		switch {
+		case info.IsDir():
+			return os.MkdirAll(target, info.Mode().Perm()|0o700)
+		case info.Mode()&fs.ModeSymlink != 0:
+			link, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		case info.Mode().IsRegular():
+			return copyFile(p, target, info.Mode().Perm())
+		}
+		return nil
+	})
+}
+
+func copyFile(src, dst string, mode fs.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// put writes stdin to path, which must not exist yet.
+func put(path, mode string) error {
+	perm, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil {
+		return fmt.Errorf("mode %q: %w", mode, err)
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, fs.FileMode(perm))
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, os.Stdin); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	// O_CREATE is subject to the umask
+	return os.Chmod(path, fs.FileMode(perm))
+}
+
+// list prints the entries of dir (like ls -A) terminated by NUL bytes, so
+// that any file name the compiler picks survives the trip.
+func list(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(os.Stdout)
+	for _, e := range entries {
+		w.WriteString(e.Name())
+		w.WriteByte(0)
+	}
+	return w.Flush()
+}
+
+// pack writes a tar of the names (relative to dir, directories recursively)
+// to stdout.
+func pack(dir string, names []string) error {
+	sort.Strings(names)
+	w := bufio.NewWriter(os.Stdout)
+	tw := tar.NewWriter(w)
+	for _, name := range names {
+		err := filepath.WalkDir(filepath.Join(dir, name), func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(dir, p)
+			if err != nil {
+				return err
+			}
+			return packEntry(tw, p, filepath.ToSlash(rel))
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+func packEntry(tw *tar.Writer, p, name string) error {
+	info, err := os.Lstat(p)
+	if err != nil {
+		return err
+	}
+	link := ""
+	if info.Mode()&fs.ModeSymlink != 0 {
+		if link, err = os.Readlink(p); err != nil {
+			return err
+		}
+	} else if !info.Mode().IsRegular() && !info.IsDir() {
+		return nil
+	}
+	hdr, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return err
+	}
+	hdr.Name = name
+	if info.IsDir() {
+		hdr.Name += "/"
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return nil
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(tw, f)
+	return err
+}
+
+// cat copies path to stdout.
+func cat(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(os.Stdout, f)
+	return err
+}
+
+// rlimitNames are the OCI names ResourceProfile.rlimits uses.
+var rlimitNames = map[string]int{
+	"RLIMIT_CPU":    unix.RLIMIT_CPU,
+	"RLIMIT_FSIZE":  unix.RLIMIT_FSIZE,
+	"RLIMIT_NOFILE": unix.RLIMIT_NOFILE,
+	"RLIMIT_NPROC":  unix.RLIMIT_NPROC,
+	"RLIMIT_STACK":  unix.RLIMIT_STACK,
+}
+
+// limit sets the rlimits (soft and hard) and replaces itself with prog, so
+// the program never runs a single instruction without them. The local
+// backend starts every step through it: rlimits cannot be set through
+// SysProcAttr and setting them from the parent after start is racy.
+func limit(args []string) error {
+	sep := -1
+	for i, a := range args {
+		if a == "--" {
+			sep = i
+			break
+		}
+	}
+	if sep < 0 || sep == len(args)-1 {
+		usage()
+	}
+	for _, a := range args[:sep] {
+		name, value, ok := strings.Cut(a, "=")
+		resource, known := rlimitNames[name]
+		if !ok || !known {
+			return fmt.Errorf("bad rlimit %q", a)
+		}
+		n, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("bad rlimit %q: %w", a, err)
+		}
+		// syscall.Setrlimit, not unix's: the runtime must not restore its
+		// own RLIMIT_NOFILE on exec
+		if err := syscall.Setrlimit(resource, &syscall.Rlimit{Cur: n, Max: n}); err != nil {
+			return fmt.Errorf("set %s: %w", name, err)
+		}
+	}
+	argv := args[sep+1:]
+	prog, err := exec.LookPath(argv[0])
+	if err != nil {
+		return err
+	}
+	return syscall.Exec(prog, argv, os.Environ())
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// TestMain runs main instead of the tests when the test binary is exec'd
+// as sandbox-init by runInit.
+func TestMain(m *testing.M) {
+	if os.Getenv("SANDBOX_INIT_TEST_MAIN") == "1" {
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// runInit runs sandbox-init with args and returns its stdout, stderr and
+// exit code.
+func runInit(t *testing.T, stdin string, args ...string) (string, string, int) {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Env = append(os.Environ(), "SANDBOX_INIT_TEST_MAIN=1")
+	cmd.Stdin = strings.NewReader(stdin)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	if err != nil && !errors.As(err, &exitErr) {
+		t.Fatal(err)
+	}
+	return stdout.String(), stderr.String(), cmd.ProcessState.ExitCode()
+}
+
+// tarNames lists the entries of a tar.
+func tarNames(t *testing.T, data string) []string {
+	t.Helper()
+	var names []string
+	tr := tar.NewReader(strings.NewReader(data))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return names
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, hdr.Name)
+	}
+}
+
+func TestSandboxInit(t *testing.T) {
+	tests := []struct {
+		name  string
+		stdin string
+		args  []string // {dir} is a temp dir holding the toolchain lang/, {self} sandbox-init
+		code  int
+		// then runs next and its stdout must match wantStdout
+		then       []string
+		wantStdout string // regexp
+		wantStderr string
+		wantTar    []string
+	}{
+		{name: "no command", code: 2, wantStderr: "usage:"},
+		{name: "unknown command", args: []string{"sh"}, code: 2, wantStderr: "usage:"},
+		{name: "wrong argument count", args: []string{"put", "{dir}/x"}, code: 2, wantStderr: "usage:"},
+		{
+			name: "prepare copies the toolchain",
+			args: []string{"prepare", "{dir}/work", "{dir}/lang"}, then: []string{"list", "{dir}/work"},
+			wantStdout: "^a.lang\x00compiler\x00liblang\x00$",
+		},
+		{
+			name: "put then cat", stdin: "print 1",
+			args: []string{"put", "{dir}/test.lang", "0600"}, then: []string{"cat", "{dir}/test.lang"},
+			wantStdout: "^print 1$",
+		},
+		{name: "put never overwrites", args: []string{"put", "{dir}/lang/compiler", "0644"}, code: 1, wantStderr: "file exists"},
+		{name: "put bad mode", args: []string{"put", "{dir}/x", "rwx"}, code: 1, wantStderr: `mode "rwx"`},
+		{name: "list a missing dir", args: []string{"list", "{dir}/none"}, code: 1, wantStderr: "sandbox-init list:"},
+		{name: "pack", args: []string{"pack", "{dir}/lang", "liblang", "a.lang"}, wantTar: []string{"a.lang", "liblang/", "liblang/std.lang"}},
+		{
+			name:       "limit sets the rlimits before exec",
+			args:       []string{"limit", "RLIMIT_NOFILE=37", "RLIMIT_FSIZE=4096", "--", "{self}", "cat", "/proc/self/limits"},
+			wantStdout: `Max file size\s+4096\s+4096(.|\n)*Max open files\s+37\s+37`,
+		},
+		{name: "limit without a program", args: []string{"limit", "RLIMIT_NOFILE=37", "--"}, code: 2, wantStderr: "usage:"},
+		{name: "limit without --", args: []string{"limit", "RLIMIT_NOFILE=37"}, code: 2, wantStderr: "usage:"},
+		{name: "limit unknown rlimit", args: []string{"limit", "RLIMIT_AS=1", "--", "{self}"}, code: 1, wantStderr: `bad rlimit "RLIMIT_AS=1"`},
+		{name: "limit bad value", args: []string{"limit", "RLIMIT_NOFILE=-1", "--", "{self}"}, code: 1, wantStderr: `bad rlimit "RLIMIT_NOFILE=-1"`},
+		{name: "limit missing program", args: []string{"limit", "--", "{dir}/none"}, code: 1, wantStderr: "sandbox-init limit:"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for name, body := range map[string]string{"compiler": "#!", "liblang/std.lang": "std", "a.lang": "a", "readme": "r"} {
+				p := filepath.Join(dir, "lang", name)
+				os.MkdirAll(filepath.Dir(p), 0o755)
+				os.WriteFile(p, []byte(body), 0o644)
+			}
+			expand := func(args []string) []string {
+				out := make([]string, len(args))
+				for i, a := range args {
+					out[i] = strings.NewReplacer("{dir}", dir, "{self}", os.Args[0]).Replace(a)
+				}
+				return out
+			}
+
+			stdout, stderr, code := runInit(t, tt.stdin, expand(tt.args)...)
+			if code != tt.code || !strings.Contains(stderr, tt.wantStderr) {
+				t.Fatalf("exit %d stderr %q, want %d and %q", code, stderr, tt.code, tt.wantStderr)
+			}
+			if tt.then != nil {
+				stdout, stderr, code = runInit(t, "", expand(tt.then)...)
+				if code != 0 {
+					t.Fatalf("%v: exit %d: %s", tt.then, code, stderr)
+				}
+			}
+			if tt.wantStdout != "" && !regexp.MustCompile(tt.wantStdout).MatchString(stdout) {
+				t.Errorf("stdout %q, want %q", stdout, tt.wantStdout)
+			}
+			if tt.wantTar != nil && strings.Join(tarNames(t, stdout), ",") != strings.Join(tt.wantTar, ",") {
+				t.Errorf("tar holds %v, want %v", tarNames(t, stdout), tt.wantTar)
+			}
+		})
+	}
+}
@@ -3,436 +3,291 @@ package main
 import (
 	"bytes"
 	"context"
-	"crypto/rand"
+	"errors"
 	"fmt"
-	"os"
-	"os/exec"
-	"path/filepath"
+	"io"
 	"strings"
-	"sync"
 	"syscall"
 	"time"
 
-	"github.com/containerd/containerd"
-	"github.com/containerd/containerd/cio"
-	"github.com/containerd/containerd/containers"
-	seccomp "github.com/containerd/containerd/contrib/seccomp"
-	"github.com/containerd/containerd/namespaces"
-	"github.com/containerd/containerd/oci"
-	specs "github.com/opencontainers/runtime-spec/specs-go"
+	"go.uber.org/zap"
 )
 
-var ErrLimitChar5k = fmt.Errorf("code exceeds 5000 character limit")
+// ErrCodeTooLong is wrapped when the code exceeds the profile's MaxCodeChars.
+var ErrCodeTooLong = errors.New("code exceeds character limit")
 
-// Global cached containerd client and base image
-var (
-	ctrdClient *containerd.Client
-	clientOnce sync.Once
-	clientErr  error
+// maxStdinBytes caps the optional stdin submitted with /compile.
+const maxStdinBytes = 64 * 1024
 
-	baseImage   containerd.Image
-	imagePulled bool
-	imageMu     sync.Mutex
-)
-
-func getContainerdClient() (*containerd.Client, error) {
-	clientOnce.Do(func() {
-		ctrdClient, clientErr = containerd.New("/run/containerd/containerd.sock")
-	})
-	return ctrdClient, clientErr
-}
+var ErrStdinTooLarge = fmt.Errorf("stdin exceeds %d byte limit", maxStdinBytes)
 
-func ensureBaseImage(ctx context.Context, ref string) (containerd.Image, bool, error) {
-	imageMu.Lock()
-	defer imageMu.Unlock()
-	if imagePulled {
-		return baseImage, true, nil
+// validateSandboxRequest checks what every backend refuses before
+// preparing anything: code over the profile's limit, a malformed cache name.
+func validateSandboxRequest(req *SandboxRequest) error {
+	if limit := req.profile().MaxCodeChars; len(req.Code) > limit {
+		return fmt.Errorf("%w of %d", ErrCodeTooLong, limit)
 	}
-	c, err := getContainerdClient()
-	if err != nil {
-		return nil, false, err
-	}
-	img, err := c.Pull(ctx, ref, containerd.WithPullUnpack)
-	if err != nil {
-		return nil, false, err
+	if req.CachedBinary != "" && !binaryCacheKeyRe.MatchString(req.CachedBinary) {
+		return fmt.Errorf("invalid cached binary name %q", req.CachedBinary)
 	}
-	baseImage = img
-	imagePulled = true
-	return baseImage, false, nil
+	return nil
 }
 
-// sandboxSpecOpt returns a SpecOpt applying mounts, limits, and hardening.
-func sandboxSpecOpt() oci.SpecOpts {
-	return func(ctx context.Context, client oci.Client, c *containers.Container, s *specs.Spec) error {
-		// mounts already added by caller; enforce limits & rlimits if not present
-		if s.Linux == nil {
-			s.Linux = &specs.Linux{}
-		}
-		// CPU quota percent environment variable: e.g. 50 -> half CPU, 0 or empty -> no explicit quota
-		var cpuQuota *int64
-		var cpuPeriod *uint64
-		var cpuShares *uint64
-		cpuShares = func() *uint64 { v := uint64(256); return &v }()
-		cpuPeriod = func() *uint64 { v := uint64(100000); return &v }()
-		if appConfig != nil && appConfig.SandboxCPUQuotaPercent > 0 {
-			pct := appConfig.SandboxCPUQuotaPercent
-			q := int64(pct) * int64(*cpuPeriod) / 100
-			cpuQuota = &q
-		} else if appConfig != nil && appConfig.SandboxCPUQuotaPercent == 0 {
-			cpuQuota = nil // explicit unlimited
-		} else {
-			q := int64(*cpuPeriod) / 10
-			cpuQuota = &q
-		}
-		s.Linux.Resources = &specs.LinuxResources{
-			CPU: &specs.LinuxCPU{Shares: cpuShares, Quota: cpuQuota, Period: cpuPeriod},
-			Memory: &specs.LinuxMemory{
-				Limit: func() *int64 { v := int64(128 * 1024 * 1024); return &v }(),
-				Swap:  func() *int64 { v := int64(128 * 1024 * 1024); return &v }(),
-			},
-			Pids: &specs.LinuxPids{Limit: 64},
-		}
-		if s.Process == nil {
-			s.Process = &specs.Process{}
-		}
-		s.Process.Rlimits = []specs.POSIXRlimit{
-			{Type: "RLIMIT_CPU", Hard: 4, Soft: 4},
-			{Type: "RLIMIT_FSIZE", Hard: 8 << 20, Soft: 8 << 20},
-			{Type: "RLIMIT_NOFILE", Hard: 256, Soft: 256},
-			{Type: "RLIMIT_NPROC", Hard: 64, Soft: 64},
-			{Type: "RLIMIT_STACK", Hard: 8 << 20, Soft: 8 << 20},
-		}
-		return nil
-	}
-}
+// ErrExecTimeout is wrapped by execInKata when the wall clock limit is hit.
+var ErrExecTimeout = errors.New("execution timed out")
 
-func buildExecutionScript(code string) (string, error) {
-	if len(code) > 5000 {
-		return "", ErrLimitChar5k
-	}
-	randBytes := make([]byte, 8)
-	if _, err := rand.Read(randBytes); err != nil {
-		return "", fmt.Errorf("generate delimiter: %w", err)
-	}
-	delim := fmt.Sprintf("LANGCODE_EOF_%x_%d", randBytes, time.Now().UnixNano())
-	for strings.Contains(code, delim) {
-		if _, err := rand.Read(randBytes); err != nil {
-			return "", fmt.Errorf("regenerate delimiter: %w", err)
-		}
-		delim = fmt.Sprintf("LANGCODE_EOF_%x_%d", randBytes, time.Now().UnixNano())
-	}
-	script := fmt.Sprintf(`set -euo pipefail
-TMPDIR=$(mktemp -d /tmp/sandbox-XXXXXX)
-cp -r /lang/compiler $TMPDIR/
-cp -r /lang/liblang $TMPDIR/ 2>/dev/null || true
-cp -r /lang/*.lang $TMPDIR/ 2>/dev/null || true
-cd $TMPDIR
-cat > test.lang <<'%s'
-%s
-%s
-chown $(id -u):$(id -g) test.lang || true
-chmod +x compiler 2>/dev/null || true
-./compiler test.lang out
-echo "----exec-out----"
-./out || true
-cd /
-rm -rf "$TMPDIR"`, delim, code, delim)
-	return script, nil
-}
+// ErrExecCanceled is returned when the caller's context ends before the run.
+var ErrExecCanceled = errors.New("execution canceled")
 
-func resolveLangMountSource(langDir string) (string, error) {
-	absLangDir, err := filepath.Abs(langDir)
-	if err != nil {
-		return "", fmt.Errorf("resolve lang directory path: %w", err)
-	}
-	realLangDir, err := filepath.EvalSymlinks(absLangDir)
-	if err != nil {
-		return "", fmt.Errorf("resolve lang directory symlinks at %s: %w", absLangDir, err)
-	}
-	fi, statErr := os.Stat(realLangDir)
-	if statErr != nil || !fi.IsDir() {
-		return "", fmt.Errorf("missing lang directory at %s", realLangDir)
-	}
+// ErrOutputLimit is wrapped when the output cap was hit under a profile with
+// kill_on_output_limit.
+var ErrOutputLimit = errors.New("output limit exceeded")
 
-	source, err := resolveHostPathFromMountInfo(realLangDir)
-	if err != nil {
-		return "", err
-	}
-	return source, nil
+// execInKata executes code inside a short-lived sandbox returning the
+// structured compile/run result (with the container ID) and an error if
+// execution failed or timed out. The result is non-nil once the sandbox ran.
+// The backend (Kata via containerd, local namespaces, fake) comes from Config.SandboxBackend.
+func execInKata(code, stdin string) (*ExecutionResult, error) {
+	return execInKataStreaming(context.Background(), code, stdin, execOptions{}, nil)
 }
 
-func resolveHostPathFromMountInfo(containerPath string) (string, error) {
-	data, err := os.ReadFile("/proc/self/mountinfo")
-	if err != nil {
-		return containerPath, nil
-	}
+// execOptions are the per-request settings of execInKataStreaming.
+type execOptions struct {
+	Profile   *ResourceProfile // nil uses defaultProfile()
+	Artifacts bool
+	CheckOnly bool       // compile only, see checkHandler
+	Toolchain *Toolchain // nil uses the registry default
+	// Cache serves/stores the result through resultsCache (see resultCacheKey);
+	// ignored with Artifacts or CheckOnly.
+	Cache bool
+}
 
-	containerPath = filepath.Clean(containerPath)
-	bestMountPoint := ""
-	bestRoot := ""
-	for _, line := range strings.Split(string(data), "\n") {
-		if line == "" {
-			continue
-		}
-		parts := strings.SplitN(line, " - ", 2)
-		if len(parts) != 2 {
-			continue
-		}
-		fields := strings.Fields(parts[0])
-		if len(fields) < 5 {
-			continue
+// execInKataStreaming is execInKata with live output: listener (may be nil)
+// sees every phase and output chunk as it is produced. Canceling reqCtx
+// (e.g. the client went away) kills the sandbox.
+func execInKataStreaming(reqCtx context.Context, code, stdin string, opts execOptions, listener outputListener) (*ExecutionResult, error) {
+	if len(stdin) > maxStdinBytes {
+		return nil, ErrStdinTooLarge
+	}
+	cacheKey := ""
+	if opts.Cache && resultsCache != nil && !opts.Artifacts && !opts.CheckOnly {
+		start := time.Now()
+		if opts.Profile == nil {
+			opts.Profile = defaultProfile()
 		}
-		root := unescapeMountInfoPath(fields[3])
-		mountPoint := filepath.Clean(unescapeMountInfoPath(fields[4]))
-		if !pathContains(mountPoint, containerPath) {
-			continue
+		if opts.Toolchain == nil {
+			tc, err := resolveToolchain("")
+			if err != nil {
+				return nil, err
+			}
+			opts.Toolchain = tc
 		}
-		if len(mountPoint) > len(bestMountPoint) {
-			bestMountPoint = mountPoint
-			bestRoot = filepath.Clean(root)
+		cacheKey = resultCacheKey(code, stdin, opts.Toolchain, opts.Profile)
+		if res := resultsCache.get(cacheKey); res != nil {
+			replayResult(res, listener)
+			res.CacheHit = true
+			res.CachedFrom = res.ContainerID
+			res.ContainerID = fmt.Sprintf("cache-hit-%d", time.Now().UnixNano())
+			res.BinaryCache = "" // nothing was compiled or run this time
+			res.DurationMS = time.Since(start).Milliseconds()
+			return res, nil
 		}
 	}
-
-	if bestMountPoint == "" {
-		return containerPath, nil
+	run := sandboxRun{Code: code, Profile: opts.Profile, Artifacts: opts.Artifacts, CheckOnly: opts.CheckOnly, Toolchain: opts.Toolchain, Listener: listener}
+	if stdin != "" {
+		run.Stdin = strings.NewReader(stdin)
 	}
-
-	rel, err := filepath.Rel(bestMountPoint, containerPath)
-	if err != nil {
-		return containerPath, nil
-	}
-	if rel == "." {
-		return bestRoot, nil
-	}
-	return filepath.Clean(filepath.Join(bestRoot, rel)), nil
-}
-
-func pathContains(parent, child string) bool {
-	if parent == child {
-		return true
-	}
-	rel, err := filepath.Rel(parent, child)
-	return err == nil && rel != "." && rel != ".." && !strings.HasPrefix(rel, ".."+string(os.PathSeparator))
-}
-
-func unescapeMountInfoPath(path string) string {
-	var b strings.Builder
-	for i := 0; i < len(path); i++ {
-		if path[i] == '\\' && i+3 < len(path) && isOctalDigit(path[i+1]) && isOctalDigit(path[i+2]) && isOctalDigit(path[i+3]) {
-			v := (path[i+1]-'0')*64 + (path[i+2]-'0')*8 + (path[i+3] - '0')
-			b.WriteByte(v)
-			i += 3
-			continue
-		}
-		b.WriteByte(path[i])
+	res, err := runInSandbox(reqCtx, run)
+	if cacheKey != "" && cacheableResult(res, err) {
+		resultsCache.put(cacheKey, res)
 	}
-	return b.String()
+	return res, err
 }
 
-func isOctalDigit(c byte) bool {
-	return c >= '0' && c <= '7'
+// sandboxRun describes one execution driven by runInSandbox.
+type sandboxRun struct {
+	Code string
+	// Stdin feeds ./out; it may block (interactive sessions). nil means no input.
+	Stdin io.Reader
+	// Profile sets the limits; nil means defaultProfile().
+	Profile *ResourceProfile
+	// Artifacts collects the compiler output files (see collectArtifacts).
+	Artifacts bool
+	// CheckOnly skips ./out (see checkHandler).
+	CheckOnly bool
+	// Cases runs ./out once per judge test case (see judgeHandler);
+	// Stdin is replaced by the case inputs.
+	Cases []JudgeCase
+	// Toolchain compiles the code; nil uses the registry default.
+	Toolchain *Toolchain
+	// Listener receives live output; may be nil.
+	Listener outputListener
+	// Timeout is the wall clock cap; <= 0 uses the profile's timeout.
+	Timeout time.Duration
+	// NoBinaryCache always compiles and keeps nothing in binariesCache.
+	NoBinaryCache bool
 }
 
-// execInKata executes code inside a short-lived Kata container returning combined output,
-// the container ID (unique sandbox ID), and an error if execution failed or timed out.
-func execInKata(code string) (string, string, error) {
+// runInSandbox prepares, runs and collects one sandbox execution. When reqCtx
+// ends the sandbox is killed; a cause wrapping ErrExecTimeout (idle sessions)
+// is reported as a timeout, anything else as ErrExecCanceled.
+func runInSandbox(reqCtx context.Context, run sandboxRun) (*ExecutionResult, error) {
 	overallStart := time.Now()
-	phaseStart := overallStart
-	script, err := buildExecutionScript(code)
+	sb, err := getSandbox()
 	if err != nil {
-		return "", "", err
+		return nil, err
 	}
-	fmt.Printf("[timing] build script: %v\n", time.Since(phaseStart))
-	phaseStart = time.Now()
-	//ask for sudo if not root
-	if os.Geteuid() != 0 {
-		sudoPath, lookErr := exec.LookPath("sudo")
-		if lookErr != nil {
-			return "", "", fmt.Errorf("need root or sudo not found: %w", lookErr)
-		}
-		args := append([]string{"-E", os.Args[0]}, os.Args[1:]...)
-		cmd := exec.Command(sudoPath, args...)
-		cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
-		if runErr := cmd.Run(); runErr != nil {
-			return "", "", fmt.Errorf("sudo elevation failed: %w", runErr)
-		}
-		os.Exit(0)
-	}
-
-	// connect (or reuse) containerd client
-	clientStart := phaseStart
-	client, err := getContainerdClient()
+	marker, err := newPhaseMarker()
 	if err != nil {
-		return "", "", fmt.Errorf("containerd client: %w", err)
-	}
-	fmt.Printf("[timing] get/reuse containerd client: %v\n", time.Since(clientStart))
-	phaseStart = time.Now()
-
-	// namespace context
-	ctx := namespaces.WithNamespace(context.Background(), "compiler")
-	// ensure base image once using configured base image
-	ensureStart := phaseStart
-	baseRef := "docker.io/library/busybox:latest"
-	if appConfig != nil && appConfig.SandboxBaseImage != "" {
-		baseRef = appConfig.SandboxBaseImage
+		return nil, err
 	}
-	img, cached, pullErr := ensureBaseImage(ctx, baseRef)
-	if pullErr != nil {
-		return "", "", fmt.Errorf("ensure image: %w", pullErr)
+	profile := run.Profile
+	if profile == nil {
+		profile = defaultProfile()
 	}
-	if cached {
-		fmt.Printf("[timing] ensure image (cached): %v\n", time.Since(ensureStart))
-	} else {
-		fmt.Printf("[timing] ensure image (pulled): %v\n", time.Since(ensureStart))
-	}
-	phaseStart = time.Now()
-
-	//working directory and lang dir
-	langDir := ""
-	if appConfig != nil && appConfig.LangDir != "" {
-		langDir = appConfig.LangDir
-	}
-	if langDir == "" {
-		if v := os.Getenv("LANG_DIR"); v != "" {
-			langDir = v
+	toolchain := run.Toolchain
+	if toolchain == nil {
+		if toolchain, err = resolveToolchain(""); err != nil {
+			return nil, err
 		}
 	}
-	if langDir == "" {
-		wd, err := os.Getwd()
+	capture := newPhaseCapture(marker, run.Listener, profile.OutputCap())
+	capture.skipRun = run.CheckOnly || len(run.Cases) > 0
+	capture.killOnOverflow = profile.KillOnOutputLimit
+	ctx := context.Background()
+	req := &SandboxRequest{Code: run.Code, Stdin: run.Stdin, Stdout: capture.stdout, Stderr: capture.stderr, PhaseMarker: marker, Profile: profile, Artifacts: run.Artifacts, CheckOnly: run.CheckOnly, Toolchain: toolchain}
+	if len(run.Cases) > 0 {
+		inputs, err := judgeInputs(run.Cases)
 		if err != nil {
-			return "", "", fmt.Errorf("getwd: %w", err)
+			return nil, fmt.Errorf("pack test case inputs: %w", err)
+		}
+		req.Stdin = bytes.NewReader(inputs)
+		for _, c := range run.Cases {
+			req.CaseTimeouts = append(req.CaseTimeouts, caseTimeoutSeconds(c))
+		}
+		if run.Timeout <= 0 {
+			run.Timeout = judgeTimeout(run.Cases, profile)
 		}
-		langDir = filepath.Join(wd, "lang")
-	}
-	langMountSource, err := resolveLangMountSource(langDir)
-	if err != nil {
-		return "", "", err
 	}
-	fmt.Printf("[timing] prep env: %v\n", time.Since(phaseStart))
-	phaseStart = time.Now()
-
-	uniqueID := fmt.Sprintf("kata-sandbox-%d", time.Now().UnixNano())
-
-	// Allow runtime override from config
-	runtimeName := "io.containerd.kata.v2"
-	if appConfig != nil && appConfig.SandboxRuntime != "" {
-		runtimeName = appConfig.SandboxRuntime
+	// wall clock timeout enforcement (configured via env, default set in main)
+	timeout := run.Timeout
+	if timeout <= 0 {
+		timeout = profile.Timeout()
 	}
-
-	specOpts := []oci.SpecOpts{
-		oci.WithImageConfig(img),
-		oci.WithProcessArgs("/bin/sh", "-c", script),
-		oci.WithEnv([]string{
-			"PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin",
-			"HOME=/home/sandbox",
-			"LANG=C",
-			"LC_ALL=C",
-		}),
-		oci.WithHostname("sandbox"),
-		oci.WithMounts([]specs.Mount{
-			{Destination: "/tmp", Type: "tmpfs", Source: "tmpfs", Options: []string{"rw", "nosuid", "nodev", "mode=1777", "size=64m"}},
-			{Type: "bind", Source: langMountSource, Destination: "/lang", Options: []string{"rbind", "ro"}},
-		}),
-		oci.WithLinuxNamespace(specs.LinuxNamespace{Type: specs.NetworkNamespace, Path: ""}),
-		oci.WithNoNewPrivileges,
-		oci.WithCapabilities([]string{}),
-		oci.WithMaskedPaths([]string{"/proc/kcore",
-			"/proc/timer_list",
-			"/proc/sched_debug",
-			"/proc/scsi",
-			"/sys/firmware",
-			"/sys/fs/selinux",
-			"/proc/net",          // hides network sockets and info
-			"/proc/sys/net",      // hides sysctl network controls
-			"/sys/class/net",     // hides network device entries (e.g. lo)
-			"/run/systemd/netif", // optional: hide other network state
-		}),
-		oci.WithReadonlyPaths([]string{"/proc/asound",
-			"/proc/bus",
-			"/proc/fs",
-			"/proc/irq",
-			"/proc/sys",
-			"/proc/sysrq-trigger",
-			"/etc/resolv.conf", // prevent modifying DNS (if you accidentally mount it)
-		}),
-		sandboxSpecOpt(),
-		seccomp.WithDefaultProfile(),
-		oci.WithRootFSReadonly(),
-		oci.WithUser("1000:1000"),
+	req.Timeout = timeout
+	// binary cache: run the cached ./out, or ask for the new one back
+	binKey := ""
+	if binariesCache != nil && binaryCacheUsable(sb) && !run.NoBinaryCache && !run.Artifacts && !run.CheckOnly {
+		binKey = binaryCacheKey(run.Code, toolchain)
 	}
-
-	container, err := client.NewContainer(
-		ctx,
-		uniqueID,
-		containerd.WithNewSnapshot(uniqueID+"-snap", img),
-		containerd.WithNewSpec(specOpts...),
-		containerd.WithRuntime(runtimeName, nil),
-	)
-	if err != nil {
-		return "", uniqueID, fmt.Errorf("create container: %w", err)
+	if binKey != "" {
+		if binariesCache.lookup(binKey) {
+			req.CachedBinary = binKey
+		} else {
+			req.ReturnBinary = true
+		}
 	}
-	defer func() { _ = container.Delete(ctx, containerd.WithSnapshotCleanup) }()
-	fmt.Printf("[timing] create container: %v\n", time.Since(phaseStart))
-	phaseStart = time.Now()
-
-	// capture stdout/stderr
-	stdoutBuf := &bytes.Buffer{}
-	stderrBuf := &bytes.Buffer{}
-	task, err := container.NewTask(ctx, cio.NewCreator(cio.WithStreams(nil, stdoutBuf, stderrBuf)))
+	execution, err := sb.Prepare(ctx, req)
 	if err != nil {
-		return "", uniqueID, fmt.Errorf("new task: %w", err)
+		return nil, err
+	}
+	uniqueID := execution.ID()
+	finish := func(exit SandboxExit, runErr error) (*ExecutionResult, error) {
+		exitedAt := time.Now()
+		usage, collectErr := execution.Collect(ctx)
+		if collectErr != nil && logger != nil {
+			logger.Warn("sandbox cleanup failed", zap.String("container_id", uniqueID), zap.String("backend", sb.Name()), zap.Error(collectErr))
+		}
+		// the cgroup counter catches OOM kills the exit path missed
+		if usage != nil && usage.OOMKills > 0 {
+			exit.OOMKilled = true
+		}
+		res := capture.result(exitedAt, exit, runErr)
+		res.Usage = usage
+		if run.CheckOnly || res.Status == StatusCompileError {
+			res.Diagnostics = parseDiagnostics(res.Compile)
+		}
+		if len(run.Cases) > 0 {
+			res.Judge = judgeCases(capture, res, run.Cases, exit, runErr)
+		}
+		if run.Artifacts && res.Compile != nil && res.Compile.ExitCode == 0 {
+			if data, err := capture.artifactData(); err != nil {
+				res.Artifacts = &Artifacts{Files: []ArtifactFile{}, Error: err.Error()}
+			} else {
+				res.Artifacts = collectArtifacts(data)
+			}
+		}
+		if binKey != "" {
+			res.BinaryCache = "miss"
+			if capture.compiledFromCache() {
+				res.BinaryCache = "hit"
+			}
+			binariesCache.record(res.BinaryCache == "hit")
+			if data, ok := capture.binaryData(); ok && res.Compile != nil && res.Compile.ExitCode == 0 {
+				if err := binariesCache.store(binKey, data); err != nil && logger != nil {
+					logger.Warn("binary cache store failed", zap.String("container_id", uniqueID), zap.Error(err))
+				}
+			}
+		}
+		res.ContainerID = uniqueID
+		if r, ok := execution.(sandboxImageReporter); ok {
+			res.ImageDigest = r.ImageDigest()
+		}
+		res.Profile = profile.Name
+		if toolchain != nil {
+			res.Toolchain = toolchain.Version
+			res.ToolchainHash = toolchain.Hash
+			res.ToolchainDeprecated = toolchain.Deprecated
+		}
+		res.DurationMS = time.Since(overallStart).Milliseconds()
+		return res, runErr
 	}
-	defer func() { _, _ = task.Delete(ctx) }()
 
-	statusC, err := task.Wait(ctx)
+	phaseStart := time.Now()
+	exitC, err := execution.Run(ctx)
 	if err != nil {
-		return "", uniqueID, fmt.Errorf("wait task: %w", err)
-	}
-	if err := task.Start(ctx); err != nil {
-		return "", uniqueID, fmt.Errorf("start task: %w", err)
+		return finish(SandboxExit{ExitCode: -1}, err)
 	}
-	fmt.Printf("[timing] start task: %v\n", time.Since(phaseStart))
-	phaseStart = time.Now()
 
-	// wall clock timeout enforcement (configured via env, default set in main)
-	timeout := kataExecTimeout
-	if timeout <= 0 {
-		timeout = 10 * time.Second
-	}
-	collect := func() string {
-		// combine stdout and stderr; limit size to avoid OOM
-		const max = 64 * 1024
-		out := stdoutBuf.String()
-		errS := stderrBuf.String()
-		if len(out) > max {
-			out = out[:max] + "...[truncated]"
-		}
-		if len(errS) > 0 {
-			if len(errS) > max {
-				errS = errS[:max] + "...[truncated]"
-			}
-			out = out + "\n[stderr]\n" + errS
-		}
-		return out
+	// executions that time their steps report which one ran out; this
+	// timer then only catches what they could not stop
+	backstop := timeout
+	if t, ok := execution.(sandboxStepTimer); ok && t.EnforcesTimeout() {
+		backstop += stepTimeoutGrace
 	}
 	select {
-	case <-statusC:
+	case exit := <-exitC:
 		fmt.Printf("[timing] wait task (success): %v\n", time.Since(phaseStart))
 		fmt.Printf("[timing] total: %v\n", time.Since(overallStart))
-		return collect(), uniqueID, nil
-	case <-time.After(timeout):
-		_ = task.Kill(ctx, syscall.SIGTERM, containerd.WithKillAll)
+		return finish(exit, exit.Err)
+	case <-reqCtx.Done():
+		// nobody is waiting for the output anymore
+		_ = execution.Kill(ctx, syscall.SIGKILL)
+		exit := <-exitC
+		fmt.Printf("[timing] total (canceled): %v\n", time.Since(overallStart))
+		if cause := context.Cause(reqCtx); errors.Is(cause, ErrExecTimeout) {
+			return finish(exit, cause)
+		}
+		return finish(exit, fmt.Errorf("%w: %v", ErrExecCanceled, reqCtx.Err()))
+	case <-capture.overflow:
+		// the rest of the output would be dropped anyway
+		_ = execution.Kill(ctx, syscall.SIGKILL)
+		exit := <-exitC
+		fmt.Printf("[timing] total (output limit): %v\n", time.Since(overallStart))
+		return finish(exit, fmt.Errorf("%w: more than %d bytes on one stream", ErrOutputLimit, profile.OutputCap()))
+	case <-time.After(backstop):
+		_ = execution.Kill(ctx, syscall.SIGTERM)
 		select {
-		case <-statusC:
+		case exit := <-exitC:
 			fmt.Printf("[timing] wait task (timeout SIGTERM): %v\n", time.Since(phaseStart))
 			fmt.Printf("[timing] total: %v\n", time.Since(overallStart))
-			return collect(), uniqueID, fmt.Errorf("execution exceeded %s (terminated with SIGTERM)", timeout)
+			return finish(exit, fmt.Errorf("%w: exceeded %s (terminated with SIGTERM)", ErrExecTimeout, timeout))
 		case <-time.After(2 * time.Second):
-			_ = task.Kill(ctx, syscall.SIGKILL, containerd.WithKillAll)
-			<-statusC
+			_ = execution.Kill(ctx, syscall.SIGKILL)
+			exit := <-exitC
 			fmt.Printf("[timing] wait task (timeout SIGKILL): %v\n", time.Since(phaseStart))
 			fmt.Printf("[timing] total: %v\n", time.Since(overallStart))
-			return collect(), uniqueID, fmt.Errorf("execution exceeded %s (forced SIGKILL)", timeout)
+			return finish(exit, fmt.Errorf("%w: exceeded %s (forced SIGKILL)", ErrExecTimeout, timeout))
 		}
 	}
 }
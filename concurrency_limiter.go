@@ -1,19 +1,57 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"sync"
+	"time"
 )
 
+// defaultSlotHold is assumed for wait estimates until a slot was released.
+const defaultSlotHold = 2 * time.Second
+
 type concurrencyLimiter struct {
 	mu       sync.Mutex
 	total    int
 	perIP    map[string]int
 	maxTotal int
 	maxPerIP int
+
+	// acquire queues callers when no slot is free: one FIFO per IP, the
+	// IPs served round-robin (rr) so a single client cannot starve others
+	maxWaiting      int
+	maxWaitingPerIP int
+	waiting         map[string][]*limiterWaiter
+	rr              []string
+	nWaiting        int
+	// avgHold is a moving average of how long a slot is kept
+	avgHold time.Duration
+}
+
+type limiterWaiter struct {
+	ready   chan struct{} // closed once release is set
+	release func()
+}
+
+// limiterBusyError is returned by acquire when no slot could be had.
+type limiterBusyError struct {
+	Reason string
+	// TimedOut: the caller waited its whole maxWait (503); otherwise the
+	// queue was full and it was turned away at once (429)
+	TimedOut      bool
+	QueueDepth    int
+	EstimatedWait time.Duration
+	Total, PerIP  int
+}
+
+func (e *limiterBusyError) Error() string {
+	return fmt.Sprintf("%s (queue depth %d, estimated wait %ds)", e.Reason, e.QueueDepth, int((e.EstimatedWait+time.Second-1)/time.Second))
 }
 
-func newConcurrencyLimiter(maxTotal, maxPerIP int) *concurrencyLimiter {
+// newConcurrencyLimiter bounds running slots by maxTotal and maxPerIP and
+// lets up to maxWaiting callers (maxWaitingPerIP per IP) wait in acquire.
+// Limits <= 0 mean "unlimited"; maxWaiting <= 0 disables waiting.
+func newConcurrencyLimiter(maxTotal, maxPerIP, maxWaiting, maxWaitingPerIP int) *concurrencyLimiter {
 	if maxTotal < 0 {
 		maxTotal = 0
 	}
@@ -21,9 +59,12 @@ func newConcurrencyLimiter(maxTotal, maxPerIP int) *concurrencyLimiter {
 		maxPerIP = 0
 	}
 	return &concurrencyLimiter{
-		perIP:    make(map[string]int),
-		maxTotal: maxTotal,
-		maxPerIP: maxPerIP,
+		perIP:           make(map[string]int),
+		maxTotal:        maxTotal,
+		maxPerIP:        maxPerIP,
+		maxWaiting:      maxWaiting,
+		maxWaitingPerIP: maxWaitingPerIP,
+		waiting:         make(map[string][]*limiterWaiter),
 	}
 }
 
@@ -39,27 +80,103 @@ func (l *concurrencyLimiter) tryAcquire(ip string) (func(), bool, string, int, i
 	l.mu.Lock()
 	defer l.mu.Unlock()
 
-	if l.maxTotal > 0 && l.total >= l.maxTotal {
-		return nil, false, fmt.Sprintf("too many concurrent compilations (limit %d)", l.maxTotal), l.total, l.perIP[ip]
+	if reason := l.fullLocked(ip); reason != "" {
+		return nil, false, reason, l.total, l.perIP[ip]
 	}
-	if l.maxPerIP > 0 {
-		if l.perIP == nil {
-			l.perIP = make(map[string]int)
-		}
-		if l.perIP[ip] >= l.maxPerIP {
-			return nil, false, fmt.Sprintf("too many concurrent compilations from this IP (limit %d)", l.maxPerIP), l.total, l.perIP[ip]
+	release := l.grantLocked(ip)
+	return release, true, "", l.total, l.perIP[ip]
+}
+
+// acquire is tryAcquire that waits up to maxWait for a slot, in round-robin
+// order between IPs. It fails with a *limiterBusyError when the queue is
+// full or the wait runs out, or with ctx's error when ctx ends first.
+func (l *concurrencyLimiter) acquire(ctx context.Context, ip string, maxWait time.Duration) (func(), error) {
+	if l == nil {
+		return func() {}, nil
+	}
+	if ip == "" {
+		ip = "unknown"
+	}
+	l.mu.Lock()
+	reason := l.fullLocked(ip)
+	if reason == "" {
+		release := l.grantLocked(ip)
+		l.mu.Unlock()
+		return release, nil
+	}
+	switch {
+	case maxWait <= 0 || l.maxWaiting <= 0:
+	case l.nWaiting >= l.maxWaiting:
+		reason = fmt.Sprintf("compilation queue is full (limit %d)", l.maxWaiting)
+	case l.maxWaitingPerIP > 0 && len(l.waiting[ip]) >= l.maxWaitingPerIP:
+		reason = fmt.Sprintf("too many queued compilations from this IP (limit %d)", l.maxWaitingPerIP)
+	default:
+		reason = ""
+	}
+	if reason != "" {
+		err := l.busyLocked(ip, reason, false)
+		l.mu.Unlock()
+		return nil, err
+	}
+	w := &limiterWaiter{ready: make(chan struct{})}
+	if len(l.waiting[ip]) == 0 {
+		l.rr = append(l.rr, ip)
+	}
+	l.waiting[ip] = append(l.waiting[ip], w)
+	l.nWaiting++
+	l.mu.Unlock()
+
+	timer := time.NewTimer(maxWait)
+	defer timer.Stop()
+	var err error
+	select {
+	case <-w.ready:
+		return w.release, nil
+	case <-ctx.Done():
+		err = ctx.Err()
+	case <-timer.C:
+	}
+
+	l.mu.Lock()
+	select {
+	case <-w.ready:
+		// granted while giving up
+		l.mu.Unlock()
+		if err != nil {
+			w.release()
+			return nil, err
 		}
+		return w.release, nil
+	default:
+	}
+	l.removeWaiterLocked(ip, w)
+	if err == nil {
+		err = l.busyLocked(ip, fmt.Sprintf("no compilation slot freed up within %s", maxWait), true)
 	}
+	l.mu.Unlock()
+	return nil, err
+}
 
+// fullLocked returns why ip cannot take a slot now ("" if it can).
+func (l *concurrencyLimiter) fullLocked(ip string) string {
+	if l.maxTotal > 0 && l.total >= l.maxTotal {
+		return fmt.Sprintf("too many concurrent compilations (limit %d)", l.maxTotal)
+	}
+	if l.maxPerIP > 0 && l.perIP[ip] >= l.maxPerIP {
+		return fmt.Sprintf("too many concurrent compilations from this IP (limit %d)", l.maxPerIP)
+	}
+	return ""
+}
+
+// grantLocked takes a slot for ip and returns its release func.
+func (l *concurrencyLimiter) grantLocked(ip string) func() {
 	l.total++
 	if l.maxPerIP > 0 {
 		l.perIP[ip]++
 	}
-	currentTotal := l.total
-	currentPerIP := l.perIP[ip]
-
+	start := time.Now()
 	released := false
-	release := func() {
+	return func() {
 		l.mu.Lock()
 		defer l.mu.Unlock()
 		if released {
@@ -78,7 +195,84 @@ func (l *concurrencyLimiter) tryAcquire(ip string) (func(), bool, string, int, i
 				l.perIP[ip] = current
 			}
 		}
+		held := time.Since(start)
+		if l.avgHold == 0 {
+			l.avgHold = held
+		} else {
+			l.avgHold = (l.avgHold*7 + held) / 8
+		}
+		l.dispatchLocked()
+	}
+}
+
+// dispatchLocked hands free slots to waiters: the first IP in rr that may
+// take one gets it and moves to the back, until no waiter fits.
+func (l *concurrencyLimiter) dispatchLocked() {
+	for granted := true; granted; {
+		granted = false
+		for i, ip := range l.rr {
+			if l.fullLocked(ip) != "" {
+				continue
+			}
+			w := l.waiting[ip][0]
+			l.waiting[ip] = l.waiting[ip][1:]
+			l.nWaiting--
+			w.release = l.grantLocked(ip)
+			close(w.ready)
+			l.rr = append(l.rr[:i], l.rr[i+1:]...)
+			if len(l.waiting[ip]) > 0 {
+				l.rr = append(l.rr, ip)
+			} else {
+				delete(l.waiting, ip)
+			}
+			granted = true
+			break
+		}
+	}
+}
+
+func (l *concurrencyLimiter) removeWaiterLocked(ip string, w *limiterWaiter) {
+	q := l.waiting[ip]
+	for i, x := range q {
+		if x == w {
+			l.waiting[ip] = append(q[:i], q[i+1:]...)
+			l.nWaiting--
+			break
+		}
+	}
+	if len(l.waiting[ip]) > 0 {
+		return
+	}
+	delete(l.waiting, ip)
+	for i, x := range l.rr {
+		if x == ip {
+			l.rr = append(l.rr[:i], l.rr[i+1:]...)
+			break
+		}
 	}
+}
 
-	return release, true, "", currentTotal, currentPerIP
+// busyLocked builds the rejection for ip, estimating how long a new waiter
+// would wait: every slot turns over once per avgHold, and ip also waits
+// behind its own queue when it is at its per-IP limit.
+func (l *concurrencyLimiter) busyLocked(ip, reason string, timedOut bool) *limiterBusyError {
+	hold := l.avgHold
+	if hold == 0 {
+		hold = defaultSlotHold
+	}
+	rounds := 1
+	if l.maxTotal > 0 {
+		rounds = l.nWaiting/l.maxTotal + 1
+	}
+	if l.maxPerIP > 0 {
+		rounds = max(rounds, len(l.waiting[ip])/l.maxPerIP+1)
+	}
+	return &limiterBusyError{
+		Reason:        reason,
+		TimedOut:      timedOut,
+		QueueDepth:    l.nWaiting,
+		EstimatedWait: time.Duration(rounds) * hold,
+		Total:         l.total,
+		PerIP:         l.perIP[ip],
+	}
 }
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+type limiterGrant struct {
+	label   string
+	release func()
+}
+
+// queueWaiter starts acquire for label (its IP is the first letter) in the
+// background and returns once it is queued; grants are sent on granted.
+func queueWaiter(t *testing.T, ctx context.Context, l *concurrencyLimiter, label string, granted chan<- limiterGrant) {
+	t.Helper()
+	l.mu.Lock()
+	before := l.nWaiting
+	l.mu.Unlock()
+	go func() {
+		release, err := l.acquire(ctx, label[:1], time.Minute)
+		if err == nil {
+			granted <- limiterGrant{label, release}
+		}
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		l.mu.Lock()
+		n := l.nWaiting
+		l.mu.Unlock()
+		if n > before {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s never queued", label)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestConcurrencyLimiterRoundRobin(t *testing.T) {
+	tests := []struct {
+		name     string
+		maxTotal int
+		maxPerIP int
+		held     []string // slots taken before anyone queues
+		queue    []string
+		release  []string // in this order
+		want     []string // granted after each release, "" for none
+	}{
+		{
+			name:     "fifo within an ip",
+			maxTotal: 1, held: []string{"A"}, queue: []string{"A1", "A2"},
+			release: []string{"A", "A1", "A2"},
+			want:    []string{"A1", "A2", ""},
+		},
+		{
+			name:     "ips take turns",
+			maxTotal: 1, held: []string{"X"}, queue: []string{"A1", "A2", "A3", "B1", "C1"},
+			release: []string{"X", "A1", "B1", "C1", "A2", "A3"},
+			want:    []string{"A1", "B1", "C1", "A2", "A3", ""},
+		},
+		{
+			name:     "an ip at its limit is passed over",
+			maxTotal: 2, maxPerIP: 1, held: []string{"A", "B"}, queue: []string{"A1", "A2", "C1"},
+			release: []string{"B", "A", "C1", "A1"},
+			want:    []string{"C1", "A1", "", "A2"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			l := newConcurrencyLimiter(tt.maxTotal, tt.maxPerIP, 10, 0)
+			holders := map[string]func(){}
+			for _, label := range tt.held {
+				release, ok, reason, _, _ := l.tryAcquire(label[:1])
+				if !ok {
+					t.Fatalf("held slot %s: %s", label, reason)
+				}
+				holders[label] = release
+			}
+			granted := make(chan limiterGrant, len(tt.queue))
+			for _, label := range tt.queue {
+				queueWaiter(t, ctx, l, label, granted)
+			}
+			for i, label := range tt.release {
+				holders[label]()
+				if tt.want[i] == "" {
+					select {
+					case g := <-granted:
+						t.Fatalf("releasing %s granted %s, want none", label, g.label)
+					case <-time.After(20 * time.Millisecond):
+					}
+					continue
+				}
+				select {
+				case g := <-granted:
+					if g.label != tt.want[i] {
+						t.Fatalf("releasing %s granted %s, want %s", label, g.label, tt.want[i])
+					}
+					holders[g.label] = g.release
+				case <-time.After(5 * time.Second):
+					t.Fatalf("releasing %s granted nothing, want %s", label, tt.want[i])
+				}
+			}
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			if l.nWaiting != 0 || len(l.rr) != 0 || len(l.waiting) != 0 {
+				t.Errorf("queue not drained: %d waiting, rr %v", l.nWaiting, l.rr)
+			}
+		})
+	}
+}
+
+func TestConcurrencyLimiterQueueCaps(t *testing.T) {
+	tests := []struct {
+		name            string
+		maxWaiting      int
+		maxWaitingPerIP int
+		queued          []string
+		ip              string
+		maxWait         time.Duration
+		reason          string
+		timedOut        bool
+	}{
+		{
+			name: "waiting disabled", ip: "B", maxWait: time.Minute,
+			reason: "too many concurrent compilations (limit 1)",
+		},
+		{
+			name: "no wait asked", maxWaiting: 5, ip: "B",
+			reason: "too many concurrent compilations (limit 1)",
+		},
+		{
+			name: "queue full", maxWaiting: 2, queued: []string{"B1", "C1"}, ip: "D", maxWait: time.Minute,
+			reason: "compilation queue is full (limit 2)",
+		},
+		{
+			name: "per ip queue full", maxWaiting: 5, maxWaitingPerIP: 1, queued: []string{"B1"}, ip: "B", maxWait: time.Minute,
+			reason: "too many queued compilations from this IP (limit 1)",
+		},
+		{
+			name: "other ips still queue, then time out", maxWaiting: 5, maxWaitingPerIP: 1, queued: []string{"B1"}, ip: "C", maxWait: 20 * time.Millisecond,
+			reason: "no compilation slot freed up within 20ms", timedOut: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			l := newConcurrencyLimiter(1, 0, tt.maxWaiting, tt.maxWaitingPerIP)
+			release, ok, _, _, _ := l.tryAcquire("A")
+			if !ok {
+				t.Fatal("first slot refused")
+			}
+			defer release()
+			granted := make(chan limiterGrant, len(tt.queued))
+			for _, label := range tt.queued {
+				queueWaiter(t, ctx, l, label, granted)
+			}
+
+			_, err := l.acquire(ctx, tt.ip, tt.maxWait)
+			var busy *limiterBusyError
+			if !errors.As(err, &busy) {
+				t.Fatalf("acquire error = %v, want a limiterBusyError", err)
+			}
+			if busy.Reason != tt.reason || busy.TimedOut != tt.timedOut {
+				t.Errorf("busy = %q timed out %v, want %q %v", busy.Reason, busy.TimedOut, tt.reason, tt.timedOut)
+			}
+			if busy.QueueDepth != len(tt.queued) || busy.Total != 1 || busy.EstimatedWait <= 0 {
+				t.Errorf("busy = %+v, want depth %d with 1 running", busy, len(tt.queued))
+			}
+		})
+	}
+}
+
+func TestConcurrencyLimiterCancel(t *testing.T) {
+	l := newConcurrencyLimiter(1, 0, 5, 0)
+	release, _, _, _, _ := l.tryAcquire("A")
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		_, err := l.acquire(ctx, "B", time.Minute)
+		done <- err
+	}()
+	for {
+		l.mu.Lock()
+		n := l.nWaiting
+		l.mu.Unlock()
+		if n == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Fatalf("acquire error = %v, want context.Canceled", err)
+	}
+	l.mu.Lock()
+	if l.nWaiting != 0 || len(l.rr) != 0 {
+		t.Errorf("canceled waiter left in the queue: %d waiting, rr %v", l.nWaiting, l.rr)
+	}
+	l.mu.Unlock()
+	release()
+	if _, ok, _, total, _ := l.tryAcquire("C"); !ok || total != 1 {
+		t.Errorf("slot not free after the release: ok %v total %d", ok, total)
+	}
+}
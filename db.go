@@ -2,6 +2,7 @@ package main
 
 import (
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"os"
@@ -20,6 +21,42 @@ const (
 
 var db *sql.DB
 
+// optionalContainerColumns were added to containers after the minimal schema.
+// ensureOptionalColumns creates them with ALTER TABLE and ensureMinimalSchema
+// keeps (and copies) them when it rebuilds the table.
+var optionalContainerColumns = []struct {
+	name string
+	ddl  string
+}{
+	{"ip", "TEXT"},
+	{"stdin", "TEXT"},
+	{"status", "TEXT"},
+	{"compile_stdout", "TEXT"},
+	{"compile_stderr", "TEXT"},
+	{"compile_exit_code", "INTEGER"},
+	{"compile_ms", "INTEGER"},
+	{"run_stdout", "TEXT"},
+	{"run_stderr", "TEXT"},
+	{"run_exit_code", "INTEGER"},
+	{"run_ms", "INTEGER"},
+	{"run_signal", "TEXT"},
+	{"exit_code", "INTEGER"},
+	{"oom_killed", "INTEGER"},
+	{"memory_peak_bytes", "INTEGER"},
+	{"cpu_user_us", "INTEGER"},
+	{"cpu_system_us", "INTEGER"},
+	{"pids_peak", "INTEGER"},
+	{"throttled_periods", "INTEGER"},
+	{"profile", "TEXT"},
+	{"verdict", "TEXT"},
+	{"toolchain", "TEXT"},
+	{"toolchain_hash", "TEXT"},
+	{"cache_hit", "INTEGER"},
+	{"binary_cache", "TEXT"},
+	{"image_digest", "TEXT"},
+	{"cached_from", "TEXT"},
+}
+
 func initDB() error {
 	if err := os.MkdirAll(filepath.Dir(defaultDBPath), 0o755); err != nil {
 		return fmt.Errorf("create db dir: %w", err)
@@ -66,13 +103,22 @@ func migrate() error {
 	if err := ensureMinimalSchema(); err != nil {
 		return fmt.Errorf("ensure minimal schema: %w", err)
 	}
-	// Ensure the ip column exists (added after initial minimal schema).
-	if err := ensureIPColumn(); err != nil {
-		return fmt.Errorf("ensure ip column: %w", err)
+	// Ensure ip, stdin, ... exist (added after initial minimal schema).
+	if err := ensureOptionalColumns(); err != nil {
+		return fmt.Errorf("ensure optional columns: %w", err)
 	}
 	if err := ensureAdminLoginFailuresSchema(); err != nil {
 		return fmt.Errorf("ensure admin login failures schema: %w", err)
 	}
+	if err := ensureJudgeCasesSchema(); err != nil {
+		return fmt.Errorf("ensure judge cases schema: %w", err)
+	}
+	if err := ensureAdminAuditSchema(); err != nil {
+		return fmt.Errorf("ensure admin audit schema: %w", err)
+	}
+	if err := ensureJobsSchema(); err != nil {
+		return fmt.Errorf("ensure jobs schema: %w", err)
+	}
 	return nil
 }
 
@@ -97,9 +143,12 @@ func ensureMinimalSchema() error {
 	if len(cols) == 0 {
 		return nil
 	}
-	// ip column intentionally NOT part of strict minimal set so we can add it later with simple ALTER (avoid full copy if it's the only missing col)
+	// optional columns intentionally NOT part of strict minimal set so we can add them later with simple ALTER (avoid full copy if they are the only missing cols)
 	required := []string{"id", "container_id", "created_at", "finished_at", "execution_time_ms", "code_executed", "output", "error_message"}
-	allowedSet := map[string]struct{}{"ip": {}}
+	allowedSet := map[string]struct{}{}
+	for _, c := range optionalContainerColumns {
+		allowedSet[c.name] = struct{}{}
+	}
 	for _, c := range required {
 		allowedSet[c] = struct{}{}
 	}
@@ -134,32 +183,30 @@ func ensureMinimalSchema() error {
 			_ = tx.Rollback()
 		}
 	}()
-	if _, err = tx.Exec(`CREATE TABLE containers_new (
+	newSchema := `CREATE TABLE containers_new (
 		id INTEGER PRIMARY KEY AUTOINCREMENT,
 		container_id TEXT NOT NULL,
 		created_at TIMESTAMP NOT NULL,
 		finished_at TIMESTAMP NOT NULL,
 		execution_time_ms INTEGER NOT NULL,
-		ip TEXT,
 		code_executed TEXT,
 		output TEXT,
-		error_message TEXT
-	);`); err != nil {
+		error_message TEXT`
+	for _, c := range optionalContainerColumns {
+		newSchema += ",\n\t\t" + c.name + " " + c.ddl
+	}
+	if _, err = tx.Exec(newSchema + "\n\t);"); err != nil {
 		return err
 	}
 	if _, err = tx.Exec(`CREATE INDEX IF NOT EXISTS idx_containers_created_at_new ON containers_new(created_at)`); err != nil {
 		return err
 	}
-	// Determine if old table had ip column; copy it if present.
-	existingHasIP := false
-	for _, c := range cols {
-		if c == "ip" {
-			existingHasIP = true
-		}
-	}
+	// Optional columns present in the old table are copied; the others start out NULL.
 	copyCols := []string{"container_id", "created_at", "finished_at", "execution_time_ms"}
-	if existingHasIP {
-		copyCols = append(copyCols, "ip")
+	for _, c := range optionalContainerColumns {
+		if _, ok := existingSet[c.name]; ok {
+			copyCols = append(copyCols, c.name)
+		}
 	}
 	// timings_json dropped
 	copyCols = append(copyCols, "code_executed", "output", "error_message")
@@ -183,14 +230,14 @@ func ensureMinimalSchema() error {
 	return nil
 }
 
-// ensureIPColumn adds the ip column (nullable) if it does not yet exist.
-func ensureIPColumn() error {
+// ensureOptionalColumns adds every missing optional column (nullable).
+func ensureOptionalColumns() error {
 	rows, err := db.Query(`PRAGMA table_info(containers)`)
 	if err != nil {
 		return err
 	}
 	defer rows.Close()
-	hasIP := false
+	existing := map[string]bool{}
 	for rows.Next() {
 		var cid int
 		var name, ctype string
@@ -199,15 +246,18 @@ func ensureIPColumn() error {
 		if err := rows.Scan(&cid, &name, &ctype, &notnull, &dflt, &pk); err != nil {
 			return err
 		}
-		if name == "ip" {
-			hasIP = true
-		}
+		existing[name] = true
 	}
-	if hasIP {
-		return nil
+	if err := rows.Err(); err != nil {
+		return err
 	}
-	if _, err := db.Exec(`ALTER TABLE containers ADD COLUMN ip TEXT`); err != nil {
-		return fmt.Errorf("add ip column: %w", err)
+	for _, c := range optionalContainerColumns {
+		if existing[c.name] {
+			continue
+		}
+		if _, err := db.Exec(`ALTER TABLE containers ADD COLUMN ` + c.name + ` ` + c.ddl); err != nil {
+			return fmt.Errorf("add %s column: %w", c.name, err)
+		}
 	}
 	return nil
 }
@@ -233,6 +283,74 @@ func ensureAdminLoginFailuresSchema() error {
 	return nil
 }
 
+// ensureJudgeCasesSchema creates the per-case results of /judge submissions,
+// linked to their containers row by container_id.
+func ensureJudgeCasesSchema() error {
+	ddl := `CREATE TABLE IF NOT EXISTS judge_cases (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		container_id TEXT NOT NULL,
+		case_index INTEGER NOT NULL,
+		verdict TEXT NOT NULL,
+		duration_ms INTEGER,
+		exit_code INTEGER,
+		signal TEXT,
+		stdout TEXT,
+		stderr TEXT
+	);`
+	if _, err := db.Exec(ddl); err != nil {
+		return err
+	}
+	_, err := db.Exec(`CREATE INDEX IF NOT EXISTS idx_judge_cases_container_id ON judge_cases(container_id)`)
+	return err
+}
+
+// ensureAdminAuditSchema creates the admin audit trail. Unlike the
+// execution history it is never pruned.
+func ensureAdminAuditSchema() error {
+	ddl := `CREATE TABLE IF NOT EXISTS admin_audit (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		occurred_at TIMESTAMP NOT NULL,
+		admin TEXT,
+		ip TEXT,
+		action TEXT NOT NULL,
+		target TEXT,
+		success INTEGER NOT NULL,
+		detail TEXT
+	);`
+	if _, err := db.Exec(ddl); err != nil {
+		return err
+	}
+	_, err := db.Exec(`CREATE INDEX IF NOT EXISTS idx_admin_audit_occurred_at ON admin_audit(occurred_at)`)
+	return err
+}
+
+// ensureJobsSchema creates the queue of POST /jobs submissions; seq orders
+// the queue, id is the random handle given to the client.
+func ensureJobsSchema() error {
+	ddl := `CREATE TABLE IF NOT EXISTS jobs (
+		seq INTEGER PRIMARY KEY AUTOINCREMENT,
+		id TEXT NOT NULL UNIQUE,
+		status TEXT NOT NULL,
+		created_at TIMESTAMP NOT NULL,
+		started_at TIMESTAMP,
+		finished_at TIMESTAMP,
+		ip TEXT,
+		code TEXT NOT NULL,
+		stdin TEXT,
+		profile TEXT,
+		toolchain TEXT,
+		cache INTEGER NOT NULL DEFAULT 0,
+		container_id TEXT,
+		result_json TEXT,
+		error TEXT
+	);`
+	if _, err := db.Exec(ddl); err != nil {
+		return err
+	}
+	_, err := db.Exec(`CREATE INDEX IF NOT EXISTS idx_jobs_status_seq ON jobs(status, seq)`)
+	return err
+}
+
 // ensureTimingsColumn adds the timings_json column if missing.
 // timings_json column removal: no longer ensured
 
@@ -241,6 +359,12 @@ func pruneOld() error {
 	if _, err := db.Exec(`DELETE FROM containers WHERE created_at < ?`, cutoff.UTC()); err != nil {
 		return err
 	}
+	if _, err := db.Exec(`DELETE FROM judge_cases WHERE container_id NOT IN (SELECT container_id FROM containers)`); err != nil {
+		return err
+	}
+	if _, err := db.Exec(`DELETE FROM jobs WHERE finished_at IS NOT NULL AND finished_at < ?`, cutoff.UTC()); err != nil {
+		return err
+	}
 	_, err := db.Exec(`DELETE FROM admin_login_failures WHERE occurred_at < ?`, cutoff.UTC())
 	return err
 }
@@ -258,19 +382,139 @@ func saveContainerRecordDB(r *ContainerRecord) error {
 	if db == nil {
 		return errors.New("db not initialized")
 	}
-	stmt := `INSERT INTO containers (container_id, created_at, finished_at, execution_time_ms, ip, code_executed, output, error_message)
-			 VALUES (?,?,?,?,?,?,?,?)`
-	_, err := db.Exec(stmt,
+	stmt := `INSERT INTO containers (container_id, created_at, finished_at, execution_time_ms, ip, code_executed, stdin, output, error_message, status,
+			 compile_stdout, compile_stderr, compile_exit_code, compile_ms, run_stdout, run_stderr, run_exit_code, run_ms, run_signal, exit_code, oom_killed,
+			 memory_peak_bytes, cpu_user_us, cpu_system_us, pids_peak, throttled_periods, profile, verdict, toolchain, toolchain_hash, cache_hit, binary_cache, image_digest, cached_from)
+			 VALUES (?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?)`
+	args := []interface{}{
 		r.ContainerID,
 		r.CreatedAt.UTC(),
 		r.FinishedAt.UTC(),
 		r.ExecutionTime.Milliseconds(),
 		r.IP,
 		r.CodeExecuted,
+		r.Stdin,
 		r.Output,
 		r.ErrorMessage,
-	)
-	return err
+		nullable(r.Status),
+	}
+	args = append(args, phaseDBValues(r.Compile)...)
+	args = append(args, phaseDBValues(r.Run)...)
+	var runSignal interface{}
+	if r.Run != nil {
+		runSignal = nullable(r.Run.Signal)
+	}
+	args = append(args, runSignal, r.ExitCode, r.OOMKilled)
+	args = append(args, usageDBValues(r.Usage)...)
+	args = append(args, nullable(r.Profile), nullable(r.Verdict), nullable(r.Toolchain), nullable(r.ToolchainHash), r.CacheHit, nullable(r.BinaryCache), nullable(r.ImageDigest), nullable(r.CachedFrom))
+	if len(r.Cases) == 0 {
+		_, err := db.Exec(stmt, args...)
+		return err
+	}
+	// a judge submission and its cases are stored together
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+	if _, err := tx.Exec(stmt, args...); err != nil {
+		return err
+	}
+	for _, c := range r.Cases {
+		if _, err := tx.Exec(`INSERT INTO judge_cases (container_id, case_index, verdict, duration_ms, exit_code, signal, stdout, stderr) VALUES (?,?,?,?,?,?,?,?)`,
+			r.ContainerID, c.Index, c.Verdict, c.DurationMS, c.ExitCode, nullable(c.Signal), c.Stdout, c.Stderr); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// loadJudgeCases attaches the stored case results to the judge submissions in recs.
+func loadJudgeCases(recs []ContainerRecord) error {
+	byID := map[string]*ContainerRecord{}
+	var ids []interface{}
+	for i := range recs {
+		if recs[i].Verdict != "" {
+			byID[recs[i].ContainerID] = &recs[i]
+			ids = append(ids, recs[i].ContainerID)
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	rows, err := db.Query(`SELECT container_id, case_index, verdict, COALESCE(duration_ms,0), COALESCE(exit_code,0), COALESCE(signal,''), COALESCE(stdout,''), COALESCE(stderr,'')
+			FROM judge_cases WHERE container_id IN (?`+strings.Repeat(",?", len(ids)-1)+`) ORDER BY container_id, case_index`, ids...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id string
+		var c JudgeCaseResult
+		if err := rows.Scan(&id, &c.Index, &c.Verdict, &c.DurationMS, &c.ExitCode, &c.Signal, &c.Stdout, &c.Stderr); err != nil {
+			return err
+		}
+		if r := byID[id]; r != nil {
+			r.Cases = append(r.Cases, c)
+		}
+	}
+	return rows.Err()
+}
+
+// phaseDBValues flattens a phase into its *_stdout, *_stderr, *_exit_code, *_ms columns (NULL when absent).
+func phaseDBValues(p *PhaseResult) []interface{} {
+	if p == nil {
+		return []interface{}{nil, nil, nil, nil}
+	}
+	return []interface{}{p.Stdout, p.Stderr, p.ExitCode, p.DurationMS}
+}
+
+// usageDBValues flattens the resource usage columns (NULL when not measured).
+// SQLite integers are signed; the counters never get near that range.
+func usageDBValues(u *ResourceUsage) []interface{} {
+	if u == nil {
+		return []interface{}{nil, nil, nil, nil, nil}
+	}
+	return []interface{}{int64(u.MemoryPeakBytes), int64(u.CPUUserUS), int64(u.CPUSystemUS), int64(u.PidsPeak), int64(u.ThrottledPeriods)}
+}
+
+// usageDBScan is the scan target matching usageDBValues.
+type usageDBScan struct {
+	memoryPeak, cpuUser, cpuSystem, pidsPeak, throttled sql.NullInt64
+}
+
+func (s *usageDBScan) dest() []interface{} {
+	return []interface{}{&s.memoryPeak, &s.cpuUser, &s.cpuSystem, &s.pidsPeak, &s.throttled}
+}
+
+func (s *usageDBScan) usage() *ResourceUsage {
+	if !s.memoryPeak.Valid {
+		return nil
+	}
+	return &ResourceUsage{
+		MemoryPeakBytes:  uint64(s.memoryPeak.Int64),
+		CPUUserUS:        uint64(s.cpuUser.Int64),
+		CPUSystemUS:      uint64(s.cpuSystem.Int64),
+		PidsPeak:         uint64(s.pidsPeak.Int64),
+		ThrottledPeriods: uint64(s.throttled.Int64),
+	}
+}
+
+// phaseDBScan is the scan target matching phaseDBValues.
+type phaseDBScan struct {
+	stdout, stderr sql.NullString
+	exitCode, ms   sql.NullInt64
+}
+
+func (s *phaseDBScan) dest() []interface{} {
+	return []interface{}{&s.stdout, &s.stderr, &s.exitCode, &s.ms}
+}
+
+func (s *phaseDBScan) phase() *PhaseResult {
+	if !s.exitCode.Valid {
+		return nil
+	}
+	return &PhaseResult{Stdout: s.stdout.String, Stderr: s.stderr.String, ExitCode: int(s.exitCode.Int64), DurationMS: s.ms.Int64}
 }
 
 func listContainerRecords(limit int) ([]ContainerRecord, error) {
@@ -280,7 +524,11 @@ func listContainerRecords(limit int) ([]ContainerRecord, error) {
 	if limit <= 0 || limit > 500 {
 		limit = 100
 	}
-	rows, err := db.Query(`SELECT container_id, created_at, finished_at, execution_time_ms, COALESCE(ip,'') as ip, code_executed, output, error_message
+	rows, err := db.Query(`SELECT container_id, created_at, finished_at, execution_time_ms, COALESCE(ip,'') as ip, code_executed, COALESCE(stdin,''), output, error_message,
+			COALESCE(status,''), compile_stdout, compile_stderr, compile_exit_code, compile_ms, run_stdout, run_stderr, run_exit_code, run_ms, COALESCE(run_signal,''),
+			COALESCE(exit_code,0), COALESCE(oom_killed,0),
+			memory_peak_bytes, cpu_user_us, cpu_system_us, pids_peak, throttled_periods, COALESCE(profile,''), COALESCE(verdict,''),
+			COALESCE(toolchain,''), COALESCE(toolchain_hash,''), COALESCE(cache_hit,0), COALESCE(binary_cache,''), COALESCE(image_digest,''), COALESCE(cached_from,'')
 			FROM containers ORDER BY created_at DESC LIMIT ?`, limit)
 	if err != nil {
 		return nil, err
@@ -290,13 +538,34 @@ func listContainerRecords(limit int) ([]ContainerRecord, error) {
 	for rows.Next() {
 		var r ContainerRecord
 		var execMs int64
-		if err := rows.Scan(&r.ContainerID, &r.CreatedAt, &r.FinishedAt, &execMs, &r.IP, &r.CodeExecuted, &r.Output, &r.ErrorMessage); err != nil {
+		var compile, run phaseDBScan
+		var usage usageDBScan
+		var runSignal string
+		dest := []interface{}{&r.ContainerID, &r.CreatedAt, &r.FinishedAt, &execMs, &r.IP, &r.CodeExecuted, &r.Stdin, &r.Output, &r.ErrorMessage, &r.Status}
+		dest = append(dest, compile.dest()...)
+		dest = append(dest, run.dest()...)
+		dest = append(dest, &runSignal, &r.ExitCode, &r.OOMKilled)
+		dest = append(dest, usage.dest()...)
+		dest = append(dest, &r.Profile, &r.Verdict, &r.Toolchain, &r.ToolchainHash, &r.CacheHit, &r.BinaryCache, &r.ImageDigest, &r.CachedFrom)
+		if err := rows.Scan(dest...); err != nil {
 			return nil, err
 		}
 		r.ExecutionTime = time.Duration(execMs) * time.Millisecond
+		r.Compile = compile.phase()
+		r.Usage = usage.usage()
+		if r.Run = run.phase(); r.Run != nil {
+			r.Run.Signal = runSignal
+		}
 		out = append(out, r)
 	}
-	return out, rows.Err()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+	if err := loadJudgeCases(out); err != nil {
+		return nil, err
+	}
+	return out, nil
 }
 
 type TimePoint struct {
@@ -335,9 +604,38 @@ type ObservabilityStats struct {
 	SuccessCount         int                    `json:"success_count"`
 	ErrorCount           int                    `json:"error_count"`
 	AverageCompileTimeMS float64                `json:"average_compile_time_ms"`
+	Resources            ResourceStats          `json:"resources"`
+	Cache                CacheStats             `json:"cache"`
 	FailedAdminLogins    AdminLoginFailureStats `json:"failed_admin_logins"`
 }
 
+// CacheStats tells how often the result cache and the compiled binary cache
+// spared work in the range. ResultHitRate is over every run, BinaryHitRate
+// over the runs that could use the binary cache; ResultCache/BinaryCache are
+// the live counters since startup (nil when that cache is disabled).
+type CacheStats struct {
+	ResultHits    int               `json:"result_hits"`
+	ResultHitRate float64           `json:"result_hit_rate"`
+	BinaryHits    int               `json:"binary_hits"`
+	BinaryMisses  int               `json:"binary_misses"`
+	BinaryHitRate float64           `json:"binary_hit_rate"`
+	ResultCache   *ResultCacheStats `json:"result_cache,omitempty"`
+	BinaryCache   *BinaryCacheStats `json:"binary_cache,omitempty"`
+}
+
+// ResourceStats aggregates the per-execution cgroup accounting.
+type ResourceStats struct {
+	Measured           int     `json:"measured"`
+	AvgMemoryPeakBytes float64 `json:"avg_memory_peak_bytes"`
+	MaxMemoryPeakBytes int64   `json:"max_memory_peak_bytes"`
+	AvgCPUTimeMS       float64 `json:"avg_cpu_time_ms"`
+	MaxCPUTimeMS       float64 `json:"max_cpu_time_ms"`
+	MaxPidsPeak        int64   `json:"max_pids_peak"`
+	ThrottledCount     int     `json:"throttled_count"`
+	MemoryLimitCount   int     `json:"memory_limit_count"`
+	CPULimitCount      int     `json:"cpu_limit_count"`
+}
+
 func saveAdminLoginFailure(ip, username, userAgent, reason string) error {
 	if db == nil {
 		return errors.New("db not initialized")
@@ -350,6 +648,39 @@ func saveAdminLoginFailure(ip, username, userAgent, reason string) error {
 	return err
 }
 
+func saveAdminAudit(e AdminAuditEntry) error {
+	if db == nil {
+		return errors.New("db not initialized")
+	}
+	_, err := db.Exec(`INSERT INTO admin_audit (occurred_at, admin, ip, action, target, success, detail) VALUES (?,?,?,?,?,?,?)`,
+		e.OccurredAt.UTC(), e.Admin, e.IP, e.Action, nullable(e.Target), e.Success, nullable(e.Detail))
+	return err
+}
+
+func listAdminAudit(limit int) ([]AdminAuditEntry, error) {
+	if db == nil {
+		return nil, errors.New("db not initialized")
+	}
+	if limit <= 0 || limit > 500 {
+		limit = 100
+	}
+	rows, err := db.Query(`SELECT id, occurred_at, COALESCE(admin,''), COALESCE(ip,''), action, COALESCE(target,''), success, COALESCE(detail,'')
+		FROM admin_audit ORDER BY id DESC LIMIT ?`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []AdminAuditEntry{}
+	for rows.Next() {
+		var e AdminAuditEntry
+		if err := rows.Scan(&e.ID, &e.OccurredAt, &e.Admin, &e.IP, &e.Action, &e.Target, &e.Success, &e.Detail); err != nil {
+			return nil, err
+		}
+		out = append(out, e)
+	}
+	return out, rows.Err()
+}
+
 func getObservabilityStats(from, to time.Time) (ObservabilityStats, error) {
 	if db == nil {
 		return ObservabilityStats{}, errors.New("db not initialized")
@@ -376,6 +707,16 @@ func getObservabilityStats(from, to time.Time) (ObservabilityStats, error) {
 	if avg.Valid {
 		stats.AverageCompileTimeMS = avg.Float64
 	}
+	resources, err := getResourceStats(from, to)
+	if err != nil {
+		return stats, err
+	}
+	stats.Resources = resources
+	cache, err := getCacheStats(from, to)
+	if err != nil {
+		return stats, err
+	}
+	stats.Cache = cache
 	ips, err := listIPStats(`created_at`, `containers`, from, to)
 	if err != nil {
 		return stats, err
@@ -394,6 +735,56 @@ func getObservabilityStats(from, to time.Time) (ObservabilityStats, error) {
 	return stats, nil
 }
 
+func getResourceStats(from, to time.Time) (ResourceStats, error) {
+	var rs ResourceStats
+	var avgMem, avgCPU, maxCPU sql.NullFloat64
+	var maxMem, maxPids, throttled, memLimit, cpuLimit sql.NullInt64
+	err := db.QueryRow(`SELECT COUNT(memory_peak_bytes), AVG(memory_peak_bytes), MAX(memory_peak_bytes),
+			AVG((cpu_user_us + cpu_system_us) / 1000.0), MAX((cpu_user_us + cpu_system_us) / 1000.0), MAX(pids_peak),
+			SUM(CASE WHEN throttled_periods > 0 THEN 1 ELSE 0 END),
+			SUM(CASE WHEN status = 'memory_limit' THEN 1 ELSE 0 END),
+			SUM(CASE WHEN status = 'cpu_limit' THEN 1 ELSE 0 END)
+		FROM containers WHERE created_at >= ? AND created_at < ?`, from, to).
+		Scan(&rs.Measured, &avgMem, &maxMem, &avgCPU, &maxCPU, &maxPids, &throttled, &memLimit, &cpuLimit)
+	if err != nil {
+		return rs, err
+	}
+	rs.AvgMemoryPeakBytes = avgMem.Float64
+	rs.MaxMemoryPeakBytes = maxMem.Int64
+	rs.AvgCPUTimeMS = avgCPU.Float64
+	rs.MaxCPUTimeMS = maxCPU.Float64
+	rs.MaxPidsPeak = maxPids.Int64
+	rs.ThrottledCount = int(throttled.Int64)
+	rs.MemoryLimitCount = int(memLimit.Int64)
+	rs.CPULimitCount = int(cpuLimit.Int64)
+	return rs, nil
+}
+
+func getCacheStats(from, to time.Time) (CacheStats, error) {
+	var cs CacheStats
+	var total int
+	var resultHits, binaryHits, binaryMisses sql.NullInt64
+	err := db.QueryRow(`SELECT COUNT(*),
+			SUM(CASE WHEN cache_hit = 1 THEN 1 ELSE 0 END),
+			SUM(CASE WHEN binary_cache = 'hit' THEN 1 ELSE 0 END),
+			SUM(CASE WHEN binary_cache = 'miss' THEN 1 ELSE 0 END)
+		FROM containers WHERE created_at >= ? AND created_at < ?`, from, to).
+		Scan(&total, &resultHits, &binaryHits, &binaryMisses)
+	if err != nil {
+		return cs, err
+	}
+	cs.ResultHits = int(resultHits.Int64)
+	cs.BinaryHits = int(binaryHits.Int64)
+	cs.BinaryMisses = int(binaryMisses.Int64)
+	if total > 0 {
+		cs.ResultHitRate = float64(cs.ResultHits) / float64(total)
+	}
+	if n := cs.BinaryHits + cs.BinaryMisses; n > 0 {
+		cs.BinaryHitRate = float64(cs.BinaryHits) / float64(n)
+	}
+	return cs, nil
+}
+
 func listIPStats(timeColumn, table string, from, to time.Time) ([]IPStat, error) {
 	query := fmt.Sprintf(`SELECT ip, COUNT(*) AS total_count, strftime('%%Y-%%m-%%dT%%H:%%M:%%fZ', MIN(%s)) AS first_seen, strftime('%%Y-%%m-%%dT%%H:%%M:%%fZ', MAX(%s)) AS last_seen
 		FROM %s
@@ -487,3 +878,139 @@ func listAdminLoginFailures(from, to time.Time) (AdminLoginFailureStats, error)
 }
 
 // old nullable helpers removed (metrics dropped)
+
+// insertJob stores a queued job unless maxQueued jobs already wait in total
+// or maxQueuedPerIP from its IP (0 disables a limit); false when it did not.
+func insertJob(j *Job, maxQueued, maxQueuedPerIP int) (bool, error) {
+	if db == nil {
+		return false, errors.New("db not initialized")
+	}
+	// one statement, so concurrent enqueues cannot both see the last free place
+	res, err := db.Exec(`INSERT INTO jobs (id, status, created_at, ip, code, stdin, profile, toolchain, cache)
+		SELECT ?,?,?,?,?,?,?,?,?
+		WHERE (? <= 0 OR (SELECT COUNT(*) FROM jobs WHERE status = ?) < ?)
+		AND (? <= 0 OR (SELECT COUNT(*) FROM jobs WHERE status = ? AND ip = ?) < ?)`,
+		j.ID, j.Status, j.CreatedAt.UTC(), nullable(j.ip), j.code, nullable(j.stdin), nullable(j.Profile), nullable(j.Toolchain), j.cache,
+		maxQueued, JobQueued, maxQueued,
+		maxQueuedPerIP, JobQueued, j.ip, maxQueuedPerIP)
+	if err != nil {
+		return false, err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return false, err
+	}
+	j.seq, err = res.LastInsertId()
+	return true, err
+}
+
+// countQueuedJobs returns how many jobs wait in total and from ip.
+func countQueuedJobs(ip string) (total, fromIP int, err error) {
+	err = db.QueryRow(`SELECT COUNT(*), COALESCE(SUM(CASE WHEN ip = ? THEN 1 ELSE 0 END),0) FROM jobs WHERE status = ?`, ip, JobQueued).
+		Scan(&total, &fromIP)
+	return total, fromIP, err
+}
+
+const jobColumns = `seq, id, status, created_at, started_at, finished_at, COALESCE(ip,''), code, COALESCE(stdin,''),
+		COALESCE(profile,''), COALESCE(toolchain,''), cache, COALESCE(container_id,''), COALESCE(result_json,''), COALESCE(error,'')`
+
+func scanJob(row interface{ Scan(...interface{}) error }) (*Job, error) {
+	var j Job
+	var started, finished sql.NullTime
+	var resultJSON string
+	if err := row.Scan(&j.seq, &j.ID, &j.Status, &j.CreatedAt, &started, &finished, &j.ip, &j.code, &j.stdin,
+		&j.Profile, &j.Toolchain, &j.cache, &j.ContainerID, &resultJSON, &j.Error); err != nil {
+		return nil, err
+	}
+	if started.Valid {
+		j.StartedAt = &started.Time
+	}
+	if finished.Valid {
+		j.FinishedAt = &finished.Time
+	}
+	if resultJSON != "" {
+		var res ExecutionResult
+		if err := json.Unmarshal([]byte(resultJSON), &res); err == nil {
+			j.Result = &res
+		}
+	}
+	return &j, nil
+}
+
+// loadJob returns the job with its queue position; nil if there is none.
+func loadJob(id string) (*Job, error) {
+	if db == nil {
+		return nil, errors.New("db not initialized")
+	}
+	j, err := scanJob(db.QueryRow(`SELECT `+jobColumns+` FROM jobs WHERE id = ?`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if j.Status == JobQueued {
+		if err := db.QueryRow(`SELECT COUNT(*) FROM jobs WHERE status = ? AND seq <= ?`, JobQueued, j.seq).Scan(&j.Position); err != nil {
+			return nil, err
+		}
+	}
+	return j, nil
+}
+
+// listQueuedJobs returns the ID and IP of the first limit queued jobs.
+func listQueuedJobs(limit int) ([]*Job, error) {
+	rows, err := db.Query(`SELECT id, COALESCE(ip,'') FROM jobs WHERE status = ? ORDER BY seq LIMIT ?`, JobQueued, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []*Job
+	for rows.Next() {
+		var j Job
+		if err := rows.Scan(&j.ID, &j.ip); err != nil {
+			return nil, err
+		}
+		out = append(out, &j)
+	}
+	return out, rows.Err()
+}
+
+// setJobStatus moves job id from status from to status to, stamping
+// started_at (running) or finished_at (any other status). It reports false
+// when the job was not in status from anymore.
+func setJobStatus(id string, from, to JobStatus) (bool, error) {
+	col := "finished_at"
+	if to == JobRunning {
+		col = "started_at"
+	}
+	res, err := db.Exec(`UPDATE jobs SET status = ?, `+col+` = ? WHERE id = ? AND status = ?`, to, time.Now().UTC(), id, from)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// finishJob stores the outcome of a running job.
+func finishJob(j *Job) error {
+	var resultJSON interface{}
+	if j.Result != nil {
+		b, err := json.Marshal(j.Result)
+		if err != nil {
+			return err
+		}
+		resultJSON = string(b)
+	}
+	_, err := db.Exec(`UPDATE jobs SET status = ?, finished_at = ?, container_id = ?, result_json = ?, error = ? WHERE id = ? AND status = ?`,
+		j.Status, time.Now().UTC(), nullable(j.ContainerID), resultJSON, nullable(j.Error), j.ID, JobRunning)
+	return err
+}
+
+// requeueInterruptedJobs puts back the jobs that were running when the
+// server stopped; they start over from the compile phase.
+func requeueInterruptedJobs() (int64, error) {
+	res, err := db.Exec(`UPDATE jobs SET status = ?, started_at = NULL WHERE status = ?`, JobQueued, JobRunning)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
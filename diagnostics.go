@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// Diagnostic is one compiler message located in the source. Line and Column
+// are 1-based; Column is 0 when the compiler does not report it.
+type Diagnostic struct {
+	File     string `json:"file"`
+	Line     int    `json:"line"`
+	Column   int    `json:"column"`
+	Severity string `json:"severity"` // error, warning or note
+	Message  string `json:"message"`
+}
+
+var (
+	// gcc style, kept for toolchains that report "file:line[:col]: severity: msg"
+	diagLocated = regexp.MustCompile(`^([^\s:]+\.lang):(\d+):(?:(\d+):)?\s*(?:(error|warning|note|fatal error):)?\s*(.+)$`)
+	// 512lang panics with "Error during parsing on line N: ..." (N is 0-based)
+	diagPanic     = regexp.MustCompile(`^panic: (.+)$`)
+	diagPanicLine = regexp.MustCompile(`\b(?:on|in|at) line (\d+)`)
+	diagPrefix    = regexp.MustCompile(`^Error [^:]*?line \d+: `)
+)
+
+// parseDiagnostics extracts structured diagnostics from the compile phase
+// output. When the compiler failed without a recognizable message, the first
+// stderr line is reported on line 1 so editors still flag something.
+func parseDiagnostics(compile *PhaseResult) []Diagnostic {
+	if compile == nil {
+		return nil
+	}
+	diags := []Diagnostic{}
+	for _, line := range strings.Split(compile.Stderr+"\n"+compile.Stdout, "\n") {
+		line = strings.TrimSpace(line)
+		if m := diagLocated.FindStringSubmatch(line); m != nil {
+			d := Diagnostic{File: m[1], Severity: "error", Message: m[5]}
+			d.Line, _ = strconv.Atoi(m[2])
+			d.Column, _ = strconv.Atoi(m[3])
+			if m[4] != "" && m[4] != "fatal error" {
+				d.Severity = m[4]
+			}
+			diags = append(diags, d)
+			continue
+		}
+		if m := diagPanic.FindStringSubmatch(line); m != nil {
+			d := Diagnostic{File: "test.lang", Line: 1, Severity: "error", Message: diagPrefix.ReplaceAllString(m[1], "")}
+			if l := diagPanicLine.FindStringSubmatch(m[1]); l != nil {
+				n, _ := strconv.Atoi(l[1])
+				d.Line = n + 1
+			}
+			diags = append(diags, d)
+		}
+	}
+	if len(diags) == 0 && compile.ExitCode != 0 {
+		msg := firstLine(compile.Stderr)
+		if msg == "" {
+			msg = firstLine(compile.Stdout)
+		}
+		if msg == "" {
+			msg = fmt.Sprintf("compiler exited with status %d", compile.ExitCode)
+		}
+		diags = append(diags, Diagnostic{File: "test.lang", Line: 1, Severity: "error", Message: msg})
+	}
+	return diags
+}
+
+func firstLine(s string) string {
+	for _, line := range strings.Split(s, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			return line
+		}
+	}
+	return ""
+}
+
+// checkHandler is /check: compile only (./out is never run) and report the
+// compiler diagnostics. The answer is JSON, or "file:line:col: severity:
+// message" lines with format=text for CI scripts. compile_error is a 200.
+func checkHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	code, _, ok := readCompileForm(w, r)
+	if !ok {
+		return
+	}
+	clientIP := extractClientIP(r)
+	toolchain, err := resolveToolchain(r.FormValue("toolchain"))
+	if err != nil {
+		http.Error(w, "Error: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	release, ok := acquireCompileSlot(w, r, clientIP)
+	if !ok {
+		return
+	}
+	defer release()
+
+	opts := execOptions{Profile: selectProfile(r), CheckOnly: true, Toolchain: toolchain}
+	result, containerRecord, err := execInKataWithHistory(r.Context(), code, "", opts, nil)
+	saveExecutionRecord(containerRecord, clientIP, err)
+	if result == nil {
+		logger.Error("code check failed", zap.Error(err))
+		http.Error(w, "Error during code check: "+executionErrorMessage(result, err), http.StatusInternalServerError)
+		return
+	}
+	if r.FormValue("format") == "text" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		for _, d := range result.Diagnostics {
+			fmt.Fprintf(w, "%s:%d:%d: %s: %s\n", d.File, d.Line, d.Column, d.Severity, d.Message)
+		}
+		fmt.Fprintf(w, "status: %s\n", result.Status)
+		return
+	}
+	writeExecutionResult(w, result)
+}
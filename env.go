@@ -2,23 +2,40 @@ package main
 
 import (
 	"fmt"
+	"net"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 )
 
 // Config centralizes all environment-driven settings.
 // Add new fields here and in LoadConfig.
 type Config struct {
+	Mode                           string // server (default) or worker (see worker.go)
 	Port                           string
 	LogLevel                       string
 	AdminUser                      string
 	AdminPass                      string
 	JWTSecret                      string
+	SandboxBackend                 string // containerd (default), local, fake or remote
 	SandboxBaseImage               string
+	SandboxImageTarball            string        // OCI/docker-archive tarball imported instead of pulling
+	SandboxImageDigest             string        // expected manifest digest of the base image
+	SandboxImagePullFallback       bool          // pull when the tarball import fails
+	SandboxAllowAnyImage           bool          // lift the docker.io/library/* allowlist
+	SandboxImageRefreshInterval    time.Duration // re-resolve the base image tag; 0 disables
+	SandboxImageRefreshAuto        bool          // swap to a new digest without admin approval
+	SandboxInitBinary              string        // static sandbox-init helper; "" looks next to the executable
 	SandboxRuntime                 string
 	SandboxCPUQuotaPercent         int // 0 means unlimited / not set
 	LangDir                        string
+	ToolchainSmokeDir              string // smoke programs for toolchain uploads; "" uses the built-in suite
+	ResultCacheEntries             int    // 0 disables the result cache
+	ResultCacheMB                  int
+	ResultCacheTTL                 time.Duration
+	BinaryCacheDir                 string
+	BinaryCacheMB                  int // 0 disables the compiled binary cache
 	KataExecTimeout                time.Duration
 	RateLimitPerMin                int
 	RateLimitBurst                 int
@@ -26,19 +43,51 @@ type Config struct {
 	AdminLoginRateLimitBurst       int
 	MaxConcurrentCompilations      int
 	MaxConcurrentCompilationsPerIP int
+	CompileQueueMax                int // callers waiting for a compile slot; 0 answers 429 at once
+	CompileQueueMaxPerIP           int
+	CompileQueueWait               time.Duration
+	JobQueueMax                    int // queued POST /jobs submissions; 0 means unlimited
+	JobQueueMaxPerIP               int
+	SandboxPoolSize                int // warm containers kept booted; 0 disables the pool
+	InteractiveIdleTimeout         time.Duration
+	InteractiveTimeoutFactor       int // interactive wall clock cap = profile timeout * factor
+	Profiles                       map[string]*ResourceProfile
+	DefaultProfile                 string
+	AdminProfile                   string // profile for requests with a valid admin JWT
+	ProfileCIDRs                   []profileCIDR
+	TrustedProxies                 []*net.IPNet
+	WorkerToken                    string // shared secret of the worker protocol
+	WorkerFrontendURL              string // MODE=worker: frontend to connect to
+	WorkerID                       string
+	WorkerCapacity                 int // MODE=worker: concurrent tasks accepted
 }
 
 func LoadConfig() (*Config, error) {
 	c := &Config{
+		Mode:                           getEnvDefault("MODE", "server"),
 		Port:                           getEnvDefault("PORT", "8080"),
 		LogLevel:                       getEnvDefault("LOG_LEVEL", "info"),
 		AdminUser:                      os.Getenv("ADMIN_USER"),
 		AdminPass:                      os.Getenv("ADMIN_PASS"),
 		JWTSecret:                      os.Getenv("JWT_SECRET"),
-		SandboxBaseImage:               getEnvDefault("SANDBOX_BASE_IMAGE", "docker.io/library/busybox:latest"),
+		SandboxBackend:                 getEnvDefault("SANDBOX_BACKEND", "containerd"),
+		SandboxBaseImage:               getEnvDefault("SANDBOX_BASE_IMAGE", scratchBaseImage),
+		SandboxImageTarball:            os.Getenv("SANDBOX_IMAGE_TARBALL"),
+		SandboxImageDigest:             os.Getenv("SANDBOX_IMAGE_DIGEST"),
+		SandboxImagePullFallback:       getEnvBool("SANDBOX_IMAGE_PULL_FALLBACK", false),
+		SandboxAllowAnyImage:           getEnvBool("SANDBOX_ALLOW_ANY_IMAGE", false),
+		SandboxImageRefreshInterval:    getEnvDurationSeconds("SANDBOX_IMAGE_REFRESH_INTERVAL_SECONDS", 0),
+		SandboxImageRefreshAuto:        getEnvBool("SANDBOX_IMAGE_REFRESH_AUTO", false),
+		SandboxInitBinary:              os.Getenv("SANDBOX_INIT_BINARY"),
 		SandboxRuntime:                 getEnvDefault("SANDBOX_RUNTIME", "io.containerd.kata.v2"),
 		SandboxCPUQuotaPercent:         getEnvInt("SANDBOX_CPU_QUOTA_PERCENT", 0),
 		LangDir:                        getEnvDefault("LANG_DIR", ""),
+		ToolchainSmokeDir:              os.Getenv("TOOLCHAIN_SMOKE_DIR"),
+		ResultCacheEntries:             getEnvInt("RESULT_CACHE_ENTRIES", 512),
+		ResultCacheMB:                  getEnvInt("RESULT_CACHE_MB", 64),
+		ResultCacheTTL:                 getEnvDurationSeconds("RESULT_CACHE_TTL_SECONDS", 600),
+		BinaryCacheDir:                 getEnvDefault("BINARY_CACHE_DIR", "data/bincache"),
+		BinaryCacheMB:                  getEnvInt("BINARY_CACHE_MB", 256),
 		KataExecTimeout:                getEnvDurationSeconds("KATA_EXEC_TIMEOUT_SECONDS", 10),
 		RateLimitPerMin:                getEnvInt("RATE_LIMIT_PER_MIN", 60),
 		RateLimitBurst:                 getEnvInt("RATE_LIMIT_BURST", 80),
@@ -46,9 +95,83 @@ func LoadConfig() (*Config, error) {
 		AdminLoginRateLimitBurst:       getEnvInt("ADMIN_LOGIN_RATE_LIMIT_BURST", 10),
 		MaxConcurrentCompilations:      getEnvInt("MAX_CONCURRENT_COMPILATIONS", 10),
 		MaxConcurrentCompilationsPerIP: getEnvInt("MAX_CONCURRENT_COMPILATIONS_PER_IP", 2),
+		CompileQueueMax:                getEnvInt("COMPILE_QUEUE_MAX", 100),
+		CompileQueueMaxPerIP:           getEnvInt("COMPILE_QUEUE_MAX_PER_IP", 5),
+		CompileQueueWait:               getEnvDurationSeconds("COMPILE_QUEUE_WAIT_SECONDS", 20),
+		JobQueueMax:                    getEnvInt("JOB_QUEUE_MAX", 1000),
+		JobQueueMaxPerIP:               getEnvInt("JOB_QUEUE_MAX_PER_IP", 20),
+		SandboxPoolSize:                getEnvInt("SANDBOX_POOL_SIZE", -1),
+		InteractiveIdleTimeout:         getEnvDurationSeconds("INTERACTIVE_IDLE_TIMEOUT_SECONDS", 30),
+		InteractiveTimeoutFactor:       getEnvInt("INTERACTIVE_TIMEOUT_FACTOR", 6),
+		DefaultProfile:                 getEnvDefault("SANDBOX_DEFAULT_PROFILE", "default"),
+		AdminProfile:                   getEnvDefault("SANDBOX_ADMIN_PROFILE", "trusted"),
+		WorkerToken:                    os.Getenv("WORKER_TOKEN"),
+		WorkerFrontendURL:              strings.TrimRight(os.Getenv("WORKER_FRONTEND_URL"), "/"),
+		WorkerID:                       os.Getenv("WORKER_ID"),
+		WorkerCapacity:                 getEnvInt("WORKER_CAPACITY", 0),
+	}
+	// pool defaults to one warm container per concurrent compilation slot
+	if c.SandboxPoolSize < 0 {
+		c.SandboxPoolSize = c.MaxConcurrentCompilations
+	}
+
+	if c.InteractiveTimeoutFactor < 1 {
+		c.InteractiveTimeoutFactor = 1
 	}
 
-	if c.JWTSecret == "" {
+	profiles, err := loadProfiles(c, os.Getenv("SANDBOX_PROFILES_FILE"))
+	if err != nil {
+		return nil, err
+	}
+	c.Profiles = profiles
+	if c.ProfileCIDRs, err = parseProfileCIDRs(os.Getenv("SANDBOX_PROFILE_CIDRS")); err != nil {
+		return nil, err
+	}
+	if c.TrustedProxies, err = parseTrustedProxies(os.Getenv("TRUSTED_PROXY_CIDRS")); err != nil {
+		return nil, err
+	}
+	for _, name := range append([]string{c.DefaultProfile, c.AdminProfile}, profileNames(c.ProfileCIDRs)...) {
+		if c.Profiles[name] == nil {
+			return nil, fmt.Errorf("unknown sandbox profile %q", name)
+		}
+	}
+
+	// only the containerd backend runs the base image
+	switch strings.ToLower(c.SandboxBackend) {
+	case "containerd", "kata":
+		if err := validateBaseImage(c); err != nil {
+			return nil, err
+		}
+	}
+
+	c.Mode = strings.ToLower(c.Mode)
+	remote := strings.EqualFold(c.SandboxBackend, "remote")
+	switch c.Mode {
+	case "server":
+	case "worker":
+		if remote {
+			return nil, fmt.Errorf("MODE=worker needs a local SANDBOX_BACKEND, not remote")
+		}
+		if c.WorkerFrontendURL == "" {
+			return nil, fmt.Errorf("WORKER_FRONTEND_URL is required in worker mode")
+		}
+		if c.WorkerID == "" {
+			if c.WorkerID, err = os.Hostname(); err != nil {
+				return nil, fmt.Errorf("WORKER_ID is required: %w", err)
+			}
+		}
+		if c.WorkerCapacity <= 0 {
+			c.WorkerCapacity = max(c.MaxConcurrentCompilations, 1)
+		}
+	default:
+		return nil, fmt.Errorf("unknown MODE %q (want server or worker)", c.Mode)
+	}
+	if (remote || c.Mode == "worker") && len(c.WorkerToken) < 16 {
+		return nil, fmt.Errorf("WORKER_TOKEN of at least 16 characters is required for the worker protocol")
+	}
+
+	// workers never serve the API, so they need no JWT secret
+	if c.JWTSecret == "" && c.Mode == "server" {
 		return nil, fmt.Errorf("JWT_SECRET is required")
 	}
 	return c, nil
@@ -70,6 +193,15 @@ func getEnvInt(key string, def int) int {
 	return def
 }
 
+func getEnvBool(key string, def bool) bool {
+	if v := os.Getenv(key); v != "" {
+		if b, err := strconv.ParseBool(v); err == nil {
+			return b
+		}
+	}
+	return def
+}
+
 func getEnvDurationSeconds(key string, defSeconds int) time.Duration {
 	if v := os.Getenv(key); v != "" {
 		if i, err := strconv.Atoi(v); err == nil && i > 0 {
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/images/archive"
+	"github.com/distribution/reference"
+	"go.uber.org/zap"
+)
+
+// imageDigestRe matches the manifest digests accepted in the config.
+var imageDigestRe = regexp.MustCompile(`^sha256:[0-9a-f]{64}$`)
+
+// ErrImageDigestMismatch is returned when the base image resolves to a
+// manifest other than the expected one.
+var ErrImageDigestMismatch = errors.New("base image digest mismatch")
+
+// scratchBaseImage as SANDBOX_BASE_IMAGE, the default, builds sandbox images
+// from the toolchain alone, like "FROM scratch": no base image is pulled or
+// refreshed. A base image is opt-in, for programs that expect its files.
+const scratchBaseImage = "scratch"
+
+// usesBaseImage reports whether sandbox images are built on a base image.
+func usesBaseImage(cfg *Config) bool {
+	return cfg != nil && cfg.SandboxBaseImage != "" && cfg.SandboxBaseImage != scratchBaseImage
+}
+
+// expectedImageDigest is the manifest digest the base image must have:
+// SANDBOX_IMAGE_DIGEST, else the digest of an "@sha256:" reference, else "".
+func expectedImageDigest(cfg *Config) string {
+	if cfg == nil {
+		return ""
+	}
+	if cfg.SandboxImageDigest != "" {
+		return cfg.SandboxImageDigest
+	}
+	if named, err := reference.ParseNormalizedNamed(cfg.SandboxBaseImage); err == nil {
+		if d, ok := named.(reference.Digested); ok {
+			return d.Digest().String()
+		}
+	}
+	return ""
+}
+
+// validateBaseImage checks SANDBOX_BASE_IMAGE for the containerd backend:
+// it must be on the allowlist (docker.io/library/*, unless
+// SANDBOX_ALLOW_ANY_IMAGE) and pinned to a manifest digest, either by an
+// "@sha256:" reference or by SANDBOX_IMAGE_DIGEST (both must then agree).
+// "scratch" needs nothing.
+func validateBaseImage(cfg *Config) error {
+	if !usesBaseImage(cfg) {
+		return nil
+	}
+	named, err := reference.ParseNormalizedNamed(cfg.SandboxBaseImage)
+	if err != nil {
+		return fmt.Errorf("SANDBOX_BASE_IMAGE %q: %w", cfg.SandboxBaseImage, err)
+	}
+	if !cfg.SandboxAllowAnyImage && (reference.Domain(named) != "docker.io" || !strings.HasPrefix(reference.Path(named), "library/")) {
+		return fmt.Errorf("SANDBOX_BASE_IMAGE %q is not a docker.io/library/* image (set SANDBOX_ALLOW_ANY_IMAGE=1 to allow it)", cfg.SandboxBaseImage)
+	}
+	if cfg.SandboxImageDigest != "" && !imageDigestRe.MatchString(cfg.SandboxImageDigest) {
+		return fmt.Errorf("SANDBOX_IMAGE_DIGEST %q is not a sha256:<64 hex> digest", cfg.SandboxImageDigest)
+	}
+	if d, ok := named.(reference.Digested); ok {
+		if cfg.SandboxImageDigest != "" && d.Digest().String() != cfg.SandboxImageDigest {
+			return fmt.Errorf("SANDBOX_BASE_IMAGE is pinned to %s but SANDBOX_IMAGE_DIGEST is %s", d.Digest(), cfg.SandboxImageDigest)
+		}
+	} else if cfg.SandboxImageDigest == "" {
+		return fmt.Errorf("SANDBOX_BASE_IMAGE %q has no @sha256: digest: pin it or set SANDBOX_IMAGE_DIGEST", cfg.SandboxBaseImage)
+	}
+	return nil
+}
+
+// obtainBaseImage gets ref into the namespace of ctx: imported from
+// SANDBOX_IMAGE_TARBALL when one is configured (pulled only when that fails
+// and SANDBOX_IMAGE_PULL_FALLBACK allows it), pulled otherwise. The image
+// must have the pinned digest: a tag that moved is refused.
+func obtainBaseImage(ctx context.Context, c *containerd.Client, ref string) (containerd.Image, error) {
+	want := pinnedImageDigest(appConfig)
+	if appConfig == nil || appConfig.SandboxImageTarball == "" {
+		return pullBaseImage(ctx, c, ref, want)
+	}
+	img, err := importBaseImage(ctx, c, ref, appConfig.SandboxImageTarball, want)
+	if err == nil {
+		return img, nil
+	}
+	if !appConfig.SandboxImagePullFallback {
+		return nil, err
+	}
+	if logger != nil {
+		logger.Warn("base image import failed, pulling instead", zap.String("image", ref), zap.String("tarball", appConfig.SandboxImageTarball), zap.Error(err))
+	}
+	img, pullErr := pullBaseImage(ctx, c, ref, want)
+	if pullErr != nil {
+		return nil, fmt.Errorf("import: %v; pull: %w", err, pullErr)
+	}
+	return img, nil
+}
+
+// pullBaseImage pulls ref and checks its manifest digest against want; an
+// image already present with that digest is used without pulling.
+func pullBaseImage(ctx context.Context, c *containerd.Client, ref, want string) (containerd.Image, error) {
+	if want != "" {
+		if img, err := c.GetImage(ctx, ref); err == nil && img.Target().Digest.String() == want {
+			if err := unpackImage(ctx, img); err != nil {
+				return nil, err
+			}
+			return img, nil
+		}
+	}
+	img, err := c.Pull(ctx, ref, containerd.WithPullUnpack)
+	if err != nil {
+		return nil, err
+	}
+	if got := img.Target().Digest.String(); want != "" && got != want {
+		_ = c.ImageService().Delete(ctx, img.Name())
+		return nil, fmt.Errorf("%w: %s resolved to %s, want %s", ErrImageDigestMismatch, ref, got, want)
+	}
+	return img, nil
+}
+
+// importBaseImage imports the OCI layout or docker-archive tarball at path
+// (optionally gzipped) and stores the image matching ref, or want, under the
+// name ref. The manifest digest must equal want. An image imported by an
+// earlier start is reused without reading the tarball.
+func importBaseImage(ctx context.Context, c *containerd.Client, ref, path, want string) (containerd.Image, error) {
+	if want == "" {
+		return nil, errors.New("importing a base image needs SANDBOX_IMAGE_DIGEST or an @sha256: reference")
+	}
+	named, err := reference.ParseNormalizedNamed(ref)
+	if err != nil {
+		return nil, fmt.Errorf("parse image reference %q: %w", ref, err)
+	}
+	if img, err := c.GetImage(ctx, ref); err == nil && img.Target().Digest.String() == want {
+		if err := unpackImage(ctx, img); err != nil {
+			return nil, err
+		}
+		return img, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open image tarball: %w", err)
+	}
+	defer f.Close()
+	var r io.Reader = bufio.NewReader(f)
+	if magic, _ := r.(*bufio.Reader).Peek(2); len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, fmt.Errorf("open image tarball: %w", err)
+		}
+		defer gz.Close()
+		r = gz
+	}
+	// OCI layouts often name images by tag only ("latest"): qualify them
+	// with the repository of ref
+	imported, err := c.Import(ctx, r, containerd.WithImageRefTranslator(archive.AddRefPrefix(reference.TrimNamed(named).String())))
+	if err != nil {
+		return nil, fmt.Errorf("import image tarball %s: %w", path, err)
+	}
+
+	is := c.ImageService()
+	var match *images.Image
+	for i := range imported {
+		if imported[i].Name == ref || imported[i].Name == named.String() {
+			match = &imported[i]
+			break
+		}
+	}
+	if match == nil {
+		// an @sha256: reference names no tag: look for the digest itself
+		for i := range imported {
+			if imported[i].Target.Digest.String() == want {
+				match = &imported[i]
+				break
+			}
+		}
+	}
+	if match == nil {
+		return nil, fmt.Errorf("image tarball %s has no image %s (found %d)", path, ref, len(imported))
+	}
+	if got := match.Target.Digest.String(); got != want {
+		// never leave a mismatching image under the configured name
+		for _, img := range imported {
+			_ = is.Delete(ctx, img.Name)
+		}
+		return nil, fmt.Errorf("%w: tarball %s has %s, want %s", ErrImageDigestMismatch, path, got, want)
+	}
+
+	rec := images.Image{Name: ref, Target: match.Target}
+	stored, err := is.Update(ctx, rec, "target")
+	if errdefs.IsNotFound(err) {
+		stored, err = is.Create(ctx, rec)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("store image %s: %w", ref, err)
+	}
+	img := containerd.NewImage(c, stored)
+	if err := unpackImage(ctx, img); err != nil {
+		return nil, err
+	}
+	return img, nil
+}
+
+// unpackImage makes sure the layers of img are in the default snapshotter.
+func unpackImage(ctx context.Context, img containerd.Image) error {
+	unpacked, err := img.IsUnpacked(ctx, "")
+	if err != nil {
+		return fmt.Errorf("check image unpacked: %w", err)
+	}
+	if unpacked {
+		return nil
+	}
+	if err := img.Unpack(ctx, ""); err != nil {
+		return fmt.Errorf("unpack image %s: %w", img.Name(), err)
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateBaseImage(t *testing.T) {
+	const (
+		d1 = "sha256:1111111111111111111111111111111111111111111111111111111111111111"
+		d2 = "sha256:2222222222222222222222222222222222222222222222222222222222222222"
+	)
+	tests := []struct {
+		name     string
+		image    string
+		digest   string
+		allowAny bool
+		wantErr  string // "" for valid
+		want     string // expectedImageDigest
+	}{
+		{name: "scratch", image: scratchBaseImage},
+		{name: "unset means scratch", image: ""},
+		{name: "pinned by reference", image: "debian:bookworm-slim@" + d1, want: d1},
+		{name: "pinned by SANDBOX_IMAGE_DIGEST", image: "docker.io/library/debian:bookworm-slim", digest: d1, want: d1},
+		{name: "unpinned", image: "debian:bookworm-slim", wantErr: "has no @sha256: digest"},
+		{name: "digests disagree", image: "alpine@" + d1, digest: d2, wantErr: "is pinned to " + d1 + " but SANDBOX_IMAGE_DIGEST is " + d2},
+		{name: "malformed digest", image: "alpine", digest: "sha256:abc", wantErr: "is not a sha256:<64 hex> digest"},
+		{name: "not on the allowlist", image: "ghcr.io/library/debian@" + d1, wantErr: "is not a docker.io/library/* image"},
+		{name: "any image allowed", image: "ghcr.io/org/img:1", digest: d2, allowAny: true, want: d2},
+		{name: "invalid reference", image: "Debian:Latest", wantErr: "must be lowercase"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{SandboxBaseImage: tt.image, SandboxImageDigest: tt.digest, SandboxAllowAnyImage: tt.allowAny}
+			err := validateBaseImage(cfg)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("validateBaseImage(%q, %q) = %v, want %q", tt.image, tt.digest, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("validateBaseImage(%q, %q) = %v", tt.image, tt.digest, err)
+			}
+			if got := expectedImageDigest(cfg); got != tt.want {
+				t.Errorf("expectedImageDigest = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUsesBaseImage(t *testing.T) {
+	tests := []struct {
+		cfg  *Config
+		want bool
+	}{
+		{cfg: nil},
+		{cfg: &Config{}},
+		{cfg: &Config{SandboxBaseImage: scratchBaseImage}},
+		{cfg: &Config{SandboxBaseImage: "debian:bookworm-slim"}, want: true},
+	}
+	for _, tt := range tests {
+		if got := usesBaseImage(tt.cfg); got != tt.want {
+			t.Errorf("usesBaseImage(%+v) = %v, want %v", tt.cfg, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,493 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/containerd/remotes/docker"
+	"github.com/distribution/reference"
+	"github.com/opencontainers/go-digest"
+	"go.uber.org/zap"
+)
+
+// baseImageStateFile records the base image digest approved by a refresh,
+// so that a restart does not go back to the configured one.
+const baseImageStateFile = "data/base_image.json"
+
+// baseImageLabel marks the images pulled or kept by refreshes; startup
+// removes the ones not in use (see gcStaleBaseImages).
+const baseImageLabel = "compiler.base-image"
+
+// baseImageState is the content of baseImageStateFile.
+type baseImageState struct {
+	// Config is SANDBOX_BASE_IMAGE at approval time: once the config
+	// changes, the recorded digest is ignored
+	Config     string    `json:"config"`
+	Digest     string    `json:"digest"`
+	Previous   string    `json:"previous,omitempty"`
+	ApprovedBy string    `json:"approved_by"`
+	ApprovedAt time.Time `json:"approved_at"`
+}
+
+// BaseImageRefresh is the outcome of one refresh.
+type BaseImageRefresh struct {
+	Previous string `json:"previous"`
+	Digest   string `json:"digest"`             // in use for new sandboxes
+	Resolved string `json:"resolved,omitempty"` // what the tag points to now
+	// Available is a new digest pulled and unpacked but waiting for approval
+	Available string `json:"available,omitempty"`
+	Swapped   bool   `json:"swapped"`
+	Drained   int    `json:"drained,omitempty"` // warm containers of the old image
+}
+
+// BaseImageStatus is returned by GET /admin/image.
+type BaseImageStatus struct {
+	Reference        string          `json:"reference"`
+	Digest           string          `json:"digest"`
+	ConfiguredDigest string          `json:"configured_digest"`
+	Approved         *baseImageState `json:"approved,omitempty"`
+	Available        string          `json:"available,omitempty"`
+	AutoApprove      bool            `json:"auto_approve"`
+	RefreshInterval  int             `json:"refresh_interval_seconds"`
+	LastCheck        *time.Time      `json:"last_check,omitempty"`
+	LastError        string          `json:"last_error,omitempty"`
+	InUse            map[string]int  `json:"in_use"`
+	Retired          []string        `json:"retired,omitempty"`
+}
+
+var (
+	// approvedImage is the digest approved at runtime (nil: the config's)
+	approvedImage atomic.Pointer[baseImageState]
+
+	// refreshMu serializes refreshes and guards the fields below
+	refreshMu    sync.Mutex
+	stagedDigest string
+	lastCheck    time.Time
+	lastCheckErr error
+)
+
+// pinnedImageDigest is the manifest digest the base image must have: the one
+// approved by a refresh, else expectedImageDigest.
+func pinnedImageDigest(cfg *Config) string {
+	if st := approvedImage.Load(); st != nil {
+		return st.Digest
+	}
+	return expectedImageDigest(cfg)
+}
+
+// baseImageRef is the reference the base image is stored under:
+// SANDBOX_BASE_IMAGE, with its "@sha256:" pin replaced by the approved digest.
+func baseImageRef(cfg *Config) string {
+	ref := scratchBaseImage
+	if cfg != nil && cfg.SandboxBaseImage != "" {
+		ref = cfg.SandboxBaseImage
+	}
+	st := approvedImage.Load()
+	if st == nil {
+		return ref
+	}
+	named, err := reference.ParseNormalizedNamed(ref)
+	if err != nil {
+		return ref
+	}
+	if _, ok := named.(reference.Digested); !ok {
+		return ref
+	}
+	base := reference.TrimNamed(named)
+	if _, ok := named.(reference.Tagged); ok {
+		base = imageTagRef(named)
+	}
+	pinned, err := reference.WithDigest(base, digest.Digest(st.Digest))
+	if err != nil {
+		return ref
+	}
+	return pinned.String()
+}
+
+// imageTagRef drops the digest of named, keeping its tag ("latest" if none):
+// the reference a refresh re-resolves.
+func imageTagRef(named reference.Named) reference.Named {
+	tagged := reference.TrimNamed(named)
+	if t, ok := named.(reference.Tagged); ok {
+		if withTag, err := reference.WithTag(tagged, t.Tag()); err == nil {
+			return withTag
+		}
+	}
+	return reference.TagNameOnly(tagged)
+}
+
+// loadBaseImageState restores the digest approved before a restart, unless
+// SANDBOX_BASE_IMAGE changed since.
+func loadBaseImageState(cfg *Config) error {
+	data, err := os.ReadFile(baseImageStateFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("read %s: %w", baseImageStateFile, err)
+	}
+	var st baseImageState
+	if err := json.Unmarshal(data, &st); err != nil {
+		return fmt.Errorf("parse %s: %w", baseImageStateFile, err)
+	}
+	if st.Config != cfg.SandboxBaseImage || !imageDigestRe.MatchString(st.Digest) {
+		if logger != nil {
+			logger.Info("ignoring approved base image: SANDBOX_BASE_IMAGE changed", zap.String("approved_for", st.Config), zap.String("digest", st.Digest))
+		}
+		return nil
+	}
+	approvedImage.Store(&st)
+	return nil
+}
+
+// saveBaseImageState atomically rewrites baseImageStateFile.
+func saveBaseImageState(st *baseImageState) error {
+	data, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(baseImageStateFile)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("write %s: %w", baseImageStateFile, err)
+	}
+	tmp, err := os.CreateTemp(dir, ".base_image-*")
+	if err != nil {
+		return fmt.Errorf("write %s: %w", baseImageStateFile, err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return fmt.Errorf("write %s: %w", baseImageStateFile, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("write %s: %w", baseImageStateFile, err)
+	}
+	if err := os.Rename(tmp.Name(), baseImageStateFile); err != nil {
+		return fmt.Errorf("write %s: %w", baseImageStateFile, err)
+	}
+	return nil
+}
+
+// refreshBaseImage re-resolves the tag of SANDBOX_BASE_IMAGE, or takes
+// approve (a digest the tag may no longer point to, e.g. a rollback). A new
+// digest is pulled and unpacked next to the current image; it replaces it
+// when approved or with SANDBOX_IMAGE_REFRESH_AUTO, otherwise it stays
+// Available until an admin approves it. Running sandboxes keep their image.
+func (s *containerdSandbox) refreshBaseImage(ctx context.Context, approve, approvedBy string) (*BaseImageRefresh, error) {
+	refreshMu.Lock()
+	defer refreshMu.Unlock()
+	ctx = namespaces.WithNamespace(ctx, "compiler")
+	c, err := getContainerdClient()
+	if err != nil {
+		return nil, fmt.Errorf("containerd client: %w", err)
+	}
+	named, err := reference.ParseNormalizedNamed(s.baseRef())
+	if err != nil {
+		return nil, fmt.Errorf("parse image reference: %w", err)
+	}
+	current := currentImageDigest()
+	if current == "" {
+		return nil, errors.New("base image not loaded yet")
+	}
+	res := &BaseImageRefresh{Previous: current, Digest: current}
+
+	target := approve
+	if approve == "" {
+		tag := imageTagRef(named).String()
+		_, desc, err := docker.NewResolver(docker.ResolverOptions{}).Resolve(ctx, tag)
+		lastCheck, lastCheckErr = time.Now(), err
+		if err != nil {
+			return nil, fmt.Errorf("resolve %s: %w", tag, err)
+		}
+		target = desc.Digest.String()
+		res.Resolved = target
+	} else if !imageDigestRe.MatchString(approve) {
+		return nil, fmt.Errorf("digest %q is not a sha256:<64 hex> digest", approve)
+	}
+	if target == current {
+		if approve == "" {
+			stagedDigest = ""
+		}
+		return res, nil
+	}
+
+	img, err := stageBaseImage(ctx, c, named, target)
+	if err != nil {
+		return nil, err
+	}
+	if approve == "" && (appConfig == nil || !appConfig.SandboxImageRefreshAuto) {
+		if stagedDigest != target && logger != nil {
+			logger.Warn("base image update available, waiting for approval", zap.String("image", imageTagRef(named).String()), zap.String("digest", current), zap.String("available", target))
+		}
+		stagedDigest = target
+		res.Available = target
+		return res, nil
+	}
+	if err := swapBaseImage(ctx, c, named, img, approvedBy); err != nil {
+		return nil, err
+	}
+	if stagedDigest == target {
+		stagedDigest = ""
+	}
+	res.Digest, res.Swapped = target, true
+	res.Drained = s.pool.drain(ctx)
+	if logger != nil {
+		logger.Info("base image swapped", zap.String("image", s.baseRef()), zap.String("digest", target), zap.String("previous", current), zap.String("approved_by", approvedBy), zap.Int("drained", res.Drained))
+	}
+	return res, nil
+}
+
+// stageBaseImage gets the image named@target, pulled (and so verified)
+// by digest unless already present, and unpacks it.
+func stageBaseImage(ctx context.Context, c *containerd.Client, named reference.Named, target string) (containerd.Image, error) {
+	ref, err := reference.WithDigest(reference.TrimNamed(named), digest.Digest(target))
+	if err != nil {
+		return nil, err
+	}
+	img, err := c.GetImage(ctx, ref.String())
+	if err != nil {
+		if img, err = c.Pull(ctx, ref.String(), containerd.WithPullUnpack, containerd.WithPullLabel(baseImageLabel, "refresh")); err != nil {
+			return nil, fmt.Errorf("pull %s: %w", ref, err)
+		}
+	}
+	if got := img.Target().Digest.String(); got != target {
+		return nil, fmt.Errorf("%w: %s resolved to %s", ErrImageDigestMismatch, ref, got)
+	}
+	if err := unpackImage(ctx, img); err != nil {
+		return nil, err
+	}
+	return img, nil
+}
+
+// swapBaseImage makes img the base image of new sandboxes. The approval is
+// persisted first; the old image keeps a name of its own until its last
+// container is gone, then it is garbage-collected (see releaseBaseImage).
+func swapBaseImage(ctx context.Context, c *containerd.Client, named reference.Named, img containerd.Image, approvedBy string) error {
+	next := img.Target().Digest.String()
+	st := &baseImageState{Digest: next, Previous: currentImageDigest(), ApprovedBy: approvedBy, ApprovedAt: time.Now().UTC()}
+	if appConfig != nil {
+		st.Config = appConfig.SandboxBaseImage
+	}
+	if err := saveBaseImageState(st); err != nil {
+		return err
+	}
+	approvedImage.Store(st)
+
+	// the reference a restart looks up (see pullBaseImage, importBaseImage)
+	is := c.ImageService()
+	rec := images.Image{Name: baseImageRef(appConfig), Target: img.Target()}
+	stored, err := is.Update(ctx, rec, "target")
+	if errdefs.IsNotFound(err) {
+		stored, err = is.Create(ctx, rec)
+	}
+	if err != nil {
+		return fmt.Errorf("store image %s: %w", rec.Name, err)
+	}
+
+	imageMu.Lock()
+	defer imageMu.Unlock()
+	old := baseImage
+	baseImage, imagePulled = containerd.NewImage(c, stored), true
+	delete(retiredImages, next)
+	if old == nil || old.Target().Digest.String() == next {
+		return nil
+	}
+	prev := old.Target().Digest.String()
+	keep, err := reference.WithDigest(reference.TrimNamed(named), digest.Digest(prev))
+	if err == nil {
+		_, err = is.Create(ctx, images.Image{Name: keep.String(), Target: old.Target(), Labels: map[string]string{baseImageLabel: "retired"}})
+	}
+	if err != nil && !errdefs.IsAlreadyExists(err) && logger != nil {
+		logger.Warn("keep retired base image", zap.String("digest", prev), zap.Error(err))
+	}
+	if imageUsers[prev] == 0 {
+		go gcBaseImage(prev)
+	} else {
+		retiredImages[prev] = true
+	}
+	return nil
+}
+
+// gcBaseImage deletes every name of a retired image; containerd then
+// removes its content and snapshots.
+func gcBaseImage(dgst string) {
+	if dgst == currentImageDigest() {
+		return
+	}
+	c, err := getContainerdClient()
+	if err != nil {
+		return
+	}
+	ctx := namespaces.WithNamespace(context.Background(), "compiler")
+	is := c.ImageService()
+	// the sandbox images built on it go first: they reference its layers
+	forgetSandboxImages(dgst)
+	derived, err := is.List(ctx, `labels."`+sandboxImageLabel+`"==`+dgst)
+	if err == nil {
+		for _, img := range derived {
+			if err := is.Delete(ctx, img.Name); err != nil && !errdefs.IsNotFound(err) && logger != nil {
+				logger.Warn("delete retired sandbox image", zap.String("image", img.Name), zap.Error(err))
+			}
+		}
+	}
+	imgs, err := is.List(ctx, "target.digest=="+dgst)
+	if err != nil {
+		if logger != nil {
+			logger.Warn("list retired base image", zap.String("digest", dgst), zap.Error(err))
+		}
+		return
+	}
+	for i, img := range imgs {
+		var opts []images.DeleteOpt
+		if i == len(imgs)-1 {
+			opts = append(opts, images.SynchronousDelete())
+		}
+		if err := is.Delete(ctx, img.Name, opts...); err != nil && !errdefs.IsNotFound(err) && logger != nil {
+			logger.Warn("delete retired base image", zap.String("image", img.Name), zap.Error(err))
+		}
+	}
+	if logger != nil {
+		logger.Info("retired base image removed", zap.String("digest", dgst), zap.Int("names", len(imgs)))
+	}
+}
+
+// gcStaleBaseImages removes the images refreshes left behind in an earlier
+// run: no container of this process can be using them.
+func gcStaleBaseImages(ctx context.Context) {
+	c, err := getContainerdClient()
+	if err != nil {
+		return
+	}
+	imgs, err := c.ImageService().List(ctx, `labels."`+baseImageLabel+`"`)
+	if err != nil {
+		return
+	}
+	current := currentImageDigest()
+	seen := map[string]bool{}
+	for _, img := range imgs {
+		if d := img.Target.Digest.String(); d != current && !seen[d] {
+			seen[d] = true
+			gcBaseImage(d)
+		}
+	}
+}
+
+// refreshLoop re-resolves the base image every interval.
+func (s *containerdSandbox) refreshLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if _, err := s.refreshBaseImage(context.Background(), "", "refresher"); err != nil && logger != nil {
+			logger.Warn("base image refresh failed", zap.String("image", s.baseRef()), zap.Error(err))
+		}
+	}
+}
+
+func baseImageStatus() BaseImageStatus {
+	st := BaseImageStatus{
+		Reference:        baseImageRef(appConfig),
+		ConfiguredDigest: expectedImageDigest(appConfig),
+		Approved:         approvedImage.Load(),
+		InUse:            map[string]int{},
+	}
+	if appConfig != nil {
+		st.AutoApprove = appConfig.SandboxImageRefreshAuto
+		st.RefreshInterval = int(appConfig.SandboxImageRefreshInterval / time.Second)
+	}
+	refreshMu.Lock()
+	st.Available = stagedDigest
+	if !lastCheck.IsZero() {
+		t := lastCheck
+		st.LastCheck = &t
+	}
+	if lastCheckErr != nil {
+		st.LastError = lastCheckErr.Error()
+	}
+	refreshMu.Unlock()
+
+	imageMu.Lock()
+	if imagePulled {
+		st.Digest = baseImage.Target().Digest.String()
+	}
+	for d, n := range imageUsers {
+		st.InUse[d] = n
+	}
+	for d := range retiredImages {
+		st.Retired = append(st.Retired, d)
+	}
+	imageMu.Unlock()
+	sort.Strings(st.Retired)
+	return st
+}
+
+// adminImageHandler is GET /admin/image: the base image in use, the digest
+// waiting for approval and the retired images still in use.
+func adminImageHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if _, ok := activeSandbox.(*containerdSandbox); !ok {
+		http.Error(w, "not running with the containerd backend", http.StatusNotFound)
+		return
+	}
+	if !usesBaseImage(appConfig) {
+		http.Error(w, "no base image (SANDBOX_BASE_IMAGE=scratch)", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(baseImageStatus())
+}
+
+// adminImageRefreshHandler is POST /admin/image/refresh: re-resolve the base
+// image now, or (digest=sha256:...) approve and swap to that digest.
+func adminImageRefreshHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	s, ok := activeSandbox.(*containerdSandbox)
+	if !ok {
+		http.Error(w, "not running with the containerd backend", http.StatusNotFound)
+		return
+	}
+	if !usesBaseImage(appConfig) {
+		http.Error(w, "no base image (SANDBOX_BASE_IMAGE=scratch)", http.StatusNotFound)
+		return
+	}
+	approve := r.FormValue("digest")
+	res, err := s.refreshBaseImage(r.Context(), approve, "admin:"+adminName(r))
+	detail := approve
+	if res != nil {
+		detail = res.Previous + " -> " + res.Digest
+		if res.Available != "" {
+			detail += " (available " + res.Available + ")"
+		}
+	}
+	auditAdminAction(r, "image.refresh", s.baseRef(), detail, err)
+	if err != nil {
+		status := http.StatusBadGateway
+		if approve != "" && !imageDigestRe.MatchString(approve) {
+			status = http.StatusBadRequest
+		} else if errors.Is(err, ErrImageDigestMismatch) {
+			status = http.StatusConflict
+		}
+		http.Error(w, "Error: "+err.Error(), status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(res)
+}
@@ -0,0 +1,422 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// JobStatus is the state of an asynchronous submission (POST /jobs).
+type JobStatus string
+
+const (
+	JobQueued   JobStatus = "queued"
+	JobRunning  JobStatus = "running"
+	JobDone     JobStatus = "done"
+	JobCanceled JobStatus = "canceled"
+	// JobFailed: the sandbox could not run it at all (Error says why).
+	JobFailed JobStatus = "failed"
+)
+
+// Job is one queued execution, persisted in the jobs table so the queue
+// survives a restart.
+type Job struct {
+	ID     string    `json:"id"`
+	Status JobStatus `json:"status"`
+	// Position is the 1-based place in the queue while Status is queued.
+	Position   int        `json:"position,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	Profile    string     `json:"profile,omitempty"`
+	Toolchain  string     `json:"toolchain,omitempty"`
+	// ContainerID links the job to its /history record.
+	ContainerID string           `json:"container_id,omitempty"`
+	Result      *ExecutionResult `json:"result,omitempty"`
+	Error       string           `json:"error,omitempty"`
+
+	seq   int64
+	ip    string
+	code  string
+	stdin string
+	cache bool
+}
+
+// jobPollInterval is how often an idle worker looks at the queue when no
+// enqueue woke it, or after compileLimiter turned it away.
+const jobPollInterval = 500 * time.Millisecond
+
+// jobSlotWait is how long a worker waits in compileLimiter for the slot of
+// the job it picked before it picks again.
+const jobSlotWait = 10 * time.Second
+
+// jobClaimWindow is how many queued jobs a worker looks at to find one
+// whose IP no other worker is waiting for.
+const jobClaimWindow = 100
+
+// jobQueue runs the queued jobs with a fixed pool of workers. Every run
+// takes a compileLimiter slot through acquire, so jobs wait in the same
+// round-robin queue as synchronous requests and share
+// MaxConcurrentCompilations, the per-IP limit and the waiting caps.
+type jobQueue struct {
+	workers        int
+	maxQueued      int // 0 means unlimited
+	maxQueuedPerIP int
+	wake           chan struct{}
+
+	claimMu sync.Mutex // one worker picks at a time
+	mu      sync.Mutex
+	running map[string]context.CancelFunc
+	// waiting are the jobs a worker waits a slot for, still queued
+	waiting map[string]waitingJob
+}
+
+// waitingJob is a job picked by a worker; stop ends its wait for a slot.
+type waitingJob struct {
+	ip   string
+	stop context.CancelFunc
+}
+
+// jobsQueue is started in main; nil until then.
+var jobsQueue *jobQueue
+
+var (
+	ErrJobQueueFull = errors.New("job queue is full")
+	ErrJobNotFound  = errors.New("job not found")
+	ErrJobFinished  = errors.New("job already finished")
+)
+
+// newJobQueue sizes the pool after MaxConcurrentCompilations; 0 (unlimited)
+// falls back to one worker per CPU.
+func newJobQueue(cfg *Config) *jobQueue {
+	workers := cfg.MaxConcurrentCompilations
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	return &jobQueue{
+		workers:        workers,
+		maxQueued:      cfg.JobQueueMax,
+		maxQueuedPerIP: cfg.JobQueueMaxPerIP,
+		wake:           make(chan struct{}, 1),
+		running:        make(map[string]context.CancelFunc),
+		waiting:        make(map[string]waitingJob),
+	}
+}
+
+// start requeues what a previous process left running and starts the workers.
+func (q *jobQueue) start() error {
+	n, err := requeueInterruptedJobs()
+	if err != nil {
+		return fmt.Errorf("requeue interrupted jobs: %w", err)
+	}
+	if n > 0 {
+		logger.Info("requeued interrupted jobs", zap.Int64("jobs", n))
+	}
+	for i := 0; i < q.workers; i++ {
+		go q.worker()
+	}
+	return nil
+}
+
+func (q *jobQueue) notify() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// enqueue stores a new job and wakes a worker.
+func (q *jobQueue) enqueue(j *Job) error {
+	idBytes := make([]byte, 16)
+	if _, err := rand.Read(idBytes); err != nil {
+		return fmt.Errorf("generate job id: %w", err)
+	}
+	j.ID = fmt.Sprintf("%x", idBytes)
+	j.Status = JobQueued
+	j.CreatedAt = time.Now()
+	inserted, err := insertJob(j, q.maxQueued, q.maxQueuedPerIP)
+	if err != nil {
+		return err
+	}
+	if !inserted {
+		// the insert checked the limits; only tell which one was hit
+		total, _, err := countQueuedJobs(j.ip)
+		if err != nil {
+			return err
+		}
+		if q.maxQueued > 0 && total >= q.maxQueued {
+			return fmt.Errorf("%w (limit %d)", ErrJobQueueFull, q.maxQueued)
+		}
+		return fmt.Errorf("%w for this IP (limit %d)", ErrJobQueueFull, q.maxQueuedPerIP)
+	}
+	q.notify()
+	return nil
+}
+
+// cancel cancels a queued job, or kills the sandbox of a running one (the
+// worker then marks it canceled).
+func (q *jobQueue) cancel(id string) error {
+	ok, err := setJobStatus(id, JobQueued, JobCanceled)
+	if err != nil {
+		return err
+	}
+	if ok {
+		// give up the worker's place in the limiter queue
+		q.mu.Lock()
+		if w, ok := q.waiting[id]; ok {
+			w.stop()
+		}
+		q.mu.Unlock()
+		return nil
+	}
+	q.mu.Lock()
+	stop := q.running[id]
+	q.mu.Unlock()
+	if stop == nil {
+		j, err := loadJob(id)
+		if err != nil {
+			return err
+		}
+		if j == nil {
+			return ErrJobNotFound
+		}
+		return ErrJobFinished
+	}
+	stop()
+	return nil
+}
+
+func (q *jobQueue) worker() {
+	for {
+		j, ctx, done, err := q.claim()
+		if err != nil {
+			logger.Error("claim job", zap.Error(err))
+		}
+		if j == nil {
+			select {
+			case <-q.wake:
+			case <-time.After(jobPollInterval):
+			}
+			continue
+		}
+		q.run(ctx, j)
+		done()
+		// a slot is free again: another job may fit now
+		q.notify()
+	}
+}
+
+// claim picks a queued job (see pick), waits for its compileLimiter slot
+// like a synchronous request and marks it running; nil when there is none
+// or no slot came up within jobSlotWait. ctx ends when the job is canceled
+// and done releases the slot once the job is over.
+func (q *jobQueue) claim() (j *Job, ctx context.Context, done func(), err error) {
+	c, waitCtx, err := q.pick()
+	if c == nil || err != nil {
+		return nil, nil, nil, err
+	}
+	release, err := compileLimiter.acquire(waitCtx, c.ip, jobSlotWait)
+	q.mu.Lock()
+	q.waiting[c.ID].stop()
+	delete(q.waiting, c.ID)
+	q.mu.Unlock()
+	var busy *limiterBusyError
+	if errors.As(err, &busy) || errors.Is(err, context.Canceled) {
+		// no slot yet (picked again later), or canceled while waiting
+		return nil, nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	// cancelable from the moment it leaves the queue
+	ctx, stop := context.WithCancel(context.Background())
+	q.mu.Lock()
+	q.running[c.ID] = stop
+	q.mu.Unlock()
+	done = func() {
+		q.mu.Lock()
+		delete(q.running, c.ID)
+		q.mu.Unlock()
+		stop()
+		release()
+	}
+	claimed, err := setJobStatus(c.ID, JobQueued, JobRunning)
+	if err != nil || !claimed {
+		// canceled meanwhile
+		done()
+		return nil, nil, nil, err
+	}
+	if j, err = loadJob(c.ID); err != nil || j == nil {
+		done()
+		return nil, nil, nil, err
+	}
+	return j, ctx, done, nil
+}
+
+// pick returns the oldest queued job no worker is waiting for, preferring
+// IPs none is waiting for: the limiter serves waiting IPs round-robin, so a
+// client with many jobs gets no more workers in its queue than it needs.
+// The returned ctx ends when the job is canceled.
+func (q *jobQueue) pick() (*Job, context.Context, error) {
+	q.claimMu.Lock()
+	defer q.claimMu.Unlock()
+	queued, err := listQueuedJobs(jobClaimWindow)
+	if err != nil {
+		return nil, nil, err
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	waitingIPs := make(map[string]bool, len(q.waiting))
+	for _, w := range q.waiting {
+		waitingIPs[w.ip] = true
+	}
+	var pick *Job
+	for _, c := range queued {
+		if _, ok := q.waiting[c.ID]; ok {
+			continue
+		}
+		if pick == nil {
+			pick = c
+		}
+		if !waitingIPs[c.ip] {
+			pick = c
+			break
+		}
+	}
+	if pick == nil {
+		return nil, nil, nil
+	}
+	ctx, stop := context.WithCancel(context.Background())
+	q.waiting[pick.ID] = waitingJob{ip: pick.ip, stop: stop}
+	return pick, ctx, nil
+}
+
+// run executes a claimed job and stores its outcome and history record.
+func (q *jobQueue) run(ctx context.Context, j *Job) {
+	profile := defaultProfile()
+	if appConfig != nil && appConfig.Profiles[j.Profile] != nil {
+		profile = appConfig.Profiles[j.Profile]
+	}
+	toolchain, err := resolveToolchain(j.Toolchain)
+	if err != nil {
+		j.Status, j.Error = JobFailed, err.Error()
+	} else {
+		result, record, err := execInKataWithHistory(ctx, j.code, j.stdin, execOptions{Profile: profile, Toolchain: toolchain, Cache: j.cache}, nil)
+		saveExecutionRecord(record, j.ip, err)
+		j.Result = result
+		if result != nil {
+			j.ContainerID = result.ContainerID
+		}
+		if err != nil {
+			j.Error = err.Error()
+		}
+		switch {
+		case ctx.Err() != nil:
+			j.Status = JobCanceled
+		case result == nil:
+			j.Status = JobFailed
+		default:
+			j.Status = JobDone
+		}
+	}
+	if err := finishJob(j); err != nil {
+		logger.Error("failed to persist job result", zap.String("job_id", j.ID), zap.Error(err))
+	}
+	logger.Info("job finished", zap.String("job_id", j.ID), zap.String("status", string(j.Status)), zap.String("container_id", j.ContainerID))
+}
+
+// jobsHandler is POST /jobs: the /compile form fields (code, stdin,
+// toolchain, cache) are queued and 202 returns the job with its position.
+func jobsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	code, stdin, ok := readCompileForm(w, r)
+	if !ok {
+		return
+	}
+	clientIP := extractClientIP(r)
+	profile := selectProfile(r)
+	if len(code) > profile.MaxCodeChars {
+		http.Error(w, fmt.Sprintf("Error: %v of %d", ErrCodeTooLong, profile.MaxCodeChars), http.StatusBadRequest)
+		return
+	}
+	toolchain, err := resolveToolchain(r.FormValue("toolchain"))
+	if err != nil {
+		http.Error(w, "Error: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	cache, _ := strconv.ParseBool(r.FormValue("cache"))
+	j := &Job{Profile: profile.Name, ip: clientIP, code: code, stdin: stdin, cache: cache}
+	if toolchain != nil {
+		j.Toolchain = toolchain.Version
+	}
+	if err := jobsQueue.enqueue(j); err != nil {
+		if errors.Is(err, ErrJobQueueFull) {
+			http.Error(w, "Error: "+err.Error(), http.StatusTooManyRequests)
+			return
+		}
+		logger.Error("enqueue job", zap.Error(err))
+		http.Error(w, "error queueing job", http.StatusInternalServerError)
+		return
+	}
+	logger.Info("job queued", zap.String("job_id", j.ID), zap.String("ip", clientIP))
+	if queued, err := loadJob(j.ID); err == nil && queued != nil {
+		j = queued
+	}
+	w.Header().Set("Location", "/jobs/"+j.ID)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	_ = json.NewEncoder(w).Encode(j)
+}
+
+// jobHandler is GET /jobs/{id} (status, position or result) and
+// DELETE /jobs/{id} (cancel). The random ID is the only credential.
+func jobHandler(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/jobs/")
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodDelete:
+		if err := jobsQueue.cancel(id); err != nil {
+			switch {
+			case errors.Is(err, ErrJobNotFound):
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			case errors.Is(err, ErrJobFinished):
+				http.Error(w, err.Error(), http.StatusConflict)
+				return
+			}
+			logger.Error("cancel job", zap.String("job_id", id), zap.Error(err))
+			http.Error(w, "error canceling job", http.StatusInternalServerError)
+			return
+		}
+		logger.Info("job cancel requested", zap.String("job_id", id))
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	j, err := loadJob(id)
+	if err != nil {
+		logger.Error("load job", zap.String("job_id", id), zap.Error(err))
+		http.Error(w, "error loading job", http.StatusInternalServerError)
+		return
+	}
+	if j == nil {
+		http.Error(w, "job not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(j)
+}
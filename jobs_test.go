@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// useJobsDB points db at a fresh database in a temp dir for the test.
+func useJobsDB(t *testing.T) {
+	t.Helper()
+	prevDB, prevLogger := db, logger
+	logger = zap.NewNop()
+	t.Chdir(t.TempDir())
+	if err := initDB(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.Close()
+		db, logger = prevDB, prevLogger
+	})
+}
+
+// queueJobs enqueues one job per ip on q and returns their IDs.
+func queueJobs(t *testing.T, q *jobQueue, ips ...string) []string {
+	t.Helper()
+	var ids []string
+	for _, ip := range ips {
+		j := &Job{ip: ip, code: "main"}
+		if err := q.enqueue(j); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, j.ID)
+	}
+	return ids
+}
+
+func TestJobQueueCaps(t *testing.T) {
+	tests := []struct {
+		name     string
+		maxTotal int
+		maxPerIP int
+		queued   []string // IPs of the jobs already waiting
+		ip       string
+		wantErr  bool
+	}{
+		{name: "unlimited", queued: []string{"a", "a", "b"}, ip: "a"},
+		{name: "under both caps", maxTotal: 3, maxPerIP: 2, queued: []string{"a", "b"}, ip: "a"},
+		{name: "queue full", maxTotal: 2, queued: []string{"a", "b"}, ip: "c", wantErr: true},
+		{name: "ip at its cap", maxPerIP: 2, queued: []string{"a", "a", "b"}, ip: "a", wantErr: true},
+		{name: "other ip under its cap", maxPerIP: 2, queued: []string{"a", "a", "b"}, ip: "b"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useJobsDB(t)
+			q := newJobQueue(&Config{JobQueueMax: tt.maxTotal, JobQueueMaxPerIP: tt.maxPerIP})
+			queueJobs(t, q, tt.queued...)
+			err := q.enqueue(&Job{ip: tt.ip, code: "main"})
+			if tt.wantErr && !errors.Is(err, ErrJobQueueFull) || !tt.wantErr && err != nil {
+				t.Errorf("enqueue error = %v, want queue full %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestJobQueueCapsConcurrent(t *testing.T) {
+	useJobsDB(t)
+	q := newJobQueue(&Config{JobQueueMax: 5, JobQueueMaxPerIP: 3})
+	var wg sync.WaitGroup
+	errs := make(chan error, 20)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(ip string) {
+			defer wg.Done()
+			if err := q.enqueue(&Job{ip: ip, code: "main"}); err != nil && !errors.Is(err, ErrJobQueueFull) {
+				errs <- err
+			}
+		}([]string{"a", "b"}[i%2])
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+	total, fromA, err := countQueuedJobs("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 5 || fromA > 3 || total-fromA > 3 {
+		t.Errorf("queued %d jobs, %d from a, want 5 with at most 3 per ip", total, fromA)
+	}
+}
+
+func TestJobQueueClaim(t *testing.T) {
+	tests := []struct {
+		name       string
+		maxTotal   int
+		maxWaiting int
+		held       []string // IPs holding a compileLimiter slot
+		freeAfter  bool     // the held slots are released while the worker waits
+		queued     []string
+		waiting    []int // queued jobs other workers wait a slot for
+		want       int   // index in queued of the claimed job, -1 for none
+	}{
+		{name: "oldest first", queued: []string{"a", "b"}, want: 0},
+		{name: "ip another worker waits for is passed over", queued: []string{"a", "a", "b"}, waiting: []int{0}, want: 2},
+		{name: "then its next job", queued: []string{"a", "a"}, waiting: []int{0}, want: 1},
+		{name: "every job picked", queued: []string{"a"}, waiting: []int{0}, want: -1},
+		{name: "waits for a slot", maxTotal: 1, maxWaiting: 1, held: []string{"c"}, freeAfter: true, queued: []string{"a"}, want: 0},
+		{name: "no slot and no waiting", maxTotal: 1, held: []string{"c"}, queued: []string{"a"}, want: -1},
+		{name: "empty queue", want: -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useJobsDB(t)
+			prev := compileLimiter
+			compileLimiter = newConcurrencyLimiter(tt.maxTotal, 0, tt.maxWaiting, 0)
+			t.Cleanup(func() { compileLimiter = prev })
+			var held []func()
+			for _, ip := range tt.held {
+				release, _, _, _, _ := compileLimiter.tryAcquire(ip)
+				held = append(held, release)
+			}
+			if tt.freeAfter {
+				freed := held
+				time.AfterFunc(20*time.Millisecond, func() {
+					for _, release := range freed {
+						release()
+					}
+				})
+				held = nil
+			}
+			q := newJobQueue(&Config{})
+			ids := queueJobs(t, q, tt.queued...)
+			for _, i := range tt.waiting {
+				q.waiting[ids[i]] = waitingJob{ip: tt.queued[i], stop: func() {}}
+			}
+
+			j, _, done, err := q.claim()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.want < 0 {
+				if j != nil {
+					t.Errorf("claimed %s, want none", j.ID)
+				}
+				return
+			}
+			if j == nil || j.ID != ids[tt.want] || j.Status != JobRunning {
+				t.Fatalf("claimed %+v, want job %d running", j, tt.want)
+			}
+			if compileLimiter.total != len(held)+1 {
+				t.Errorf("limiter holds %d slots, want %d", compileLimiter.total, len(held)+1)
+			}
+			done()
+			if compileLimiter.total != len(held) {
+				t.Errorf("done left %d slots held, want %d", compileLimiter.total, len(held))
+			}
+		})
+	}
+}
+
+func TestJobQueueCancel(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  JobStatus // "" cancels an unknown ID
+		running bool      // a worker holds the job
+		waiting bool      // a worker waits a slot for the job
+		want    JobStatus
+		wantErr error
+	}{
+		{name: "queued", status: JobQueued, want: JobCanceled},
+		{name: "waiting for a slot", status: JobQueued, waiting: true, want: JobCanceled},
+		{name: "running", status: JobRunning, running: true, want: JobRunning},
+		{name: "finished", status: JobDone, want: JobDone, wantErr: ErrJobFinished},
+		{name: "unknown", wantErr: ErrJobNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useJobsDB(t)
+			q := newJobQueue(&Config{})
+			id := "missing"
+			if tt.status != "" {
+				id = queueJobs(t, q, "a")[0]
+				if tt.status != JobQueued {
+					setJobStatus(id, JobQueued, tt.status)
+				}
+			}
+			ctx, stop := context.WithCancel(context.Background())
+			defer stop()
+			if tt.running {
+				q.running[id] = stop
+			}
+			if tt.waiting {
+				q.waiting[id] = waitingJob{ip: "a", stop: stop}
+			}
+
+			if err := q.cancel(id); !errors.Is(err, tt.wantErr) {
+				t.Fatalf("cancel error = %v, want %v", err, tt.wantErr)
+			}
+			if (tt.running || tt.waiting) && ctx.Err() == nil {
+				t.Error("the worker holding the job was not stopped")
+			}
+			if tt.status != "" {
+				j, err := loadJob(id)
+				if err != nil || j.Status != tt.want {
+					t.Errorf("job status %v (%v), want %s", j.Status, err, tt.want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Judge verdicts of one test case (and of the whole submission).
+const (
+	VerdictAccepted      = "AC"
+	VerdictWrongAnswer   = "WA"
+	VerdictTimeLimit     = "TLE"
+	VerdictRuntimeError  = "RE"
+	VerdictMemoryLimit   = "MLE"
+	VerdictOutputLimit   = "OLE"
+	VerdictCompileError  = "CE"
+	VerdictSkipped       = "SK" // never started: the sandbox died on an earlier case
+	VerdictInternalError = "IE"
+)
+
+const (
+	maxJudgeCases         = 50
+	maxJudgeInputBytes    = 1 << 20 // all stdins together
+	defaultCaseTimeoutMS  = 2000
+	defaultFloatTolerance = 1e-6
+)
+
+// JudgeCase is one test: the program gets Stdin and its stdout is compared
+// with Expected. Mode is exact, trimmed (default: trailing whitespace of
+// each line and trailing blank lines ignored), tokens (whitespace separated
+// tokens) or float (tokens, numbers equal within Tolerance, absolute or
+// relative).
+type JudgeCase struct {
+	Stdin     string  `json:"stdin"`
+	Expected  string  `json:"expected"`
+	Mode      string  `json:"mode,omitempty"`
+	Tolerance float64 `json:"tolerance,omitempty"`
+	TimeoutMS int     `json:"timeout_ms,omitempty"`
+}
+
+// JudgeCaseResult is the verdict of one case.
+type JudgeCaseResult struct {
+	Index      int    `json:"index"`
+	Verdict    string `json:"verdict"`
+	DurationMS int64  `json:"duration_ms"`
+	ExitCode   int    `json:"exit_code"`
+	Signal     string `json:"signal,omitempty"`
+	Stdout     string `json:"stdout"`
+	Stderr     string `json:"stderr,omitempty"`
+	Truncated  bool   `json:"truncated,omitempty"`
+}
+
+// JudgeResult summarizes a submission: Verdict is the first non-AC case
+// verdict (CE when it did not compile, AC when every case passed).
+type JudgeResult struct {
+	Verdict string            `json:"verdict"`
+	Passed  int               `json:"passed"`
+	Total   int               `json:"total"`
+	Cases   []JudgeCaseResult `json:"cases"`
+}
+
+// validateJudgeCases applies the defaults and the limits of profile.
+func validateJudgeCases(cases []JudgeCase, profile *ResourceProfile) error {
+	if len(cases) == 0 {
+		return errors.New("at least one test case is required")
+	}
+	if len(cases) > maxJudgeCases {
+		return fmt.Errorf("too many test cases (max %d)", maxJudgeCases)
+	}
+	total := 0
+	maxMS := int(profile.Timeout() / time.Millisecond)
+	for i := range cases {
+		c := &cases[i]
+		if len(c.Stdin) > maxStdinBytes {
+			return fmt.Errorf("case %d: %w", i, ErrStdinTooLarge)
+		}
+		total += len(c.Stdin)
+		switch c.Mode {
+		case "":
+			c.Mode = "trimmed"
+		case "exact", "trimmed", "tokens", "float":
+		default:
+			return fmt.Errorf("case %d: unknown comparison mode %q", i, c.Mode)
+		}
+		if c.Tolerance <= 0 {
+			c.Tolerance = defaultFloatTolerance
+		}
+		if c.TimeoutMS <= 0 {
+			c.TimeoutMS = defaultCaseTimeoutMS
+		}
+		if c.TimeoutMS > maxMS {
+			return fmt.Errorf("case %d: timeout_ms exceeds the %d ms limit", i, maxMS)
+		}
+	}
+	if total > maxJudgeInputBytes {
+		return fmt.Errorf("test case inputs exceed %d bytes", maxJudgeInputBytes)
+	}
+	return nil
+}
+
+// caseTimeoutSeconds is the kill deadline of each case step (whole seconds,
+// rounded up); verdicts use the exact TimeoutMS.
+func caseTimeoutSeconds(c JudgeCase) int {
+	return (c.TimeoutMS + 999) / 1000
+}
+
+// judgeTimeout is the wall clock cap of a submission: the profile timeout
+// for compiling plus every case deadline and a second of slack per case.
+func judgeTimeout(cases []JudgeCase, profile *ResourceProfile) time.Duration {
+	total := profile.Timeout()
+	for _, c := range cases {
+		total += time.Duration(caseTimeoutSeconds(c)+1) * time.Second
+	}
+	return total
+}
+
+// judgeInputs packs the case stdins as a tar ("0", "1", ...) in
+// SandboxRequest.Stdin; the backends split it with judgeCaseInputs.
+func judgeInputs(cases []JudgeCase) ([]byte, error) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for i, c := range cases {
+		hdr := &tar.Header{Name: strconv.Itoa(i), Mode: 0o644, Size: int64(len(c.Stdin)), ModTime: time.Now()}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return nil, err
+		}
+		if _, err := tw.Write([]byte(c.Stdin)); err != nil {
+			return nil, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// judgeCaseInputs unpacks a judgeInputs tar back into n case inputs, for
+// backends that feed every case to ./out themselves.
+func judgeCaseInputs(r io.Reader, n int) ([][]byte, error) {
+	inputs := make([][]byte, n)
+	if r == nil {
+		return inputs, nil
+	}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return inputs, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		i, err := strconv.Atoi(hdr.Name)
+		if err != nil || i < 0 || i >= n {
+			return nil, fmt.Errorf("unexpected case input %q", hdr.Name)
+		}
+		if inputs[i], err = io.ReadAll(tr); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// judgeCases turns the captured case output into verdicts. exit and runErr
+// describe how the whole sandbox ended, for the case it was killed in.
+func judgeCases(capture *phaseCapture, res *ExecutionResult, cases []JudgeCase, exit SandboxExit, runErr error) *JudgeResult {
+	jr := &JudgeResult{Total: len(cases), Cases: make([]JudgeCaseResult, 0, len(cases))}
+	compiled := res.Compile != nil && res.Compile.ExitCode == 0 && res.Status != StatusCompileError
+	for i, tc := range cases {
+		cr := JudgeCaseResult{Index: i, ExitCode: -1}
+		cc := capture.caseResult(i)
+		switch {
+		case !compiled && res.Status == StatusCompileError:
+			cr.Verdict = VerdictCompileError
+		case !compiled:
+			cr.Verdict = VerdictInternalError
+		case cc == nil:
+			cr.Verdict = VerdictSkipped
+		default:
+			cr.Stdout, cr.Stderr = cc.stdout, cc.stderr
+			cr.Truncated = cc.cut
+			end := cc.ended
+			if end.IsZero() {
+				end = time.Now()
+			}
+			cr.DurationMS = end.Sub(cc.started).Milliseconds()
+			cr.Verdict = caseVerdict(tc, cc, &cr, exit, runErr)
+		}
+		if cr.Verdict == VerdictAccepted {
+			jr.Passed++
+		} else if jr.Verdict == "" {
+			jr.Verdict = cr.Verdict
+		}
+		jr.Cases = append(jr.Cases, cr)
+	}
+	if jr.Verdict == "" {
+		jr.Verdict = VerdictAccepted
+	}
+	return jr
+}
+
+func caseVerdict(tc JudgeCase, cc *caseCapture, cr *JudgeCaseResult, exit SandboxExit, runErr error) string {
+	if cc.exit == nil {
+		// the sandbox itself died while this case ran
+		switch {
+		case exit.OOMKilled:
+			return VerdictMemoryLimit
+		case errors.Is(runErr, ErrExecTimeout):
+			return VerdictTimeLimit
+		case errors.Is(runErr, ErrOutputLimit):
+			return VerdictOutputLimit
+		}
+		return VerdictRuntimeError
+	}
+	cr.ExitCode = *cc.exit
+	var sig syscall.Signal
+	if cr.ExitCode > 128 && cr.ExitCode < 128+65 {
+		sig = syscall.Signal(cr.ExitCode - 128)
+		cr.Signal = signalName(sig)
+	}
+	switch {
+	case cr.DurationMS >= int64(tc.TimeoutMS), sig == syscall.SIGXCPU:
+		return VerdictTimeLimit
+	case sig == syscall.SIGKILL:
+		// not the deadline (above) and RLIMIT_CPU sends SIGXCPU first: OOM killer
+		return VerdictMemoryLimit
+	case cr.ExitCode != 0:
+		return VerdictRuntimeError
+	case outputMatches(tc, cc.stdout):
+		return VerdictAccepted
+	}
+	return VerdictWrongAnswer
+}
+
+// outputMatches compares got with tc.Expected using tc.Mode.
+func outputMatches(tc JudgeCase, got string) bool {
+	switch tc.Mode {
+	case "exact":
+		return got == tc.Expected
+	case "tokens":
+		return slices.Equal(strings.Fields(got), strings.Fields(tc.Expected))
+	case "float":
+		g, w := strings.Fields(got), strings.Fields(tc.Expected)
+		if len(g) != len(w) {
+			return false
+		}
+		for i := range g {
+			if g[i] == w[i] {
+				continue
+			}
+			a, errA := strconv.ParseFloat(g[i], 64)
+			b, errB := strconv.ParseFloat(w[i], 64)
+			if errA != nil || errB != nil {
+				return false
+			}
+			if diff := math.Abs(a - b); diff > tc.Tolerance && diff > tc.Tolerance*math.Abs(b) {
+				return false
+			}
+		}
+		return true
+	}
+	return trimOutput(got) == trimOutput(tc.Expected)
+}
+
+// trimOutput drops trailing whitespace on every line and trailing blank lines.
+func trimOutput(s string) string {
+	lines := strings.Split(strings.ReplaceAll(s, "\r\n", "\n"), "\n")
+	for i, l := range lines {
+		lines[i] = strings.TrimRight(l, " \t")
+	}
+	return strings.TrimRight(strings.Join(lines, "\n"), "\n")
+}
+
+// judgeRequest is the JSON body of /judge.
+type judgeRequest struct {
+	Code      string      `json:"code"`
+	Cases     []JudgeCase `json:"cases"`
+	Toolchain string      `json:"toolchain,omitempty"`
+}
+
+// judgeHandler is /judge: compile the program once, then run it against
+// every test case in the same sandbox. The submission is stored as one
+// history record with its case results.
+func judgeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req judgeRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4*maxJudgeInputBytes)).Decode(&req); err != nil {
+		http.Error(w, "invalid JSON body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Code == "" {
+		http.Error(w, "code not provided", http.StatusBadRequest)
+		return
+	}
+	clientIP := extractClientIP(r)
+	profile := selectProfile(r)
+	if err := validateJudgeCases(req.Cases, profile); err != nil {
+		http.Error(w, "Error: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	toolchain, err := resolveToolchain(req.Toolchain)
+	if err != nil {
+		http.Error(w, "Error: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	release, ok := acquireCompileSlot(w, r, clientIP)
+	if !ok {
+		return
+	}
+	defer release()
+
+	record := &ContainerRecord{CreatedAt: time.Now(), CodeExecuted: req.Code, Profile: profile.Name}
+	if toolchain != nil {
+		record.Toolchain, record.ToolchainHash = toolchain.Version, toolchain.Hash
+	}
+	result, err := runInSandbox(r.Context(), sandboxRun{Code: req.Code, Profile: profile, Cases: req.Cases, Toolchain: toolchain})
+	fillExecutionRecord(record, result, err)
+	saveExecutionRecord(record, clientIP, err)
+	if result == nil {
+		logger.Error("judge submission failed", zap.Error(err))
+		http.Error(w, "Error during code execution: "+executionErrorMessage(result, err), http.StatusInternalServerError)
+		return
+	}
+	writeExecutionResult(w, result)
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeSandboxOutput feeds c what a backend would print: "#event" lines
+// become marker lines on both streams, "2>text" lines go to stderr and the
+// others to stdout.
+func writeSandboxOutput(c *phaseCapture, marker string, lines ...string) {
+	for _, l := range lines {
+		switch {
+		case strings.HasPrefix(l, "#"):
+			m := marker + " " + l[1:] + "\n"
+			c.stdout.Write([]byte(m))
+			c.stderr.Write([]byte(m))
+		case strings.HasPrefix(l, "2>"):
+			c.stderr.Write([]byte(l[2:] + "\n"))
+		default:
+			c.stdout.Write([]byte(l + "\n"))
+		}
+	}
+}
+
+func TestOutputMatches(t *testing.T) {
+	tests := []struct {
+		mode      string
+		tolerance float64
+		expected  string
+		got       string
+		want      bool
+	}{
+		{mode: "exact", expected: "1 2\n", got: "1 2\n", want: true},
+		{mode: "exact", expected: "1 2\n", got: "1 2", want: false},
+		{mode: "trimmed", expected: "a\nb", got: "a  \r\nb\t\n\n", want: true},
+		{mode: "trimmed", expected: "a\nb", got: " a\nb", want: false},
+		{mode: "tokens", expected: "1 2 3", got: "1\n2\t 3\n", want: true},
+		{mode: "tokens", expected: "1 2 3", got: "1 2", want: false},
+		{mode: "float", tolerance: 1e-6, expected: "3.14159265 x", got: "3.1415927 x", want: true},
+		{mode: "float", tolerance: 1e-6, expected: "3.14159", got: "3.15", want: false},
+		{mode: "float", tolerance: 1e-3, expected: "1000000", got: "1000100", want: true}, // relative
+		{mode: "float", tolerance: 1e-6, expected: "1.0", got: "one", want: false},
+	}
+	for _, tt := range tests {
+		tc := JudgeCase{Mode: tt.mode, Tolerance: tt.tolerance, Expected: tt.expected}
+		if got := outputMatches(tc, tt.got); got != tt.want {
+			t.Errorf("outputMatches(%s %q, %q) = %v, want %v", tt.mode, tt.expected, tt.got, got, tt.want)
+		}
+	}
+}
+
+func TestJudgeCases(t *testing.T) {
+	tests := []struct {
+		name    string
+		output  []string
+		exit    SandboxExit
+		runErr  error
+		want    []string // verdicts of the cases expecting "42", "42" and "42"
+		verdict string
+	}{
+		{
+			name:    "accepted, wrong answer, runtime error",
+			output:  []string{"#compile-start", "#compile-end 0", "#case-start 0", "42", "#case-end 0 0", "#case-start 1", "2>42", "#case-end 1 0", "#case-start 2", "#case-end 2 1"},
+			want:    []string{VerdictAccepted, VerdictWrongAnswer, VerdictRuntimeError},
+			verdict: VerdictWrongAnswer,
+		},
+		{
+			name:    "signals",
+			output:  []string{"#compile-start", "#compile-end 0", "#case-start 0", "#case-end 0 152", "#case-start 1", "#case-end 1 137", "#case-start 2", "#case-end 2 139"},
+			want:    []string{VerdictTimeLimit, VerdictMemoryLimit, VerdictRuntimeError},
+			verdict: VerdictTimeLimit,
+		},
+		{
+			name:    "compile error",
+			output:  []string{"#compile-start", "2>syntax error", "#compile-end 1"},
+			exit:    SandboxExit{ExitCode: 1},
+			want:    []string{VerdictCompileError, VerdictCompileError, VerdictCompileError},
+			verdict: VerdictCompileError,
+		},
+		{
+			name:    "sandbox failed before compiling",
+			exit:    SandboxExit{ExitCode: -1},
+			runErr:  errors.New("boom"),
+			want:    []string{VerdictInternalError, VerdictInternalError, VerdictInternalError},
+			verdict: VerdictInternalError,
+		},
+		{
+			name:    "timed out in a case, the rest skipped",
+			output:  []string{"#compile-start", "#compile-end 0", "#case-start 0", "42", "#case-end 0 0", "#case-start 1"},
+			exit:    SandboxExit{ExitCode: 137},
+			runErr:  ErrExecTimeout,
+			want:    []string{VerdictAccepted, VerdictTimeLimit, VerdictSkipped},
+			verdict: VerdictTimeLimit,
+		},
+		{
+			name:    "output limit in a case",
+			output:  []string{"#compile-start", "#compile-end 0", "#case-start 0", "yyyy"},
+			exit:    SandboxExit{ExitCode: 137},
+			runErr:  ErrOutputLimit,
+			want:    []string{VerdictOutputLimit, VerdictSkipped, VerdictSkipped},
+			verdict: VerdictOutputLimit,
+		},
+		{
+			name:    "oom kill of the sandbox in a case",
+			output:  []string{"#compile-start", "#compile-end 0", "#case-start 0"},
+			exit:    SandboxExit{ExitCode: 137, OOMKilled: true},
+			want:    []string{VerdictMemoryLimit, VerdictSkipped, VerdictSkipped},
+			verdict: VerdictMemoryLimit,
+		},
+	}
+	cases := make([]JudgeCase, 3)
+	for i := range cases {
+		cases[i] = JudgeCase{Expected: "42", Mode: "trimmed", TimeoutMS: 2000}
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newPhaseCapture("__m__", nil, 1<<20)
+			c.skipRun = true
+			writeSandboxOutput(c, "__m__", tt.output...)
+			res := c.result(time.Now(), tt.exit, tt.runErr)
+			jr := judgeCases(c, res, cases, tt.exit, tt.runErr)
+			var got []string
+			for _, cr := range jr.Cases {
+				got = append(got, cr.Verdict)
+			}
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") || jr.Verdict != tt.verdict {
+				t.Errorf("verdicts %v overall %s, want %v overall %s", got, jr.Verdict, tt.want, tt.verdict)
+			}
+		})
+	}
+}
+
+func TestJudgeCaseOutputCap(t *testing.T) {
+	c := newPhaseCapture("__m__", nil, 4)
+	c.skipRun = true
+	writeSandboxOutput(c, "__m__", "#compile-start", "#compile-end 0", "#case-start 0", "123456", "#case-end 0 0", "#case-start 1", "42", "#case-end 1 0")
+	res := c.result(time.Now(), SandboxExit{}, nil)
+	cases := []JudgeCase{{Expected: "123456", TimeoutMS: 2000}, {Expected: "42", TimeoutMS: 2000}}
+	jr := judgeCases(c, res, cases, SandboxExit{}, nil)
+	if cr := jr.Cases[0]; cr.Stdout != "1234" || !cr.Truncated || cr.Verdict != VerdictWrongAnswer {
+		t.Errorf("case 0 = %+v, want stdout cut to 4 bytes and WA", cr)
+	}
+	if cr := jr.Cases[1]; cr.Stdout != "42\n" || cr.Truncated || cr.Verdict != VerdictAccepted {
+		t.Errorf("case 1 = %+v, want its own output and AC", cr)
+	}
+}
+
+// TestJudgeHandlerFake runs /judge end to end on the fake backend, which
+// prints its canned stdout and exit code for every case.
+func TestJudgeHandlerFake(t *testing.T) {
+	tests := []struct {
+		name     string
+		exitCode int
+		expected []string
+		verdict  string
+		passed   int
+	}{
+		{name: "accepted", expected: []string{"42", "42\n\n"}, verdict: VerdictAccepted, passed: 2},
+		{name: "wrong answer", expected: []string{"42", "41"}, verdict: VerdictWrongAnswer, passed: 1},
+		{name: "runtime error", exitCode: 3, expected: []string{"42"}, verdict: VerdictRuntimeError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useFakeSandbox(t, &fakeSandbox{active: map[string]*fakeExecution{}, Stdout: "42\n", ExitCode: tt.exitCode})
+			body := judgeRequest{Code: "print 42"}
+			for _, e := range tt.expected {
+				body.Cases = append(body.Cases, JudgeCase{Stdin: "x", Expected: e})
+			}
+			data, _ := json.Marshal(body)
+			w := httptest.NewRecorder()
+			judgeHandler(w, httptest.NewRequest(http.MethodPost, "/judge", strings.NewReader(string(data))))
+			var res ExecutionResult
+			if err := json.NewDecoder(w.Body).Decode(&res); err != nil || w.Code != http.StatusOK {
+				t.Fatalf("status %d: %v", w.Code, err)
+			}
+			if res.Judge == nil || res.Judge.Verdict != tt.verdict || res.Judge.Passed != tt.passed || len(res.Judge.Cases) != len(tt.expected) {
+				t.Errorf("judge = %+v, want %s with %d of %d passed", res.Judge, tt.verdict, tt.passed, len(tt.expected))
+			}
+		})
+	}
+
+	w := httptest.NewRecorder()
+	judgeHandler(w, httptest.NewRequest(http.MethodPost, "/judge", strings.NewReader(`{"code":"x","cases":[]}`)))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("no cases: status %d, want 400", w.Code)
+	}
+}
@@ -57,20 +57,36 @@ func parseJWT(tokenStr string) (jwt.MapClaims, error) {
 	return nil, errors.New("invalid token")
 }
 
+// requestToken returns the JWT sent via Authorization header or cookie "admintoken".
+func requestToken(r *http.Request) string {
+	authH := r.Header.Get("Authorization")
+	if strings.HasPrefix(strings.ToLower(authH), "bearer ") {
+		return strings.TrimSpace(authH[7:])
+	}
+	if c, err := r.Cookie("admintoken"); err == nil {
+		return c.Value
+	}
+	return ""
+}
+
+// isAdminRequest reports whether r carries a valid admin JWT (no redirect).
+func isAdminRequest(r *http.Request) bool {
+	tokenStr := requestToken(r)
+	if tokenStr == "" {
+		return false
+	}
+	claims, err := parseJWT(tokenStr)
+	if err != nil {
+		return false
+	}
+	role, _ := claims["role"].(string)
+	return role == "admin"
+}
+
 // requireAdmin verifies Authorization Bearer JWT.
 func requireAdmin(h http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		// Accept token via Authorization header or cookie "admintoken"
-		var tokenStr string
-		authH := r.Header.Get("Authorization")
-		if strings.HasPrefix(strings.ToLower(authH), "bearer ") {
-			tokenStr = strings.TrimSpace(authH[7:])
-		}
-		if tokenStr == "" {
-			if c, err := r.Cookie("admintoken"); err == nil {
-				tokenStr = c.Value
-			}
-		}
+		tokenStr := requestToken(r)
 		redirectToLogin := func() {
 			if r.Method == http.MethodGet && strings.Contains(r.Header.Get("Accept"), "text/html") {
 				http.Redirect(w, r, "/adminLogin", http.StatusFound)
@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
 	"net/http"
@@ -13,8 +14,6 @@ import (
 	"strings"
 	"time"
 
-	"github.com/containerd/containerd"
-	"github.com/containerd/containerd/namespaces"
 	"github.com/joho/godotenv"
 	"go.uber.org/zap"
 )
@@ -35,14 +34,31 @@ type ContainerHistory struct {
 
 // ContainerRecord representa um registro completo de um container
 type ContainerRecord struct {
-	ContainerID   string        `json:"container_id"`
-	CreatedAt     time.Time     `json:"created_at"`
-	FinishedAt    time.Time     `json:"finished_at"`
-	ExecutionTime time.Duration `json:"execution_time"`
-	IP            string        `json:"ip,omitempty"`
-	CodeExecuted  string        `json:"code_executed"`
-	Output        string        `json:"output"`
-	ErrorMessage  string        `json:"error_message"`
+	ContainerID   string         `json:"container_id"`
+	CreatedAt     time.Time      `json:"created_at"`
+	FinishedAt    time.Time      `json:"finished_at"`
+	ExecutionTime time.Duration  `json:"execution_time"`
+	IP            string         `json:"ip,omitempty"`
+	CodeExecuted  string         `json:"code_executed"`
+	Stdin         string         `json:"stdin,omitempty"`
+	Output        string         `json:"output"`
+	ErrorMessage  string         `json:"error_message"`
+	Status        string         `json:"status,omitempty"`
+	Profile       string         `json:"profile,omitempty"`
+	Toolchain     string         `json:"toolchain,omitempty"`
+	ToolchainHash string         `json:"toolchain_hash,omitempty"`
+	CacheHit      bool           `json:"cache_hit,omitempty"`
+	CachedFrom    string         `json:"cached_from,omitempty"`
+	BinaryCache   string         `json:"binary_cache,omitempty"`
+	ImageDigest   string         `json:"image_digest,omitempty"`
+	ExitCode      int            `json:"exit_code"`
+	OOMKilled     bool           `json:"oom_killed,omitempty"`
+	Usage         *ResourceUsage `json:"usage,omitempty"`
+	Compile       *PhaseResult   `json:"compile,omitempty"`
+	Run           *PhaseResult   `json:"run,omitempty"`
+	// Verdict and Cases are set for /judge submissions.
+	Verdict string            `json:"verdict,omitempty"`
+	Cases   []JudgeCaseResult `json:"cases,omitempty"`
 }
 
 // ContainerStats simples (sem métricas de recursos)
@@ -53,84 +69,226 @@ type ContainerStats struct {
 	Runtime     string    `json:"runtime,omitempty"`
 }
 
-func compileHandler(w http.ResponseWriter, r *http.Request) {
-	code := r.FormValue("code")
+// readCompileForm reads the code and stdin fields shared by /compile and
+// /compile/stream, answering 400 itself when they are missing or too large.
+func readCompileForm(w http.ResponseWriter, r *http.Request) (code, stdin string, ok bool) {
+	code = r.FormValue("code")
 	if code == "" {
 		logger.Warn("code not provided")
 		http.Error(w, "code not provided", http.StatusBadRequest)
+		return "", "", false
+	}
+	stdin = r.FormValue("stdin")
+	if len(stdin) > maxStdinBytes {
+		logger.Warn("stdin too large", zap.Int("bytes", len(stdin)))
+		http.Error(w, "Error: "+ErrStdinTooLarge.Error(), http.StatusBadRequest)
+		return "", "", false
+	}
+	return code, stdin, true
+}
+
+func compileHandler(w http.ResponseWriter, r *http.Request) {
+	code, stdin, ok := readCompileForm(w, r)
+	if !ok {
 		return
 	}
 	clientIP := extractClientIP(r)
-	if compileLimiter != nil {
-		release, ok, msg, total, perIP := compileLimiter.tryAcquire(clientIP)
-		if !ok {
-			if logger != nil {
-				fields := []zap.Field{
-					zap.String("ip", clientIP),
-					zap.String("reason", msg),
-					zap.Int("concurrent_total", total),
-					zap.Int("concurrent_ip", perIP),
-				}
-				if appConfig != nil {
-					fields = append(fields, zap.Int("limit_total", appConfig.MaxConcurrentCompilations), zap.Int("limit_ip", appConfig.MaxConcurrentCompilationsPerIP))
-				}
-				logger.Warn(fmt.Sprintf("compile concurrency limit hit (ip=%s)", clientIP), fields...)
-			}
-			http.Error(w, msg, http.StatusTooManyRequests)
-			return
+	opts, err := compileOptions(r)
+	if err != nil {
+		http.Error(w, "Error: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	release, ok := acquireCompileSlot(w, r, clientIP)
+	if !ok {
+		return
+	}
+	defer release()
+
+	result, containerRecord, err := execInKataWithHistory(r.Context(), code, stdin, opts, nil)
+	saveExecutionRecord(containerRecord, clientIP, err)
+	wantJSON := wantsJSONResult(r)
+	if err != nil {
+		logger.Error("code execution failed", zap.Error(err))
+		if errors.Is(err, ErrCodeTooLong) {
+			http.Error(w, "Error: "+err.Error()+"\n"+result.Text(), http.StatusBadRequest)
+		} else if wantJSON && result != nil {
+			writeExecutionResult(w, result)
+		} else {
+			http.Error(w, fmt.Sprintf("Error during code execution: %s\n%s", executionErrorMessage(result, err), result.Text()), http.StatusInternalServerError)
+		}
+		return
+	}
+	logger.Info("code executed successfully", zap.String("status", string(result.Status)))
+	if wantJSON {
+		writeExecutionResult(w, result)
+		return
+	}
+	w.Write([]byte(result.Text()))
+}
+
+// saveExecutionRecord stores the history row of one execution.
+func saveExecutionRecord(record *ContainerRecord, clientIP string, err error) {
+	if record == nil {
+		return
+	}
+	record.IP = clientIP
+	if err != nil {
+		record.ErrorMessage = err.Error()
+	}
+	if dbErr := saveContainerRecordDB(record); dbErr != nil {
+		logger.Error("failed to persist record", zap.Error(dbErr))
+	}
+}
+
+// executionErrorMessage explains a failed run from its status instead of
+// guessing ("maybe timeout or 5k char limit").
+func executionErrorMessage(result *ExecutionResult, err error) string {
+	if result == nil {
+		return err.Error()
+	}
+	if result.Status == StatusTimeout {
+		to := int(kataExecTimeout.Seconds())
+		if to <= 0 {
+			to = 10
+		}
+		return fmt.Sprintf("time limit exceeded (%d sec)", to)
+	}
+	if msg := result.Status.Message(); msg != "" {
+		return msg + ": " + err.Error()
+	}
+	return err.Error()
+}
+
+// acquireCompileSlot takes a compileLimiter slot for clientIP, waiting up
+// to COMPILE_QUEUE_WAIT_SECONDS behind other clients. When none is had it
+// answers 429 (queue full) or 503 (wait ran out) itself, with the queue
+// depth and estimated wait, and returns false; otherwise the caller must
+// call release once the execution is over.
+func acquireCompileSlot(w http.ResponseWriter, r *http.Request, clientIP string) (func(), bool) {
+	if compileLimiter == nil {
+		return func() {}, true
+	}
+	var maxWait time.Duration
+	if appConfig != nil {
+		maxWait = appConfig.CompileQueueWait
+	}
+	waitStart := time.Now()
+	release, err := compileLimiter.acquire(r.Context(), clientIP, maxWait)
+	if err != nil {
+		var busy *limiterBusyError
+		if !errors.As(err, &busy) {
+			// the client went away while queued
+			logger.Info("client left the compile queue", zap.String("ip", clientIP), zap.Duration("waited", time.Since(waitStart)))
+			return nil, false
 		}
 		if logger != nil {
-			ipLimit := 0
-			totalLimit := 0
+			fields := []zap.Field{
+				zap.String("ip", clientIP),
+				zap.String("reason", busy.Reason),
+				zap.Int("concurrent_total", busy.Total),
+				zap.Int("concurrent_ip", busy.PerIP),
+				zap.Int("queue_depth", busy.QueueDepth),
+				zap.Duration("estimated_wait", busy.EstimatedWait),
+				zap.Bool("timed_out", busy.TimedOut),
+			}
 			if appConfig != nil {
-				ipLimit = appConfig.MaxConcurrentCompilationsPerIP
-				totalLimit = appConfig.MaxConcurrentCompilations
+				fields = append(fields, zap.Int("limit_total", appConfig.MaxConcurrentCompilations), zap.Int("limit_ip", appConfig.MaxConcurrentCompilationsPerIP))
 			}
-			logger.Info(fmt.Sprintf("this IP has %d active compilations out of max %d", perIP, ipLimit),
-				zap.String("ip", clientIP),
-				zap.Int("concurrent_ip", perIP),
-				zap.Int("limit_ip", ipLimit),
-			)
-			logger.Info(fmt.Sprintf("the program has %d active compilations out of max %d", total, totalLimit),
-				zap.Int("concurrent_total", total),
-				zap.Int("limit_total", totalLimit),
-			)
+			logger.Warn(fmt.Sprintf("compile concurrency limit hit (ip=%s)", clientIP), fields...)
+		}
+		status := http.StatusTooManyRequests
+		if busy.TimedOut {
+			status = http.StatusServiceUnavailable
+		}
+		w.Header().Set("Retry-After", strconv.Itoa(int((busy.EstimatedWait+time.Second-1)/time.Second)))
+		w.Header().Set("X-Queue-Depth", strconv.Itoa(busy.QueueDepth))
+		w.Header().Set("X-Estimated-Wait-Ms", strconv.FormatInt(busy.EstimatedWait.Milliseconds(), 10))
+		http.Error(w, busy.Error(), status)
+		return nil, false
+	}
+	if logger != nil {
+		if waited := time.Since(waitStart); waited > 10*time.Millisecond {
+			logger.Info("compile slot acquired after queueing", zap.String("ip", clientIP), zap.Duration("waited", waited))
 		}
-		defer release()
 	}
+	return release, true
+}
+
+// wantsJSONResult reports whether the client asked for the structured result
+// (format=json or Accept: application/json); otherwise /compile keeps the
+// legacy plain-text body with the "----exec-out----" marker.
+func wantsJSONResult(r *http.Request) bool {
+	if strings.EqualFold(r.FormValue("format"), "json") {
+		return true
+	}
+	return strings.Contains(r.Header.Get("Accept"), "application/json")
+}
 
-	result, containerRecord, err := execInKataWithHistory(code)
+// compileOptions reads the per-request settings of /compile and /compile/stream:
+// the caller's resource profile, artifacts=1, cache=1 and toolchain=<version>.
+// Only an unknown toolchain is an error.
+func compileOptions(r *http.Request) (execOptions, error) {
+	artifacts, _ := strconv.ParseBool(r.FormValue("artifacts"))
+	cache, _ := strconv.ParseBool(r.FormValue("cache"))
+	toolchain, err := resolveToolchain(r.FormValue("toolchain"))
 	if err != nil {
-		logger.Error("code execution failed", zap.Error(err))
-		if containerRecord != nil {
-			containerRecord.IP = clientIP
-			containerRecord.ErrorMessage = err.Error()
-			if dbErr := saveContainerRecordDB(containerRecord); dbErr != nil {
-				logger.Error("failed to persist error record", zap.Error(dbErr))
+		return execOptions{}, err
+	}
+	return execOptions{Profile: selectProfile(r), Artifacts: artifacts, Cache: cache, Toolchain: toolchain}, nil
+}
+
+func writeExecutionResult(w http.ResponseWriter, result *ExecutionResult) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(result)
+}
+
+// verifiedClientIP is the client IP for decisions that grant something
+// (see selectProfile): the peer address, unless the peer is one of the
+// TRUSTED_PROXY_CIDRS. Then X-Forwarded-For is walked from the right,
+// skipping trusted proxies, and X-Real-IP is used when it is absent.
+func verifiedClientIP(r *http.Request) string {
+	peer, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		peer = r.RemoteAddr
+	}
+	if appConfig == nil || !trustedProxy(appConfig.TrustedProxies, peer) {
+		return peer
+	}
+	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+		hops := strings.Split(xff, ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := strings.TrimSpace(hops[i])
+			if net.ParseIP(hop) == nil {
+				// a malformed entry: nothing left of it can be trusted
+				return peer
 			}
-		}
-		if err == ErrLimitChar5k {
-			http.Error(w, "Error: code exceeds 5000 character limit\n"+result, http.StatusBadRequest)
-		} else {
-			to := int(kataExecTimeout.Seconds())
-			if to <= 0 {
-				to = 10
+			if !trustedProxy(appConfig.TrustedProxies, hop) || i == 0 {
+				return hop
 			}
-			http.Error(w, fmt.Sprintf("Error during code execution (maybe timeout %d sec or 5k char limit)\n%s", to, result), http.StatusInternalServerError)
 		}
-		return
 	}
-	if containerRecord != nil {
-		containerRecord.IP = clientIP
-		if dbErr := saveContainerRecordDB(containerRecord); dbErr != nil {
-			logger.Error("failed to persist record", zap.Error(dbErr))
+	if rip := strings.TrimSpace(r.Header.Get("X-Real-IP")); net.ParseIP(rip) != nil {
+		return rip
+	}
+	return peer
+}
+
+func trustedProxy(proxies []*net.IPNet, addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, n := range proxies {
+		if n.Contains(ip) {
+			return true
 		}
 	}
-	logger.Info("code executed successfully")
-	w.Write([]byte(result))
+	return false
 }
 
 // extractClientIP returns the best-effort client IP considering common proxy headers.
+// Headers are not verified: use it for logs and rate limits, not to grant
+// limits (see verifiedClientIP).
 func extractClientIP(r *http.Request) string {
 	// Check X-Forwarded-For (may contain multiple comma-separated IPs: client, proxy1, proxy2)
 	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
@@ -155,37 +313,61 @@ func extractClientIP(r *http.Request) string {
 }
 
 // execInKataWithHistory executa código e retorna dados completos para o histórico
-func execInKataWithHistory(code string) (string, *ContainerRecord, error) {
+// (listener, se não for nil, recebe a saída em tempo real)
+func execInKataWithHistory(ctx context.Context, code, stdin string, opts execOptions, listener outputListener) (*ExecutionResult, *ContainerRecord, error) {
 	startTime := time.Now()
 
 	// Criar o registro base
 	record := &ContainerRecord{
 		CreatedAt:    startTime,
 		CodeExecuted: code,
-		// resource usage removido
+		Stdin:        stdin,
+	}
+	if opts.Profile != nil {
+		record.Profile = opts.Profile.Name
+	}
+	if opts.Toolchain != nil {
+		record.Toolchain, record.ToolchainHash = opts.Toolchain.Version, opts.Toolchain.Hash
 	}
 
 	// Executar o código original
-	result, containerID, err := execInKata(code)
-	endTime := time.Now()
+	result, err := execInKataStreaming(ctx, code, stdin, opts, listener)
+	fillExecutionRecord(record, result, err)
+	return result, record, err
+}
 
-	// Preencher dados finais
+// fillExecutionRecord preenche os dados finais do registro após a execução
+func fillExecutionRecord(record *ContainerRecord, result *ExecutionResult, err error) {
+	endTime := time.Now()
 	record.FinishedAt = endTime
-	record.ExecutionTime = endTime.Sub(startTime)
-	record.Output = result
-
-	record.ContainerID = containerID
-
-	// Set containerID from exec result if stats didn't provide
-	if record.ContainerID == "" {
-		record.ContainerID = containerID
+	record.ExecutionTime = endTime.Sub(record.CreatedAt)
+	if result != nil {
+		record.Output = result.Text()
+		record.ContainerID = result.ContainerID
+		record.Status = string(result.Status)
+		record.Profile = result.Profile
+		record.Toolchain = result.Toolchain
+		record.ToolchainHash = result.ToolchainHash
+		record.CacheHit = result.CacheHit
+		record.CachedFrom = result.CachedFrom
+		record.BinaryCache = result.BinaryCache
+		record.ImageDigest = result.ImageDigest
+		record.ExitCode = result.ExitCode
+		record.OOMKilled = result.OOMKilled
+		record.Usage = result.Usage
+		record.Compile = result.Compile
+		record.Run = result.Run
+		if result.Judge != nil {
+			record.Verdict = result.Judge.Verdict
+			record.Cases = result.Judge.Cases
+		}
+	} else if err != nil {
+		record.Status = string(StatusInternalError)
 	}
 	// Fallback if still empty
 	if record.ContainerID == "" {
-		record.ContainerID = fmt.Sprintf("kata-exec-%d", startTime.UnixNano())
+		record.ContainerID = fmt.Sprintf("kata-exec-%d", record.CreatedAt.UnixNano())
 	}
-
-	return result, record, err
 }
 
 // timing aggregation removed
@@ -197,12 +379,19 @@ func statsHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, fmt.Sprintf("Error getting container stats: %v", err), http.StatusInternalServerError)
 		return
 	}
+	var pool *WarmPoolStats
+	if sb, err := getSandbox(); err == nil {
+		if pr, ok := sb.(sandboxPoolReporter); ok {
+			pool = pr.PoolStats()
+		}
+	}
 	w.Header().Set("Content-Type", "application/json")
 	_ = json.NewEncoder(w).Encode(struct {
 		Timestamp      time.Time        `json:"timestamp"`
 		ContainerCount int              `json:"container_count"`
 		Containers     []ContainerStats `json:"containers"`
-	}{Timestamp: time.Now(), ContainerCount: len(stats), Containers: stats})
+		Pool           *WarmPoolStats   `json:"pool,omitempty"`
+	}{Timestamp: time.Now(), ContainerCount: len(stats), Containers: stats, Pool: pool})
 	logger.Info("container stats retrieved", zap.Int("count", len(stats)))
 }
 
@@ -278,6 +467,14 @@ func observabilityHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "error loading observability stats", http.StatusInternalServerError)
 		return
 	}
+	if resultsCache != nil {
+		rs := resultsCache.stats()
+		stats.Cache.ResultCache = &rs
+	}
+	if binariesCache != nil {
+		bs := binariesCache.stats()
+		stats.Cache.BinaryCache = &bs
+	}
 	w.Header().Set("Content-Type", "application/json")
 	_ = json.NewEncoder(w).Encode(stats)
 }
@@ -338,67 +535,11 @@ func parseQueryTime(value string) (time.Time, error) {
 }
 
 func getContainerStats() ([]ContainerStats, error) {
-	// Conectar ao containerd
-	client, err := containerd.New("/run/containerd/containerd.sock")
-	if err != nil {
-		return nil, fmt.Errorf("containerd client: %w", err)
-	}
-	defer client.Close()
-
-	ctx := namespaces.WithNamespace(context.Background(), "compiler")
-
-	// Listar todos os containers
-	containers, err := client.Containers(ctx)
-	if err != nil {
-		return nil, fmt.Errorf("list containers: %w", err)
-	}
-
-	var stats []ContainerStats
-	for _, container := range containers {
-		containerStat, err := getIndividualContainerStats(ctx, container)
-		if err != nil {
-			// Log o erro mas continue com outros containers
-			logger.Warn("failed to get stats for container",
-				zap.String("container_id", container.ID()),
-				zap.Error(err))
-			continue
-		}
-		stats = append(stats, containerStat)
-	}
-
-	return stats, nil
-}
-
-func getIndividualContainerStats(ctx context.Context, container containerd.Container) (ContainerStats, error) {
-	// Obter task do container
-	task, err := container.Task(ctx, nil)
+	sb, err := getSandbox()
 	if err != nil {
-		// Container pode não ter task ativa
-		return ContainerStats{
-			ContainerID: container.ID(),
-			Timestamp:   time.Now(),
-			Status:      "no_task",
-			Runtime:     "io.containerd.kata.v2",
-		}, nil
+		return nil, err
 	}
-
-	// Obter status da task
-	status, err := task.Status(ctx)
-	if err != nil {
-		logger.Warn("failed to get task status", zap.String("container_id", container.ID()), zap.Error(err))
-	}
-
-	// Converter métricas para nossa estrutura
-	containerStats := ContainerStats{
-		ContainerID: container.ID(),
-		Timestamp:   time.Now(),
-		Status:      string(status.Status),
-		Runtime:     "io.containerd.kata.v2",
-	}
-
-	// métricas detalhadas removidas
-
-	return containerStats, nil
+	return sb.Stats(context.Background())
 }
 
 // parseMetrics coleta métricas reais lendo arquivos de cgroup (tenta v2 depois v1)
@@ -436,7 +577,7 @@ func main() {
 	appConfig = cfg
 	adminUser = cfg.AdminUser
 	adminPass = cfg.AdminPass
-	compileLimiter = newConcurrencyLimiter(cfg.MaxConcurrentCompilations, cfg.MaxConcurrentCompilationsPerIP)
+	compileLimiter = newConcurrencyLimiter(cfg.MaxConcurrentCompilations, cfg.MaxConcurrentCompilationsPerIP, cfg.CompileQueueMax, cfg.CompileQueueMaxPerIP)
 
 	// Inicializa logger custom que grava em SQLite (data/logs.sql)
 	logDBPath := "data/logs.sql" // extensão .sql como solicitado
@@ -448,17 +589,53 @@ func main() {
 	logger = l
 
 	// Print sanitized config
-	logger.Info("config loaded", zap.String("port", cfg.Port), zap.String("log_level", cfg.LogLevel), zap.String("sandbox_base_image", cfg.SandboxBaseImage), zap.String("sandbox_runtime", cfg.SandboxRuntime), zap.Int("sandbox_cpu_quota_percent", cfg.SandboxCPUQuotaPercent), zap.String("lang_dir", cfg.LangDir), zap.Duration("kata_exec_timeout", cfg.KataExecTimeout), zap.Int("rate_limit_per_min", cfg.RateLimitPerMin), zap.Int("rate_limit_burst", cfg.RateLimitBurst), zap.Int("admin_login_rate_per_min", cfg.AdminLoginRateLimitPerMin), zap.Int("admin_login_rate_burst", cfg.AdminLoginRateLimitBurst), zap.Int("max_concurrent_compilations", cfg.MaxConcurrentCompilations), zap.Int("max_concurrent_compilations_per_ip", cfg.MaxConcurrentCompilationsPerIP))
+	logger.Info("config loaded", zap.String("mode", cfg.Mode), zap.String("port", cfg.Port), zap.String("log_level", cfg.LogLevel), zap.String("sandbox_backend", cfg.SandboxBackend), zap.String("sandbox_base_image", cfg.SandboxBaseImage), zap.String("sandbox_runtime", cfg.SandboxRuntime), zap.Int("sandbox_cpu_quota_percent", cfg.SandboxCPUQuotaPercent), zap.String("lang_dir", cfg.LangDir), zap.Duration("kata_exec_timeout", cfg.KataExecTimeout), zap.Int("rate_limit_per_min", cfg.RateLimitPerMin), zap.Int("rate_limit_burst", cfg.RateLimitBurst), zap.Int("admin_login_rate_per_min", cfg.AdminLoginRateLimitPerMin), zap.Int("admin_login_rate_burst", cfg.AdminLoginRateLimitBurst), zap.Int("max_concurrent_compilations", cfg.MaxConcurrentCompilations), zap.Int("max_concurrent_compilations_per_ip", cfg.MaxConcurrentCompilationsPerIP), zap.Int("compile_queue_max", cfg.CompileQueueMax), zap.Int("compile_queue_max_per_ip", cfg.CompileQueueMaxPerIP), zap.Duration("compile_queue_wait", cfg.CompileQueueWait), zap.Int("sandbox_pool_size", cfg.SandboxPoolSize), zap.Duration("interactive_idle_timeout", cfg.InteractiveIdleTimeout), zap.Int("interactive_timeout_factor", cfg.InteractiveTimeoutFactor), zap.String("default_profile", cfg.DefaultProfile), zap.String("admin_profile", cfg.AdminProfile), zap.Int("profiles", len(cfg.Profiles)))
+
+	sb, err := newSandbox(cfg)
+	if err != nil {
+		logger.Fatal("sandbox backend", zap.Error(err))
+	}
+	activeSandbox = sb
+	logger.Info("sandbox backend selected", zap.String("backend", sb.Name()))
+
+	// Binary cache before the preload. Remote workers cannot see the
+	// frontend's disk (see binaryCacheUsable) and workers compile for it.
+	if binaryCacheUsable(sb) && cfg.Mode == "server" {
+		if binariesCache, err = newBinaryCache(cfg.BinaryCacheDir, int64(cfg.BinaryCacheMB)<<20); err != nil {
+			logger.Fatal("binary cache", zap.String("dir", cfg.BinaryCacheDir), zap.Error(err))
+		}
+	}
+	logger.Info("binary cache configured", zap.Bool("enabled", binariesCache != nil), zap.String("dir", cfg.BinaryCacheDir), zap.Int("mb", cfg.BinaryCacheMB))
+
+	// Toolchain registry (LANG_DIR with toolchains.json, or LANG_DIR itself)
+	langDir, err := resolveLangDir()
+	if err != nil {
+		logger.Fatal("resolve lang dir", zap.Error(err))
+	}
+	if toolchains, err = loadToolchainRegistry(langDir); err != nil {
+		logger.Fatal("load toolchains", zap.String("lang_dir", langDir), zap.Error(err))
+	}
+	for _, tc := range toolchains.list() {
+		logger.Info("toolchain available", zap.String("version", tc.Version), zap.String("dir", tc.Dir), zap.String("hash", tc.Hash), zap.Bool("default", tc.Default), zap.Bool("deprecated", tc.Deprecated))
+	}
 
-	// Base image preload (pull once at startup so first user request is fast)
-	baseRef := cfg.SandboxBaseImage
-	ctx := namespaces.WithNamespace(context.Background(), "compiler")
-	if _, cached, err := ensureBaseImage(ctx, baseRef); err != nil {
-		logger.Fatal("preload base image", zap.String("image", baseRef), zap.Error(err))
-	} else {
-		logger.Info("base image ready", zap.String("image", baseRef), zap.Bool("cached", cached))
+	// Base image preload (pull once at startup so first user request is fast);
+	// after the registry: warm containers run the default toolchain's image
+	if cs, ok := sb.(*containerdSandbox); ok {
+		if err := cs.Preload(context.Background()); err != nil {
+			logger.Fatal("preload base image", zap.String("image", cfg.SandboxBaseImage), zap.Error(err))
+		}
 	}
 
+	// Worker mode: no HTTP API, history or caches, only tasks from the frontend
+	if cfg.Mode == "worker" {
+		runWorker(cfg, sb)
+		return
+	}
+
+	resultsCache = newResultCache(cfg.ResultCacheEntries, int64(cfg.ResultCacheMB)<<20, cfg.ResultCacheTTL)
+	logger.Info("result cache configured", zap.Bool("enabled", resultsCache != nil), zap.Int("entries", cfg.ResultCacheEntries), zap.Int("mb", cfg.ResultCacheMB), zap.Duration("ttl", cfg.ResultCacheTTL))
+
 	// Kata exec timeout from config
 	kataExecTimeout = cfg.KataExecTimeout
 	logger.Info("kata exec timeout configured", zap.Duration("timeout", kataExecTimeout))
@@ -469,6 +646,13 @@ func main() {
 	}
 	logger.Info("sqlite history ready")
 
+	// Async job workers (after the DB: the queue lives in the jobs table)
+	jobsQueue = newJobQueue(cfg)
+	if err := jobsQueue.start(); err != nil {
+		logger.Fatal("start job queue", zap.Error(err))
+	}
+	logger.Info("job queue started", zap.Int("workers", jobsQueue.workers), zap.Int("max_queued", cfg.JobQueueMax), zap.Int("max_queued_per_ip", cfg.JobQueueMaxPerIP))
+
 	// Prepare JWT secret (in jwt.go). Falls back to ADMIN_PASS if JWT secret env not set.
 	if err := initJWT(); err != nil {
 		logger.Fatal("init jwt", zap.Error(err))
@@ -516,6 +700,14 @@ func main() {
 	logger.Info("rate limiters configured", zap.Int("compile_per_min", ratePerMin), zap.Int("compile_burst", burst), zap.Int("admin_login_per_min", adminRatePerMin), zap.Int("admin_login_burst", adminBurst))
 	go ipLimiter.cleanupLoop()
 	http.Handle("/compile", rateLimitMiddleware(http.HandlerFunc(compileHandler), ipLimiter))
+	http.Handle("/judge", rateLimitMiddleware(http.HandlerFunc(judgeHandler), ipLimiter))
+	http.Handle("/check", rateLimitMiddleware(http.HandlerFunc(checkHandler), ipLimiter))
+	http.Handle("/compile/stream", rateLimitMiddleware(http.HandlerFunc(compileStreamHandler), ipLimiter))
+	http.Handle("/session", rateLimitMiddleware(http.HandlerFunc(sessionHandler), ipLimiter))
+	http.Handle("/artifacts/", rateLimitMiddleware(http.HandlerFunc(artifactsHandler), ipLimiter))
+	http.Handle("/jobs", rateLimitMiddleware(http.HandlerFunc(jobsHandler), ipLimiter))
+	http.HandleFunc("/jobs/", jobHandler)
+	http.HandleFunc("/toolchains", toolchainsHandler)
 
 	//protected endpoints
 	http.HandleFunc("/stats", requireAdmin(statsHandler))
@@ -524,6 +716,25 @@ func main() {
 	http.HandleFunc("/observability", requireAdmin(observabilityHandler))
 	http.HandleFunc("/admin", requireAdmin(adminHandler))
 	http.HandleFunc("/admin/observability", requireAdmin(adminObservabilityHandler))
+	http.HandleFunc("/admin/toolchains", requireAdmin(adminToolchainsHandler))
+	http.HandleFunc("/admin/toolchains/deprecate", requireAdmin(adminDeprecateToolchainHandler))
+	http.HandleFunc("/admin/toolchains/upload", requireAdmin(adminUploadToolchainHandler))
+	http.HandleFunc("/admin/toolchains/activate", requireAdmin(adminActivateToolchainHandler))
+	http.HandleFunc("/admin/toolchains/rollback", requireAdmin(adminRollbackToolchainHandler))
+	http.HandleFunc("/admin/audit", requireAdmin(adminAuditHandler))
+	http.HandleFunc("/admin/cache", requireAdmin(adminCacheHandler))
+	http.HandleFunc("/admin/workers", requireAdmin(adminWorkersHandler))
+	http.HandleFunc("/admin/image", requireAdmin(adminImageHandler))
+	http.HandleFunc("/admin/image/refresh", requireAdmin(adminImageRefreshHandler))
+
+	// worker protocol (SANDBOX_BACKEND=remote)
+	if rs, ok := sb.(*remoteSandbox); ok {
+		go rs.reapLoop()
+		http.HandleFunc("/worker/register", requireWorker(rs.handleRegister))
+		http.HandleFunc("/worker/heartbeat", requireWorker(rs.handleHeartbeat))
+		http.HandleFunc("/worker/poll", requireWorker(rs.handlePoll))
+		http.HandleFunc("/worker/tasks/", requireWorker(rs.handleTask))
+	}
 	http.Handle("/adminLogin", rateLimitMiddleware(http.HandlerFunc(adminHandlerLogin), adminLimiter))
 
 	addr := ":" + cfg.Port
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// ResourceProfile groups every limit applied to one execution. Profiles are
+// named in Config.Profiles and selectProfile picks one per request.
+type ResourceProfile struct {
+	Name            string `json:"name"`
+	MemoryMB        int64  `json:"memory_mb"`
+	SwapMB          int64  `json:"swap_mb"` // swap allowed on top of MemoryMB; 0 disables swap
+	Pids            int64  `json:"pids"`
+	CPUQuotaPercent int    `json:"cpu_quota_percent"` // percent of one CPU; 0 means unlimited
+	CPUShares       uint64 `json:"cpu_shares"`
+	RlimitCPUSec    uint64 `json:"rlimit_cpu_seconds"`
+	RlimitFsizeMB   uint64 `json:"rlimit_fsize_mb"`
+	RlimitNofile    uint64 `json:"rlimit_nofile"`
+	RlimitNproc     uint64 `json:"rlimit_nproc"`
+	RlimitStackMB   uint64 `json:"rlimit_stack_mb"`
+	TmpfsMB         int64  `json:"tmpfs_mb"`
+	TimeoutSeconds  int    `json:"timeout_seconds"`
+	MaxCodeChars    int    `json:"max_code_chars"`
+	MaxOutputKB     int    `json:"max_output_kb"` // per stream (stdout, stderr)
+	// KillOnOutputLimit kills the run as soon as MaxOutputKB is exceeded
+	// instead of dropping the rest of the output until it exits.
+	KillOnOutputLimit bool `json:"kill_on_output_limit"`
+	// CompileTimeoutSeconds and CompileRlimitCPUSec limit the compile step
+	// on its own (0: only the limits above apply). The containerd and
+	// local backends run the compiler as a step of its own to enforce them.
+	CompileTimeoutSeconds int    `json:"compile_timeout_seconds"`
+	CompileRlimitCPUSec   uint64 `json:"compile_rlimit_cpu_seconds"`
+}
+
+// MemoryBytes is the cgroup memory limit.
+func (p *ResourceProfile) MemoryBytes() int64 { return p.MemoryMB << 20 }
+
+// MemorySwapBytes is the cgroup memory+swap limit (OCI semantics).
+func (p *ResourceProfile) MemorySwapBytes() int64 { return (p.MemoryMB + p.SwapMB) << 20 }
+
+// Timeout is the wall clock limit of a run.
+func (p *ResourceProfile) Timeout() time.Duration {
+	return time.Duration(p.TimeoutSeconds) * time.Second
+}
+
+// CompileTimeout is the wall clock limit of the compile step, 0 for none.
+func (p *ResourceProfile) CompileTimeout() time.Duration {
+	return time.Duration(p.CompileTimeoutSeconds) * time.Second
+}
+
+// OutputCap is the number of bytes kept per output stream.
+func (p *ResourceProfile) OutputCap() int { return p.MaxOutputKB << 10 }
+
+// CPUQuota returns the CFS quota for a 100ms period, nil for unlimited.
+func (p *ResourceProfile) CPUQuota() *int64 {
+	if p.CPUQuotaPercent <= 0 {
+		return nil
+	}
+	q := int64(p.CPUQuotaPercent) * 1000
+	return &q
+}
+
+// profileRlimit is one rlimit of the profile, named like the OCI spec.
+type profileRlimit struct {
+	Type  string
+	Value uint64
+}
+
+func (p *ResourceProfile) rlimits() []profileRlimit {
+	return []profileRlimit{
+		{"RLIMIT_CPU", p.RlimitCPUSec},
+		{"RLIMIT_FSIZE", p.RlimitFsizeMB << 20},
+		{"RLIMIT_NOFILE", p.RlimitNofile},
+		{"RLIMIT_NPROC", p.RlimitNproc},
+		{"RLIMIT_STACK", p.RlimitStackMB << 20},
+	}
+}
+
+// compileRlimits are the rlimits of the compiler process: RLIMIT_CPU is
+// CompileRlimitCPUSec when set.
+func (p *ResourceProfile) compileRlimits() []profileRlimit {
+	out := p.rlimits()
+	for i := range out {
+		if out[i].Type == "RLIMIT_CPU" && p.CompileRlimitCPUSec > 0 {
+			out[i].Value = p.CompileRlimitCPUSec
+		}
+	}
+	return out
+}
+
+// containerKey identifies the container-level limits (cgroup, tmpfs); two
+// profiles with the same key can share warm containers since rlimits are set
+// per exec'd process.
+func (p *ResourceProfile) containerKey() string {
+	return fmt.Sprintf("mem=%d swap=%d pids=%d cpu=%d shares=%d tmpfs=%d",
+		p.MemoryMB, p.SwapMB, p.Pids, p.CPUQuotaPercent, p.CPUShares, p.TmpfsMB)
+}
+
+func (p *ResourceProfile) validate() error {
+	switch {
+	case p.MemoryMB <= 0, p.Pids <= 0, p.TmpfsMB <= 0:
+		return fmt.Errorf("profile %q: memory_mb, pids and tmpfs_mb must be positive", p.Name)
+	case p.SwapMB < 0, p.CPUQuotaPercent < 0, p.CompileTimeoutSeconds < 0:
+		return fmt.Errorf("profile %q: swap_mb, cpu_quota_percent and compile_timeout_seconds cannot be negative", p.Name)
+	case p.TimeoutSeconds <= 0, p.MaxCodeChars <= 0, p.MaxOutputKB <= 0:
+		return fmt.Errorf("profile %q: timeout_seconds, max_code_chars and max_output_kb must be positive", p.Name)
+	case p.RlimitCPUSec == 0, p.RlimitNofile == 0, p.RlimitNproc == 0:
+		return fmt.Errorf("profile %q: rlimits must be positive", p.Name)
+	}
+	return nil
+}
+
+// builtinProfiles are the profiles available without SANDBOX_PROFILES_FILE.
+// "default" keeps the historical limits (128 MiB, 64 pids, 4s of CPU...).
+func builtinProfiles(c *Config) map[string]*ResourceProfile {
+	timeout := int(c.KataExecTimeout / time.Second)
+	if timeout <= 0 {
+		timeout = 10
+	}
+	def := &ResourceProfile{
+		Name:            "default",
+		MemoryMB:        128,
+		Pids:            64,
+		CPUQuotaPercent: c.SandboxCPUQuotaPercent,
+		CPUShares:       256,
+		RlimitCPUSec:    4,
+		RlimitFsizeMB:   8,
+		RlimitNofile:    256,
+		RlimitNproc:     64,
+		RlimitStackMB:   8,
+		TmpfsMB:         64,
+		TimeoutSeconds:  timeout,
+		MaxCodeChars:    5000,
+		MaxOutputKB:     64,
+	}
+	threads := *def
+	threads.Name = "threads-heavy"
+	threads.MemoryMB = 256
+	threads.Pids = 256
+	threads.RlimitNproc = 256
+	threads.RlimitCPUSec = 8 // CPU time adds up across threads
+
+	trusted := *def
+	trusted.Name = "trusted"
+	trusted.MemoryMB = 512
+	trusted.Pids = 256
+	trusted.RlimitNproc = 256
+	trusted.RlimitCPUSec = 30
+	trusted.RlimitFsizeMB = 64
+	trusted.TmpfsMB = 256
+	trusted.TimeoutSeconds = timeout * 3
+	trusted.MaxCodeChars = 50000
+	trusted.MaxOutputKB = 1024
+
+	return map[string]*ResourceProfile{def.Name: def, threads.Name: &threads, trusted.Name: &trusted}
+}
+
+// loadProfiles returns the built-in profiles overridden/extended by the JSON
+// file at path ({"name": {"memory_mb": 256, ...}, ...}). Fields left out of
+// a new profile are inherited from "default".
+func loadProfiles(c *Config, path string) (map[string]*ResourceProfile, error) {
+	profiles := builtinProfiles(c)
+	if path == "" {
+		return profiles, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read profiles file: %w", err)
+	}
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("parse profiles file: %w", err)
+	}
+	for name, body := range raw {
+		p := profiles[name]
+		if p == nil {
+			cp := *profiles["default"]
+			p = &cp
+		}
+		if err := json.Unmarshal(body, p); err != nil {
+			return nil, fmt.Errorf("profile %q: %w", name, err)
+		}
+		p.Name = name
+		profiles[name] = p
+	}
+	for _, p := range profiles {
+		if err := p.validate(); err != nil {
+			return nil, err
+		}
+	}
+	return profiles, nil
+}
+
+// profileCIDR assigns a profile to the clients of a network.
+type profileCIDR struct {
+	Net     *net.IPNet
+	Profile string
+}
+
+// parseProfileCIDRs parses "10.0.0.0/8=trusted,192.168.1.0/24=threads-heavy".
+func parseProfileCIDRs(v string) ([]profileCIDR, error) {
+	var out []profileCIDR
+	for _, part := range strings.Split(v, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		cidr, name, ok := strings.Cut(part, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid SANDBOX_PROFILE_CIDRS entry %q (want cidr=profile)", part)
+		}
+		_, ipnet, err := net.ParseCIDR(strings.TrimSpace(cidr))
+		if err != nil {
+			return nil, fmt.Errorf("invalid SANDBOX_PROFILE_CIDRS entry %q: %w", part, err)
+		}
+		out = append(out, profileCIDR{Net: ipnet, Profile: strings.TrimSpace(name)})
+	}
+	return out, nil
+}
+
+func profileNames(cidrs []profileCIDR) []string {
+	names := make([]string, 0, len(cidrs))
+	for _, pc := range cidrs {
+		names = append(names, pc.Profile)
+	}
+	return names
+}
+
+// defaultProfile is used when no Config is loaded (or it lacks "default").
+func defaultProfile() *ResourceProfile {
+	if appConfig != nil {
+		if p := appConfig.Profiles[appConfig.DefaultProfile]; p != nil {
+			return p
+		}
+	}
+	return builtinProfiles(&Config{KataExecTimeout: kataExecTimeout})["default"]
+}
+
+// parseTrustedProxies parses TRUSTED_PROXY_CIDRS: comma separated networks
+// or single addresses of the reverse proxies whose forwarded headers count.
+func parseTrustedProxies(v string) ([]*net.IPNet, error) {
+	var out []*net.IPNet
+	for _, part := range strings.Split(v, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		if !strings.Contains(part, "/") {
+			ip := net.ParseIP(part)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid TRUSTED_PROXY_CIDRS entry %q", part)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			out = append(out, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipnet, err := net.ParseCIDR(part)
+		if err != nil {
+			return nil, fmt.Errorf("invalid TRUSTED_PROXY_CIDRS entry %q: %w", part, err)
+		}
+		out = append(out, ipnet)
+	}
+	return out, nil
+}
+
+// selectProfile picks the profile for a request from the caller's identity:
+// admins get AdminProfile, clients in a SANDBOX_PROFILE_CIDRS network get
+// that tier, everyone else DefaultProfile. The network is matched against
+// verifiedClientIP: forwarded headers only count from TRUSTED_PROXY_CIDRS.
+func selectProfile(r *http.Request) *ResourceProfile {
+	if appConfig == nil {
+		return defaultProfile()
+	}
+	if isAdminRequest(r) {
+		if p := appConfig.Profiles[appConfig.AdminProfile]; p != nil {
+			return p
+		}
+	}
+	if ip := net.ParseIP(verifiedClientIP(r)); ip != nil {
+		for _, pc := range appConfig.ProfileCIDRs {
+			if pc.Net.Contains(ip) {
+				if p := appConfig.Profiles[pc.Profile]; p != nil {
+					return p
+				}
+			}
+		}
+	}
+	return defaultProfile()
+}
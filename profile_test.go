@@ -0,0 +1,174 @@
+package main
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// withConfig installs cfg as appConfig for the duration of the test.
+func withConfig(t *testing.T, cfg *Config) {
+	t.Helper()
+	prev := appConfig
+	appConfig = cfg
+	t.Cleanup(func() { appConfig = prev })
+}
+
+func TestParseProfileCIDRs(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    []string // "network=profile"
+		wantErr bool
+	}{
+		{in: ""},
+		{in: " , ,"},
+		{in: " 192.168.1.0/24 = trusted , 10.1.0.0/16=classroom", want: []string{"192.168.1.0/24=trusted", "10.1.0.0/16=classroom"}},
+		{in: "10.1.2.3/16=classroom", want: []string{"10.1.0.0/16=classroom"}},
+		{in: "2001:db8::/32=trusted", want: []string{"2001:db8::/32=trusted"}},
+		{in: "10.0.0.0/8", wantErr: true},
+		{in: "10.0.0.1=classroom", wantErr: true},
+		{in: "10.0.0.0/8=classroom,nope=trusted", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseProfileCIDRs(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Fatalf("parseProfileCIDRs(%q) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+		}
+		var names []string
+		for _, pc := range got {
+			names = append(names, pc.Net.String()+"="+pc.Profile)
+		}
+		if !reflect.DeepEqual(names, tt.want) {
+			t.Errorf("parseProfileCIDRs(%q) = %v, want %v", tt.in, names, tt.want)
+		}
+	}
+}
+
+func TestLoadProfiles(t *testing.T) {
+	tests := []struct {
+		name     string
+		file     string
+		profile  string
+		memoryMB int64
+		pids     int64
+		wantErr  bool
+	}{
+		{name: "no file", profile: "default", memoryMB: 128, pids: 64},
+		{name: "override a builtin", file: `{"default": {"memory_mb": 96}}`, profile: "default", memoryMB: 96, pids: 64},
+		{name: "new profiles inherit default", file: `{"classroom": {"pids": 16}}`, profile: "classroom", memoryMB: 128, pids: 16},
+		{name: "invalid limits", file: `{"classroom": {"memory_mb": 0}}`, wantErr: true},
+		{name: "not json", file: `memory_mb=1`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := ""
+			if tt.file != "" {
+				path = filepath.Join(t.TempDir(), "profiles.json")
+				if err := os.WriteFile(path, []byte(tt.file), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			profiles, err := loadProfiles(&Config{}, path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("loadProfiles error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			p := profiles[tt.profile]
+			if p == nil || p.Name != tt.profile || p.MemoryMB != tt.memoryMB || p.Pids != tt.pids {
+				t.Errorf("profile %q = %+v, want memory %d pids %d", tt.profile, p, tt.memoryMB, tt.pids)
+			}
+		})
+	}
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    []string
+		wantErr bool
+	}{
+		{in: ""},
+		{in: "10.0.0.1", want: []string{"10.0.0.1/32"}},
+		{in: "::1, 172.16.0.0/12", want: []string{"::1/128", "172.16.0.0/12"}},
+		{in: "proxy.local", wantErr: true},
+		{in: "10.0.0.0/40", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseTrustedProxies(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Fatalf("parseTrustedProxies(%q) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+		}
+		var nets []string
+		for _, n := range got {
+			nets = append(nets, n.String())
+		}
+		if !reflect.DeepEqual(nets, tt.want) {
+			t.Errorf("parseTrustedProxies(%q) = %v, want %v", tt.in, nets, tt.want)
+		}
+	}
+}
+
+func TestSelectProfile(t *testing.T) {
+	cidrs, err := parseProfileCIDRs("10.1.0.0/16=classroom,192.168.0.0/16=trusted")
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxies, err := parseTrustedProxies("127.0.0.1,10.9.0.0/16")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &Config{DefaultProfile: "default", AdminProfile: "trusted", ProfileCIDRs: cidrs, TrustedProxies: proxies}
+	cfg.Profiles = builtinProfiles(cfg)
+	cfg.Profiles["classroom"] = &ResourceProfile{Name: "classroom"}
+	withConfig(t, cfg)
+	prevSecret := jwtSecret
+	jwtSecret = []byte("0123456789abcdef0123")
+	t.Cleanup(func() { jwtSecret = prevSecret })
+	token, err := issueJWT("admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		remote  string
+		xff     string
+		realIP  string
+		token   string
+		profile string
+	}{
+		{name: "peer in a tier", remote: "10.1.2.3:5000", profile: "classroom"},
+		{name: "peer outside every tier", remote: "172.20.0.1:5000", profile: "default"},
+		{name: "spoofed xff from an untrusted peer", remote: "172.20.0.1:5000", xff: "192.168.1.1", profile: "default"},
+		{name: "spoofed x-real-ip from an untrusted peer", remote: "172.20.0.1:5000", realIP: "10.1.0.1", profile: "default"},
+		{name: "xff from a trusted proxy", remote: "127.0.0.1:5000", xff: "10.1.2.3", profile: "classroom"},
+		{name: "rightmost untrusted hop wins", remote: "127.0.0.1:5000", xff: "192.168.1.1, 10.1.2.3", profile: "classroom"},
+		{name: "trusted hops are skipped", remote: "127.0.0.1:5000", xff: "192.168.1.1, 10.9.0.5", profile: "trusted"},
+		{name: "malformed hop falls back to the peer", remote: "127.0.0.1:5000", xff: "10.1.2.3, garbage", profile: "default"},
+		{name: "x-real-ip from a trusted proxy", remote: "127.0.0.1:5000", realIP: "192.168.3.4", profile: "trusted"},
+		{name: "admin token", remote: "10.1.2.3:5000", token: token, profile: "trusted"},
+		{name: "bad token", remote: "10.1.2.3:5000", token: "nope", profile: "classroom"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/compile", nil)
+			r.RemoteAddr = tt.remote
+			if tt.xff != "" {
+				r.Header.Set("X-Forwarded-For", tt.xff)
+			}
+			if tt.realIP != "" {
+				r.Header.Set("X-Real-IP", tt.realIP)
+			}
+			if tt.token != "" {
+				r.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			if got := selectProfile(r); got.Name != tt.profile {
+				t.Errorf("selectProfile(%s, xff %q, real ip %q) = %q, want %q", tt.remote, tt.xff, tt.realIP, got.Name, tt.profile)
+			}
+		})
+	}
+}
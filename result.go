@@ -0,0 +1,646 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// ExecutionStatus is the overall outcome of a /compile request.
+type ExecutionStatus string
+
+const (
+	StatusOK            ExecutionStatus = "ok"
+	StatusCompileError  ExecutionStatus = "compile_error"
+	StatusRuntimeError  ExecutionStatus = "runtime_error"
+	StatusTimeout       ExecutionStatus = "timeout"
+	StatusInternalError ExecutionStatus = "internal_error"
+	// StatusSignaled: the program was killed by a signal (SIGSEGV, SIGABRT...).
+	StatusSignaled ExecutionStatus = "signaled"
+	// StatusCPULimit: RLIMIT_CPU fired (SIGXCPU, or SIGKILL at the hard limit).
+	StatusCPULimit ExecutionStatus = "cpu_limit"
+	// StatusMemoryLimit: the cgroup memory limit triggered the OOM killer.
+	StatusMemoryLimit ExecutionStatus = "memory_limit"
+	// StatusCanceled: the client went away and the run was killed.
+	StatusCanceled ExecutionStatus = "canceled"
+	// StatusOutputLimit: the output cap was hit and the profile kills on it.
+	StatusOutputLimit ExecutionStatus = "output_limit"
+)
+
+// Message is a short human-readable explanation of a non-ok status.
+func (s ExecutionStatus) Message() string {
+	switch s {
+	case StatusCompileError:
+		return "compilation failed"
+	case StatusRuntimeError:
+		return "program exited with a non-zero status"
+	case StatusTimeout:
+		return "time limit exceeded"
+	case StatusSignaled:
+		return "program was killed by a signal"
+	case StatusCPULimit:
+		return "CPU time limit exceeded"
+	case StatusMemoryLimit:
+		return "memory limit exceeded (killed by the OOM killer)"
+	case StatusCanceled:
+		return "execution canceled"
+	case StatusOutputLimit:
+		return "output limit exceeded"
+	case StatusInternalError:
+		return "internal error while running the sandbox"
+	}
+	return ""
+}
+
+// PhaseResult is what one step (compile or run) produced.
+type PhaseResult struct {
+	Stdout     string `json:"stdout"`
+	Stderr     string `json:"stderr"`
+	ExitCode   int    `json:"exit_code"`
+	Signal     string `json:"signal,omitempty"`
+	DurationMS int64  `json:"duration_ms"`
+}
+
+// ResourceUsage is what the sandbox cgroup accounted for one execution.
+// Peaks the kernel does not keep are sampled while the program runs.
+type ResourceUsage struct {
+	MemoryPeakBytes  uint64 `json:"memory_peak_bytes"`
+	CPUUserUS        uint64 `json:"cpu_user_us"`
+	CPUSystemUS      uint64 `json:"cpu_system_us"`
+	PidsPeak         uint64 `json:"pids_peak"`
+	ThrottledPeriods uint64 `json:"throttled_periods"`
+	OOMKills         uint64 `json:"oom_kills,omitempty"`
+}
+
+// merge keeps the highest value of every counter (all of them only grow).
+func (u *ResourceUsage) merge(o *ResourceUsage) {
+	if o == nil {
+		return
+	}
+	u.MemoryPeakBytes = max(u.MemoryPeakBytes, o.MemoryPeakBytes)
+	u.CPUUserUS = max(u.CPUUserUS, o.CPUUserUS)
+	u.CPUSystemUS = max(u.CPUSystemUS, o.CPUSystemUS)
+	u.PidsPeak = max(u.PidsPeak, o.PidsPeak)
+	u.ThrottledPeriods = max(u.ThrottledPeriods, o.ThrottledPeriods)
+	u.OOMKills = max(u.OOMKills, o.OOMKills)
+}
+
+// StreamStats tells how much of a stream was kept: each phase keeps up to
+// the profile's output cap, the rest is counted in BytesDropped.
+type StreamStats struct {
+	Bytes        int64 `json:"bytes"`
+	Truncated    bool  `json:"truncated"`
+	BytesDropped int64 `json:"bytes_dropped"`
+}
+
+// OutputStats is StreamStats for both streams of a run.
+type OutputStats struct {
+	Stdout StreamStats `json:"stdout"`
+	Stderr StreamStats `json:"stderr"`
+}
+
+// ExecutionResult replaces the "----exec-out----" text protocol: the compile
+// and run phases are reported separately with their own exit code and timing.
+type ExecutionResult struct {
+	Status      ExecutionStatus `json:"status"`
+	ContainerID string          `json:"container_id,omitempty"`
+	Profile     string          `json:"profile,omitempty"`
+	Compile     *PhaseResult    `json:"compile,omitempty"`
+	Run         *PhaseResult    `json:"run,omitempty"`
+	DurationMS  int64           `json:"duration_ms"`
+	Error       string          `json:"error,omitempty"`
+
+	// Toolchain is the compiler version used and ToolchainHash its content
+	// hash; ToolchainDeprecated flags a version admins retired.
+	Toolchain           string `json:"toolchain,omitempty"`
+	ToolchainHash       string `json:"toolchain_hash,omitempty"`
+	ToolchainDeprecated bool   `json:"toolchain_deprecated,omitempty"`
+	// CacheHit marks a result served from resultsCache: nothing ran, the
+	// phases are those of the original run, whose ContainerID is kept in
+	// CachedFrom (each hit gets an ID of its own).
+	CacheHit   bool   `json:"cache_hit,omitempty"`
+	CachedFrom string `json:"cached_from,omitempty"`
+	// BinaryCache is "hit" when ./out came from binariesCache instead of
+	// the compiler, "miss" when it was compiled (and offered to the cache).
+	BinaryCache string `json:"binary_cache,omitempty"`
+	// ImageDigest is the manifest digest of the sandbox base image (empty
+	// for backends that run no image).
+	ImageDigest string `json:"image_digest,omitempty"`
+
+	// ExitCode/Signal/OOMKilled describe how the sandbox process itself ended.
+	ExitCode  int    `json:"exit_code"`
+	Signal    string `json:"signal,omitempty"`
+	OOMKilled bool   `json:"oom_killed,omitempty"`
+	// Usage is nil when the backend cannot measure (fake).
+	Usage *ResourceUsage `json:"usage,omitempty"`
+	// Artifacts is set in artifacts mode when the compilation succeeded.
+	Artifacts *Artifacts `json:"artifacts,omitempty"`
+	// Diagnostics are parsed from the compiler output on compile errors
+	// and in check mode.
+	Diagnostics []Diagnostic `json:"diagnostics,omitempty"`
+	// Judge holds the per-case verdicts of a /judge submission.
+	Judge *JudgeResult `json:"judge,omitempty"`
+	// Output reports the bytes each stream produced and dropped.
+	Output *OutputStats `json:"output,omitempty"`
+}
+
+// Text renders the result in the legacy plain-text format
+// (compiler output, marker, program output, then [stderr]).
+func (r *ExecutionResult) Text() string {
+	if r == nil {
+		return ""
+	}
+	var out SandboxOutput
+	if r.Compile != nil {
+		out.Stdout += r.Compile.Stdout
+		out.Stderr += r.Compile.Stderr
+	}
+	if r.Run != nil {
+		out.Stdout += "----exec-out----\n" + r.Run.Stdout
+		out.Stderr += r.Run.Stderr
+	}
+	return formatOutput(out)
+}
+
+// Phase names used in the markers runSteps writes around each step.
+const (
+	phaseCompile = "compile"
+	phaseRun     = "run"
+	phaseDone    = "done"
+	// phaseArtifacts is the base64 archive printed on stderr in artifacts
+	// mode; it is kept apart and never forwarded as output.
+	phaseArtifacts = "artifacts"
+	// phaseBinary is the base64 ./out printed on stderr for the binary
+	// cache; like artifacts it is never forwarded.
+	phaseBinary = "binary"
+)
+
+// newPhaseMarker returns a per-run random token. The sandbox prints
+// "<token> compile-start", "<token> compile-end <rc>", ... on both streams.
+func newPhaseMarker() (string, error) {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("generate phase marker: %w", err)
+	}
+	return fmt.Sprintf("__phase_%x__", b), nil
+}
+
+// OutputChunk is a piece of output forwarded live to an outputListener.
+type OutputChunk struct {
+	Phase  string `json:"phase"`
+	Stream string `json:"stream"`
+	Data   string `json:"data"`
+	// Truncated is set on the last chunk of a stream that hit the output cap.
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+// outputListener is notified while the sandbox runs (see streamHandler).
+// Calls are serialized by the phaseCapture lock.
+type outputListener interface {
+	phaseStarted(phase string)
+	output(chunk OutputChunk)
+}
+
+// phaseCapture splits the sandbox stdout/stderr into compile and run phases
+// using the sandbox's marker lines, timestamping each marker as it arrives.
+type phaseCapture struct {
+	mu       sync.Mutex
+	token    []byte
+	stdout   *phaseStream
+	stderr   *phaseStream
+	listener outputListener
+	maxBytes int // per stream and phase, see ResourceProfile.OutputCap
+
+	// overflow is closed the first time a stream drops bytes when
+	// killOnOverflow is set, so the driver can kill the sandbox
+	killOnOverflow bool
+	overflow       chan struct{}
+	overflowed     bool
+
+	marks       map[string]time.Time
+	compileExit *int
+	runExit     *int
+
+	artifacts         bytes.Buffer
+	artifactsOverflow bool
+	binary            bytes.Buffer
+	binaryOverflow    bool
+	binaryExit        *int
+	// skipRun: check and judge modes have no run phase, a successful
+	// compile (plus the judge cases) is the whole run
+	skipRun bool
+	cases   map[int]*caseCapture
+}
+
+// caseCapture is what one judge test case printed (see judge.go).
+type caseCapture struct {
+	stdout, stderr string
+	cut            bool // output over the cap was dropped
+	exit           *int
+	started, ended time.Time
+}
+
+// newPhaseCapture returns a capture for marker keeping up to maxBytes per
+// stream; listener may be nil.
+func newPhaseCapture(marker string, listener outputListener, maxBytes int) *phaseCapture {
+	c := &phaseCapture{token: []byte(marker + " "), marks: make(map[string]time.Time), listener: listener, maxBytes: maxBytes, overflow: make(chan struct{})}
+	c.stdout = &phaseStream{capture: c, name: "stdout", phase: phaseCompile, bufs: map[string]*bytes.Buffer{}, cut: map[string]bool{}}
+	c.stderr = &phaseStream{capture: c, name: "stderr", phase: phaseCompile, bufs: map[string]*bytes.Buffer{}, cut: map[string]bool{}}
+	return c
+}
+
+// mark records a marker line; both streams carry it, the first one wins.
+func (c *phaseCapture) mark(line string) string {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return ""
+	}
+	event := fields[0]
+	if event == "case-start" || event == "case-end" {
+		return c.markCase(fields)
+	}
+	if event == "binary-start" || event == "compile-cached" {
+		// printed by the sandbox before ./out starts; later copies come from
+		// the program and must not poison the binary cache
+		if _, ran := c.marks["run-start"]; ran || c.cases != nil {
+			return ""
+		}
+	}
+	if _, seen := c.marks[event]; !seen {
+		c.marks[event] = time.Now()
+		if c.listener != nil {
+			switch event {
+			case "compile-start":
+				c.listener.phaseStarted(phaseCompile)
+			case "run-start":
+				c.listener.phaseStarted(phaseRun)
+			}
+		}
+		if len(fields) > 1 {
+			if rc, err := strconv.Atoi(fields[1]); err == nil {
+				switch event {
+				case "compile-end":
+					c.compileExit = &rc
+				case "run-end":
+					c.runExit = &rc
+				case "binary-end":
+					c.binaryExit = &rc
+				}
+			}
+		}
+	}
+	switch event {
+	case "compile-start":
+		return phaseCompile
+	case "run-start":
+		return phaseRun
+	case "artifacts-start":
+		return phaseArtifacts
+	case "binary-start":
+		return phaseBinary
+	case "compile-end", "run-end", "artifacts-end", "binary-end":
+		return phaseDone
+	}
+	return ""
+}
+
+// markCase handles "case-start <i>" and "case-end <i> <rc>"; the output in
+// between goes to phase "case-<i>".
+func (c *phaseCapture) markCase(fields []string) string {
+	if len(fields) < 2 {
+		return ""
+	}
+	i, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return ""
+	}
+	if c.cases == nil {
+		c.cases = make(map[int]*caseCapture)
+	}
+	cc := c.cases[i]
+	if cc == nil {
+		cc = &caseCapture{}
+		c.cases[i] = cc
+	}
+	if fields[0] == "case-start" {
+		if cc.started.IsZero() {
+			cc.started = time.Now()
+		}
+		return casePhase(i)
+	}
+	if cc.ended.IsZero() {
+		cc.ended = time.Now()
+		if len(fields) > 2 {
+			if rc, err := strconv.Atoi(fields[2]); err == nil {
+				cc.exit = &rc
+			}
+		}
+	}
+	return phaseDone
+}
+
+func casePhase(i int) string { return "case-" + strconv.Itoa(i) }
+
+// caseResult returns what case i printed; nil if it never started. Call it
+// after result(), once both streams are flushed.
+func (c *phaseCapture) caseResult(i int) *caseCapture {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cc := c.cases[i]
+	if cc == nil || cc.started.IsZero() {
+		return nil
+	}
+	out := *cc
+	out.stdout = c.stdout.text(casePhase(i))
+	out.stderr = c.stderr.text(casePhase(i))
+	out.cut = c.stdout.cut[casePhase(i)] || c.stderr.cut[casePhase(i)]
+	return &out
+}
+
+// artifactData returns the archive printed in artifacts mode ("" if none).
+func (c *phaseCapture) artifactData() (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.artifactsOverflow {
+		return "", fmt.Errorf("artifacts exceed %d bytes", maxArtifactBytes)
+	}
+	return c.artifacts.String(), nil
+}
+
+// binaryData returns the base64 ./out printed for the binary cache; ok is
+// false unless it was printed completely.
+func (c *phaseCapture) binaryData() (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.binaryExit == nil || *c.binaryExit != 0 || c.binaryOverflow {
+		return "", false
+	}
+	return c.binary.String(), true
+}
+
+// compiledFromCache reports whether the sandbox ran a cached binary.
+func (c *phaseCapture) compiledFromCache() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.marks["compile-cached"]
+	return ok
+}
+
+// phaseStream is the io.Writer handed to a backend for one stream.
+type phaseStream struct {
+	capture   *phaseCapture
+	name      string
+	phase     string
+	pending   []byte
+	bufs      map[string]*bytes.Buffer
+	forwarded int
+	truncated bool
+
+	// total counts every byte written, dropped the ones over the cap;
+	// cut marks the phases that lost output
+	total   int64
+	dropped int64
+	cut     map[string]bool
+}
+
+func (s *phaseStream) emit(p []byte) {
+	if len(p) == 0 {
+		return
+	}
+	if s.phase == phaseArtifacts {
+		c := s.capture
+		if c.artifacts.Len()+len(p) > maxArtifactBytes {
+			c.artifactsOverflow = true
+			return
+		}
+		c.artifacts.Write(p)
+		return
+	}
+	if s.phase == phaseBinary {
+		c := s.capture
+		if c.binary.Len()+len(p) > maxBinaryBytes {
+			c.binaryOverflow = true
+			return
+		}
+		c.binary.Write(p)
+		return
+	}
+	b := s.bufs[s.phase]
+	if b == nil {
+		b = &bytes.Buffer{}
+		s.bufs[s.phase] = b
+	}
+	s.total += int64(len(p))
+	s.forward(p)
+	if room := s.capture.maxBytes - b.Len(); len(p) > room {
+		b.Write(p[:max(room, 0)])
+		s.dropped += int64(len(p) - max(room, 0))
+		s.cut[s.phase] = true
+		s.capture.overflowOnce()
+		return
+	}
+	b.Write(p)
+}
+
+// overflowOnce signals the driver the first time output is dropped.
+func (c *phaseCapture) overflowOnce() {
+	if c.killOnOverflow && !c.overflowed {
+		c.overflowed = true
+		close(c.overflow)
+	}
+}
+
+func (s *phaseStream) stats() StreamStats {
+	return StreamStats{Bytes: s.total, Truncated: s.dropped > 0, BytesDropped: s.dropped}
+}
+
+// output returns the kept text of phases, marked when any of them was cut.
+func (s *phaseStream) output(phases ...string) string {
+	var b strings.Builder
+	cut := false
+	for _, ph := range phases {
+		b.WriteString(s.text(ph))
+		cut = cut || s.cut[ph]
+	}
+	if cut {
+		b.WriteString("...[truncated]")
+	}
+	return b.String()
+}
+
+// forward hands p to the listener until the output cap has been sent.
+func (s *phaseStream) forward(p []byte) {
+	l := s.capture.listener
+	if l == nil || s.truncated {
+		return
+	}
+	chunk := OutputChunk{Phase: s.phase, Stream: s.name}
+	if chunk.Phase == phaseDone {
+		// result() reports trailing output with the run phase too
+		chunk.Phase = phaseRun
+	}
+	if room := s.capture.maxBytes - s.forwarded; len(p) > room {
+		p = p[:room]
+		chunk.Truncated = true
+		s.truncated = true
+	}
+	s.forwarded += len(p)
+	chunk.Data = string(p)
+	l.output(chunk)
+}
+
+func (s *phaseStream) Write(p []byte) (int, error) {
+	c := s.capture
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s.pending = append(s.pending, p...)
+	for {
+		idx := bytes.Index(s.pending, c.token)
+		if idx < 0 {
+			// keep a tail that could be the start of a split token
+			keep := 0
+			for n := len(c.token) - 1; n > 0; n-- {
+				if len(s.pending) >= n && bytes.HasPrefix(c.token, s.pending[len(s.pending)-n:]) {
+					keep = n
+					break
+				}
+			}
+			s.emit(s.pending[:len(s.pending)-keep])
+			s.pending = append(s.pending[:0], s.pending[len(s.pending)-keep:]...)
+			return len(p), nil
+		}
+		nl := bytes.IndexByte(s.pending[idx:], '\n')
+		if nl < 0 {
+			// marker line not complete yet
+			s.emit(s.pending[:idx])
+			s.pending = append(s.pending[:0], s.pending[idx:]...)
+			return len(p), nil
+		}
+		s.emit(s.pending[:idx])
+		line := string(s.pending[idx+len(c.token) : idx+nl])
+		if next := c.mark(line); next != "" {
+			s.phase = next
+		}
+		s.pending = append(s.pending[:0], s.pending[idx+nl+1:]...)
+	}
+}
+
+func (s *phaseStream) flush() {
+	s.emit(s.pending)
+	s.pending = nil
+}
+
+func (s *phaseStream) text(phase string) string {
+	if b := s.bufs[phase]; b != nil {
+		return b.String()
+	}
+	return ""
+}
+
+// result builds the structured result once the sandbox process has exited.
+// exit is what the backend reported; runErr is the driver error (timeout...).
+func (c *phaseCapture) result(exitedAt time.Time, exit SandboxExit, runErr error) *ExecutionResult {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stdout.flush()
+	c.stderr.flush()
+	exitCode := exit.ExitCode
+	res := &ExecutionResult{ExitCode: exitCode, OOMKilled: exit.OOMKilled}
+	res.Output = &OutputStats{Stdout: c.stdout.stats(), Stderr: c.stderr.stats()}
+	if exit.Signal != 0 {
+		res.Signal = signalName(exit.Signal)
+	}
+	duration := func(start, end string) int64 {
+		st, ok := c.marks[start]
+		if !ok {
+			return 0
+		}
+		en, ok := c.marks[end]
+		if !ok {
+			en = exitedAt
+		}
+		return en.Sub(st).Milliseconds()
+	}
+
+	if _, ok := c.marks["compile-start"]; ok || c.stdout.text(phaseCompile) != "" || c.stderr.text(phaseCompile) != "" {
+		res.Compile = &PhaseResult{
+			Stdout:     c.stdout.output(phaseCompile),
+			Stderr:     c.stderr.output(phaseCompile),
+			ExitCode:   exitCode,
+			DurationMS: duration("compile-start", "compile-end"),
+		}
+		if c.compileExit != nil {
+			res.Compile.ExitCode = *c.compileExit
+		}
+	}
+	if _, ok := c.marks["run-start"]; ok {
+		res.Run = &PhaseResult{
+			Stdout:     c.stdout.output(phaseRun, phaseDone),
+			Stderr:     c.stderr.output(phaseRun, phaseDone),
+			ExitCode:   exitCode,
+			DurationMS: duration("run-start", "run-end"),
+		}
+		if c.runExit != nil {
+			res.Run.ExitCode = *c.runExit
+		}
+		// the shell reports a child killed by signal N as 128+N
+		if res.Run.ExitCode > 128 && res.Run.ExitCode < 128+65 {
+			res.Run.Signal = signalName(syscall.Signal(res.Run.ExitCode - 128))
+		} else if c.runExit == nil && exit.Signal != 0 {
+			// the whole sandbox was killed before its steps could report
+			res.Run.Signal = signalName(exit.Signal)
+		}
+	}
+
+	switch {
+	case errors.Is(runErr, ErrExecTimeout):
+		res.Status = StatusTimeout
+	case errors.Is(runErr, ErrExecCanceled):
+		res.Status = StatusCanceled
+	case errors.Is(runErr, ErrOutputLimit):
+		res.Status = StatusOutputLimit
+	case exit.OOMKilled:
+		res.Status = StatusMemoryLimit
+	case c.compileExit != nil && *c.compileExit != 0:
+		res.Status = StatusCompileError
+	case c.skipRun && c.compileExit != nil:
+		res.Status = StatusOK
+	case c.runExit != nil && *c.runExit == 0:
+		res.Status = StatusOK
+	case res.Run != nil && (res.Run.Signal == "SIGXCPU" || res.Run.Signal == "SIGKILL"):
+		// nothing else sends SIGKILL: timeouts and OOM kills are handled above
+		res.Status = StatusCPULimit
+	case res.Run != nil && res.Run.Signal != "":
+		res.Status = StatusSignaled
+	case c.runExit != nil:
+		res.Status = StatusRuntimeError
+	default:
+		res.Status = StatusInternalError
+	}
+	if runErr != nil {
+		res.Error = runErr.Error()
+	}
+	return res
+}
+
+// signalName returns e.g. "SIGSEGV" for syscall.SIGSEGV.
+func signalName(sig syscall.Signal) string {
+	names := map[syscall.Signal]string{
+		syscall.SIGHUP: "SIGHUP", syscall.SIGINT: "SIGINT", syscall.SIGQUIT: "SIGQUIT",
+		syscall.SIGILL: "SIGILL", syscall.SIGTRAP: "SIGTRAP", syscall.SIGABRT: "SIGABRT",
+		syscall.SIGBUS: "SIGBUS", syscall.SIGFPE: "SIGFPE", syscall.SIGKILL: "SIGKILL",
+		syscall.SIGSEGV: "SIGSEGV", syscall.SIGPIPE: "SIGPIPE", syscall.SIGALRM: "SIGALRM",
+		syscall.SIGTERM: "SIGTERM", syscall.SIGXCPU: "SIGXCPU", syscall.SIGXFSZ: "SIGXFSZ",
+		syscall.SIGSYS: "SIGSYS",
+	}
+	if n, ok := names[sig]; ok {
+		return n
+	}
+	return fmt.Sprintf("SIG%d", int(sig))
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// writeChunks writes s to w in pieces of n bytes (all at once if n <= 0).
+func writeChunks(w *phaseStream, s string, n int) {
+	if n <= 0 {
+		n = len(s)
+	}
+	for len(s) > 0 {
+		k := min(n, len(s))
+		w.Write([]byte(s[:k]))
+		s = s[k:]
+	}
+}
+
+// chunkRecorder is an outputListener keeping what it was sent.
+type chunkRecorder struct{ chunks []OutputChunk }
+
+func (r *chunkRecorder) phaseStarted(string)      {}
+func (r *chunkRecorder) output(chunk OutputChunk) { r.chunks = append(r.chunks, chunk) }
+
+func TestPhaseStreamWrite(t *testing.T) {
+	tests := []struct {
+		name       string
+		stdout     string
+		compileOut string
+		runOut     string
+		runRC      int
+	}{
+		{
+			name:       "phases",
+			stdout:     "early\n__m__ compile-start\ncc\n__m__ compile-end 0\n__m__ run-start\nhello\n__m__ run-end 3\n",
+			compileOut: "early\ncc\n", runOut: "hello\n", runRC: 3,
+		},
+		{
+			name:       "look-alike text is kept",
+			stdout:     "__m__ compile-start\n__m_ x __m__x\n__m__ compile-end 0\n__m__ run-start\n__m\n__m__ run-end 0\n",
+			compileOut: "__m_ x __m__x\n", runOut: "__m\n",
+		},
+		{
+			name:       "output after run-end is run output",
+			stdout:     "__m__ compile-start\n__m__ compile-end 0\n__m__ run-start\na\n__m__ run-end 0\nb",
+			compileOut: "", runOut: "a\nb",
+		},
+	}
+	for _, tt := range tests {
+		// every split of the markers across writes must parse the same
+		for _, n := range []int{0, 1, 2, 3, 7} {
+			c := newPhaseCapture("__m__", nil, 1<<20)
+			writeChunks(c.stdout, tt.stdout, n)
+			res := c.result(time.Now(), SandboxExit{}, nil)
+			if res.Compile == nil || res.Compile.Stdout != tt.compileOut {
+				t.Errorf("%s, %d byte writes: compile = %+v, want stdout %q", tt.name, n, res.Compile, tt.compileOut)
+			}
+			if res.Run == nil || res.Run.Stdout != tt.runOut || res.Run.ExitCode != tt.runRC {
+				t.Errorf("%s, %d byte writes: run = %+v, want stdout %q rc %d", tt.name, n, res.Run, tt.runOut, tt.runRC)
+			}
+		}
+	}
+}
+
+func TestPhaseStreamCaps(t *testing.T) {
+	tests := []struct {
+		name       string
+		maxBytes   int
+		stdout     string
+		stderr     string
+		runStdout  string
+		runStderr  string
+		stdoutDrop int64
+		stderrDrop int64
+	}{
+		{
+			name:     "under the cap",
+			maxBytes: 8, stdout: "12345678", stderr: "abc",
+			runStdout: "12345678", runStderr: "abc",
+		},
+		{
+			name:     "stdout over the cap",
+			maxBytes: 4, stdout: "hello world", stderr: "ab",
+			runStdout: "hell...[truncated]", runStderr: "ab", stdoutDrop: 7,
+		},
+		{
+			name:     "streams are capped separately",
+			maxBytes: 3, stdout: "abcd", stderr: "wxyz!",
+			runStdout: "abc...[truncated]", runStderr: "wxy...[truncated]", stdoutDrop: 1, stderrDrop: 2,
+		},
+	}
+	for _, tt := range tests {
+		for _, kill := range []bool{false, true} {
+			r := &chunkRecorder{}
+			c := newPhaseCapture("__m__", r, tt.maxBytes)
+			c.killOnOverflow = kill
+			writeChunks(c.stdout, "__m__ compile-start\n__m__ compile-end 0\n__m__ run-start\n"+tt.stdout, 2)
+			writeChunks(c.stderr, "__m__ compile-start\n__m__ compile-end 0\n__m__ run-start\n"+tt.stderr, 2)
+			res := c.result(time.Now(), SandboxExit{}, nil)
+
+			if res.Run.Stdout != tt.runStdout || res.Run.Stderr != tt.runStderr {
+				t.Errorf("%s: run stdout %q stderr %q, want %q and %q", tt.name, res.Run.Stdout, res.Run.Stderr, tt.runStdout, tt.runStderr)
+			}
+			if got := res.Output.Stdout; got.BytesDropped != tt.stdoutDrop || got.Truncated != (tt.stdoutDrop > 0) || got.Bytes != int64(len(tt.stdout)) {
+				t.Errorf("%s: stdout stats %+v, want %d of %d bytes dropped", tt.name, got, tt.stdoutDrop, len(tt.stdout))
+			}
+			if got := res.Output.Stderr; got.BytesDropped != tt.stderrDrop {
+				t.Errorf("%s: stderr stats %+v, want %d dropped", tt.name, got, tt.stderrDrop)
+			}
+			select {
+			case <-c.overflow:
+				if !kill || tt.stdoutDrop+tt.stderrDrop == 0 {
+					t.Errorf("%s: overflow signaled with killOnOverflow %v", tt.name, kill)
+				}
+			default:
+				if kill && tt.stdoutDrop+tt.stderrDrop > 0 {
+					t.Errorf("%s: overflow not signaled", tt.name)
+				}
+			}
+			sent := map[string]int{}
+			for _, ch := range r.chunks {
+				sent[ch.Stream] += len(ch.Data)
+			}
+			if sent["stdout"] > tt.maxBytes || sent["stderr"] > tt.maxBytes {
+				t.Errorf("%s: forwarded %v, cap %d per stream", tt.name, sent, tt.maxBytes)
+			}
+		}
+	}
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// resultCache remembers finished results of opt-in runs (cache=1) so that
+// identical submissions (the editor's examples) do not boot a sandbox. It is
+// an LRU bounded by entries and by the bytes of captured output; entries
+// expire after ttl.
+type resultCache struct {
+	mu         sync.Mutex
+	maxEntries int
+	maxBytes   int64
+	ttl        time.Duration
+	ll         *list.List // front is the most recently used
+	items      map[string]*list.Element
+	bytes      int64
+	hits       uint64
+	misses     uint64
+}
+
+type resultCacheEntry struct {
+	key      string
+	result   ExecutionResult
+	size     int64
+	storedAt time.Time
+}
+
+// ResultCacheStats is reported by GET /admin/cache.
+type ResultCacheStats struct {
+	Entries    int     `json:"entries"`
+	Bytes      int64   `json:"bytes"`
+	MaxEntries int     `json:"max_entries"`
+	MaxBytes   int64   `json:"max_bytes"`
+	TTLSeconds int     `json:"ttl_seconds"`
+	Hits       uint64  `json:"hits"`
+	Misses     uint64  `json:"misses"`
+	HitRate    float64 `json:"hit_rate"`
+}
+
+// resultsCache is built in main from the RESULT_CACHE_* settings; nil
+// disables caching.
+var resultsCache *resultCache
+
+func newResultCache(maxEntries int, maxBytes int64, ttl time.Duration) *resultCache {
+	if maxEntries <= 0 || maxBytes <= 0 || ttl <= 0 {
+		return nil
+	}
+	return &resultCache{maxEntries: maxEntries, maxBytes: maxBytes, ttl: ttl, ll: list.New(), items: make(map[string]*list.Element)}
+}
+
+// resultCacheKey hashes everything that decides the outcome of a run: the
+// code, its stdin, the exact toolchain and the profile's limits.
+func resultCacheKey(code, stdin string, toolchain *Toolchain, profile *ResourceProfile) string {
+	h := sha256.New()
+	limits, _ := json.Marshal(profile)
+	parts := []string{code, stdin, profile.Name, string(limits)}
+	if toolchain != nil {
+		parts = append(parts, toolchain.Version, toolchain.Hash)
+	}
+	for _, p := range parts {
+		// length prefixes keep ("ab","c") and ("a","bc") apart
+		_ = binary.Write(h, binary.BigEndian, uint64(len(p)))
+		h.Write([]byte(p))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// cacheableResult reports whether res may be served again: the program (or
+// the compiler) exited on its own, without timeout, signal or limit.
+func cacheableResult(res *ExecutionResult, err error) bool {
+	if err != nil || res == nil {
+		return false
+	}
+	switch res.Status {
+	case StatusOK, StatusRuntimeError, StatusCompileError:
+		return true
+	}
+	return false
+}
+
+func resultSize(res *ExecutionResult) int64 {
+	n := int64(len(res.Error))
+	for _, p := range []*PhaseResult{res.Compile, res.Run} {
+		if p != nil {
+			n += int64(len(p.Stdout) + len(p.Stderr))
+		}
+	}
+	return n + 512 // struct overhead, roughly
+}
+
+// copyResult copies res deep enough that callers may modify the copy.
+func copyResult(res *ExecutionResult) ExecutionResult {
+	cp := *res
+	if res.Compile != nil {
+		c := *res.Compile
+		cp.Compile = &c
+	}
+	if res.Run != nil {
+		r := *res.Run
+		cp.Run = &r
+	}
+	if res.Usage != nil {
+		u := *res.Usage
+		cp.Usage = &u
+	}
+	if res.Output != nil {
+		o := *res.Output
+		cp.Output = &o
+	}
+	return cp
+}
+
+// get returns a copy of the cached result for key, or nil.
+func (c *resultCache) get(key string) *ExecutionResult {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.items[key]
+	if !ok {
+		c.misses++
+		return nil
+	}
+	e := el.Value.(*resultCacheEntry)
+	if time.Since(e.storedAt) > c.ttl {
+		c.removeElement(el)
+		c.misses++
+		return nil
+	}
+	c.ll.MoveToFront(el)
+	c.hits++
+	res := copyResult(&e.result)
+	return &res
+}
+
+// put stores a copy of res, evicting the least recently used entries until
+// the bounds hold. Results larger than the whole cache are not stored.
+func (c *resultCache) put(key string, res *ExecutionResult) {
+	size := resultSize(res)
+	if size > c.maxBytes {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[key]; ok {
+		c.removeElement(el)
+	}
+	e := &resultCacheEntry{key: key, result: copyResult(res), size: size, storedAt: time.Now()}
+	c.items[key] = c.ll.PushFront(e)
+	c.bytes += size
+	for c.ll.Len() > c.maxEntries || c.bytes > c.maxBytes {
+		c.removeElement(c.ll.Back())
+	}
+}
+
+func (c *resultCache) removeElement(el *list.Element) {
+	e := el.Value.(*resultCacheEntry)
+	c.ll.Remove(el)
+	delete(c.items, e.key)
+	c.bytes -= e.size
+}
+
+// purge drops every entry and returns how many there were.
+func (c *resultCache) purge() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := c.ll.Len()
+	c.ll.Init()
+	c.items = make(map[string]*list.Element)
+	c.bytes = 0
+	return n
+}
+
+func (c *resultCache) stats() ResultCacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := ResultCacheStats{
+		Entries:    c.ll.Len(),
+		Bytes:      c.bytes,
+		MaxEntries: c.maxEntries,
+		MaxBytes:   c.maxBytes,
+		TTLSeconds: int(c.ttl.Seconds()),
+		Hits:       c.hits,
+		Misses:     c.misses,
+	}
+	if total := c.hits + c.misses; total > 0 {
+		s.HitRate = float64(c.hits) / float64(total)
+	}
+	return s
+}
+
+// replayResult feeds a cached result to a streaming listener as if it ran.
+func replayResult(res *ExecutionResult, listener outputListener) {
+	if listener == nil {
+		return
+	}
+	for _, ph := range []struct {
+		name string
+		res  *PhaseResult
+	}{{phaseCompile, res.Compile}, {phaseRun, res.Run}} {
+		if ph.res == nil {
+			continue
+		}
+		listener.phaseStarted(ph.name)
+		if ph.res.Stdout != "" {
+			listener.output(OutputChunk{Phase: ph.name, Stream: "stdout", Data: ph.res.Stdout})
+		}
+		if ph.res.Stderr != "" {
+			listener.output(OutputChunk{Phase: ph.name, Stream: "stderr", Data: ph.res.Stderr})
+		}
+	}
+}
+
+// adminCacheHandler is GET /admin/cache (stats) and DELETE /admin/cache
+// (purge every entry).
+func adminCacheHandler(w http.ResponseWriter, r *http.Request) {
+	if resultsCache == nil {
+		http.Error(w, "result cache disabled", http.StatusNotFound)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodDelete:
+		n := resultsCache.purge()
+		auditAdminAction(r, "result_cache.purge", "", fmt.Sprintf("%d entries", n), nil)
+		logger.Info("result cache purged", zap.Int("entries", n))
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(resultsCache.stats())
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sizedResult is a result whose resultSize is n+512.
+func sizedResult(n int) *ExecutionResult {
+	return &ExecutionResult{Status: StatusOK, Run: &PhaseResult{Stdout: strings.Repeat("x", n)}}
+}
+
+func TestResultCacheLRU(t *testing.T) {
+	tests := []struct {
+		name       string
+		maxEntries int
+		maxBytes   int64
+		ops        []string // "key" or "key:size" stores, "?key" looks up
+		want       []string // most recently used first
+	}{
+		{name: "evicts the oldest entry", maxEntries: 2, maxBytes: 1 << 20, ops: []string{"a", "b", "c"}, want: []string{"c", "b"}},
+		{name: "a hit refreshes the entry", maxEntries: 2, maxBytes: 1 << 20, ops: []string{"a", "b", "?a", "c"}, want: []string{"c", "a"}},
+		{name: "evicts by bytes", maxEntries: 10, maxBytes: 2000, ops: []string{"a", "b", "c:1000"}, want: []string{"c"}},
+		{name: "larger than the cache", maxEntries: 10, maxBytes: 1000, ops: []string{"a", "big:1000"}, want: []string{"a"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newResultCache(tt.maxEntries, tt.maxBytes, time.Hour)
+			for _, op := range tt.ops {
+				if key, ok := strings.CutPrefix(op, "?"); ok {
+					c.get(key)
+					continue
+				}
+				key, size, _ := strings.Cut(op, ":")
+				n, _ := strconv.Atoi(size)
+				c.put(key, sizedResult(n))
+			}
+			var got []string
+			for el := c.ll.Front(); el != nil; el = el.Next() {
+				got = append(got, el.Value.(*resultCacheEntry).key)
+			}
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("entries %v, want %v", got, tt.want)
+			}
+			if s := c.stats(); s.Bytes > tt.maxBytes {
+				t.Errorf("cache holds %d bytes, max %d", s.Bytes, tt.maxBytes)
+			}
+		})
+	}
+}
+
+func TestResultCacheTTL(t *testing.T) {
+	c := newResultCache(10, 1<<20, time.Minute)
+	c.put("fresh", sizedResult(1))
+	c.put("stale", sizedResult(1))
+	c.items["stale"].Value.(*resultCacheEntry).storedAt = time.Now().Add(-2 * time.Minute)
+
+	if c.get("fresh") == nil || c.get("stale") != nil {
+		t.Error("want the fresh entry served and the expired one dropped")
+	}
+	if s := c.stats(); s.Entries != 1 || s.Hits != 1 || s.Misses != 1 {
+		t.Errorf("stats %+v, want 1 entry, 1 hit and 1 miss", s)
+	}
+}
+
+func TestCacheableResult(t *testing.T) {
+	tests := []struct {
+		status ExecutionStatus
+		err    error
+		want   bool
+	}{
+		{status: StatusOK, want: true},
+		{status: StatusRuntimeError, want: true},
+		{status: StatusCompileError, want: true},
+		{status: StatusTimeout, err: ErrExecTimeout},
+		{status: StatusMemoryLimit},
+		{status: StatusOutputLimit},
+		{status: StatusInternalError},
+		{status: StatusOK, err: errors.New("collect failed")},
+	}
+	for _, tt := range tests {
+		if got := cacheableResult(&ExecutionResult{Status: tt.status}, tt.err); got != tt.want {
+			t.Errorf("cacheableResult(%s, %v) = %v, want %v", tt.status, tt.err, got, tt.want)
+		}
+	}
+}
+
+// TestResultCacheFake runs cached submissions end to end on the fake backend.
+func TestResultCacheFake(t *testing.T) {
+	useFakeSandbox(t, &fakeSandbox{active: map[string]*fakeExecution{}, Stdout: "hi\n", ExitCode: 1})
+	prev := resultsCache
+	resultsCache = newResultCache(10, 1<<20, time.Minute)
+	t.Cleanup(func() { resultsCache = prev })
+
+	tests := []struct {
+		name  string
+		code  string
+		stdin string
+		opts  execOptions
+		hit   bool
+	}{
+		{name: "first run", code: "main", opts: execOptions{Cache: true}},
+		{name: "same submission", code: "main", opts: execOptions{Cache: true}, hit: true},
+		{name: "other stdin", code: "main", stdin: "1\n", opts: execOptions{Cache: true}},
+		{name: "other code", code: "main2", opts: execOptions{Cache: true}},
+		{name: "not opted in", code: "main", opts: execOptions{}},
+		{name: "check only bypasses the cache", code: "main", opts: execOptions{Cache: true, CheckOnly: true}},
+	}
+	ran := map[string]string{} // code+stdin -> container that ran it
+	for _, tt := range tests {
+		res, err := execInKataStreaming(context.Background(), tt.code, tt.stdin, tt.opts, nil)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if res.CacheHit != tt.hit {
+			t.Errorf("%s: cache_hit %v, want %v", tt.name, res.CacheHit, tt.hit)
+		}
+		key := tt.code + "\x00" + tt.stdin
+		switch {
+		case tt.hit && (res.CachedFrom != ran[key] || !strings.HasPrefix(res.ContainerID, "cache-hit-")):
+			t.Errorf("%s: container %q cached_from %q, want a fresh id and %q", tt.name, res.ContainerID, res.CachedFrom, ran[key])
+		case !tt.hit && res.CachedFrom != "":
+			t.Errorf("%s: cached_from %q on a run", tt.name, res.CachedFrom)
+		case !tt.hit && ran[key] == "":
+			ran[key] = res.ContainerID
+		}
+		if res.Status != StatusRuntimeError && !tt.opts.CheckOnly {
+			t.Errorf("%s: status %s, want the run's runtime_error", tt.name, res.Status)
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// SandboxRequest describes a single execution submitted to a sandbox backend.
+type SandboxRequest struct {
+	Code string
+	// Stdin feeds ./out only (the compiler reads /dev/null); nil means no input.
+	Stdin io.Reader
+	// Stdout/Stderr receive the sandbox output as it is produced.
+	Stdout io.Writer
+	Stderr io.Writer
+	// PhaseMarker prefixes the phase lines printed by the sandbox (see newPhaseMarker).
+	PhaseMarker string
+	// Profile holds the limits of this run; nil means defaultProfile().
+	Profile *ResourceProfile
+	// Artifacts makes the sandbox print the files produced by the compiler
+	// (see phaseArtifacts) before running ./out.
+	Artifacts bool
+	// CheckOnly stops after the compile phase; ./out is never run.
+	CheckOnly bool
+	// CaseTimeouts switches to judge mode: Stdin is a tar of the case
+	// inputs ("0", "1", ...) and ./out runs once per case, killed after
+	// CaseTimeouts[i] seconds.
+	CaseTimeouts []int
+	// Toolchain is the registry entry to compile with; nil uses the
+	// lang root itself (legacy single-toolchain layout).
+	Toolchain *Toolchain
+	// CachedBinary names a file of the binary cache to run instead of
+	// compiling (see binaryCache); the compiler still runs if it is gone.
+	CachedBinary string
+	// ReturnBinary makes the sandbox print ./out as base64 on stderr (see
+	// phaseBinary) after a successful compile, before anything runs.
+	ReturnBinary bool
+	// Timeout is the wall clock budget of the request. Backends that run
+	// one process per step stop the compile and run steps when it is used
+	// up (see sandboxStepTimer); 0 leaves it to the caller.
+	Timeout time.Duration
+}
+
+// profile returns the request's profile, falling back to the default one.
+func (r *SandboxRequest) profile() *ResourceProfile {
+	if r.Profile != nil {
+		return r.Profile
+	}
+	return defaultProfile()
+}
+
+// SandboxExit is delivered once the sandboxed process has exited.
+type SandboxExit struct {
+	ExitCode int
+	// Signal is set when the top-level process was killed by a signal.
+	Signal syscall.Signal
+	// OOMKilled reports that the cgroup memory limit triggered the OOM killer.
+	OOMKilled bool
+	// Err is set when the backend lost track of the process (a remote
+	// worker died, see ErrWorkerLost); it becomes the result's error.
+	Err error `json:"-"`
+}
+
+// SandboxOutput holds stdout/stderr text (see formatOutput).
+type SandboxOutput struct {
+	Stdout string
+	Stderr string
+}
+
+// Sandbox is a backend able to run untrusted code in isolation.
+// execInKata drives it: Prepare -> Run -> (Kill on timeout) -> Collect.
+// Output is written to the request's Stdout/Stderr while the process runs.
+type Sandbox interface {
+	// Name identifies the backend in logs and stats.
+	Name() string
+	// Prepare allocates everything needed to run req but does not start it.
+	Prepare(ctx context.Context, req *SandboxRequest) (SandboxExecution, error)
+	// Stats lists the executions currently known to the backend.
+	Stats(ctx context.Context) ([]ContainerStats, error)
+}
+
+// SandboxExecution is one prepared run inside a Sandbox.
+type SandboxExecution interface {
+	// ID is the unique sandbox/container identifier stored in the history.
+	ID() string
+	// Run starts the process; the channel receives its exit exactly once.
+	Run(ctx context.Context) (<-chan SandboxExit, error)
+	// Kill signals every process of the execution.
+	Kill(ctx context.Context, sig syscall.Signal) error
+	// Collect reads the final resource usage (nil if unknown) and releases
+	// all resources once the process has exited.
+	// It must be called once for every successful Prepare.
+	Collect(ctx context.Context) (*ResourceUsage, error)
+}
+
+// sandboxPoolReporter is implemented by backends that keep a warm pool.
+type sandboxPoolReporter interface {
+	PoolStats() *WarmPoolStats
+}
+
+// sandboxImageReporter is implemented by executions that run in a container
+// image; the digest is recorded with the result.
+type sandboxImageReporter interface {
+	ImageDigest() string
+}
+
+// sandboxStepTimer is implemented by executions that enforce
+// SandboxRequest.Timeout on their own steps, so that the error names the
+// step that ran out; the caller's timer is then only a backstop.
+type sandboxStepTimer interface {
+	EnforcesTimeout() bool
+}
+
+// activeSandbox is the backend selected through Config.SandboxBackend.
+var activeSandbox Sandbox
+
+// newSandbox builds the backend named in the config.
+func newSandbox(cfg *Config) (Sandbox, error) {
+	backend := "containerd"
+	if cfg != nil && cfg.SandboxBackend != "" {
+		backend = strings.ToLower(cfg.SandboxBackend)
+	}
+	switch backend {
+	case "containerd", "kata":
+		return &containerdSandbox{}, nil
+	case "local":
+		return &localSandbox{}, nil
+	case "fake":
+		return newFakeSandbox(), nil
+	case "remote":
+		return newRemoteSandbox(), nil
+	default:
+		return nil, fmt.Errorf("unknown sandbox backend %q (want containerd, local, fake or remote)", backend)
+	}
+}
+
+func getSandbox() (Sandbox, error) {
+	if activeSandbox != nil {
+		return activeSandbox, nil
+	}
+	sb, err := newSandbox(appConfig)
+	if err != nil {
+		return nil, err
+	}
+	activeSandbox = sb
+	return sb, nil
+}
+
+// ensureRoot re-executes the binary through sudo when not running as root.
+// Backends that touch containerd or cgroups call it from Prepare.
+func ensureRoot() error {
+	if os.Geteuid() == 0 {
+		return nil
+	}
+	sudoPath, lookErr := exec.LookPath("sudo")
+	if lookErr != nil {
+		return fmt.Errorf("need root or sudo not found: %w", lookErr)
+	}
+	args := append([]string{"-E", os.Args[0]}, os.Args[1:]...)
+	cmd := exec.Command(sudoPath, args...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if runErr := cmd.Run(); runErr != nil {
+		return fmt.Errorf("sudo elevation failed: %w", runErr)
+	}
+	os.Exit(0)
+	return nil
+}
+
+// formatOutput combines stdout and stderr; limit size to avoid OOM.
+func formatOutput(out SandboxOutput) string {
+	const max = 64 * 1024
+	stdout := out.Stdout
+	stderr := out.Stderr
+	if len(stdout) > max {
+		stdout = stdout[:max] + "...[truncated]"
+	}
+	if len(stderr) > 0 {
+		if len(stderr) > max {
+			stderr = stderr[:max] + "...[truncated]"
+		}
+		stdout = stdout + "\n[stderr]\n" + stderr
+	}
+	return stdout
+}
+
+// resolveLangDir returns the configured toolchain directory (LANG_DIR or ./lang).
+func resolveLangDir() (string, error) {
+	langDir := ""
+	if appConfig != nil && appConfig.LangDir != "" {
+		langDir = appConfig.LangDir
+	}
+	if langDir == "" {
+		if v := os.Getenv("LANG_DIR"); v != "" {
+			langDir = v
+		}
+	}
+	if langDir == "" {
+		wd, err := os.Getwd()
+		if err != nil {
+			return "", fmt.Errorf("getwd: %w", err)
+		}
+		langDir = filepath.Join(wd, "lang")
+	}
+	return langDir, nil
+}
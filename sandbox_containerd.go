@@ -0,0 +1,723 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"syscall"
+	"time"
+
+	cgroup1stats "github.com/containerd/cgroups/v3/cgroup1/stats"
+	cgroup2stats "github.com/containerd/cgroups/v3/cgroup2/stats"
+	"github.com/containerd/containerd"
+	apievents "github.com/containerd/containerd/api/events"
+	"github.com/containerd/containerd/cio"
+	"github.com/containerd/containerd/containers"
+	seccomp "github.com/containerd/containerd/contrib/seccomp"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/containerd/oci"
+	"github.com/containerd/typeurl/v2"
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+	"go.uber.org/zap"
+)
+
+// Global cached containerd client and base image
+var (
+	ctrdClient *containerd.Client
+	clientOnce sync.Once
+	clientErr  error
+
+	baseImage   containerd.Image
+	imagePulled bool
+	imageMu     sync.Mutex
+	// imageUsers counts the live containers of each base image digest;
+	// retiredImages are the digests replaced by a refresh, deleted once
+	// their last container is gone (see swapBaseImage)
+	imageUsers    = map[string]int{}
+	retiredImages = map[string]bool{}
+)
+
+func getContainerdClient() (*containerd.Client, error) {
+	clientOnce.Do(func() {
+		ctrdClient, clientErr = containerd.New("/run/containerd/containerd.sock")
+	})
+	return ctrdClient, clientErr
+}
+
+func ensureBaseImage(ctx context.Context, ref string) (containerd.Image, bool, error) {
+	imageMu.Lock()
+	defer imageMu.Unlock()
+	return ensureBaseImageLocked(ctx, ref)
+}
+
+func ensureBaseImageLocked(ctx context.Context, ref string) (containerd.Image, bool, error) {
+	if imagePulled {
+		return baseImage, true, nil
+	}
+	c, err := getContainerdClient()
+	if err != nil {
+		return nil, false, err
+	}
+	img, err := obtainBaseImage(ctx, c, ref)
+	if err != nil {
+		return nil, false, err
+	}
+	baseImage = img
+	imagePulled = true
+	return baseImage, false, nil
+}
+
+// acquireBaseImage is ensureBaseImage for a container about to be created
+// from the image: it stays in use until releaseBaseImage.
+func acquireBaseImage(ctx context.Context, ref string) (containerd.Image, bool, error) {
+	imageMu.Lock()
+	defer imageMu.Unlock()
+	img, cached, err := ensureBaseImageLocked(ctx, ref)
+	if err == nil {
+		imageUsers[img.Target().Digest.String()]++
+	}
+	return img, cached, err
+}
+
+// releaseBaseImage drops a container of the image digest; the last one of
+// a retired image garbage-collects it.
+func releaseBaseImage(digest string) {
+	if digest == "" {
+		// built from scratch
+		return
+	}
+	imageMu.Lock()
+	defer imageMu.Unlock()
+	if imageUsers[digest]--; imageUsers[digest] > 0 {
+		return
+	}
+	delete(imageUsers, digest)
+	if retiredImages[digest] {
+		delete(retiredImages, digest)
+		go gcBaseImage(digest)
+	}
+}
+
+// currentImageDigest is the digest new containers are created from ("" before
+// the first ensureBaseImage).
+func currentImageDigest() string {
+	imageMu.Lock()
+	defer imageMu.Unlock()
+	if !imagePulled {
+		return ""
+	}
+	return baseImage.Target().Digest.String()
+}
+
+// sandboxSpecOpt returns a SpecOpt applying the profile's limits and rlimits.
+func sandboxSpecOpt(profile *ResourceProfile) oci.SpecOpts {
+	return func(ctx context.Context, client oci.Client, c *containers.Container, s *specs.Spec) error {
+		// mounts already added by caller; enforce limits & rlimits if not present
+		if s.Linux == nil {
+			s.Linux = &specs.Linux{}
+		}
+		shares := profile.CPUShares
+		period := uint64(100000)
+		memory, swap := profile.MemoryBytes(), profile.MemorySwapBytes()
+		s.Linux.Resources = &specs.LinuxResources{
+			// nil quota means unlimited (cpu_quota_percent 0)
+			CPU:    &specs.LinuxCPU{Shares: &shares, Quota: profile.CPUQuota(), Period: &period},
+			Memory: &specs.LinuxMemory{Limit: &memory, Swap: &swap},
+			Pids:   &specs.LinuxPids{Limit: profile.Pids},
+		}
+		if s.Process == nil {
+			s.Process = &specs.Process{}
+		}
+		s.Process.Rlimits = ociRlimits(profile.rlimits())
+		return nil
+	}
+}
+
+func ociRlimits(rlimits []profileRlimit) []specs.POSIXRlimit {
+	var out []specs.POSIXRlimit
+	for _, rl := range rlimits {
+		out = append(out, specs.POSIXRlimit{Type: rl.Type, Hard: rl.Value, Soft: rl.Value})
+	}
+	return out
+}
+
+// containerdSandbox runs each execution in a fresh containerd container,
+// by default under the Kata runtime (one lightweight VM per run).
+// Containers boot with the idle sandbox-init; every step of the execution is
+// started with task.Exec so that booted containers can wait in a warm pool.
+type containerdSandbox struct {
+	pool *warmPool
+	// poolKey is the containerKey of the profile warm containers are booted
+	// with; requests for other container limits always start cold.
+	poolKey string
+	// refreshing is set once refreshLoop runs
+	refreshing bool
+}
+
+func (s *containerdSandbox) Name() string { return "containerd" }
+
+func (s *containerdSandbox) runtimeName() string {
+	// Allow runtime override from config
+	if appConfig != nil && appConfig.SandboxRuntime != "" {
+		return appConfig.SandboxRuntime
+	}
+	return "io.containerd.kata.v2"
+}
+
+func (s *containerdSandbox) baseRef() string {
+	return baseImageRef(appConfig)
+}
+
+// Preload pulls the base image once so the first user request is fast,
+// then starts the warm pool and the image refresher (if configured).
+func (s *containerdSandbox) Preload(ctx context.Context) error {
+	if _, _, err := sandboxInitBinary(); err != nil {
+		return err
+	}
+	ctx = namespaces.WithNamespace(ctx, "compiler")
+	if usesBaseImage(appConfig) {
+		if appConfig != nil {
+			if err := loadBaseImageState(appConfig); err != nil {
+				return err
+			}
+		}
+		ref := s.baseRef()
+		if img, cached, err := ensureBaseImage(ctx, ref); err != nil {
+			return err
+		} else if logger != nil {
+			logger.Info("base image ready", zap.String("image", ref), zap.String("digest", img.Target().Digest.String()), zap.Bool("cached", cached), zap.Bool("approved_at_runtime", approvedImage.Load() != nil))
+		}
+		gcStaleBaseImages(ctx)
+	} else if logger != nil {
+		logger.Info("sandbox images built from scratch (no base image)")
+	}
+	gcStaleSandboxImages(ctx)
+	size := 0
+	if appConfig != nil {
+		size = appConfig.SandboxPoolSize
+	}
+	if size > 0 && s.pool == nil {
+		profile := defaultProfile()
+		s.poolKey = profile.containerKey()
+		// booted for the default toolchain of the moment
+		s.pool = newWarmPool(size, func(ctx context.Context) (*warmContainer, error) {
+			return s.createWarm(ctx, profile, nil)
+		})
+		s.pool.start()
+		if logger != nil {
+			logger.Info("sandbox warm pool started", zap.Int("size", size))
+		}
+	}
+	if appConfig != nil && appConfig.SandboxImageRefreshInterval > 0 && usesBaseImage(appConfig) && !s.refreshing {
+		s.refreshing = true
+		go s.refreshLoop(appConfig.SandboxImageRefreshInterval)
+		if logger != nil {
+			logger.Info("base image refresher started", zap.Duration("interval", appConfig.SandboxImageRefreshInterval), zap.Bool("auto_approve", appConfig.SandboxImageRefreshAuto))
+		}
+	}
+	return nil
+}
+
+// PoolStats reports the warm pool state (nil when pooling is disabled).
+func (s *containerdSandbox) PoolStats() *WarmPoolStats {
+	if s.pool == nil {
+		return nil
+	}
+	st := s.pool.stats()
+	return &st
+}
+
+func (s *containerdSandbox) Prepare(ctx context.Context, req *SandboxRequest) (SandboxExecution, error) {
+	phaseStart := time.Now()
+	if err := validateSandboxRequest(req); err != nil {
+		return nil, err
+	}
+	var cases [][]byte
+	if len(req.CaseTimeouts) > 0 {
+		// each case is fed to its own ./out process (see runSteps)
+		var err error
+		if cases, err = judgeCaseInputs(req.Stdin, len(req.CaseTimeouts)); err != nil {
+			return nil, fmt.Errorf("read test case inputs: %w", err)
+		}
+	}
+	if err := ensureRoot(); err != nil {
+		return nil, err
+	}
+
+	profile := req.profile()
+	tc, _, err := sandboxToolchain(req.Toolchain)
+	if err != nil {
+		return nil, err
+	}
+	var warm *warmContainer
+	hit := false
+	if profile.containerKey() == s.poolKey {
+		warm, hit = s.pool.take()
+		// booted before a base image refresh, or for the previous default
+		// toolchain: never run on the wrong image
+		if hit && (warm.imageDigest != currentImageDigest() || warm.toolchainHash != tc.Hash) {
+			go warm.destroy(context.Background())
+			warm, hit = nil, false
+		}
+	}
+	if hit {
+		logger.Debug("sandbox container ready", zap.Bool("warm", true), zap.Duration("took", time.Since(phaseStart)))
+	} else {
+		if warm, err = s.createWarm(ctx, profile, tc); err != nil {
+			return nil, err
+		}
+		logger.Debug("sandbox container ready", zap.Bool("warm", false), zap.Duration("took", time.Since(phaseStart)))
+	}
+	e := &containerdExecution{warm: warm}
+	e.sandboxSteps = sandboxSteps{
+		req:            req,
+		cases:          cases,
+		rlimits:        ociRlimits(profile.rlimits()),
+		compileRlimits: ociRlimits(profile.compileRlimits()),
+		compileTimeout: profile.CompileTimeout(),
+		initPath:       sandboxInitPath,
+		workDir:        sandboxWorkDir,
+		langDir:        "/lang",
+		start:          e.execStep,
+	}
+	return e, nil
+}
+
+// createWarm creates a container from the sandbox image of tc (nil: the
+// default toolchain) and starts its idle init process, i.e. it pays the whole
+// cold-start cost (snapshot, spec, Kata VM boot) up front.
+func (s *containerdSandbox) createWarm(ctx context.Context, profile *ResourceProfile, tc *Toolchain) (*warmContainer, error) {
+	phaseStart := time.Now()
+	// connect (or reuse) containerd client
+	client, err := getContainerdClient()
+	if err != nil {
+		return nil, fmt.Errorf("containerd client: %w", err)
+	}
+	fmt.Printf("[timing] get/reuse containerd client: %v\n", time.Since(phaseStart))
+	phaseStart = time.Now()
+
+	// namespace context
+	ctx = namespaces.WithNamespace(ctx, "compiler")
+	// ensure base image once using configured base image; the container
+	// holds it until destroy
+	var img containerd.Image
+	digest := ""
+	if usesBaseImage(appConfig) {
+		ensureStart := phaseStart
+		base, cached, pullErr := acquireBaseImage(ctx, s.baseRef())
+		if pullErr != nil {
+			return nil, fmt.Errorf("ensure image: %w", pullErr)
+		}
+		img, digest = base, base.Target().Digest.String()
+		if cached {
+			fmt.Printf("[timing] ensure image (cached): %v\n", time.Since(ensureStart))
+		} else {
+			fmt.Printf("[timing] ensure image (pulled): %v\n", time.Since(ensureStart))
+		}
+	}
+	held := true
+	defer func() {
+		// once wrapped in a warmContainer, destroy releases the image
+		if held {
+			releaseBaseImage(digest)
+		}
+	}()
+	phaseStart = time.Now()
+
+	// toolchain image on top of the base image (built once per toolchain)
+	tc, tcDir, err := sandboxToolchain(tc)
+	if err != nil {
+		return nil, err
+	}
+	img, err = sandboxImageFor(ctx, client, img, tc, tcDir)
+	if err != nil {
+		return nil, fmt.Errorf("sandbox image %s: %w", tc.Version, err)
+	}
+	fmt.Printf("[timing] sandbox image: %v\n", time.Since(phaseStart))
+	phaseStart = time.Now()
+
+	// the only writable place: the work dir, the source and ./out live here
+	mounts := []specs.Mount{
+		{Destination: "/tmp", Type: "tmpfs", Source: "tmpfs", Options: []string{"rw", "nosuid", "nodev", "mode=1777", fmt.Sprintf("size=%dm", profile.TmpfsMB)}},
+	}
+
+	uniqueID := fmt.Sprintf("kata-sandbox-%d", time.Now().UnixNano())
+
+	specOpts := []oci.SpecOpts{
+		oci.WithImageConfig(img),
+		// idle init: keeps the VM alive until the steps are exec'd into it
+		oci.WithProcessArgs(sandboxInitPath, "idle"),
+		oci.WithEnv([]string{
+			"PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin",
+			"HOME=/home/sandbox",
+			"LANG=C",
+			"LC_ALL=C",
+		}),
+		oci.WithHostname("sandbox"),
+		oci.WithMounts(mounts),
+		oci.WithLinuxNamespace(specs.LinuxNamespace{Type: specs.NetworkNamespace, Path: ""}),
+		oci.WithNoNewPrivileges,
+		oci.WithCapabilities([]string{}),
+		oci.WithMaskedPaths([]string{"/proc/kcore",
+			"/proc/timer_list",
+			"/proc/sched_debug",
+			"/proc/scsi",
+			"/sys/firmware",
+			"/sys/fs/selinux",
+			"/proc/net",          // hides network sockets and info
+			"/proc/sys/net",      // hides sysctl network controls
+			"/sys/class/net",     // hides network device entries (e.g. lo)
+			"/run/systemd/netif", // optional: hide other network state
+		}),
+		oci.WithReadonlyPaths([]string{"/proc/asound",
+			"/proc/bus",
+			"/proc/fs",
+			"/proc/irq",
+			"/proc/sys",
+			"/proc/sysrq-trigger",
+			"/etc/resolv.conf", // prevent modifying DNS (if you accidentally mount it)
+		}),
+		sandboxSpecOpt(profile),
+		seccomp.WithDefaultProfile(),
+		oci.WithRootFSReadonly(),
+		oci.WithUser("1000:1000"),
+	}
+
+	container, err := client.NewContainer(
+		ctx,
+		uniqueID,
+		containerd.WithNewSnapshot(uniqueID+"-snap", img),
+		containerd.WithNewSpec(specOpts...),
+		containerd.WithRuntime(s.runtimeName(), nil),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("create container: %w", err)
+	}
+	fmt.Printf("[timing] create container: %v\n", time.Since(phaseStart))
+	phaseStart = time.Now()
+
+	w := &warmContainer{id: uniqueID, container: container, createdAt: time.Now(), imageDigest: digest, sandboxDigest: img.Target().Digest.String(), toolchainHash: tc.Hash}
+	held = false
+	task, err := container.NewTask(ctx, cio.NullIO)
+	if err != nil {
+		w.destroy(ctx)
+		return nil, fmt.Errorf("new task: %w", err)
+	}
+	w.task = task
+	if err := task.Start(ctx); err != nil {
+		w.destroy(ctx)
+		return nil, fmt.Errorf("start task: %w", err)
+	}
+	fmt.Printf("[timing] start task: %v\n", time.Since(phaseStart))
+	return w, nil
+}
+
+func (s *containerdSandbox) Stats(ctx context.Context) ([]ContainerStats, error) {
+	// Conectar ao containerd
+	client, err := getContainerdClient()
+	if err != nil {
+		return nil, fmt.Errorf("containerd client: %w", err)
+	}
+
+	ctx = namespaces.WithNamespace(ctx, "compiler")
+
+	// Listar todos os containers
+	containers, err := client.Containers(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("list containers: %w", err)
+	}
+
+	var stats []ContainerStats
+	for _, container := range containers {
+		containerStat, err := s.containerStats(ctx, container)
+		if err != nil {
+			// Log o erro mas continue com outros containers
+			logger.Warn("failed to get stats for container",
+				zap.String("container_id", container.ID()),
+				zap.Error(err))
+			continue
+		}
+		stats = append(stats, containerStat)
+	}
+
+	return stats, nil
+}
+
+func (s *containerdSandbox) containerStats(ctx context.Context, container containerd.Container) (ContainerStats, error) {
+	// Obter task do container
+	task, err := container.Task(ctx, nil)
+	if err != nil {
+		// Container pode não ter task ativa
+		return ContainerStats{
+			ContainerID: container.ID(),
+			Timestamp:   time.Now(),
+			Status:      "no_task",
+			Runtime:     s.runtimeName(),
+		}, nil
+	}
+
+	// Obter status da task
+	status, err := task.Status(ctx)
+	if err != nil {
+		logger.Warn("failed to get task status", zap.String("container_id", container.ID()), zap.Error(err))
+	}
+
+	return ContainerStats{
+		ContainerID: container.ID(),
+		Timestamp:   time.Now(),
+		Status:      string(status.Status),
+		Runtime:     s.runtimeName(),
+	}, nil
+}
+
+// warmContainer is a created container whose idle init task is running.
+// It is handed to exactly one execution and destroyed afterwards.
+type warmContainer struct {
+	id        string
+	container containerd.Container
+	task      containerd.Task
+	createdAt time.Time
+	// imageDigest is the manifest digest of the base image it was created
+	// from ("" for scratch), sandboxDigest the one of its sandbox image;
+	// toolchainHash identifies the toolchain layer of the latter
+	imageDigest   string
+	sandboxDigest string
+	toolchainHash string
+}
+
+// destroy kills the task and removes the container and its snapshot.
+func (w *warmContainer) destroy(ctx context.Context) error {
+	ctx = namespaces.WithNamespace(ctx, "compiler")
+	if w.task != nil {
+		_, _ = w.task.Delete(ctx, containerd.WithProcessKill)
+	}
+	err := w.container.Delete(ctx, containerd.WithSnapshotCleanup)
+	releaseBaseImage(w.imageDigest)
+	return err
+}
+
+// containerdExecution runs the steps of a request (see runSteps) as exec'd
+// processes in a warm container.
+type containerdExecution struct {
+	sandboxSteps
+	warm *warmContainer
+	// pspec is the init process spec the steps are derived from
+	pspec specs.Process
+
+	// usage accumulates task.Metrics samples taken while the steps run
+	usage       ResourceUsage
+	stopSamples chan struct{}
+	samplesDone chan struct{}
+}
+
+func (e *containerdExecution) ID() string { return e.warm.id }
+
+// ImageDigest is the base image digest, or the sandbox image's for scratch.
+func (e *containerdExecution) ImageDigest() string {
+	if e.warm.imageDigest == "" {
+		return e.warm.sandboxDigest
+	}
+	return e.warm.imageDigest
+}
+
+func (e *containerdExecution) Run(ctx context.Context) (<-chan SandboxExit, error) {
+	phaseStart := time.Now()
+	ctx = namespaces.WithNamespace(ctx, "compiler")
+	spec, err := e.warm.container.Spec(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("load spec: %w", err)
+	}
+	e.pspec = *spec.Process
+	e.pspec.Terminal = false
+
+	// subscribe before starting so an early OOM kill is not missed
+	oomCtx, stopOOM := context.WithCancel(ctx)
+	oomC, err := watchOOM(oomCtx, e.warm.id)
+	if err != nil {
+		stopOOM()
+		return nil, err
+	}
+	logger.Debug("sandbox steps ready", zap.String("container_id", e.warm.id), zap.Duration("took", time.Since(phaseStart)))
+	e.stopSamples = make(chan struct{})
+	e.samplesDone = make(chan struct{})
+	go e.sampleUsage(ctx)
+
+	exitC := make(chan SandboxExit, 1)
+	go func() {
+		defer stopOOM()
+		exit := e.runSteps(ctx)
+		if sig := syscall.Signal(e.killed.Load()); sig != 0 {
+			// the steps died with the container, like the shell would
+			exit = SandboxExit{ExitCode: 128 + int(sig)}
+		}
+		// the shim reports a process killed by signal N as 128+N
+		if exit.ExitCode > 128 && exit.ExitCode < 128+65 {
+			exit.Signal = syscall.Signal(exit.ExitCode - 128)
+		}
+		select {
+		case <-oomC:
+			exit.OOMKilled = true
+		default:
+			// the OOM event can be published just after the exit
+			if exit.ExitCode > 128 {
+				select {
+				case <-oomC:
+					exit.OOMKilled = true
+				case <-time.After(200 * time.Millisecond):
+				}
+			}
+		}
+		exitC <- exit
+	}()
+	return exitC, nil
+}
+
+// execStep starts a step as a task.Exec process (sandboxSteps.start).
+func (e *containerdExecution) execStep(ctx context.Context, st sandboxStep) (exitCode int, timedOut bool, err error) {
+	start := time.Now()
+	// same user, env and capabilities as the init process
+	pspec := e.pspec
+	pspec.Args = st.args
+	pspec.Cwd = st.cwd
+	pspec.Rlimits = st.rlimits
+	process, err := e.warm.task.Exec(ctx, st.id, &pspec, cio.NewCreator(cio.WithStreams(st.stdin, st.stdout, st.stderr)))
+	if err != nil {
+		return -1, false, fmt.Errorf("exec %s: %w", st.id, err)
+	}
+	// waits for the IO copy to finish, so all output has been written
+	defer process.Delete(ctx, containerd.WithProcessKill)
+	statusC, err := process.Wait(ctx)
+	if err != nil {
+		return -1, false, fmt.Errorf("wait %s: %w", st.id, err)
+	}
+	if err := process.Start(ctx); err != nil {
+		return -1, false, fmt.Errorf("start %s: %w", st.id, err)
+	}
+	var limitC <-chan time.Time
+	if st.limit > 0 {
+		timer := time.NewTimer(st.limit)
+		defer timer.Stop()
+		limitC = timer.C
+	}
+	var status containerd.ExitStatus
+	select {
+	case status = <-statusC:
+	case <-limitC:
+		timedOut = true
+		_ = process.Kill(ctx, syscall.SIGKILL)
+		status = <-statusC
+	}
+	logger.Debug("sandbox step finished", zap.String("step", st.id), zap.Duration("took", time.Since(start)))
+	return int(status.ExitCode()), timedOut, nil
+}
+
+// watchOOM returns a channel closed when containerd publishes a TaskOOM event
+// for the container, i.e. the cgroup memory limit invoked the OOM killer.
+func watchOOM(ctx context.Context, containerID string) (<-chan struct{}, error) {
+	client, err := getContainerdClient()
+	if err != nil {
+		return nil, fmt.Errorf("containerd client: %w", err)
+	}
+	envC, errC := client.Subscribe(ctx, `topic=="/tasks/oom",namespace=="compiler"`)
+	oomC := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case env, ok := <-envC:
+				if !ok {
+					return
+				}
+				v, err := typeurl.UnmarshalAny(env.Event)
+				if err != nil {
+					continue
+				}
+				if ev, ok := v.(*apievents.TaskOOM); ok && ev.ContainerID == containerID {
+					close(oomC)
+					return
+				}
+			case <-errC:
+				return
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return oomC, nil
+}
+
+func (e *containerdExecution) Kill(ctx context.Context, sig syscall.Signal) error {
+	ctx = namespaces.WithNamespace(ctx, "compiler")
+	e.killed.CompareAndSwap(0, int32(sig))
+	// kill every process in the container, the init and the current step
+	return e.warm.task.Kill(ctx, sig, containerd.WithKillAll)
+}
+
+// sampleUsage polls the task metrics until Collect: cgroup v2 keeps no memory
+// peak and pids are only reported as a current count.
+func (e *containerdExecution) sampleUsage(ctx context.Context) {
+	defer close(e.samplesDone)
+	ticker := time.NewTicker(200 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-e.stopSamples:
+			return
+		case <-ticker.C:
+			if u, err := taskUsage(ctx, e.warm.task); err == nil {
+				e.usage.merge(u)
+			}
+		}
+	}
+}
+
+// taskUsage decodes task.Metrics, which is cgroup v1 or v2 depending on the
+// host (runc) or the guest kernel (Kata).
+func taskUsage(ctx context.Context, task containerd.Task) (*ResourceUsage, error) {
+	m, err := task.Metrics(ctx)
+	if err != nil {
+		return nil, err
+	}
+	v, err := typeurl.UnmarshalAny(m.Data)
+	if err != nil {
+		return nil, fmt.Errorf("decode metrics: %w", err)
+	}
+	u := &ResourceUsage{}
+	switch st := v.(type) {
+	case *cgroup1stats.Metrics:
+		if mem := st.GetMemory().GetUsage(); mem != nil {
+			u.MemoryPeakBytes = max(mem.Max, mem.Usage)
+		}
+		if cpu := st.GetCPU(); cpu != nil {
+			u.CPUUserUS = cpu.GetUsage().GetUser() / 1000
+			u.CPUSystemUS = cpu.GetUsage().GetKernel() / 1000
+			u.ThrottledPeriods = cpu.GetThrottling().GetThrottledPeriods()
+		}
+		u.PidsPeak = st.GetPids().GetCurrent()
+		u.OOMKills = st.GetMemoryOomControl().GetOomKill()
+	case *cgroup2stats.Metrics:
+		u.MemoryPeakBytes = st.GetMemory().GetUsage()
+		u.CPUUserUS = st.GetCPU().GetUserUsec()
+		u.CPUSystemUS = st.GetCPU().GetSystemUsec()
+		u.ThrottledPeriods = st.GetCPU().GetNrThrottled()
+		u.PidsPeak = st.GetPids().GetCurrent()
+		u.OOMKills = st.GetMemoryEvents().GetOomKill()
+	default:
+		return nil, fmt.Errorf("unsupported metrics type %T", v)
+	}
+	return u, nil
+}
+
+func (e *containerdExecution) Collect(ctx context.Context) (*ResourceUsage, error) {
+	ctx = namespaces.WithNamespace(ctx, "compiler")
+	var usage *ResourceUsage
+	if e.stopSamples != nil {
+		close(e.stopSamples)
+		<-e.samplesDone
+		// last read before the cgroup goes away (cumulative CPU, memory max)
+		if u, err := taskUsage(ctx, e.warm.task); err == nil {
+			e.usage.merge(u)
+		}
+		usage = &e.usage
+	}
+	return usage, e.warm.destroy(ctx)
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// fakeSandbox is an in-process backend that never runs the submitted code.
+// It lets the HTTP server, limiter and history run on machines without
+// containerd (SANDBOX_BACKEND=fake) and makes the handlers easy to exercise.
+type fakeSandbox struct {
+	mu     sync.Mutex
+	active map[string]*fakeExecution
+
+	// Delay simulates the run time; Stdout/Stderr/ExitCode are returned as-is.
+	// An empty Stdout echoes a short summary of the submitted code;
+	// any stdin is copied to stdout first.
+	Delay    time.Duration
+	Stdout   string
+	Stderr   string
+	ExitCode int
+}
+
+func newFakeSandbox() *fakeSandbox {
+	return &fakeSandbox{active: make(map[string]*fakeExecution)}
+}
+
+func (s *fakeSandbox) Name() string { return "fake" }
+
+func (s *fakeSandbox) Prepare(ctx context.Context, req *SandboxRequest) (SandboxExecution, error) {
+	if err := validateSandboxRequest(req); err != nil {
+		return nil, err
+	}
+	stdout := s.Stdout
+	if stdout == "" {
+		stdout = fmt.Sprintf("fake sandbox: received %d bytes of code\n", len(req.Code))
+	}
+	e := &fakeExecution{
+		id:     fmt.Sprintf("fake-sandbox-%d", time.Now().UnixNano()),
+		owner:  s,
+		req:    req,
+		delay:  s.Delay,
+		stdout: stdout,
+		stderr: s.Stderr,
+		code:   s.ExitCode,
+		killed: make(chan syscall.Signal, 1),
+	}
+	s.mu.Lock()
+	s.active[e.id] = e
+	s.mu.Unlock()
+	return e, nil
+}
+
+func (s *fakeSandbox) Stats(ctx context.Context) ([]ContainerStats, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stats := make([]ContainerStats, 0, len(s.active))
+	for id := range s.active {
+		stats = append(stats, ContainerStats{ContainerID: id, Timestamp: time.Now(), Status: "running", Runtime: "fake"})
+	}
+	return stats, nil
+}
+
+type fakeExecution struct {
+	id     string
+	owner  *fakeSandbox
+	req    *SandboxRequest
+	delay  time.Duration
+	stdout string
+	stderr string
+	code   int
+	killed chan syscall.Signal
+}
+
+func (e *fakeExecution) ID() string { return e.id }
+
+// phase writes a marker line the way sandboxSteps.mark would.
+func (e *fakeExecution) phase(event string) {
+	line := e.req.PhaseMarker + " " + event + "\n"
+	if e.req.Stdout != nil {
+		_, _ = io.WriteString(e.req.Stdout, line)
+	}
+	if e.req.Stderr != nil {
+		_, _ = io.WriteString(e.req.Stderr, line)
+	}
+}
+
+func (e *fakeExecution) Run(ctx context.Context) (<-chan SandboxExit, error) {
+	exitC := make(chan SandboxExit, 1)
+	go func() {
+		e.phase("compile-start")
+		if e.req.CachedBinary != "" {
+			e.phase("compile-cached")
+		}
+		e.phase("compile-end 0")
+		if e.req.ReturnBinary && e.req.Stderr != nil {
+			// a stand-in ./out, enough for the binary cache to keep it
+			_, _ = io.WriteString(e.req.Stderr, e.req.PhaseMarker+" binary-start\n"+base64.StdEncoding.EncodeToString([]byte("\x7fELF fake sandbox binary\n"))+"\n"+e.req.PhaseMarker+" binary-end 0\n")
+		}
+		if e.req.CheckOnly {
+			exitC <- SandboxExit{}
+			return
+		}
+		if len(e.req.CaseTimeouts) > 0 {
+			// judge mode: every case prints the canned stdout
+			for i := range e.req.CaseTimeouts {
+				e.phase(fmt.Sprintf("case-start %d", i))
+				if e.req.Stdout != nil {
+					_, _ = io.WriteString(e.req.Stdout, e.stdout)
+				}
+				e.phase(fmt.Sprintf("case-end %d %d", i, e.code))
+			}
+			exitC <- SandboxExit{}
+			return
+		}
+		e.phase("run-start")
+		// echo the program input, like a cat-style program would
+		if e.req.Stdin != nil && e.req.Stdout != nil {
+			echoed := make(chan struct{})
+			go func() {
+				_, _ = io.Copy(e.req.Stdout, e.req.Stdin)
+				close(echoed)
+			}()
+			select {
+			case <-echoed:
+			case sig := <-e.killed:
+				exitC <- SandboxExit{ExitCode: 128 + int(sig), Signal: sig}
+				return
+			}
+		}
+		select {
+		case <-time.After(e.delay):
+			if e.req.Stdout != nil {
+				_, _ = io.WriteString(e.req.Stdout, e.stdout)
+			}
+			if e.req.Stderr != nil && e.stderr != "" {
+				_, _ = io.WriteString(e.req.Stderr, e.stderr)
+			}
+			e.phase(fmt.Sprintf("run-end %d", e.code))
+			exitC <- SandboxExit{ExitCode: e.code}
+		case sig := <-e.killed:
+			exitC <- SandboxExit{ExitCode: 128 + int(sig), Signal: sig}
+		}
+	}()
+	return exitC, nil
+}
+
+func (e *fakeExecution) Kill(ctx context.Context, sig syscall.Signal) error {
+	select {
+	case e.killed <- sig:
+	default:
+	}
+	return nil
+}
+
+func (e *fakeExecution) Collect(ctx context.Context) (*ResourceUsage, error) {
+	e.owner.mu.Lock()
+	delete(e.owner.active, e.id)
+	e.owner.mu.Unlock()
+	return nil, nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// useFakeSandbox makes sb the active backend, with a no-op logger, for the
+// duration of the test.
+func useFakeSandbox(t *testing.T, sb *fakeSandbox) {
+	t.Helper()
+	prevSandbox, prevLogger := activeSandbox, logger
+	activeSandbox, logger = sb, zap.NewNop()
+	t.Cleanup(func() { activeSandbox, logger = prevSandbox, prevLogger })
+}
+
+func TestNewSandbox(t *testing.T) {
+	tests := []struct {
+		backend string
+		want    string
+		wantErr bool
+	}{
+		{backend: "", want: "containerd"},
+		{backend: "kata", want: "containerd"},
+		{backend: "Local", want: "local"},
+		{backend: "fake", want: "fake"},
+		{backend: "docker", wantErr: true},
+	}
+	for _, tt := range tests {
+		sb, err := newSandbox(&Config{SandboxBackend: tt.backend})
+		if (err != nil) != tt.wantErr {
+			t.Fatalf("newSandbox(%q) error = %v, wantErr %v", tt.backend, err, tt.wantErr)
+		}
+		if err == nil && sb.Name() != tt.want {
+			t.Errorf("newSandbox(%q) = %s, want %s", tt.backend, sb.Name(), tt.want)
+		}
+	}
+}
+
+// TestExecInKataFake drives the Sandbox interface through execInKata.
+func TestExecInKataFake(t *testing.T) {
+	tests := []struct {
+		name    string
+		sandbox *fakeSandbox
+		code    string
+		stdin   string
+		timeout int // seconds, of the default profile
+		status  ExecutionStatus
+		stdout  string // substring of the run output
+		stderr  string
+		wantErr string
+	}{
+		{name: "default output", sandbox: newFakeSandbox(), code: "main", status: StatusOK, stdout: "received 4 bytes of code"},
+		{name: "runtime error", sandbox: &fakeSandbox{Stdout: "hi\n", Stderr: "warn", ExitCode: 3}, code: "main", status: StatusRuntimeError, stdout: "hi\n", stderr: "warn"},
+		{name: "code too long", sandbox: newFakeSandbox(), code: strings.Repeat("x", 5001), wantErr: "code exceeds character limit of 5000"},
+		{name: "stdin too large", sandbox: newFakeSandbox(), code: "main", stdin: strings.Repeat("x", maxStdinBytes+1), wantErr: ErrStdinTooLarge.Error()},
+		{name: "killed on timeout", sandbox: &fakeSandbox{Delay: time.Hour}, code: "main", timeout: 1, status: StatusTimeout, wantErr: "exceeded 1s (terminated with SIGTERM)"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.sandbox.active == nil {
+				tt.sandbox.active = make(map[string]*fakeExecution)
+			}
+			useFakeSandbox(t, tt.sandbox)
+			if tt.timeout > 0 {
+				cfg := &Config{DefaultProfile: "default"}
+				cfg.Profiles = builtinProfiles(cfg)
+				cfg.Profiles["default"].TimeoutSeconds = tt.timeout
+				withConfig(t, cfg)
+			}
+
+			res, err := execInKata(tt.code, tt.stdin)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want %q", err, tt.wantErr)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if tt.status == "" {
+				return
+			}
+			if res == nil || res.Status != tt.status || !strings.HasPrefix(res.ContainerID, "fake-sandbox-") {
+				t.Fatalf("result %+v, want status %s from a fake sandbox", res, tt.status)
+			}
+			if res.Run == nil || !strings.Contains(res.Run.Stdout, tt.stdout) || !strings.Contains(res.Run.Stderr, tt.stderr) {
+				t.Errorf("run %+v, want stdout %q and stderr %q", res.Run, tt.stdout, tt.stderr)
+			}
+			if stats, _ := tt.sandbox.Stats(context.Background()); len(stats) != 0 {
+				t.Errorf("%d executions left after Collect", len(stats))
+			}
+		})
+	}
+}
+
+func TestFakeSandboxKill(t *testing.T) {
+	sb := &fakeSandbox{active: make(map[string]*fakeExecution), Delay: time.Hour}
+	ctx := context.Background()
+	e, err := sb.Prepare(ctx, &SandboxRequest{Code: "main", PhaseMarker: "__m__"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	exitC, err := e.Run(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats, _ := sb.Stats(ctx); len(stats) != 1 || stats[0].ContainerID != e.ID() {
+		t.Errorf("stats while running = %+v", stats)
+	}
+	if err := e.Kill(ctx, syscall.SIGKILL); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case exit := <-exitC:
+		if exit.ExitCode != 137 {
+			t.Errorf("exit code %d, want 137", exit.ExitCode)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Kill did not stop the run")
+	}
+	if _, err := e.Collect(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,633 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"debug/elf"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/platforms"
+	"github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"go.uber.org/zap"
+)
+
+// Sandbox images: instead of bind-mounting LANG_DIR, every toolchain gets
+// an image of its own, built locally and stored in containerd's content
+// store. On top of the base image (nothing with SANDBOX_BASE_IMAGE=scratch:
+// the sandbox runs no shell) it adds
+//
+//	a layer with the shared libraries the toolchain's ELF files load
+//	a layer with the toolchain at /lang (compiler, liblang/, *.lang)
+//	a layer with the sandbox-init helper at sandboxInitPath
+//
+// Layers are plain tars with fixed owners and timestamps, so the image is
+// content-addressed: the same toolchain and helper on the same base image
+// always give the same manifest digest.
+const (
+	sandboxImageRepo = "compiler.local/sandbox"
+	// sandboxImageLabel holds the digest of the base image a sandbox image
+	// was built on ("scratch" for none); its toolchain hash is under
+	// sandboxToolchainLabel and the helper's under sandboxInitLabel
+	sandboxImageLabel     = "compiler.sandbox-base"
+	sandboxToolchainLabel = "compiler.toolchain"
+	sandboxInitLabel      = "compiler.sandbox-init"
+	// sandboxInitPath is where the helper (cmd/sandbox-init) is in the image
+	sandboxInitPath = "/.sandbox/init"
+)
+
+// sandboxLibDirs are searched for the shared libraries of the toolchain, in
+// the order of the dynamic linker's default path.
+var sandboxLibDirs = []string{
+	"/lib/x86_64-linux-gnu", "/usr/lib/x86_64-linux-gnu",
+	"/lib/aarch64-linux-gnu", "/usr/lib/aarch64-linux-gnu",
+	"/lib64", "/usr/lib64", "/lib", "/usr/lib",
+}
+
+var (
+	sandboxImagesMu sync.Mutex
+	// sandboxImages caches the images built by this process, by
+	// toolchain hash and base image digest (see sandboxImageKey)
+	sandboxImages = map[string]containerd.Image{}
+	// sandboxImageBuilds are the builds in progress, by the same key: a
+	// second container for the image waits for the first build instead
+	// of starting its own, other images build meanwhile
+	sandboxImageBuilds = map[string]*sandboxImageBuild{}
+)
+
+// sandboxImageBuild is one sandboxImageFor build; done is closed once img
+// or err is set.
+type sandboxImageBuild struct {
+	done chan struct{}
+	img  containerd.Image
+	err  error
+}
+
+func sandboxImageKey(toolchainHash, baseDigest string) string {
+	return toolchainHash + "@" + baseDigest
+}
+
+var (
+	sandboxInitOnce sync.Once
+	sandboxInitFile string
+	sandboxInitHash string
+	sandboxInitErr  error
+)
+
+// sandboxInitBinary returns the host path and sha256 of the sandbox-init
+// helper: SANDBOX_INIT_BINARY, else "sandbox-init" next to this executable.
+// It must be a static ELF binary, since a scratch image has no libc.
+func sandboxInitBinary() (string, string, error) {
+	sandboxInitOnce.Do(func() {
+		p := ""
+		if appConfig != nil {
+			p = appConfig.SandboxInitBinary
+		}
+		if p == "" {
+			exe, err := os.Executable()
+			if err != nil {
+				sandboxInitErr = fmt.Errorf("locate sandbox-init: %w", err)
+				return
+			}
+			p = filepath.Join(filepath.Dir(exe), "sandbox-init")
+		}
+		data, err := os.ReadFile(p)
+		if err != nil {
+			sandboxInitErr = fmt.Errorf("sandbox-init helper (build it with make sandbox-init or set SANDBOX_INIT_BINARY): %w", err)
+			return
+		}
+		if !bytes.HasPrefix(data, elfMagic) {
+			sandboxInitErr = fmt.Errorf("sandbox-init helper %s is not an ELF binary", p)
+			return
+		}
+		if interp, needed, err := elfDependencies(p); err != nil {
+			sandboxInitErr = err
+			return
+		} else if interp != "" || len(needed) > 0 {
+			sandboxInitErr = fmt.Errorf("sandbox-init helper %s is dynamically linked: build it with CGO_ENABLED=0", p)
+			return
+		}
+		sandboxInitFile, sandboxInitHash = p, digest.FromBytes(data).String()
+	})
+	return sandboxInitFile, sandboxInitHash, sandboxInitErr
+}
+
+// sandboxToolchain resolves the toolchain a container is built for: tc, else
+// the default one, else LANG_DIR itself (legacy layout). It returns the
+// toolchain with its directory on the host.
+func sandboxToolchain(tc *Toolchain) (*Toolchain, string, error) {
+	langDir, err := resolveLangDir()
+	if err != nil {
+		return nil, "", err
+	}
+	if tc == nil {
+		if tc, err = resolveToolchain(""); err != nil {
+			return nil, "", err
+		}
+	}
+	if tc == nil {
+		hash, err := legacyToolchainHash(langDir)
+		if err != nil {
+			return nil, "", err
+		}
+		return &Toolchain{Version: legacyToolchainVersion, Dir: ".", Hash: hash}, langDir, nil
+	}
+	return tc, filepath.Join(langDir, filepath.FromSlash(tc.Dir)), nil
+}
+
+var (
+	legacyHashesMu sync.Mutex
+	// legacyHashes caches hashToolchainDir of a legacy LANG_DIR, by path:
+	// like registry toolchains it is hashed once, not per container (a
+	// replaced toolchain needs a restart)
+	legacyHashes = map[string]string{}
+)
+
+// legacyToolchainHash returns the hash of the legacy toolchain in langDir.
+func legacyToolchainHash(langDir string) (string, error) {
+	legacyHashesMu.Lock()
+	defer legacyHashesMu.Unlock()
+	if hash, ok := legacyHashes[langDir]; ok {
+		return hash, nil
+	}
+	hash, err := hashToolchainDir(langDir)
+	if err != nil {
+		return "", fmt.Errorf("hash toolchain %s: %w", langDir, err)
+	}
+	legacyHashes[langDir] = hash
+	return hash, nil
+}
+
+// sandboxImageFor returns the sandbox image of tc (found in dir) on top of
+// base (nil: from scratch), building and unpacking it on first use.
+func sandboxImageFor(ctx context.Context, c *containerd.Client, base containerd.Image, tc *Toolchain, dir string) (containerd.Image, error) {
+	baseDigest := scratchBaseImage
+	if base != nil {
+		baseDigest = base.Target().Digest.String()
+	}
+	key := sandboxImageKey(tc.Hash, baseDigest)
+	sandboxImagesMu.Lock()
+	if img, ok := sandboxImages[key]; ok {
+		sandboxImagesMu.Unlock()
+		return img, nil
+	}
+	if b, ok := sandboxImageBuilds[key]; ok {
+		sandboxImagesMu.Unlock()
+		select {
+		case <-b.done:
+			return b.img, b.err
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	b := &sandboxImageBuild{done: make(chan struct{})}
+	sandboxImageBuilds[key] = b
+	sandboxImagesMu.Unlock()
+
+	// the lock is not held while building: images of other toolchains or
+	// base images build in parallel, and cached ones are served meanwhile
+	b.img, b.err = buildSandboxImage(ctx, c, base, baseDigest, tc, dir)
+	sandboxImagesMu.Lock()
+	delete(sandboxImageBuilds, key)
+	if b.err == nil {
+		sandboxImages[key] = b.img
+	}
+	sandboxImagesMu.Unlock()
+	close(b.done)
+	return b.img, b.err
+}
+
+// buildSandboxImage builds, stores and unpacks the sandbox image of tc on
+// base (see sandboxImageFor).
+func buildSandboxImage(ctx context.Context, c *containerd.Client, base containerd.Image, baseDigest string, tc *Toolchain, dir string) (containerd.Image, error) {
+	start := time.Now()
+	// the lease keeps the new blobs until the image record references them
+	ctx, done, err := c.WithLease(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("sandbox image lease: %w", err)
+	}
+	defer done(context.Background())
+
+	cs := c.ContentStore()
+	manifest, config, err := sandboxImageBase(ctx, cs, base)
+	if err != nil {
+		return nil, err
+	}
+
+	initPath, initHash, err := sandboxInitBinary()
+	if err != nil {
+		return nil, err
+	}
+	initFiles := []layerFile{{name: strings.TrimPrefix(sandboxInitPath, "/"), source: initPath, mode: 0o755}}
+	if base == nil {
+		// mount point of the /tmp tmpfs
+		initFiles = append(initFiles, layerFile{name: "tmp", mode: fs.ModeDir | 0o755})
+	}
+	tcFiles, err := toolchainLayerFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+	libFiles, err := libraryLayerFiles(tcFiles)
+	if err != nil {
+		return nil, err
+	}
+	created := time.Unix(0, 0).UTC()
+	for _, layer := range []struct {
+		files   []layerFile
+		comment string
+	}{
+		{libFiles, "shared libraries of toolchain " + tc.Version},
+		{tcFiles, "toolchain " + tc.Version + " (" + tc.Hash + ")"},
+		{initFiles, "sandbox-init (" + initHash + ")"},
+	} {
+		if len(layer.files) == 0 {
+			continue
+		}
+		desc, err := writeLayer(ctx, cs, layer.files)
+		if err != nil {
+			return nil, err
+		}
+		manifest.Layers = append(manifest.Layers, desc)
+		config.RootFS.DiffIDs = append(config.RootFS.DiffIDs, desc.Digest)
+		config.History = append(config.History, ocispec.History{Created: &created, CreatedBy: "compilerOnline", Comment: layer.comment})
+	}
+
+	config.Created = &created
+	configDesc, err := writeJSONBlob(ctx, cs, ocispec.MediaTypeImageConfig, config, nil)
+	if err != nil {
+		return nil, fmt.Errorf("write sandbox image config: %w", err)
+	}
+	manifest.MediaType = ocispec.MediaTypeImageManifest
+	manifest.Config = configDesc
+	gcRefs := map[string]string{"containerd.io/gc.ref.content.config": configDesc.Digest.String()}
+	for i, l := range manifest.Layers {
+		gcRefs[fmt.Sprintf("containerd.io/gc.ref.content.l.%d", i)] = l.Digest.String()
+	}
+	manifestDesc, err := writeJSONBlob(ctx, cs, ocispec.MediaTypeImageManifest, manifest, gcRefs)
+	if err != nil {
+		return nil, fmt.Errorf("write sandbox image manifest: %w", err)
+	}
+
+	rec := images.Image{
+		Name:   sandboxImageRepo + "@" + manifestDesc.Digest.String(),
+		Target: manifestDesc,
+		Labels: map[string]string{sandboxImageLabel: baseDigest, sandboxToolchainLabel: tc.Hash, sandboxInitLabel: initHash},
+	}
+	is := c.ImageService()
+	stored, err := is.Create(ctx, rec)
+	if errdefs.IsAlreadyExists(err) {
+		stored, err = is.Get(ctx, rec.Name)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("store sandbox image: %w", err)
+	}
+	img := containerd.NewImage(c, stored)
+	if err := unpackImage(ctx, img); err != nil {
+		return nil, err
+	}
+	if logger != nil {
+		logger.Info("sandbox image ready", zap.String("toolchain", tc.Version), zap.String("toolchain_hash", tc.Hash), zap.String("base_digest", baseDigest), zap.String("image", stored.Name), zap.Int("libraries", len(libFiles)), zap.Duration("took", time.Since(start)))
+	}
+	return img, nil
+}
+
+// sandboxImageBase returns the manifest and config a sandbox image starts
+// from: base's, or empty ones for scratch.
+func sandboxImageBase(ctx context.Context, cs content.Store, base containerd.Image) (ocispec.Manifest, ocispec.Image, error) {
+	if base == nil {
+		manifest := ocispec.Manifest{Versioned: specs.Versioned{SchemaVersion: 2}}
+		config := ocispec.Image{Platform: ocispec.Platform{OS: "linux", Architecture: runtime.GOARCH}, RootFS: ocispec.RootFS{Type: "layers"}}
+		return manifest, config, nil
+	}
+	var config ocispec.Image
+	manifest, err := images.Manifest(ctx, cs, base.Target(), platforms.Default())
+	if err != nil {
+		return manifest, config, fmt.Errorf("read base image manifest: %w", err)
+	}
+	rawConfig, err := content.ReadBlob(ctx, cs, manifest.Config)
+	if err != nil {
+		return manifest, config, fmt.Errorf("read base image config: %w", err)
+	}
+	if err := json.Unmarshal(rawConfig, &config); err != nil {
+		return manifest, config, fmt.Errorf("parse base image config: %w", err)
+	}
+	return manifest, config, nil
+}
+
+// forgetSandboxImages drops the cached sandbox images built on baseDigest
+// (their records are deleted by gcBaseImage).
+func forgetSandboxImages(baseDigest string) {
+	sandboxImagesMu.Lock()
+	defer sandboxImagesMu.Unlock()
+	for key := range sandboxImages {
+		if strings.HasSuffix(key, "@"+baseDigest) {
+			delete(sandboxImages, key)
+		}
+	}
+}
+
+// gcStaleSandboxImages removes the sandbox images of an earlier run built on
+// another base image, with another sandbox-init or for a toolchain no longer
+// in the registry.
+func gcStaleSandboxImages(ctx context.Context) {
+	c, err := getContainerdClient()
+	if err != nil {
+		return
+	}
+	is := c.ImageService()
+	imgs, err := is.List(ctx, `labels."`+sandboxImageLabel+`"`)
+	if err != nil {
+		return
+	}
+	current := currentImageDigest()
+	if !usesBaseImage(appConfig) {
+		current = scratchBaseImage
+	}
+	_, initHash, _ := sandboxInitBinary()
+	known := map[string]bool{}
+	if toolchains != nil {
+		for _, tc := range toolchains.list() {
+			known[tc.Hash] = true
+		}
+	}
+	for _, img := range imgs {
+		if img.Labels[sandboxImageLabel] == current && img.Labels[sandboxInitLabel] == initHash && (toolchains == nil || known[img.Labels[sandboxToolchainLabel]]) {
+			continue
+		}
+		if err := is.Delete(ctx, img.Name); err != nil && !errdefs.IsNotFound(err) && logger != nil {
+			logger.Warn("delete stale sandbox image", zap.String("image", img.Name), zap.Error(err))
+		}
+	}
+}
+
+// writeJSONBlob stores v in the content store and returns its descriptor.
+func writeJSONBlob(ctx context.Context, cs content.Store, mediaType string, v any, labels map[string]string) (ocispec.Descriptor, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	desc := ocispec.Descriptor{MediaType: mediaType, Digest: digest.FromBytes(data), Size: int64(len(data))}
+	var opts []content.Opt
+	if labels != nil {
+		opts = append(opts, content.WithLabels(labels))
+	}
+	if err := content.WriteBlob(ctx, cs, "sandbox-"+desc.Digest.Encoded(), bytes.NewReader(data), desc, opts...); err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	return desc, nil
+}
+
+// layerFile is one entry of a layer: a host file, directory or symlink
+// stored at name (relative to the image root).
+type layerFile struct {
+	name   string
+	source string // regular files: read (following symlinks) from here
+	mode   fs.FileMode
+	link   string
+}
+
+// writeLayer tars files (sorted, root-owned, zero timestamps) into the
+// content store as an uncompressed layer, whose digest is its diff ID.
+func writeLayer(ctx context.Context, cs content.Store, files []layerFile) (ocispec.Descriptor, error) {
+	files = withParentDirs(files)
+	tmp, err := os.CreateTemp("", "sandbox-layer-*")
+	if err != nil {
+		return ocispec.Descriptor{}, fmt.Errorf("sandbox layer: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	digester := digest.Canonical.Digester()
+	counter := &countingWriter{}
+	tw := tar.NewWriter(io.MultiWriter(tmp, digester.Hash(), counter))
+	epoch := time.Unix(0, 0)
+	for _, f := range files {
+		hdr := &tar.Header{Name: f.name, Mode: int64(f.mode.Perm()), ModTime: epoch, Format: tar.FormatPAX}
+		switch {
+		case f.mode.IsDir():
+			hdr.Typeflag, hdr.Name = tar.TypeDir, f.name+"/"
+		case f.mode&fs.ModeSymlink != 0:
+			hdr.Typeflag, hdr.Linkname = tar.TypeSymlink, f.link
+		default:
+			hdr.Typeflag = tar.TypeReg
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			if err := tw.WriteHeader(hdr); err != nil {
+				return ocispec.Descriptor{}, fmt.Errorf("sandbox layer: %w", err)
+			}
+			continue
+		}
+		if err := writeLayerFile(tw, hdr, f.source); err != nil {
+			return ocispec.Descriptor{}, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return ocispec.Descriptor{}, fmt.Errorf("sandbox layer: %w", err)
+	}
+	desc := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageLayer, Digest: digester.Digest(), Size: counter.n}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return ocispec.Descriptor{}, fmt.Errorf("sandbox layer: %w", err)
+	}
+	if err := content.WriteBlob(ctx, cs, "sandbox-"+desc.Digest.Encoded(), tmp, desc); err != nil {
+		return ocispec.Descriptor{}, fmt.Errorf("write sandbox layer: %w", err)
+	}
+	return desc, nil
+}
+
+func writeLayerFile(tw *tar.Writer, hdr *tar.Header, source string) error {
+	f, err := os.Open(source)
+	if err != nil {
+		return fmt.Errorf("sandbox layer: %w", err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("sandbox layer: %w", err)
+	}
+	hdr.Size = info.Size()
+	if err := tw.WriteHeader(hdr); err != nil {
+		return fmt.Errorf("sandbox layer: %w", err)
+	}
+	if _, err := io.Copy(tw, f); err != nil {
+		return fmt.Errorf("sandbox layer %s: %w", source, err)
+	}
+	return nil
+}
+
+type countingWriter struct{ n int64 }
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	return len(p), nil
+}
+
+// withParentDirs adds the missing parent directories of files and sorts
+// them by name, dropping duplicates.
+func withParentDirs(files []layerFile) []layerFile {
+	byName := map[string]layerFile{}
+	for _, f := range files {
+		byName[f.name] = f
+		for dir := path.Dir(f.name); dir != "." && dir != "/"; dir = path.Dir(dir) {
+			if _, ok := byName[dir]; !ok {
+				byName[dir] = layerFile{name: dir, mode: fs.ModeDir | 0o755}
+			}
+		}
+	}
+	out := make([]layerFile, 0, len(byName))
+	for _, f := range byName {
+		out = append(out, f)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].name < out[j].name })
+	return out
+}
+
+// toolchainLayerFiles lists what hashToolchainDir covers (compiler,
+// liblang/, *.lang) under lang/ in the image.
+func toolchainLayerFiles(dir string) ([]layerFile, error) {
+	roots := []string{"compiler", "liblang"}
+	extra, err := filepath.Glob(filepath.Join(dir, "*.lang"))
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range extra {
+		roots = append(roots, filepath.Base(p))
+	}
+	var files []layerFile
+	for _, root := range roots {
+		err := filepath.WalkDir(filepath.Join(dir, root), func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				if errors.Is(err, fs.ErrNotExist) && root == "liblang" && p == filepath.Join(dir, root) {
+					return nil
+				}
+				return err
+			}
+			rel, _ := filepath.Rel(dir, p)
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			f := layerFile{name: path.Join("lang", filepath.ToSlash(rel)), source: p, mode: info.Mode()}
+			if info.Mode()&fs.ModeSymlink != 0 {
+				if f.link, err = os.Readlink(p); err != nil {
+					return err
+				}
+			} else if !info.Mode().IsRegular() && !info.IsDir() {
+				return nil
+			}
+			files = append(files, f)
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("toolchain %s: %w", dir, err)
+		}
+	}
+	return files, nil
+}
+
+// libraryLayerFiles lists the dynamic linker and the shared libraries the ELF
+// files among files need, recursively, at their host paths. Statically
+// linked toolchains need none.
+func libraryLayerFiles(files []layerFile) ([]layerFile, error) {
+	seen := map[string]bool{}
+	var queue, libs []string
+	for _, f := range files {
+		if f.mode.IsRegular() {
+			queue = append(queue, f.source)
+		}
+	}
+	for len(queue) > 0 {
+		p := queue[0]
+		queue = queue[1:]
+		interp, needed, err := elfDependencies(p)
+		if err != nil {
+			return nil, err
+		}
+		deps := needed[:0:0]
+		if interp != "" {
+			deps = append(deps, interp)
+		}
+		for _, name := range needed {
+			lib, err := findLibrary(name)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", p, err)
+			}
+			deps = append(deps, lib)
+		}
+		for _, lib := range deps {
+			if !seen[lib] {
+				seen[lib] = true
+				libs = append(libs, lib)
+				queue = append(queue, lib)
+			}
+		}
+	}
+	out := make([]layerFile, 0, len(libs))
+	for _, lib := range libs {
+		info, err := os.Stat(lib)
+		if err != nil {
+			return nil, fmt.Errorf("shared library: %w", err)
+		}
+		out = append(out, layerFile{name: strings.TrimPrefix(lib, "/"), source: lib, mode: info.Mode().Perm()})
+	}
+	return out, nil
+}
+
+// elfDependencies returns the interpreter and DT_NEEDED entries of the ELF
+// file p; other files have none.
+func elfDependencies(p string) (interp string, needed []string, err error) {
+	f, err := elf.Open(p)
+	if err != nil {
+		var formatErr *elf.FormatError
+		if errors.As(err, &formatErr) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return "", nil, nil
+		}
+		return "", nil, err
+	}
+	defer f.Close()
+	for _, prog := range f.Progs {
+		if prog.Type != elf.PT_INTERP {
+			continue
+		}
+		data, err := io.ReadAll(prog.Open())
+		if err != nil {
+			return "", nil, fmt.Errorf("%s: read interpreter: %w", p, err)
+		}
+		interp = strings.TrimRight(string(data), "\x00")
+	}
+	if needed, err = f.ImportedLibraries(); err != nil {
+		return "", nil, fmt.Errorf("%s: %w", p, err)
+	}
+	return interp, needed, nil
+}
+
+// findLibrary looks a DT_NEEDED name up in sandboxLibDirs.
+func findLibrary(name string) (string, error) {
+	if strings.Contains(name, "/") {
+		return name, nil
+	}
+	for _, dir := range sandboxLibDirs {
+		p := filepath.Join(dir, name)
+		if _, err := os.Stat(p); err == nil {
+			return p, nil
+		}
+	}
+	return "", fmt.Errorf("shared library %s not found on the host", name)
+}
@@ -0,0 +1,417 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+	"go.uber.org/zap"
+	"golang.org/x/sys/unix"
+)
+
+// localCgroupRoot is the cgroup v2 subtree owned by the local backend.
+const localCgroupRoot = "/sys/fs/cgroup/compileronline"
+
+// Every local execution runs as an unprivileged uid (and gid) of its own,
+// taken from this range, so a submission cannot read or replace the work dir
+// of another one running next to it, or signal its processes. The uids are
+// handed out in turn rather than lowest first, so one is reused only after
+// the whole range went by.
+const (
+	localSandboxUIDBase  = 200000
+	localSandboxUIDCount = 65536
+)
+
+// localSandbox runs executions as host processes isolated with Linux
+// namespaces (unshare) and a per-run cgroup v2. No daemon is required, but
+// the isolation is weaker than Kata: use it for development or trusted hosts.
+type localSandbox struct {
+	mu     sync.Mutex
+	active map[string]*localExecution
+	// uids in use by executions, and the offset of the next one to try
+	uids    map[int]bool
+	nextUID int
+}
+
+func (s *localSandbox) Name() string { return "local" }
+
+func (s *localSandbox) Prepare(ctx context.Context, req *SandboxRequest) (SandboxExecution, error) {
+	if err := validateSandboxRequest(req); err != nil {
+		return nil, err
+	}
+	var cases [][]byte
+	if len(req.CaseTimeouts) > 0 {
+		// each case is fed to its own ./out process (see runSteps)
+		var err error
+		if cases, err = judgeCaseInputs(req.Stdin, len(req.CaseTimeouts)); err != nil {
+			return nil, fmt.Errorf("read test case inputs: %w", err)
+		}
+	}
+	if err := ensureRoot(); err != nil {
+		return nil, err
+	}
+	langDir, err := resolveLangDir()
+	if err != nil {
+		return nil, err
+	}
+	langDir, err = filepath.Abs(langDir)
+	if err != nil {
+		return nil, fmt.Errorf("resolve lang directory path: %w", err)
+	}
+	if req.Toolchain != nil && req.Toolchain.Dir != "" {
+		langDir = filepath.Join(langDir, req.Toolchain.Dir)
+	}
+	if fi, statErr := os.Stat(langDir); statErr != nil || !fi.IsDir() {
+		return nil, fmt.Errorf("missing lang directory at %s", langDir)
+	}
+	initPath, _, err := sandboxInitBinary()
+	if err != nil {
+		return nil, err
+	}
+
+	uid, err := s.allocUID()
+	if err != nil {
+		return nil, err
+	}
+	uniqueID := fmt.Sprintf("local-sandbox-%d", time.Now().UnixNano())
+	// MkdirTemp creates it 0700: only the execution's own uid gets in
+	workDir, err := os.MkdirTemp("", "sandbox-")
+	if err != nil {
+		s.releaseUID(uid)
+		return nil, fmt.Errorf("create work dir: %w", err)
+	}
+	if err := os.Chown(workDir, uid, uid); err != nil {
+		_ = os.Remove(workDir)
+		s.releaseUID(uid)
+		return nil, fmt.Errorf("create work dir: %w", err)
+	}
+	profile := req.profile()
+	cgroupDir, err := createLocalCgroup(uniqueID, profile)
+	if err != nil {
+		_ = os.Remove(workDir)
+		s.releaseUID(uid)
+		return nil, err
+	}
+	cgroupFD, err := unix.Open(cgroupDir, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		_ = os.Remove(cgroupDir)
+		_ = os.Remove(workDir)
+		s.releaseUID(uid)
+		return nil, fmt.Errorf("open cgroup: %w", err)
+	}
+
+	e := &localExecution{
+		id:        uniqueID,
+		owner:     s,
+		uid:       uid,
+		cgroupDir: cgroupDir,
+		cgroupFD:  cgroupFD,
+	}
+	e.sandboxSteps = sandboxSteps{
+		req:            req,
+		cases:          cases,
+		rlimits:        ociRlimits(profile.rlimits()),
+		compileRlimits: ociRlimits(profile.compileRlimits()),
+		compileTimeout: profile.CompileTimeout(),
+		initPath:       initPath,
+		workDir:        workDir,
+		langDir:        langDir,
+		start:          e.execStep,
+	}
+
+	s.mu.Lock()
+	if s.active == nil {
+		s.active = make(map[string]*localExecution)
+	}
+	s.active[uniqueID] = e
+	s.mu.Unlock()
+	return e, nil
+}
+
+// allocUID reserves a uid no other execution is running as.
+func (s *localSandbox) allocUID() (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.uids == nil {
+		s.uids = make(map[int]bool)
+	}
+	for i := 0; i < localSandboxUIDCount; i++ {
+		off := (s.nextUID + i) % localSandboxUIDCount
+		if uid := localSandboxUIDBase + off; !s.uids[uid] {
+			s.uids[uid] = true
+			s.nextUID = (off + 1) % localSandboxUIDCount
+			return uid, nil
+		}
+	}
+	return 0, errors.New("local sandbox: no free uid")
+}
+
+func (s *localSandbox) releaseUID(uid int) {
+	s.mu.Lock()
+	delete(s.uids, uid)
+	s.mu.Unlock()
+}
+
+func (s *localSandbox) Stats(ctx context.Context) ([]ContainerStats, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stats := make([]ContainerStats, 0, len(s.active))
+	for id, e := range s.active {
+		status := "created"
+		if e.started {
+			status = "running"
+		}
+		stats = append(stats, ContainerStats{ContainerID: id, Timestamp: time.Now(), Status: status, Runtime: "local"})
+	}
+	return stats, nil
+}
+
+// createLocalCgroup creates a child cgroup with the profile limits
+// sandboxSpecOpt applies to containerd sandboxes.
+func createLocalCgroup(id string, profile *ResourceProfile) (string, error) {
+	var st unix.Statfs_t
+	if err := unix.Statfs("/sys/fs/cgroup", &st); err != nil || st.Type != unix.CGROUP2_SUPER_MAGIC {
+		return "", fmt.Errorf("local sandbox requires the cgroup v2 unified hierarchy at /sys/fs/cgroup")
+	}
+	if err := os.MkdirAll(localCgroupRoot, 0o755); err != nil {
+		return "", fmt.Errorf("create cgroup root (cgroup v2 required): %w", err)
+	}
+	// Controllers must be delegated to the subtree before children can use them.
+	_ = os.WriteFile(filepath.Join(localCgroupRoot, "cgroup.subtree_control"), []byte("+memory +pids +cpu"), 0o644)
+	dir := filepath.Join(localCgroupRoot, id)
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		return "", fmt.Errorf("create cgroup: %w", err)
+	}
+	cpuMax := "max 100000"
+	if q := profile.CPUQuota(); q != nil {
+		cpuMax = fmt.Sprintf("%d 100000", *q)
+	}
+	limits := map[string]string{
+		"memory.max":      strconv.FormatInt(profile.MemoryBytes(), 10),
+		"memory.swap.max": strconv.FormatInt(profile.SwapMB<<20, 10),
+		"pids.max":        strconv.FormatInt(profile.Pids, 10),
+		"cpu.max":         cpuMax,
+	}
+	for file, value := range limits {
+		if err := os.WriteFile(filepath.Join(dir, file), []byte(value), 0o644); err != nil {
+			_ = os.Remove(dir)
+			return "", fmt.Errorf("set %s: %w", file, err)
+		}
+	}
+	return dir, nil
+}
+
+// localRlimitArgs formats rlimits as the NAME=value arguments of
+// sandbox-init limit.
+func localRlimitArgs(rlimits []specs.POSIXRlimit) []string {
+	args := make([]string, 0, len(rlimits))
+	for _, rl := range rlimits {
+		args = append(args, fmt.Sprintf("%s=%d", rl.Type, rl.Hard))
+	}
+	return args
+}
+
+// localExecution runs the steps of a request (see runSteps) as host
+// processes, each in its own namespaces and all in one cgroup.
+type localExecution struct {
+	sandboxSteps
+	id        string
+	owner     *localSandbox
+	uid       int
+	cgroupDir string
+	cgroupFD  int
+	started   bool
+	// current is the running step, signaled by Kill
+	current *exec.Cmd
+}
+
+func (e *localExecution) ID() string { return e.id }
+
+func (e *localExecution) Run(ctx context.Context) (<-chan SandboxExit, error) {
+	e.owner.mu.Lock()
+	e.started = true
+	e.owner.mu.Unlock()
+
+	exitC := make(chan SandboxExit, 1)
+	go func() {
+		exit := e.runSteps(ctx)
+		if sig := syscall.Signal(e.killed.Load()); sig != 0 {
+			// the steps died with the execution
+			exit = SandboxExit{ExitCode: 128 + int(sig)}
+		}
+		if exit.ExitCode > 128 && exit.ExitCode < 128+65 {
+			exit.Signal = syscall.Signal(exit.ExitCode - 128)
+		}
+		exit.OOMKilled = cgroupStat(e.cgroupDir, "memory.events", "oom_kill") > 0
+		exitC <- exit
+	}()
+	return exitC, nil
+}
+
+// execStep starts a step through sandbox-init limit, which sets its rlimits
+// before it execs st.args (sandboxSteps.start).
+func (e *localExecution) execStep(ctx context.Context, st sandboxStep) (exitCode int, timedOut bool, err error) {
+	start := time.Now()
+	args := append([]string{"limit"}, localRlimitArgs(st.rlimits)...)
+	cmd := exec.Command(e.initPath, append(append(args, "--"), st.args...)...)
+	cmd.Dir = st.cwd
+	cmd.Env = []string{
+		"PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin",
+		"HOME=/tmp",
+		"LANG=C",
+		"LC_ALL=C",
+	}
+	cmd.Stdin = st.stdin
+	cmd.Stdout = st.stdout
+	cmd.Stderr = st.stderr
+	// an interactive stdin may never reach EOF: do not let Wait block on its copy
+	cmd.WaitDelay = time.Second
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags:  syscall.CLONE_NEWNS | syscall.CLONE_NEWPID | syscall.CLONE_NEWNET | syscall.CLONE_NEWUTS | syscall.CLONE_NEWIPC,
+		UseCgroupFD: true,
+		CgroupFD:    e.cgroupFD,
+		Credential:  &syscall.Credential{Uid: uint32(e.uid), Gid: uint32(e.uid)},
+		Pdeathsig:   syscall.SIGKILL,
+	}
+	// Kill must either see the step or stop it from starting
+	e.owner.mu.Lock()
+	if e.killed.Load() != 0 {
+		e.owner.mu.Unlock()
+		return -1, false, errors.New("execution killed")
+	}
+	if err := cmd.Start(); err != nil {
+		e.owner.mu.Unlock()
+		return -1, false, fmt.Errorf("start %s: %w", st.id, err)
+	}
+	e.current = cmd
+	e.owner.mu.Unlock()
+
+	waitC := make(chan struct{})
+	go func() {
+		_ = cmd.Wait()
+		close(waitC)
+	}()
+	var limitC <-chan time.Time
+	if st.limit > 0 {
+		timer := time.NewTimer(st.limit)
+		defer timer.Stop()
+		limitC = timer.C
+	}
+	select {
+	case <-waitC:
+	case <-limitC:
+		timedOut = true
+		// the step is PID 1 of its namespace: the rest dies with it
+		_ = cmd.Process.Kill()
+		<-waitC
+	}
+	e.owner.mu.Lock()
+	e.current = nil
+	e.owner.mu.Unlock()
+	logger.Debug("sandbox step finished", zap.String("step", st.id), zap.Duration("took", time.Since(start)))
+	ps := cmd.ProcessState
+	if ws, ok := ps.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		// like a shell (and the containerd shim) reports it
+		return 128 + int(ws.Signal()), timedOut, nil
+	}
+	return ps.ExitCode(), timedOut, nil
+}
+
+// cgroupStat returns one "key value" entry of a flat-keyed cgroup file
+// (memory.events, cpu.stat); 0 when missing.
+func cgroupStat(dir, file, key string) uint64 {
+	data, err := os.ReadFile(filepath.Join(dir, file))
+	if err != nil {
+		return 0
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if f := strings.Fields(line); len(f) == 2 && f[0] == key {
+			n, _ := strconv.ParseUint(f[1], 10, 64)
+			return n
+		}
+	}
+	return 0
+}
+
+// cgroupValue reads a single-value cgroup file (memory.peak, pids.peak).
+func cgroupValue(dir, file string) uint64 {
+	data, err := os.ReadFile(filepath.Join(dir, file))
+	if err != nil {
+		return 0
+	}
+	n, _ := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+	return n
+}
+
+// cgroupUsage reads the accounting of a finished run. memory.peak needs
+// Linux 5.19 and pids.peak 6.1; older kernels report 0 for them.
+func cgroupUsage(dir string) *ResourceUsage {
+	return &ResourceUsage{
+		MemoryPeakBytes:  cgroupValue(dir, "memory.peak"),
+		CPUUserUS:        cgroupStat(dir, "cpu.stat", "user_usec"),
+		CPUSystemUS:      cgroupStat(dir, "cpu.stat", "system_usec"),
+		PidsPeak:         cgroupValue(dir, "pids.peak"),
+		ThrottledPeriods: cgroupStat(dir, "cpu.stat", "nr_throttled"),
+		OOMKills:         cgroupStat(dir, "memory.events", "oom_kill"),
+	}
+}
+
+func (e *localExecution) Kill(ctx context.Context, sig syscall.Signal) error {
+	e.owner.mu.Lock()
+	defer e.owner.mu.Unlock()
+	e.killed.CompareAndSwap(0, int32(sig))
+	if sig == syscall.SIGKILL {
+		// cgroup.kill (Linux 5.14+) kills every process in the cgroup at once.
+		if err := os.WriteFile(filepath.Join(e.cgroupDir, "cgroup.kill"), []byte("1"), 0o644); err == nil {
+			return nil
+		}
+	}
+	if e.current == nil {
+		return nil
+	}
+	// The step is PID 1 of its own namespace; killing it tears down the rest.
+	return e.current.Process.Signal(sig)
+}
+
+func (e *localExecution) Collect(ctx context.Context) (*ResourceUsage, error) {
+	e.owner.mu.Lock()
+	started := e.started
+	_, live := e.owner.active[e.id]
+	delete(e.owner.active, e.id)
+	e.owner.mu.Unlock()
+	var usage *ResourceUsage
+	if started {
+		usage = cgroupUsage(e.cgroupDir)
+	}
+	_ = unix.Close(e.cgroupFD)
+	var err error
+	// rmdir fails while processes linger; retry briefly after a kill.
+	for i := 0; i < 10; i++ {
+		if err = os.Remove(e.cgroupDir); err == nil || os.IsNotExist(err) {
+			err = nil
+			break
+		}
+		_ = os.WriteFile(filepath.Join(e.cgroupDir, "cgroup.kill"), []byte("1"), 0o644)
+		time.Sleep(50 * time.Millisecond)
+	}
+	if err != nil {
+		err = fmt.Errorf("remove cgroup: %w", err)
+	}
+	if rmErr := os.RemoveAll(e.workDir); rmErr != nil && err == nil {
+		err = fmt.Errorf("remove work dir: %w", rmErr)
+	}
+	if live {
+		// only once the processes and files of the uid are gone
+		e.owner.releaseUID(e.uid)
+	}
+	return usage, err
+}
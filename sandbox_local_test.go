@@ -0,0 +1,31 @@
+package main
+
+import "testing"
+
+func TestLocalSandboxUIDs(t *testing.T) {
+	s := &localSandbox{}
+	a, err := s.allocUID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := s.allocUID()
+	if a != localSandboxUIDBase || b != a+1 {
+		t.Fatalf("uids = %d, %d, want %d, %d", a, b, localSandboxUIDBase, localSandboxUIDBase+1)
+	}
+	// a released uid is not handed out again before the rest of the range
+	s.releaseUID(a)
+	if c, _ := s.allocUID(); c != b+1 {
+		t.Fatalf("next uid = %d, want %d", c, b+1)
+	}
+	for i := 3; i < localSandboxUIDCount; i++ {
+		if _, err := s.allocUID(); err != nil {
+			t.Fatalf("alloc %d: %v", i, err)
+		}
+	}
+	if c, _ := s.allocUID(); c != a {
+		t.Fatalf("wrapped uid = %d, want %d", c, a)
+	}
+	if _, err := s.allocUID(); err == nil {
+		t.Fatal("allocated a uid with the whole range in use")
+	}
+}
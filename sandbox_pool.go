@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// WarmPoolStats is reported by /stats when the warm pool is enabled.
+type WarmPoolStats struct {
+	Capacity     int   `json:"capacity"`
+	Ready        int   `json:"ready"`
+	Hits         int64 `json:"hits"`
+	Misses       int64 `json:"misses"`
+	CreateErrors int64 `json:"create_errors"`
+}
+
+// warmPool keeps up to size booted, idle containers. take hands each one out
+// at most once; the refillers notice the free slot and boot a replacement.
+type warmPool struct {
+	size   int
+	create func(context.Context) (*warmContainer, error)
+	ready  chan *warmContainer
+
+	hits         atomic.Int64
+	misses       atomic.Int64
+	createErrors atomic.Int64
+}
+
+func newWarmPool(size int, create func(context.Context) (*warmContainer, error)) *warmPool {
+	return &warmPool{
+		size:   size,
+		create: create,
+		ready:  make(chan *warmContainer, size),
+	}
+}
+
+// start launches the background refillers. Sends on ready block while the
+// pool is full, so a refiller only boots a container once a slot is free.
+func (p *warmPool) start() {
+	refillers := p.size
+	if refillers > 2 {
+		refillers = 2
+	}
+	for i := 0; i < refillers; i++ {
+		go p.refillLoop()
+	}
+}
+
+func (p *warmPool) refillLoop() {
+	backoff := time.Second
+	for {
+		w, err := p.create(context.Background())
+		if err != nil {
+			p.createErrors.Add(1)
+			if logger != nil {
+				logger.Warn("warm pool refill failed", zap.Error(err), zap.Duration("retry_in", backoff))
+			}
+			time.Sleep(backoff)
+			if backoff < time.Minute {
+				backoff *= 2
+			}
+			continue
+		}
+		backoff = time.Second
+		p.ready <- w
+	}
+}
+
+// take returns a warm container if one is ready; it never blocks.
+// A nil pool always misses without counting.
+func (p *warmPool) take() (*warmContainer, bool) {
+	if p == nil {
+		return nil, false
+	}
+	select {
+	case w := <-p.ready:
+		p.hits.Add(1)
+		return w, true
+	default:
+		p.misses.Add(1)
+		return nil, false
+	}
+}
+
+func (p *warmPool) stats() WarmPoolStats {
+	return WarmPoolStats{
+		Capacity:     p.size,
+		Ready:        len(p.ready),
+		Hits:         p.hits.Load(),
+		Misses:       p.misses.Load(),
+		CreateErrors: p.createErrors.Load(),
+	}
+}
+
+// drain destroys the containers waiting in the pool, e.g. after a base
+// image refresh; the refillers boot replacements. A nil pool is a no-op.
+func (p *warmPool) drain(ctx context.Context) int {
+	if p == nil {
+		return 0
+	}
+	n := 0
+	for {
+		select {
+		case w := <-p.ready:
+			if err := w.destroy(ctx); err != nil && logger != nil {
+				logger.Warn("destroy drained warm container", zap.String("container_id", w.id), zap.Error(err))
+			}
+			n++
+		default:
+			return n
+		}
+	}
+}
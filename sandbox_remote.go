@@ -0,0 +1,718 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// remoteMaxAttempts bounds how many workers a task is handed to before it
+// fails with ErrWorkerLost (each attempt ends by a worker death or by
+// workerStartTimeout).
+const remoteMaxAttempts = 3
+
+// remoteSandbox (SANDBOX_BACKEND=remote) runs nothing itself: every
+// execution is handed to the least loaded live worker (MODE=worker) that
+// has the requested toolchain, over the protocol of worker_protocol.go.
+// Output, exit and resource usage come back on the task stream, so the
+// handlers, history and caches above the Sandbox interface are unchanged.
+type remoteSandbox struct {
+	mu      sync.Mutex
+	workers map[string]*remoteWorker
+	tasks   map[string]*remoteTask
+}
+
+type remoteWorker struct {
+	reg          workerRegistration
+	registeredAt time.Time
+	lastSeen     time.Time
+	pending      []*remoteTask // assigned, not polled yet
+	wake         chan struct{}
+	completed    uint64
+	lost         uint64
+}
+
+// remoteTask is one execution. The fields up to started are guarded by
+// remoteSandbox.mu; output writes and the exit by outMu.
+type remoteTask struct {
+	id    string
+	owner *remoteSandbox
+	req   *SandboxRequest
+	spec  workerTask
+
+	worker    string // "" while being reassigned
+	attempt   int    // bumped on every assignment: stale streams are refused
+	streaming bool
+	isStarted bool
+	stdinSent bool
+	lost      chan struct{} // closed when the current attempt must be redone
+
+	started     chan struct{} // closed by the started or error frame
+	startErr    error
+	containerID string
+	imageDigest string
+
+	control chan syscall.Signal
+
+	outMu    sync.Mutex
+	exited   bool
+	exitC    chan SandboxExit
+	usage    *ResourceUsage
+	done     chan struct{} // closed once the stream is over
+	doneOnce sync.Once
+}
+
+// WorkerInfo is one entry of GET /admin/workers.
+type WorkerInfo struct {
+	ID           string            `json:"id"`
+	Backend      string            `json:"backend"`
+	Capacity     int               `json:"capacity"`
+	Active       int               `json:"active"`
+	Queued       int               `json:"queued"`
+	Toolchains   []workerToolchain `json:"toolchains"`
+	RegisteredAt time.Time         `json:"registered_at"`
+	LastSeen     time.Time         `json:"last_seen"`
+	Completed    uint64            `json:"completed"`
+	Lost         uint64            `json:"lost"`
+}
+
+func newRemoteSandbox() *remoteSandbox {
+	return &remoteSandbox{workers: make(map[string]*remoteWorker), tasks: make(map[string]*remoteTask)}
+}
+
+func (s *remoteSandbox) Name() string { return "remote" }
+
+// Prepare hands req to a worker and returns once the worker has prepared
+// it, trying another worker when the chosen one dies or does not start it.
+func (s *remoteSandbox) Prepare(ctx context.Context, req *SandboxRequest) (SandboxExecution, error) {
+	if err := validateSandboxRequest(req); err != nil {
+		return nil, err
+	}
+	idBytes := make([]byte, 16)
+	if _, err := rand.Read(idBytes); err != nil {
+		return nil, fmt.Errorf("generate task id: %w", err)
+	}
+	t := &remoteTask{
+		id:      fmt.Sprintf("%x", idBytes),
+		owner:   s,
+		req:     req,
+		started: make(chan struct{}),
+		control: make(chan syscall.Signal, 4),
+		exitC:   make(chan SandboxExit, 1),
+		done:    make(chan struct{}),
+	}
+	t.spec = workerTask{
+		ID:           t.id,
+		Code:         req.Code,
+		HasStdin:     req.Stdin != nil,
+		PhaseMarker:  req.PhaseMarker,
+		Profile:      req.profile(),
+		Artifacts:    req.Artifacts,
+		CheckOnly:    req.CheckOnly,
+		CaseTimeouts: req.CaseTimeouts,
+		TimeoutMS:    req.Timeout.Milliseconds(),
+	}
+	if req.Toolchain != nil {
+		t.spec.Toolchain, t.spec.ToolchainHash = req.Toolchain.Version, req.Toolchain.Hash
+	}
+
+	for attempt := 1; ; attempt++ {
+		lost, workerID, err := s.assign(t)
+		if err != nil {
+			s.drop(t)
+			return nil, err
+		}
+		timer := time.NewTimer(workerStartTimeout)
+		select {
+		case <-t.started:
+			timer.Stop()
+			return s.started(t)
+		case <-lost:
+			timer.Stop()
+		case <-timer.C:
+			if s.unassign(t) {
+				return s.started(t)
+			}
+			logger.Warn("worker did not start task", zap.String("worker", workerID), zap.String("task", t.id))
+		case <-ctx.Done():
+			timer.Stop()
+			if s.unassign(t) {
+				// too late: runInSandbox kills it
+				return s.started(t)
+			}
+			s.drop(t)
+			return nil, ctx.Err()
+		}
+		if attempt >= remoteMaxAttempts {
+			s.drop(t)
+			return nil, fmt.Errorf("%w: task not started after %d attempts", ErrWorkerLost, attempt)
+		}
+	}
+}
+
+// started returns t once its worker answered the assignment.
+func (s *remoteSandbox) started(t *remoteTask) (SandboxExecution, error) {
+	<-t.started
+	if t.startErr != nil {
+		s.drop(t)
+		return nil, t.startErr
+	}
+	return t, nil
+}
+
+// assign queues t on the live worker with the lowest load that has its
+// toolchain. Workers that are full still take it: it waits in their queue.
+func (s *remoteSandbox) assign(t *remoteTask) (lost <-chan struct{}, workerID string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	load := s.loadLocked()
+	var best *remoteWorker
+	var bestLoad float64
+	for _, w := range s.workers {
+		if !w.hasToolchain(t.spec) {
+			continue
+		}
+		l := float64(load[w.reg.ID]) / float64(max(w.reg.Capacity, 1))
+		if best == nil || l < bestLoad || (l == bestLoad && w.reg.ID < best.reg.ID) {
+			best, bestLoad = w, l
+		}
+	}
+	if best == nil {
+		if t.spec.Toolchain != "" {
+			return nil, "", fmt.Errorf("%w for toolchain %q", ErrNoWorker, t.spec.Toolchain)
+		}
+		return nil, "", ErrNoWorker
+	}
+	t.worker = best.reg.ID
+	t.attempt++
+	t.streaming = false
+	t.stdinSent = false
+	t.lost = make(chan struct{})
+	s.tasks[t.id] = t
+	best.pending = append(best.pending, t)
+	select {
+	case best.wake <- struct{}{}:
+	default:
+	}
+	return t.lost, best.reg.ID, nil
+}
+
+// unassign takes t back from its worker; true when it has already started.
+func (s *remoteSandbox) unassign(t *remoteTask) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if t.isStarted {
+		return true
+	}
+	s.requeueLocked(t)
+	return false
+}
+
+// requeueLocked detaches a task that has not started from its worker and
+// wakes Prepare to assign it again.
+func (s *remoteSandbox) requeueLocked(t *remoteTask) {
+	if w := s.workers[t.worker]; w != nil {
+		w.removePending(t)
+	}
+	t.worker = ""
+	t.attempt++
+	if t.lost != nil {
+		close(t.lost)
+		t.lost = nil
+	}
+}
+
+// drop forgets a task that never started (Collect is not called for it).
+func (s *remoteSandbox) drop(t *remoteTask) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if w := s.workers[t.worker]; w != nil {
+		w.removePending(t)
+	}
+	t.worker = ""
+	t.attempt++
+	delete(s.tasks, t.id)
+	t.finish()
+}
+
+// loadLocked counts the tasks each worker holds, queued or running.
+func (s *remoteSandbox) loadLocked() map[string]int {
+	load := make(map[string]int, len(s.workers))
+	for _, t := range s.tasks {
+		if t.worker != "" {
+			load[t.worker]++
+		}
+	}
+	return load
+}
+
+func (w *remoteWorker) hasToolchain(spec workerTask) bool {
+	if spec.Toolchain == "" && spec.ToolchainHash == "" {
+		return true
+	}
+	for _, tc := range w.reg.Toolchains {
+		if spec.ToolchainHash != "" && tc.Hash == spec.ToolchainHash {
+			return true
+		}
+		if spec.ToolchainHash == "" && tc.Version == spec.Toolchain {
+			return true
+		}
+	}
+	return false
+}
+
+func (w *remoteWorker) removePending(t *remoteTask) {
+	for i, p := range w.pending {
+		if p == t {
+			w.pending = append(w.pending[:i], w.pending[i+1:]...)
+			return
+		}
+	}
+}
+
+func (s *remoteSandbox) Stats(ctx context.Context) ([]ContainerStats, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stats := make([]ContainerStats, 0, len(s.tasks))
+	for _, t := range s.tasks {
+		st := ContainerStats{ContainerID: t.id, Timestamp: time.Now(), Status: "queued", Runtime: "remote"}
+		if t.isStarted {
+			st.ContainerID, st.Status = t.containerID, "running"
+		}
+		if t.worker != "" {
+			st.Runtime = "remote:" + t.worker
+		}
+		stats = append(stats, st)
+	}
+	return stats, nil
+}
+
+// workerInfos lists the registered workers for GET /admin/workers.
+func (s *remoteSandbox) workerInfos() []WorkerInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	load := s.loadLocked()
+	out := make([]WorkerInfo, 0, len(s.workers))
+	for _, w := range s.workers {
+		out = append(out, WorkerInfo{
+			ID:           w.reg.ID,
+			Backend:      w.reg.Backend,
+			Capacity:     w.reg.Capacity,
+			Active:       load[w.reg.ID] - len(w.pending),
+			Queued:       len(w.pending),
+			Toolchains:   w.reg.Toolchains,
+			RegisteredAt: w.registeredAt,
+			LastSeen:     w.lastSeen,
+			Completed:    w.completed,
+			Lost:         w.lost,
+		})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out
+}
+
+// reapLoop drops workers that stopped sending heartbeats.
+func (s *remoteSandbox) reapLoop() {
+	ticker := time.NewTicker(workerHeartbeatInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		s.reap(time.Now())
+	}
+}
+
+func (s *remoteSandbox) reap(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, w := range s.workers {
+		if now.Sub(w.lastSeen) < workerDeadAfter {
+			continue
+		}
+		delete(s.workers, id)
+		requeued, lost := 0, 0
+		for _, t := range s.tasks {
+			if t.worker != id {
+				continue
+			}
+			if !t.isStarted {
+				s.requeueLocked(t)
+				requeued++
+				continue
+			}
+			t.exit(SandboxExit{ExitCode: -1, Err: ErrWorkerLost})
+			t.finish()
+			lost++
+		}
+		logger.Warn("worker lost", zap.String("worker", id), zap.Time("last_seen", w.lastSeen), zap.Int("requeued", requeued), zap.Int("lost", lost))
+	}
+}
+
+// write copies a chunk of the worker's output unless the run is over.
+func (t *remoteTask) write(stream string, data []byte) {
+	t.outMu.Lock()
+	defer t.outMu.Unlock()
+	if t.exited {
+		return
+	}
+	dst := t.req.Stdout
+	if stream == "stderr" {
+		dst = t.req.Stderr
+	}
+	if dst != nil {
+		_, _ = dst.Write(data)
+	}
+}
+
+// exit delivers the first exit only.
+func (t *remoteTask) exit(e SandboxExit) {
+	t.outMu.Lock()
+	defer t.outMu.Unlock()
+	if t.exited {
+		return
+	}
+	t.exited = true
+	t.exitC <- e
+}
+
+func (t *remoteTask) finish() {
+	t.doneOnce.Do(func() { close(t.done) })
+}
+
+func (t *remoteTask) ID() string { return t.containerID }
+
+// EnforcesTimeout implements sandboxStepTimer: the worker stops the run
+// when the timeout of the task is used up.
+func (t *remoteTask) EnforcesTimeout() bool { return t.spec.TimeoutMS > 0 }
+
+func (t *remoteTask) ImageDigest() string { return t.imageDigest }
+
+func (t *remoteTask) Run(ctx context.Context) (<-chan SandboxExit, error) {
+	// the worker runs the task as soon as it is prepared
+	return t.exitC, nil
+}
+
+func (t *remoteTask) Kill(ctx context.Context, sig syscall.Signal) error {
+	select {
+	case t.control <- sig:
+	default:
+	}
+	return nil
+}
+
+// Collect waits for the usage frame that follows the exit.
+func (t *remoteTask) Collect(ctx context.Context) (*ResourceUsage, error) {
+	timer := time.NewTimer(10 * time.Second)
+	defer timer.Stop()
+	select {
+	case <-t.done:
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+	s := t.owner
+	s.mu.Lock()
+	delete(s.tasks, t.id)
+	if w := s.workers[t.worker]; w != nil {
+		w.completed++
+	}
+	s.mu.Unlock()
+	t.outMu.Lock()
+	defer t.outMu.Unlock()
+	return t.usage, nil
+}
+
+// handleRegister is POST /worker/register. A worker registering again
+// under a known ID has restarted: what it had polled but not started is
+// handed out again.
+func (s *remoteSandbox) handleRegister(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var reg workerRegistration
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&reg); err != nil {
+		http.Error(w, "invalid registration", http.StatusBadRequest)
+		return
+	}
+	if reg.ID == "" || reg.ID != r.Header.Get("X-Worker-ID") || reg.Capacity <= 0 {
+		http.Error(w, "invalid registration", http.StatusBadRequest)
+		return
+	}
+	now := time.Now()
+	s.mu.Lock()
+	if old := s.workers[reg.ID]; old != nil {
+		for _, t := range s.tasks {
+			if t.worker == reg.ID && !t.streaming && !containsTask(old.pending, t) {
+				s.requeueLocked(t)
+			}
+		}
+		old.reg, old.lastSeen = reg, now
+	} else {
+		s.workers[reg.ID] = &remoteWorker{reg: reg, registeredAt: now, lastSeen: now, wake: make(chan struct{}, 1)}
+	}
+	s.mu.Unlock()
+	logger.Info("worker registered", zap.String("worker", reg.ID), zap.String("backend", reg.Backend), zap.Int("capacity", reg.Capacity), zap.Int("toolchains", len(reg.Toolchains)), zap.String("ip", extractClientIP(r)))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func containsTask(ts []*remoteTask, t *remoteTask) bool {
+	for _, x := range ts {
+		if x == t {
+			return true
+		}
+	}
+	return false
+}
+
+// handleHeartbeat is POST /worker/heartbeat; 404 asks the worker to
+// register again (the frontend restarted or dropped it).
+func (s *remoteSandbox) handleHeartbeat(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	s.mu.Lock()
+	wk := s.workers[r.Header.Get("X-Worker-ID")]
+	if wk != nil {
+		wk.lastSeen = time.Now()
+	}
+	s.mu.Unlock()
+	if wk == nil {
+		http.Error(w, "worker not registered", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handlePoll is GET /worker/poll: the next task queued for the worker, or
+// 204 after workerPollTimeout.
+func (s *remoteSandbox) handlePoll(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id := r.Header.Get("X-Worker-ID")
+	timer := time.NewTimer(workerPollTimeout)
+	defer timer.Stop()
+	for {
+		s.mu.Lock()
+		wk := s.workers[id]
+		if wk == nil {
+			s.mu.Unlock()
+			http.Error(w, "worker not registered", http.StatusNotFound)
+			return
+		}
+		wk.lastSeen = time.Now()
+		if len(wk.pending) > 0 {
+			t := wk.pending[0]
+			wk.pending = wk.pending[1:]
+			spec := t.spec
+			s.mu.Unlock()
+			w.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(w).Encode(spec)
+			return
+		}
+		wake := wk.wake
+		s.mu.Unlock()
+		select {
+		case <-wake:
+		case <-timer.C:
+			w.WriteHeader(http.StatusNoContent)
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// handleTask serves /worker/tasks/{id}/{stream,stdin,control}.
+func (s *remoteSandbox) handleTask(w http.ResponseWriter, r *http.Request) {
+	id, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/worker/tasks/"), "/")
+	workerID := r.Header.Get("X-Worker-ID")
+	s.mu.Lock()
+	t := s.tasks[id]
+	if t == nil || t.worker != workerID {
+		s.mu.Unlock()
+		http.Error(w, "task not assigned to this worker", http.StatusConflict)
+		return
+	}
+	attempt := t.attempt
+	switch {
+	case action == "stream" && r.Method == http.MethodPost:
+		if t.streaming {
+			s.mu.Unlock()
+			http.Error(w, "task already streaming", http.StatusConflict)
+			return
+		}
+		t.streaming = true
+		s.mu.Unlock()
+		s.streamTask(w, r, t, workerID, attempt)
+	case action == "stdin" && r.Method == http.MethodGet:
+		if t.stdinSent {
+			s.mu.Unlock()
+			http.Error(w, "stdin already sent", http.StatusConflict)
+			return
+		}
+		t.stdinSent = true
+		s.mu.Unlock()
+		sendTaskStdin(w, t)
+	case action == "control" && r.Method == http.MethodGet:
+		s.mu.Unlock()
+		controlTask(w, r, t)
+	default:
+		s.mu.Unlock()
+		http.NotFound(w, r)
+	}
+}
+
+// streamTask reads the worker's frames until the usage frame or EOF. A
+// stream that breaks before started sends the task to another worker; one
+// that breaks later ends the run with ErrWorkerLost.
+func (s *remoteSandbox) streamTask(w http.ResponseWriter, r *http.Request, t *remoteTask, workerID string, attempt int) {
+	dec := json.NewDecoder(r.Body)
+	started, stale := false, false
+	for !stale {
+		var f workerFrame
+		if err := dec.Decode(&f); err != nil {
+			break
+		}
+		if !started {
+			if f.Type != "started" && f.Type != "error" {
+				continue
+			}
+			s.mu.Lock()
+			if t.worker != workerID || t.attempt != attempt {
+				// reassigned meanwhile; the worker kills its copy
+				s.mu.Unlock()
+				stale = true
+				break
+			}
+			if f.Type == "error" {
+				t.startErr = fmt.Errorf("worker %s: %s", workerID, f.Error)
+			}
+			t.containerID, t.imageDigest = f.ContainerID, f.ImageDigest
+			t.isStarted = true
+			close(t.started)
+			s.mu.Unlock()
+			started = true
+			if f.Type == "error" {
+				break
+			}
+			continue
+		}
+		switch f.Type {
+		case "stdout", "stderr":
+			t.write(f.Type, f.Data)
+		case "exit":
+			if f.Exit != nil {
+				e := *f.Exit
+				e.Err = f.exitErr(workerID)
+				t.exit(e)
+			}
+		case "usage":
+			t.outMu.Lock()
+			t.usage = f.Usage
+			t.outMu.Unlock()
+		case "error":
+			t.exit(SandboxExit{ExitCode: -1, Err: fmt.Errorf("worker %s: %s", workerID, f.Error)})
+		}
+	}
+	if stale {
+		http.Error(w, "task reassigned", http.StatusConflict)
+		return
+	}
+	if !started {
+		s.mu.Lock()
+		if t.worker == workerID && t.attempt == attempt {
+			s.requeueLocked(t)
+		}
+		s.mu.Unlock()
+		http.Error(w, "stream ended before the task started", http.StatusBadRequest)
+		return
+	}
+	t.outMu.Lock()
+	exited := t.exited
+	t.outMu.Unlock()
+	if !exited && t.startErr == nil {
+		t.exit(SandboxExit{ExitCode: -1, Err: ErrWorkerLost})
+		s.mu.Lock()
+		if wk := s.workers[workerID]; wk != nil {
+			wk.lost++
+		}
+		s.mu.Unlock()
+		logger.Warn("worker stream ended before exit", zap.String("worker", workerID), zap.String("task", t.id), zap.String("container_id", t.containerID))
+	}
+	t.finish()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// sendTaskStdin streams the program input to the worker as it is produced
+// (interactive sessions write it while the program runs).
+func sendTaskStdin(w http.ResponseWriter, t *remoteTask) {
+	flusher, _ := w.(http.Flusher)
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.WriteHeader(http.StatusOK)
+	if flusher != nil {
+		flusher.Flush()
+	}
+	if t.req.Stdin == nil {
+		return
+	}
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := t.req.Stdin.Read(buf)
+		if n > 0 {
+			if _, werr := w.Write(buf[:n]); werr != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// controlTask long-polls for the next Kill of the task.
+func controlTask(w http.ResponseWriter, r *http.Request, t *remoteTask) {
+	timer := time.NewTimer(workerPollTimeout)
+	defer timer.Stop()
+	var c workerControl
+	select {
+	case c.Signal = <-t.control:
+	case <-t.done:
+		c.Done = true
+	case <-timer.C:
+		w.WriteHeader(http.StatusNoContent)
+		return
+	case <-r.Context().Done():
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(c)
+}
+
+// adminWorkersHandler is GET /admin/workers.
+func adminWorkersHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	s, ok := activeSandbox.(*remoteSandbox)
+	if !ok {
+		http.Error(w, "not running with SANDBOX_BACKEND=remote", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(s.workerInfos())
+}
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// newTestRemote returns a remoteSandbox with the given workers registered.
+func newTestRemote(t *testing.T, workers ...workerRegistration) *remoteSandbox {
+	t.Helper()
+	prev := logger
+	logger = zap.NewNop()
+	t.Cleanup(func() { logger = prev })
+	s := newRemoteSandbox()
+	for _, reg := range workers {
+		registerWorker(t, s, reg)
+	}
+	return s
+}
+
+func registerWorker(t *testing.T, s *remoteSandbox, reg workerRegistration) {
+	t.Helper()
+	body, _ := json.Marshal(reg)
+	r := httptest.NewRequest(http.MethodPost, "/worker/register", bytes.NewReader(body))
+	r.Header.Set("X-Worker-ID", reg.ID)
+	w := httptest.NewRecorder()
+	s.handleRegister(w, r)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("register %s: status %d", reg.ID, w.Code)
+	}
+}
+
+// workerCall sends a worker request for task id on behalf of workerID.
+func workerCall(s *remoteSandbox, method, path, workerID string, body io.Reader) int {
+	r := httptest.NewRequest(method, path, body)
+	r.Header.Set("X-Worker-ID", workerID)
+	w := httptest.NewRecorder()
+	if strings.HasPrefix(path, "/worker/tasks/") {
+		s.handleTask(w, r)
+	} else {
+		s.handlePoll(w, r)
+	}
+	return w.Code
+}
+
+// frames encodes a task stream.
+func frames(fs ...workerFrame) io.Reader {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, f := range fs {
+		enc.Encode(f)
+	}
+	return &buf
+}
+
+// waitAssigned waits until the only task is queued on a worker for an
+// attempt after the given one, and returns it with the worker ID.
+func waitAssigned(t *testing.T, s *remoteSandbox, after int) (*remoteTask, string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		s.mu.Lock()
+		for _, task := range s.tasks {
+			if w := s.workers[task.worker]; w != nil && task.attempt > after && containsTask(w.pending, task) {
+				s.mu.Unlock()
+				return task, w.reg.ID
+			}
+		}
+		s.mu.Unlock()
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("no task assigned after attempt %d", after)
+	return nil, ""
+}
+
+type prepared struct {
+	exec SandboxExecution
+	err  error
+}
+
+// prepareAsync runs Prepare for a small program in the background.
+func prepareAsync(s *remoteSandbox, stdout io.Writer) <-chan prepared {
+	out := make(chan prepared, 1)
+	go func() {
+		exec, err := s.Prepare(context.Background(), &SandboxRequest{Code: "main", PhaseMarker: "__m__", Stdout: stdout})
+		out <- prepared{exec, err}
+	}()
+	return out
+}
+
+func TestRemoteSandboxAssign(t *testing.T) {
+	v2 := workerToolchain{Version: "v2", Hash: "h2"}
+	tests := []struct {
+		name    string
+		workers []workerRegistration
+		load    map[string]int // tasks already held
+		spec    workerTask
+		want    string
+		wantErr error
+	}{
+		{
+			name:    "lowest load for its capacity",
+			workers: []workerRegistration{{ID: "a", Capacity: 1}, {ID: "b", Capacity: 4}},
+			load:    map[string]int{"a": 1, "b": 2},
+			want:    "b",
+		},
+		{
+			name:    "ties go to the lowest ID",
+			workers: []workerRegistration{{ID: "b", Capacity: 2}, {ID: "a", Capacity: 2}},
+			want:    "a",
+		},
+		{
+			name:    "full workers still queue",
+			workers: []workerRegistration{{ID: "a", Capacity: 1}},
+			load:    map[string]int{"a": 3},
+			want:    "a",
+		},
+		{
+			name:    "toolchain by hash",
+			workers: []workerRegistration{{ID: "a", Capacity: 1}, {ID: "b", Capacity: 1, Toolchains: []workerToolchain{v2}}},
+			spec:    workerTask{Toolchain: "v2", ToolchainHash: "h2"},
+			want:    "b",
+		},
+		{
+			name:    "toolchain by version",
+			workers: []workerRegistration{{ID: "a", Capacity: 1, Toolchains: []workerToolchain{v2}}},
+			spec:    workerTask{Toolchain: "v2"},
+			want:    "a",
+		},
+		{
+			name:    "no worker has the toolchain",
+			workers: []workerRegistration{{ID: "a", Capacity: 1, Toolchains: []workerToolchain{v2}}},
+			spec:    workerTask{Toolchain: "v2", ToolchainHash: "other"},
+			wantErr: ErrNoWorker,
+		},
+		{name: "no worker", wantErr: ErrNoWorker},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestRemote(t, tt.workers...)
+			for id, n := range tt.load {
+				for i := 0; i < n; i++ {
+					key := id + strings.Repeat("+", i+1)
+					s.tasks[key] = &remoteTask{id: key, worker: id}
+				}
+			}
+			task := &remoteTask{id: "new", spec: tt.spec}
+			_, got, err := s.assign(task)
+			if !errors.Is(err, tt.wantErr) || got != tt.want {
+				t.Fatalf("assigned to %q (%v), want %q (%v)", got, err, tt.want, tt.wantErr)
+			}
+			if err == nil && !containsTask(s.workers[got].pending, task) {
+				t.Error("task not queued on its worker")
+			}
+		})
+	}
+}
+
+// TestRemoteSandboxReassign checks that a task which has not started goes
+// back to a live worker and runs there.
+func TestRemoteSandboxReassign(t *testing.T) {
+	tests := []struct {
+		name  string
+		event func(s *remoteSandbox, task *remoteTask)
+		want  string // worker the task ends up on
+	}{
+		{
+			name: "worker dies before polling",
+			event: func(s *remoteSandbox, task *remoteTask) {
+				s.mu.Lock()
+				s.workers["a"].lastSeen = time.Now().Add(-workerDeadAfter)
+				s.mu.Unlock()
+				s.reap(time.Now())
+			},
+			want: "b",
+		},
+		{
+			name: "stream ends before started",
+			event: func(s *remoteSandbox, task *remoteTask) {
+				workerCall(s, http.MethodPost, "/worker/tasks/"+task.id+"/stream", "a", frames())
+			},
+			want: "a",
+		},
+		{
+			name: "worker restarts after polling",
+			event: func(s *remoteSandbox, task *remoteTask) {
+				workerCall(s, http.MethodGet, "/worker/poll", "a", nil)
+				registerWorker(t, s, workerRegistration{ID: "a", Capacity: 1})
+			},
+			want: "a",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestRemote(t, workerRegistration{ID: "a", Capacity: 1}, workerRegistration{ID: "b", Capacity: 1})
+			var stdout bytes.Buffer
+			res := prepareAsync(s, &stdout)
+			task, first := waitAssigned(t, s, 0)
+			if first != "a" {
+				t.Fatalf("first assigned to %s, want a", first)
+			}
+			tt.event(s, task)
+			task, got := waitAssigned(t, s, 1)
+			if got != tt.want {
+				t.Fatalf("reassigned to %s, want %s", got, tt.want)
+			}
+			// a stream from the previous owner is refused
+			if got != "a" {
+				if code := workerCall(s, http.MethodPost, "/worker/tasks/"+task.id+"/stream", "a", frames()); code != http.StatusConflict {
+					t.Errorf("stale stream: status %d, want 409", code)
+				}
+			}
+
+			code := workerCall(s, http.MethodPost, "/worker/tasks/"+task.id+"/stream", got, frames(
+				workerFrame{Type: "started", ContainerID: "c1"},
+				workerFrame{Type: "stdout", Data: []byte("hi\n")},
+				workerFrame{Type: "exit", Exit: &SandboxExit{ExitCode: 3}},
+				workerFrame{Type: "usage", Usage: &ResourceUsage{}},
+			))
+			if code != http.StatusNoContent {
+				t.Fatalf("stream: status %d", code)
+			}
+			p := <-res
+			if p.err != nil {
+				t.Fatal(p.err)
+			}
+			exitC, _ := p.exec.Run(context.Background())
+			if e := <-exitC; e.ExitCode != 3 || p.exec.ID() != "c1" || stdout.String() != "hi\n" {
+				t.Errorf("exit %+v id %s stdout %q, want 3 from c1 printing hi", e, p.exec.ID(), stdout.String())
+			}
+			if usage, _ := p.exec.Collect(context.Background()); usage == nil {
+				t.Error("usage frame lost")
+			}
+		})
+	}
+}
+
+// TestRemoteSandboxWorkerLost checks the runs that end with ErrWorkerLost.
+func TestRemoteSandboxWorkerLost(t *testing.T) {
+	tests := []struct {
+		name string
+		// lose runs the worker side; it returns once the worker is gone
+		lose       func(t *testing.T, s *remoteSandbox, res <-chan prepared) prepared
+		prepareErr bool // Prepare itself fails
+	}{
+		{
+			name: "stream ends before the exit",
+			lose: func(t *testing.T, s *remoteSandbox, res <-chan prepared) prepared {
+				task, w := waitAssigned(t, s, 0)
+				workerCall(s, http.MethodPost, "/worker/tasks/"+task.id+"/stream", w, frames(
+					workerFrame{Type: "started", ContainerID: "c1"},
+					workerFrame{Type: "stdout", Data: []byte("partial")},
+				))
+				return <-res
+			},
+		},
+		{
+			name: "heartbeats stop mid-run",
+			lose: func(t *testing.T, s *remoteSandbox, res <-chan prepared) prepared {
+				task, w := waitAssigned(t, s, 0)
+				pr, pw := io.Pipe()
+				go workerCall(s, http.MethodPost, "/worker/tasks/"+task.id+"/stream", w, pr)
+				json.NewEncoder(pw).Encode(workerFrame{Type: "started", ContainerID: "c1"})
+				p := <-res
+				s.reap(time.Now().Add(workerDeadAfter))
+				pw.Close()
+				return p
+			},
+		},
+		{
+			name: "never started",
+			lose: func(t *testing.T, s *remoteSandbox, res <-chan prepared) prepared {
+				attempt := 0
+				for i := 0; i < remoteMaxAttempts; i++ {
+					task, w := waitAssigned(t, s, attempt)
+					attempt = task.attempt
+					workerCall(s, http.MethodPost, "/worker/tasks/"+task.id+"/stream", w, frames())
+				}
+				return <-res
+			},
+			prepareErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestRemote(t, workerRegistration{ID: "a", Capacity: 1})
+			p := tt.lose(t, s, prepareAsync(s, io.Discard))
+			if tt.prepareErr || p.err != nil {
+				if !tt.prepareErr || !errors.Is(p.err, ErrWorkerLost) {
+					t.Fatalf("Prepare error = %v, want ErrWorkerLost %v", p.err, tt.prepareErr)
+				}
+				return
+			}
+			exitC, _ := p.exec.Run(context.Background())
+			select {
+			case e := <-exitC:
+				if !errors.Is(e.Err, ErrWorkerLost) {
+					t.Errorf("exit %+v, want ErrWorkerLost", e)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("no exit after the worker was lost")
+			}
+			p.exec.Collect(context.Background())
+			if stats, _ := s.Stats(context.Background()); len(stats) != 0 {
+				t.Errorf("%d tasks left after Collect", len(stats))
+			}
+		})
+	}
+}
+
+// TestRemoteSandboxTimeout runs a task on a worker with the fake backend,
+// which does not time its steps: the worker must stop it.
+func TestRemoteSandboxTimeout(t *testing.T) {
+	tests := []struct {
+		name     string
+		delay    time.Duration
+		timeout  time.Duration
+		timedOut bool
+	}{
+		{name: "run ends in time", timeout: 5 * time.Second},
+		{name: "worker stops the run", delay: time.Hour, timeout: 200 * time.Millisecond, timedOut: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestRemote(t, workerRegistration{ID: "w", Capacity: 1})
+			mux := http.NewServeMux()
+			mux.HandleFunc("/worker/tasks/", s.handleTask)
+			srv := httptest.NewServer(mux)
+			defer srv.Close()
+			c := &workerClient{base: srv.URL, id: "w", sb: &fakeSandbox{active: map[string]*fakeExecution{}, Delay: tt.delay}, http: srv.Client()}
+
+			res := make(chan prepared, 1)
+			go func() {
+				exec, err := s.Prepare(context.Background(), &SandboxRequest{Code: "main", PhaseMarker: "__m__", Timeout: tt.timeout})
+				res <- prepared{exec, err}
+			}()
+			task, _ := waitAssigned(t, s, 0)
+			if task.spec.TimeoutMS != tt.timeout.Milliseconds() {
+				t.Errorf("task timeout %dms, want %s", task.spec.TimeoutMS, tt.timeout)
+			}
+			go c.runTask(&task.spec)
+			p := <-res
+			if p.err != nil {
+				t.Fatal(p.err)
+			}
+			if st, ok := p.exec.(sandboxStepTimer); !ok || !st.EnforcesTimeout() {
+				t.Error("the frontend does not leave the timeout to the worker")
+			}
+			exitC, _ := p.exec.Run(context.Background())
+			select {
+			case e := <-exitC:
+				if errors.Is(e.Err, ErrExecTimeout) != tt.timedOut {
+					t.Errorf("exit %+v, want timed out %v", e, tt.timedOut)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("the worker never stopped the run")
+			}
+			p.exec.Collect(context.Background())
+		})
+	}
+}
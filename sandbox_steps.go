@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// sandboxWorkDir is where the containerd backend compiles and runs, on the
+// /tmp tmpfs of the container.
+const sandboxWorkDir = "/tmp/work"
+
+// stepTimeoutGrace is how much longer than SandboxRequest.Timeout the caller
+// waits for an execution that stops its steps itself (sandboxStepTimer).
+const stepTimeoutGrace = 2 * time.Second
+
+// sandboxStep is one process started by runSteps.
+type sandboxStep struct {
+	id      string // exec ID, unique within the execution
+	args    []string
+	cwd     string
+	stdin   io.Reader // nil: /dev/null
+	stdout  io.Writer // nil: discarded
+	stderr  io.Writer
+	rlimits []specs.POSIXRlimit
+	// limit kills the process with SIGKILL after it; 0 for none
+	limit time.Duration
+}
+
+// sandboxSteps runs a request one process per step and without a shell; the
+// containerd and local backends embed it and supply start.
+type sandboxSteps struct {
+	req *SandboxRequest
+	// cases are the judge inputs, split out of req.Stdin
+	cases [][]byte
+	// rlimits of ./out and the helper, compileRlimits of the compiler: the
+	// request's profile (warm containers may differ)
+	rlimits        []specs.POSIXRlimit
+	compileRlimits []specs.POSIXRlimit
+	compileTimeout time.Duration
+	// initPath is the sandbox-init binary, workDir where the steps compile
+	// and run, langDir the toolchain to copy, all as the steps see them
+	initPath string
+	workDir  string
+	langDir  string
+	// start runs one step and waits for it and for its output to be copied.
+	// A step killed for exceeding its limit reports timedOut.
+	start func(ctx context.Context, st sandboxStep) (exitCode int, timedOut bool, err error)
+	// killed holds the signal of Kill; no step is started after it
+	killed atomic.Int32
+}
+
+// EnforcesTimeout implements sandboxStepTimer.
+func (e *sandboxSteps) EnforcesTimeout() bool { return true }
+
+// runSteps compiles and runs req: the helper (sandbox-init) copies the
+// toolchain and writes the source, then the compiler and ./out run with
+// explicit argv. The phase markers phaseCapture parses are written around
+// them here. The compile and run steps get what is left of req.Timeout, so
+// a timeout names the step that ran out.
+func (e *sandboxSteps) runSteps(ctx context.Context) SandboxExit {
+	req := e.req
+	started := time.Now()
+	// remaining is the rest of req.Timeout, 0 when there is none
+	remaining := func() time.Duration {
+		if req.Timeout <= 0 {
+			return 0
+		}
+		return max(req.Timeout-time.Since(started), time.Millisecond)
+	}
+	if err := e.helper(ctx, "prepare", nil, nil, "prepare", e.workDir, e.langDir); err != nil {
+		return e.failed(err)
+	}
+	// the code is a file the helper reads from stdin, never a command line
+	if err := e.helper(ctx, "put-source", strings.NewReader(req.Code), nil, "put", path.Join(e.workDir, "test.lang"), "0644"); err != nil {
+		return e.failed(err)
+	}
+	var before map[string]bool
+	if req.Artifacts {
+		names, err := e.listWorkDir(ctx, "list-before")
+		if err != nil {
+			return e.failed(err)
+		}
+		before = make(map[string]bool, len(names))
+		for _, name := range names {
+			before[name] = true
+		}
+	}
+
+	e.mark("compile-start")
+	exit := SandboxExit{}
+	if req.CachedBinary != "" && e.putCachedBinary(ctx) {
+		e.mark("compile-cached")
+	} else {
+		limit := e.compileTimeout
+		if rest := remaining(); rest > 0 && (limit == 0 || rest < limit) {
+			limit = rest
+		}
+		rc, timedOut, err := e.start(ctx, sandboxStep{
+			id: "compile", args: []string{"./compiler", "test.lang", "out"}, cwd: e.workDir,
+			stdout: req.Stdout, stderr: req.Stderr, rlimits: e.compileRlimits, limit: limit,
+		})
+		if err != nil {
+			return e.failed(err)
+		}
+		exit.ExitCode = rc
+		switch {
+		case timedOut && limit == e.compileTimeout:
+			exit.Err = fmt.Errorf("%w: compile step exceeded %s", ErrExecTimeout, e.compileTimeout)
+		case timedOut:
+			exit.Err = fmt.Errorf("%w: compile step exceeded the %s timeout", ErrExecTimeout, req.Timeout)
+		}
+	}
+	if e.killed.Load() != 0 {
+		return exit
+	}
+	e.mark(fmt.Sprintf("compile-end %d", exit.ExitCode))
+	if exit.ExitCode != 0 {
+		return exit
+	}
+
+	if req.Artifacts {
+		e.sendArtifacts(ctx, before)
+	}
+	// binary cache: ./out goes back before anything of the program ran
+	if req.ReturnBinary {
+		e.markStderr("binary-start")
+		e.markStderr(fmt.Sprintf("binary-end %d", e.sendBase64(ctx, "binary", "cat", path.Join(e.workDir, "out"))))
+	}
+	switch {
+	case len(req.CaseTimeouts) > 0:
+		for i, secs := range req.CaseTimeouts {
+			if e.killed.Load() != 0 {
+				return exit
+			}
+			e.mark(fmt.Sprintf("case-start %d", i))
+			rc, _, err := e.start(ctx, sandboxStep{
+				id: fmt.Sprintf("case-%d", i), args: []string{"./out"}, cwd: e.workDir,
+				stdin: bytes.NewReader(e.cases[i]), stdout: req.Stdout, stderr: req.Stderr,
+				rlimits: e.rlimits, limit: time.Duration(secs) * time.Second,
+			})
+			if err != nil {
+				return e.failed(err)
+			}
+			if e.killed.Load() != 0 {
+				return exit
+			}
+			e.mark(fmt.Sprintf("case-end %d %d", i, rc))
+		}
+	case !req.CheckOnly:
+		e.mark("run-start")
+		limit := remaining()
+		rc, timedOut, err := e.start(ctx, sandboxStep{
+			id: "run", args: []string{"./out"}, cwd: e.workDir,
+			stdin: req.Stdin, stdout: req.Stdout, stderr: req.Stderr, rlimits: e.rlimits, limit: limit,
+		})
+		if err != nil {
+			return e.failed(err)
+		}
+		exit.ExitCode = rc
+		if timedOut {
+			exit.Err = fmt.Errorf("%w: run step exceeded the %s left of the %s timeout", ErrExecTimeout, limit.Round(time.Millisecond), req.Timeout)
+		}
+		if e.killed.Load() != 0 {
+			return exit
+		}
+		e.mark(fmt.Sprintf("run-end %d", rc))
+	}
+	return exit
+}
+
+// failed is the exit of a step that could not be run at all.
+func (e *sandboxSteps) failed(err error) SandboxExit {
+	return SandboxExit{ExitCode: -1, Err: fmt.Errorf("sandbox step: %w", err)}
+}
+
+// helper runs the sandbox-init helper with args; a failure carries what it
+// printed on stderr.
+func (e *sandboxSteps) helper(ctx context.Context, id string, stdin io.Reader, stdout io.Writer, args ...string) error {
+	var stderr bytes.Buffer
+	rc, _, err := e.start(ctx, sandboxStep{
+		id: id, args: append([]string{e.initPath}, args...), cwd: "/",
+		stdin: stdin, stdout: stdout, stderr: &stderr, rlimits: e.rlimits,
+	})
+	if err != nil {
+		return err
+	}
+	if rc != 0 {
+		return fmt.Errorf("%s: exit status %d: %s", id, rc, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// listWorkDir returns the names in the work dir (like ls -A).
+func (e *sandboxSteps) listWorkDir(ctx context.Context, id string) ([]string, error) {
+	var out bytes.Buffer
+	if err := e.helper(ctx, id, nil, &out, "list", e.workDir); err != nil {
+		return nil, err
+	}
+	return strings.FieldsFunc(out.String(), func(r rune) bool { return r == 0 }), nil
+}
+
+// sendArtifacts prints the files the compiler added as a base64 tar on
+// stderr, between artifacts markers.
+func (e *sandboxSteps) sendArtifacts(ctx context.Context, before map[string]bool) {
+	e.markStderr("artifacts-start")
+	names, err := e.listWorkDir(ctx, "list-after")
+	if err != nil {
+		e.markStderr("artifacts-end 1")
+		return
+	}
+	args := []string{"pack", e.workDir}
+	for _, name := range names {
+		if !before[name] {
+			args = append(args, name)
+		}
+	}
+	e.markStderr(fmt.Sprintf("artifacts-end %d", e.sendBase64(ctx, "artifacts", args...)))
+}
+
+// sendBase64 prints what the helper writes on stdout as base64 on stderr,
+// returning the status for the end marker.
+func (e *sandboxSteps) sendBase64(ctx context.Context, id string, args ...string) int {
+	if e.req.Stderr == nil {
+		return 1
+	}
+	lines := &lineWrapper{w: e.req.Stderr, width: 76}
+	enc := base64.NewEncoder(base64.StdEncoding, lines)
+	err := e.helper(ctx, id, nil, enc, args...)
+	_ = enc.Close()
+	if lines.col > 0 {
+		_, _ = io.WriteString(e.req.Stderr, "\n")
+	}
+	if err != nil {
+		return 1
+	}
+	return 0
+}
+
+// putCachedBinary copies the cached ./out of the request into the work dir.
+// It is false (compile instead) when the file was evicted meanwhile.
+func (e *sandboxSteps) putCachedBinary(ctx context.Context) bool {
+	if binariesCache == nil {
+		return false
+	}
+	f, err := os.Open(filepath.Join(binariesCache.dir, e.req.CachedBinary))
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	return e.helper(ctx, "put-binary", f, nil, "put", path.Join(e.workDir, "out"), "0755") == nil
+}
+
+// mark prints a phase marker on both streams, markStderr on stderr only.
+func (e *sandboxSteps) mark(event string) {
+	line := e.req.PhaseMarker + " " + event + "\n"
+	if e.req.Stdout != nil {
+		_, _ = io.WriteString(e.req.Stdout, line)
+	}
+	e.markStderr(event)
+}
+
+func (e *sandboxSteps) markStderr(event string) {
+	if e.req.Stderr != nil {
+		_, _ = io.WriteString(e.req.Stderr, e.req.PhaseMarker+" "+event+"\n")
+	}
+}
+
+// lineWrapper breaks what is written to w into lines of width bytes, like
+// the base64 tool does.
+type lineWrapper struct {
+	w     io.Writer
+	width int
+	col   int
+}
+
+func (l *lineWrapper) Write(p []byte) (int, error) {
+	n := 0
+	for len(p) > 0 {
+		chunk := min(len(p), l.width-l.col)
+		if _, err := l.w.Write(p[:chunk]); err != nil {
+			return n, err
+		}
+		n += chunk
+		p = p[chunk:]
+		if l.col += chunk; l.col == l.width {
+			if _, err := io.WriteString(l.w, "\n"); err != nil {
+				return n, err
+			}
+			l.col = 0
+		}
+	}
+	return n, nil
+}
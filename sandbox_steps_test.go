@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"io"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// fakeStep is what a step prints and returns under runStepsFake.
+type fakeStep struct {
+	stdout, stderr string
+	rc             int
+	timedOut       bool
+	kill           bool // Kill arrives while the step runs
+}
+
+// runStepsFake runs req through runSteps with steps standing in for the
+// processes, and returns the result phaseCapture makes of it with the IDs
+// and limits of the steps started.
+func runStepsFake(req *SandboxRequest, compileTimeout time.Duration, cases [][]byte, steps map[string]fakeStep) (*ExecutionResult, SandboxExit, []string, map[string]time.Duration) {
+	c := newPhaseCapture("__m__", nil, 1<<20)
+	c.skipRun = len(req.CaseTimeouts) > 0 || req.CheckOnly
+	req.PhaseMarker, req.Stdout, req.Stderr = "__m__", c.stdout, c.stderr
+	e := &sandboxSteps{req: req, cases: cases, compileTimeout: compileTimeout, initPath: "/init", workDir: "/tmp/work", langDir: "/lang"}
+	var ids []string
+	limits := map[string]time.Duration{}
+	e.start = func(ctx context.Context, st sandboxStep) (int, bool, error) {
+		ids = append(ids, st.id)
+		limits[st.id] = st.limit
+		f := steps[st.id]
+		if st.stdout != nil {
+			io.WriteString(st.stdout, f.stdout)
+		}
+		if st.stderr != nil {
+			io.WriteString(st.stderr, f.stderr)
+		}
+		if f.kill {
+			e.killed.Store(int32(syscall.SIGKILL))
+		}
+		return f.rc, f.timedOut, nil
+	}
+	exit := e.runSteps(context.Background())
+	return c.result(time.Now(), exit, exit.Err), exit, ids, limits
+}
+
+func TestRunSteps(t *testing.T) {
+	tests := []struct {
+		name           string
+		req            SandboxRequest
+		compileTimeout time.Duration
+		steps          map[string]fakeStep
+		want           []string // step IDs in order
+		limits         map[string]time.Duration
+		status         ExecutionStatus
+		runStdout      string
+		wantErr        string
+	}{
+		{
+			name:      "compile and run",
+			steps:     map[string]fakeStep{"compile": {stdout: "ok\n"}, "run": {stdout: "hi\n", rc: 3}},
+			want:      []string{"prepare", "put-source", "compile", "run"},
+			status:    StatusRuntimeError,
+			runStdout: "hi\n",
+		},
+		{
+			name:   "compile error",
+			steps:  map[string]fakeStep{"compile": {stderr: "syntax error\n", rc: 1}},
+			want:   []string{"prepare", "put-source", "compile"},
+			status: StatusCompileError,
+		},
+		{
+			name:   "check only",
+			req:    SandboxRequest{CheckOnly: true},
+			want:   []string{"prepare", "put-source", "compile"},
+			status: StatusOK,
+		},
+		{
+			name:    "helper fails",
+			steps:   map[string]fakeStep{"prepare": {stderr: "no space left\n", rc: 1}},
+			want:    []string{"prepare"},
+			status:  StatusInternalError,
+			wantErr: "sandbox step: prepare: exit status 1: no space left",
+		},
+		{
+			name:           "compile limit",
+			compileTimeout: 10 * time.Second,
+			steps:          map[string]fakeStep{"compile": {rc: 137, timedOut: true}},
+			want:           []string{"prepare", "put-source", "compile"},
+			limits:         map[string]time.Duration{"compile": 10 * time.Second},
+			status:         StatusTimeout,
+			wantErr:        "compile step exceeded 10s",
+		},
+		{
+			name:           "compile gets what is left of the timeout",
+			req:            SandboxRequest{Timeout: 2 * time.Second},
+			compileTimeout: 10 * time.Second,
+			steps:          map[string]fakeStep{"compile": {rc: 137, timedOut: true}},
+			want:           []string{"prepare", "put-source", "compile"},
+			limits:         map[string]time.Duration{"compile": 2 * time.Second},
+			status:         StatusTimeout,
+			wantErr:        "compile step exceeded the 2s timeout",
+		},
+		{
+			name:    "run times out",
+			req:     SandboxRequest{Timeout: 2 * time.Second},
+			steps:   map[string]fakeStep{"run": {stdout: "partial\n", rc: 137, timedOut: true}},
+			want:    []string{"prepare", "put-source", "compile", "run"},
+			limits:  map[string]time.Duration{"run": 2 * time.Second},
+			status:  StatusTimeout,
+			wantErr: "run step exceeded",
+		},
+		{
+			name:   "judge cases",
+			req:    SandboxRequest{CaseTimeouts: []int{1, 3}},
+			steps:  map[string]fakeStep{"case-1": {rc: 1}},
+			want:   []string{"prepare", "put-source", "compile", "case-0", "case-1"},
+			limits: map[string]time.Duration{"case-0": time.Second, "case-1": 3 * time.Second},
+			status: StatusOK,
+		},
+		{
+			name:   "killed during the compile",
+			steps:  map[string]fakeStep{"compile": {kill: true}},
+			want:   []string{"prepare", "put-source", "compile"},
+			status: StatusInternalError,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := tt.req
+			req.Code = "main"
+			res, exit, ids, limits := runStepsFake(&req, tt.compileTimeout, [][]byte{[]byte("1"), []byte("2")}, tt.steps)
+			if strings.Join(ids, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("steps %v, want %v", ids, tt.want)
+			}
+			for id, max := range tt.limits {
+				if limits[id] <= 0 || limits[id] > max {
+					t.Errorf("%s limit %s, want (0, %s]", id, limits[id], max)
+				}
+			}
+			if tt.limits["run"] == 0 && limits["run"] != 0 {
+				t.Errorf("run limit %s without a timeout", limits["run"])
+			}
+			if res.Status != tt.status {
+				t.Errorf("status %s, want %s", res.Status, tt.status)
+			}
+			if tt.runStdout != "" && (res.Run == nil || res.Run.Stdout != tt.runStdout) {
+				t.Errorf("run = %+v, want stdout %q", res.Run, tt.runStdout)
+			}
+			if tt.wantErr == "" && exit.Err != nil || tt.wantErr != "" && (exit.Err == nil || !strings.Contains(exit.Err.Error(), tt.wantErr)) {
+				t.Errorf("exit error %v, want %q", exit.Err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestLineWrapper(t *testing.T) {
+	tests := []struct {
+		writes []string
+		width  int
+		want   string
+	}{
+		{writes: []string{"abc"}, width: 4, want: "abc"},
+		{writes: []string{"abcd"}, width: 4, want: "abcd\n"},
+		{writes: []string{"abcdefghij"}, width: 4, want: "abcd\nefgh\nij"},
+		{writes: []string{"ab", "cdef", "g"}, width: 3, want: "abc\ndef\ng"},
+	}
+	for _, tt := range tests {
+		var out strings.Builder
+		l := &lineWrapper{w: &out, width: tt.width}
+		for _, w := range tt.writes {
+			if n, err := l.Write([]byte(w)); n != len(w) || err != nil {
+				t.Fatalf("Write(%q) = %d, %v", w, n, err)
+			}
+		}
+		if out.String() != tt.want {
+			t.Errorf("%q in %d columns = %q, want %q", tt.writes, tt.width, out.String(), tt.want)
+		}
+	}
+}
@@ -19,6 +19,7 @@ rsync -a --delete "${PROJECT_DIR}/" "${INSTALL_DIR}/"
 echo "==> Building Go binary..."
 cd "${INSTALL_DIR}"
 go build -o compilerOnline .
+CGO_ENABLED=0 go build -o sandbox-init ./cmd/sandbox-init
 
 echo "==> Setting up Kata host prerequisites..."
 cp "${INSTALL_DIR}/scripts/setup-kata.sh" /usr/local/bin/compileronline-setup-kata.sh
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/net/websocket"
+)
+
+// sessionMessage is the JSON frame exchanged on /session.
+//
+// Client -> server:
+//
+//	{"type":"start","code":"..."}   first frame, starts the program
+//	                                (optional "toolchain":"<version>")
+//	{"type":"stdin","data":"..."}   forwarded to the program's stdin
+//	{"type":"eof"}                  closes the program's stdin
+//
+// Server -> client: "phase" (phase), "output" (phase, stream, data,
+// truncated), then one "result" (result) or "error" (error).
+type sessionMessage struct {
+	Type      string           `json:"type"`
+	Code      string           `json:"code,omitempty"`
+	Toolchain string           `json:"toolchain,omitempty"`
+	Data      string           `json:"data,omitempty"`
+	Phase     string           `json:"phase,omitempty"`
+	Stream    string           `json:"stream,omitempty"`
+	Truncated bool             `json:"truncated,omitempty"`
+	Result    *ExecutionResult `json:"result,omitempty"`
+	Error     string           `json:"error,omitempty"`
+}
+
+// sessionConn sends frames on the WebSocket and implements outputListener.
+// Every frame sent or received counts as activity for the idle timeout.
+type sessionConn struct {
+	mu           sync.Mutex
+	ws           *websocket.Conn
+	lastActivity atomic.Int64
+}
+
+func (c *sessionConn) touch() {
+	c.lastActivity.Store(time.Now().UnixNano())
+}
+
+func (c *sessionConn) idleFor() time.Duration {
+	return time.Since(time.Unix(0, c.lastActivity.Load()))
+}
+
+func (c *sessionConn) send(msg sessionMessage) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_ = c.ws.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	if err := websocket.JSON.Send(c.ws, msg); err == nil {
+		c.touch()
+	}
+}
+
+func (c *sessionConn) phaseStarted(phase string) {
+	c.send(sessionMessage{Type: "phase", Phase: phase})
+}
+
+func (c *sessionConn) output(chunk OutputChunk) {
+	c.send(sessionMessage{Type: "output", Phase: chunk.Phase, Stream: chunk.Stream, Data: chunk.Data, Truncated: chunk.Truncated})
+}
+
+// sessionHandler upgrades to a WebSocket running one interactive program:
+// the browser's input is piped to ./out while the output is streamed back.
+// The session holds a compileLimiter slot for its whole life, ends after
+// InteractiveIdleTimeout without traffic and is capped at the profile's
+// timeout * InteractiveTimeoutFactor of wall clock time.
+func sessionHandler(w http.ResponseWriter, r *http.Request) {
+	clientIP := extractClientIP(r)
+	release, ok := acquireCompileSlot(w, r, clientIP)
+	if !ok {
+		return
+	}
+	defer release()
+	profile := selectProfile(r)
+	srv := websocket.Server{
+		Handshake: checkSessionOrigin,
+		Handler: func(ws *websocket.Conn) {
+			runSession(ws, clientIP, profile)
+		},
+	}
+	srv.ServeHTTP(w, r)
+}
+
+// checkSessionOrigin only accepts browsers on this site; clients that do not
+// send an Origin (curl, scripts) are let through like they are on /compile.
+func checkSessionOrigin(cfg *websocket.Config, r *http.Request) error {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return nil
+	}
+	u, err := url.Parse(origin)
+	if err != nil || !strings.EqualFold(u.Host, r.Host) {
+		return fmt.Errorf("cross-origin session from %q rejected", origin)
+	}
+	cfg.Origin = u
+	return nil
+}
+
+func sessionTimeouts(profile *ResourceProfile) (idle, total time.Duration) {
+	idle, factor := 30*time.Second, 6
+	if appConfig != nil {
+		idle, factor = appConfig.InteractiveIdleTimeout, appConfig.InteractiveTimeoutFactor
+	}
+	return idle, profile.Timeout() * time.Duration(factor)
+}
+
+func runSession(ws *websocket.Conn, clientIP string, profile *ResourceProfile) {
+	defer ws.Close()
+	conn := &sessionConn{ws: ws}
+	conn.touch()
+	idle, total := sessionTimeouts(profile)
+
+	var start sessionMessage
+	_ = ws.SetReadDeadline(time.Now().Add(idle))
+	if err := websocket.JSON.Receive(ws, &start); err != nil {
+		return
+	}
+	_ = ws.SetReadDeadline(time.Time{})
+	if start.Type != "start" || start.Code == "" {
+		conn.send(sessionMessage{Type: "error", Error: "first message must be {\"type\":\"start\",\"code\":...}"})
+		return
+	}
+	toolchain, err := resolveToolchain(start.Toolchain)
+	if err != nil {
+		conn.send(sessionMessage{Type: "error", Error: err.Error()})
+		return
+	}
+
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+	stdinR, stdinW := io.Pipe()
+	defer stdinW.Close()
+
+	// input: forward frames to the program until EOF, disconnect or overflow
+	var (
+		inputMu    sync.Mutex
+		transcript strings.Builder
+	)
+	go func() {
+		for {
+			var msg sessionMessage
+			if err := websocket.JSON.Receive(ws, &msg); err != nil {
+				cancel(nil)
+				_ = stdinW.CloseWithError(err)
+				return
+			}
+			conn.touch()
+			switch msg.Type {
+			case "stdin":
+				inputMu.Lock()
+				tooLarge := transcript.Len()+len(msg.Data) > maxStdinBytes
+				if !tooLarge {
+					transcript.WriteString(msg.Data)
+				}
+				inputMu.Unlock()
+				if tooLarge {
+					conn.send(sessionMessage{Type: "error", Error: ErrStdinTooLarge.Error()})
+					cancel(nil)
+					_ = stdinW.CloseWithError(ErrStdinTooLarge)
+					return
+				}
+				if _, err := io.WriteString(stdinW, msg.Data); err != nil {
+					return
+				}
+			case "eof":
+				_ = stdinW.Close()
+			}
+		}
+	}()
+
+	// idle watchdog
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if conn.idleFor() > idle {
+					cancel(fmt.Errorf("%w: session idle for %s", ErrExecTimeout, idle))
+					return
+				}
+			}
+		}
+	}()
+
+	record := &ContainerRecord{CreatedAt: time.Now(), CodeExecuted: start.Code, Profile: profile.Name}
+	if toolchain != nil {
+		record.Toolchain, record.ToolchainHash = toolchain.Version, toolchain.Hash
+	}
+	result, err := runInSandbox(ctx, sandboxRun{Code: start.Code, Stdin: stdinR, Profile: profile, Toolchain: toolchain, Listener: conn, Timeout: total})
+	_ = stdinW.CloseWithError(io.EOF)
+	fillExecutionRecord(record, result, err)
+	inputMu.Lock()
+	record.Stdin = transcript.String()
+	inputMu.Unlock()
+	saveExecutionRecord(record, clientIP, err)
+	if err != nil {
+		logger.Warn("interactive session ended with error", zap.String("ip", clientIP), zap.Error(err))
+	}
+	if result == nil {
+		msg := "execution failed"
+		if err != nil {
+			msg = err.Error()
+		}
+		conn.send(sessionMessage{Type: "error", Error: msg})
+		return
+	}
+	conn.send(sessionMessage{Type: "result", Result: result})
+}
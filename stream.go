@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+// sseWriter sends Server-Sent Events and implements outputListener, so the
+// sandbox output reaches the browser while the program is still running.
+type sseWriter struct {
+	mu      sync.Mutex
+	w       http.ResponseWriter
+	flusher http.Flusher
+}
+
+// send writes one "event: <name>" with v as JSON data and flushes it.
+func (s *sseWriter) send(event string, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fmt.Fprintf(s.w, "event: %s\ndata: %s\n\n", event, data)
+	s.flusher.Flush()
+}
+
+func (s *sseWriter) phaseStarted(phase string) {
+	s.send("phase", map[string]string{"phase": phase})
+}
+
+func (s *sseWriter) output(chunk OutputChunk) {
+	s.send("output", chunk)
+}
+
+// compileStreamHandler is /compile with live output over Server-Sent Events:
+//
+//	event: phase   {"phase":"compile"|"run"}
+//	event: output  {"phase":..., "stream":"stdout"|"stderr", "data":..., "truncated":bool}
+//	event: result  the final ExecutionResult (same JSON as /compile?format=json)
+//	event: error   {"error":...} when the code could not be run at all
+//
+// Each stream is capped at the profile's output cap, like the buffered result.
+func compileStreamHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	code, stdin, ok := readCompileForm(w, r)
+	if !ok {
+		return
+	}
+	clientIP := extractClientIP(r)
+	opts, err := compileOptions(r)
+	if err != nil {
+		http.Error(w, "Error: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	release, ok := acquireCompileSlot(w, r, clientIP)
+	if !ok {
+		return
+	}
+	defer release()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	sse := &sseWriter{w: w, flusher: flusher}
+	flusher.Flush()
+
+	result, containerRecord, err := execInKataWithHistory(r.Context(), code, stdin, opts, sse)
+	saveExecutionRecord(containerRecord, clientIP, err)
+	if err != nil {
+		logger.Error("code execution failed", zap.Error(err), zap.Bool("stream", true))
+	}
+	if result == nil {
+		msg := "execution failed"
+		if err != nil {
+			msg = err.Error()
+		}
+		sse.send("error", map[string]string{"error": msg})
+		return
+	}
+	sse.send("result", result)
+}
@@ -0,0 +1,453 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+// toolchainManifestName is the registry manifest at the root of LANG_DIR.
+// Without it LANG_DIR is a single toolchain (compiler + liblang) named
+// legacyToolchainVersion.
+const toolchainManifestName = "toolchains.json"
+
+const legacyToolchainVersion = "default"
+
+// ErrUnknownToolchain is wrapped when a request names a version that is not
+// in the registry.
+var ErrUnknownToolchain = errors.New("unknown toolchain")
+
+var toolchainVersionRe = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,63}$`)
+
+// Toolchain is one compiler + liblang tree of the registry. Dir is relative
+// to the registry root (LANG_DIR), Hash covers every file the sandbox copies.
+type Toolchain struct {
+	Version    string `json:"version"`
+	Dir        string `json:"dir"`
+	Hash       string `json:"hash"`
+	Default    bool   `json:"default"`
+	Deprecated bool   `json:"deprecated"`
+	Note       string `json:"note,omitempty"`
+}
+
+// toolchainManifest is the JSON layout of toolchains.json:
+//
+//	{"default": "1.2.0", "toolchains": [{"version": "1.1.0", "dir": "1.1.0", "deprecated": true}, ...]}
+//
+// dir defaults to the version. previous is the default replaced by the last
+// activation, the target of a rollback.
+type toolchainManifest struct {
+	Default    string                   `json:"default"`
+	Previous   string                   `json:"previous,omitempty"`
+	Toolchains []toolchainManifestEntry `json:"toolchains"`
+}
+
+type toolchainManifestEntry struct {
+	Version    string `json:"version"`
+	Dir        string `json:"dir,omitempty"`
+	Deprecated bool   `json:"deprecated,omitempty"`
+	Note       string `json:"note,omitempty"`
+}
+
+// toolchainRegistry holds the toolchains available under root. Lookups
+// return copies, so callers never see a later deprecation mid-run.
+type toolchainRegistry struct {
+	mu          sync.RWMutex
+	root        string
+	managed     bool // root has a manifest; otherwise root is the only toolchain
+	defaultVer  string
+	previousVer string
+	toolchains  []*Toolchain
+	// installing serializes uploads (see install)
+	installing sync.Mutex
+}
+
+// toolchains is loaded in main; nil means the legacy layout without hashes.
+var toolchains *toolchainRegistry
+
+// loadToolchainRegistry reads the manifest under root and hashes every
+// toolchain. A legacy root that does not exist yet only logs a warning: the
+// backends report the missing directory when they run.
+func loadToolchainRegistry(root string) (*toolchainRegistry, error) {
+	reg := &toolchainRegistry{root: root}
+	data, err := os.ReadFile(filepath.Join(root, toolchainManifestName))
+	if errors.Is(err, fs.ErrNotExist) {
+		tc := &Toolchain{Version: legacyToolchainVersion}
+		if tc.Hash, err = hashToolchainDir(root); err != nil && logger != nil {
+			logger.Warn("cannot hash toolchain", zap.String("dir", root), zap.Error(err))
+		}
+		reg.defaultVer = tc.Version
+		reg.toolchains = []*Toolchain{tc}
+		return reg, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read toolchain manifest: %w", err)
+	}
+	var m toolchainManifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("parse toolchain manifest: %w", err)
+	}
+	reg.managed = true
+	reg.defaultVer, reg.previousVer = m.Default, m.Previous
+	for _, e := range m.Toolchains {
+		tc := &Toolchain{Version: e.Version, Dir: e.Dir, Deprecated: e.Deprecated, Note: e.Note}
+		if tc.Dir == "" {
+			tc.Dir = tc.Version
+		}
+		if err := validateToolchain(tc); err != nil {
+			return nil, err
+		}
+		if reg.lookup(tc.Version) != nil {
+			return nil, fmt.Errorf("toolchain %q listed twice", tc.Version)
+		}
+		if tc.Hash, err = hashToolchainDir(filepath.Join(root, tc.Dir)); err != nil {
+			return nil, fmt.Errorf("toolchain %q: %w", tc.Version, err)
+		}
+		reg.toolchains = append(reg.toolchains, tc)
+	}
+	def := reg.lookup(reg.defaultVer)
+	if def == nil {
+		return nil, fmt.Errorf("default toolchain %q is not in %s", reg.defaultVer, toolchainManifestName)
+	}
+	if def.Deprecated {
+		return nil, fmt.Errorf("default toolchain %q is deprecated", def.Version)
+	}
+	return reg, nil
+}
+
+func validateToolchain(tc *Toolchain) error {
+	if !toolchainVersionRe.MatchString(tc.Version) {
+		return fmt.Errorf("invalid toolchain version %q", tc.Version)
+	}
+	if !filepath.IsLocal(tc.Dir) {
+		return fmt.Errorf("toolchain %q: dir %q must be relative to the registry", tc.Version, tc.Dir)
+	}
+	return nil
+}
+
+// lookup returns the entry of version; the caller holds mu.
+func (reg *toolchainRegistry) lookup(version string) *Toolchain {
+	for _, tc := range reg.toolchains {
+		if tc.Version == version {
+			return tc
+		}
+	}
+	return nil
+}
+
+// resolve returns a copy of version, or of the default when version is "".
+// Deprecated versions still resolve so old snippets keep running.
+func (reg *toolchainRegistry) resolve(version string) (*Toolchain, error) {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+	if version == "" {
+		version = reg.defaultVer
+	}
+	tc := reg.lookup(version)
+	if tc == nil {
+		return nil, fmt.Errorf("%w %q", ErrUnknownToolchain, version)
+	}
+	cp := *tc
+	cp.Default = cp.Version == reg.defaultVer
+	return &cp, nil
+}
+
+// list returns a copy of every toolchain in manifest order.
+func (reg *toolchainRegistry) list() []Toolchain {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+	out := make([]Toolchain, 0, len(reg.toolchains))
+	for _, tc := range reg.toolchains {
+		cp := *tc
+		cp.Default = cp.Version == reg.defaultVer
+		out = append(out, cp)
+	}
+	return out
+}
+
+// setDeprecated flags version and rewrites the manifest. The default
+// toolchain cannot be deprecated.
+func (reg *toolchainRegistry) setDeprecated(version string, deprecated bool, note string) (*Toolchain, error) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	if !reg.managed {
+		return nil, fmt.Errorf("%s has no %s: the only toolchain cannot be deprecated", reg.root, toolchainManifestName)
+	}
+	tc := reg.lookup(version)
+	if tc == nil {
+		return nil, fmt.Errorf("%w %q", ErrUnknownToolchain, version)
+	}
+	if deprecated && tc.Version == reg.defaultVer {
+		return nil, fmt.Errorf("toolchain %q is the default and cannot be deprecated", version)
+	}
+	prevDeprecated, prevNote := tc.Deprecated, tc.Note
+	tc.Deprecated, tc.Note = deprecated, note
+	if err := reg.saveManifest(); err != nil {
+		tc.Deprecated, tc.Note = prevDeprecated, prevNote
+		return nil, err
+	}
+	cp := *tc
+	cp.Default = cp.Version == reg.defaultVer
+	return &cp, nil
+}
+
+// activate makes version the default used by requests that do not name
+// one; runs in flight keep the toolchain they resolved. It returns the
+// version it replaced, which a rollback switches back to.
+func (reg *toolchainRegistry) activate(version string) (string, error) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	return reg.activateLocked(version)
+}
+
+func (reg *toolchainRegistry) activateLocked(version string) (string, error) {
+	tc := reg.lookup(version)
+	if tc == nil {
+		return "", fmt.Errorf("%w %q", ErrUnknownToolchain, version)
+	}
+	if tc.Deprecated {
+		return "", fmt.Errorf("toolchain %q is deprecated", version)
+	}
+	if version == reg.defaultVer {
+		return "", fmt.Errorf("toolchain %q is already the default", version)
+	}
+	if !reg.managed {
+		return "", fmt.Errorf("%s has no %s: there is nothing to activate", reg.root, toolchainManifestName)
+	}
+	prevDefault, prevPrevious := reg.defaultVer, reg.previousVer
+	reg.defaultVer, reg.previousVer = version, prevDefault
+	if err := reg.saveManifest(); err != nil {
+		reg.defaultVer, reg.previousVer = prevDefault, prevPrevious
+		return "", err
+	}
+	return prevDefault, nil
+}
+
+// rollback re-activates the default replaced by the last activation
+// (rolling back twice returns to where it started).
+func (reg *toolchainRegistry) rollback() (to, from string, err error) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	if reg.previousVer == "" {
+		return "", "", errors.New("no previous toolchain to roll back to")
+	}
+	to = reg.previousVer
+	from, err = reg.activateLocked(to)
+	return to, from, err
+}
+
+// add registers an installed toolchain and rewrites the manifest. A legacy
+// root becomes a registry whose first entry is the root itself (dir ".").
+func (reg *toolchainRegistry) add(tc *Toolchain) error {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	if reg.lookup(tc.Version) != nil {
+		return fmt.Errorf("toolchain %q already exists", tc.Version)
+	}
+	prevManaged := reg.managed
+	if !reg.managed {
+		for _, old := range reg.toolchains {
+			old.Dir = "."
+		}
+		reg.managed = true
+	}
+	reg.toolchains = append(reg.toolchains, tc)
+	if err := reg.saveManifest(); err != nil {
+		reg.toolchains = reg.toolchains[:len(reg.toolchains)-1]
+		reg.managed = prevManaged
+		return err
+	}
+	return nil
+}
+
+// saveManifest atomically rewrites toolchains.json; the caller holds mu.
+func (reg *toolchainRegistry) saveManifest() error {
+	m := toolchainManifest{Default: reg.defaultVer, Previous: reg.previousVer, Toolchains: make([]toolchainManifestEntry, 0, len(reg.toolchains))}
+	for _, tc := range reg.toolchains {
+		m.Toolchains = append(m.Toolchains, toolchainManifestEntry{Version: tc.Version, Dir: tc.Dir, Deprecated: tc.Deprecated, Note: tc.Note})
+	}
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(reg.root, "."+toolchainManifestName+"-*")
+	if err != nil {
+		return fmt.Errorf("write toolchain manifest: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return fmt.Errorf("write toolchain manifest: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("write toolchain manifest: %w", err)
+	}
+	if err := os.Chmod(tmp.Name(), 0o644); err != nil {
+		return fmt.Errorf("write toolchain manifest: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(reg.root, toolchainManifestName)); err != nil {
+		return fmt.Errorf("write toolchain manifest: %w", err)
+	}
+	return nil
+}
+
+// hashToolchainDir hashes what sandbox-init prepare copies into the sandbox
+// (compiler, liblang/ and *.lang): paths, modes and contents in lexical order.
+func hashToolchainDir(dir string) (string, error) {
+	if _, err := os.Stat(filepath.Join(dir, "compiler")); err != nil {
+		return "", fmt.Errorf("missing compiler: %w", err)
+	}
+	roots := []string{"compiler", "liblang"}
+	extra, err := filepath.Glob(filepath.Join(dir, "*.lang"))
+	if err != nil {
+		return "", err
+	}
+	for _, p := range extra {
+		roots = append(roots, filepath.Base(p))
+	}
+	sort.Strings(roots)
+	h := sha256.New()
+	for _, root := range roots {
+		err := filepath.WalkDir(filepath.Join(dir, root), func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				if errors.Is(err, fs.ErrNotExist) && path == filepath.Join(dir, root) {
+					return nil // liblang is optional
+				}
+				return err
+			}
+			rel, _ := filepath.Rel(dir, path)
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			io.WriteString(h, rel+"\x00"+strconv.FormatUint(uint64(info.Mode()), 8)+"\x00")
+			switch {
+			case info.Mode()&fs.ModeSymlink != 0:
+				target, err := os.Readlink(path)
+				if err != nil {
+					return err
+				}
+				io.WriteString(h, target)
+			case info.Mode().IsRegular():
+				f, err := os.Open(path)
+				if err != nil {
+					return err
+				}
+				_, err = io.Copy(h, f)
+				f.Close()
+				if err != nil {
+					return err
+				}
+			}
+			h.Write([]byte{0})
+			return nil
+		})
+		if err != nil {
+			return "", err
+		}
+	}
+	return "sha256:" + hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// resolveToolchain returns the toolchain named version ("" is the default).
+// Without a loaded registry it is nil and the sandbox uses LANG_DIR as is.
+func resolveToolchain(version string) (*Toolchain, error) {
+	if toolchains == nil {
+		if version != "" && version != legacyToolchainVersion {
+			return nil, fmt.Errorf("%w %q", ErrUnknownToolchain, version)
+		}
+		return nil, nil
+	}
+	return toolchains.resolve(version)
+}
+
+// toolchainsHandler is the public GET /toolchains used by the editor's
+// version picker: deprecated versions are left out.
+func toolchainsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	type publicToolchain struct {
+		Version string `json:"version"`
+		Default bool   `json:"default"`
+	}
+	out := []publicToolchain{}
+	if toolchains != nil {
+		for _, tc := range toolchains.list() {
+			if !tc.Deprecated {
+				out = append(out, publicToolchain{Version: tc.Version, Default: tc.Default})
+			}
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"toolchains": out})
+}
+
+// adminToolchainsHandler is GET /admin/toolchains: every version with its
+// directory, hash and deprecation state.
+func adminToolchainsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	out := []Toolchain{}
+	if toolchains != nil {
+		out = toolchains.list()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"toolchains": out})
+}
+
+// adminDeprecateToolchainHandler is POST /admin/toolchains/deprecate with
+// version, deprecated (default true; false reinstates it) and an optional note.
+func adminDeprecateToolchainHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if toolchains == nil {
+		http.Error(w, "toolchain registry not loaded", http.StatusServiceUnavailable)
+		return
+	}
+	version := r.FormValue("version")
+	deprecated := true
+	if v := r.FormValue("deprecated"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			http.Error(w, "invalid deprecated value", http.StatusBadRequest)
+			return
+		}
+		deprecated = b
+	}
+	tc, err := toolchains.setDeprecated(version, deprecated, r.FormValue("note"))
+	action := "toolchain.deprecate"
+	if !deprecated {
+		action = "toolchain.undeprecate"
+	}
+	auditAdminAction(r, action, version, r.FormValue("note"), err)
+	if err != nil {
+		status := http.StatusBadRequest
+		if errors.Is(err, ErrUnknownToolchain) {
+			status = http.StatusNotFound
+		}
+		http.Error(w, "Error: "+err.Error(), status)
+		return
+	}
+	logger.Info("toolchain deprecation changed", zap.String("version", tc.Version), zap.Bool("deprecated", tc.Deprecated), zap.String("note", tc.Note))
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(tc)
+}
@@ -0,0 +1,438 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	maxToolchainUploadBytes  = 256 << 20 // the tarball as sent
+	maxToolchainExtractBytes = 512 << 20 // all files once unpacked
+	maxToolchainFiles        = 10000
+)
+
+// ErrSmokeFailed is returned by install when the new toolchain failed at
+// least one smoke program; the upload is rejected.
+var ErrSmokeFailed = errors.New("smoke tests failed")
+
+// smokeProgram is one program of the suite run against a staged toolchain.
+// Expected (when HasExpected) is compared with the run's stdout like the
+// judge's trimmed mode.
+type smokeProgram struct {
+	Name        string
+	Code        string
+	Stdin       string
+	Expected    string
+	HasExpected bool
+	Status      ExecutionStatus
+}
+
+// SmokeResult is the outcome of one smoke program.
+type SmokeResult struct {
+	Name       string          `json:"name"`
+	Passed     bool            `json:"passed"`
+	Status     ExecutionStatus `json:"status,omitempty"`
+	Want       ExecutionStatus `json:"want"`
+	Error      string          `json:"error,omitempty"`
+	Output     string          `json:"output,omitempty"`
+	DurationMS int64           `json:"duration_ms"`
+}
+
+// builtinSmokePrograms is used when TOOLCHAIN_SMOKE_DIR is not set: the
+// stdlib must link and run, and a broken program must be rejected.
+func builtinSmokePrograms() []smokeProgram {
+	return []smokeProgram{
+		{
+			Name:        "hello",
+			Code:        "include(\"liblang/strings.lang\")\nfunc main(dq argc){\n\tprint(\"hello\\n\");\n\treturn;\n}\n",
+			Expected:    "hello\n",
+			HasExpected: true,
+			Status:      StatusOK,
+		},
+		{
+			Name:   "compile_error",
+			Code:   "func main(dq argc){\n\tnotAFunction();\n\treturn;\n}\n",
+			Status: StatusCompileError,
+		},
+	}
+}
+
+// loadSmokePrograms reads the suite from dir: every <name>.lang is a program,
+// with optional <name>.in (stdin), <name>.out (expected stdout) and
+// <name>.status (expected status, default ok).
+func loadSmokePrograms(dir string) ([]smokeProgram, error) {
+	if dir == "" {
+		return builtinSmokePrograms(), nil
+	}
+	paths, err := filepath.Glob(filepath.Join(dir, "*.lang"))
+	if err != nil {
+		return nil, err
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("no .lang programs in smoke dir %s", dir)
+	}
+	sort.Strings(paths)
+	var progs []smokeProgram
+	for _, p := range paths {
+		base := strings.TrimSuffix(p, ".lang")
+		code, err := os.ReadFile(p)
+		if err != nil {
+			return nil, err
+		}
+		prog := smokeProgram{Name: filepath.Base(base), Code: string(code), Status: StatusOK}
+		if in, err := os.ReadFile(base + ".in"); err == nil {
+			prog.Stdin = string(in)
+		}
+		if out, err := os.ReadFile(base + ".out"); err == nil {
+			prog.Expected, prog.HasExpected = string(out), true
+		}
+		if st, err := os.ReadFile(base + ".status"); err == nil {
+			prog.Status = ExecutionStatus(strings.TrimSpace(string(st)))
+		}
+		progs = append(progs, prog)
+	}
+	return progs, nil
+}
+
+// runSmokePrograms runs the suite one program at a time with the default
+// profile against tc. It does not take compileLimiter slots: uploads are
+// rare and serialized.
+func runSmokePrograms(ctx context.Context, tc *Toolchain, progs []smokeProgram) ([]SmokeResult, bool) {
+	results := make([]SmokeResult, 0, len(progs))
+	allPassed := true
+	for _, prog := range progs {
+		sr := SmokeResult{Name: prog.Name, Want: prog.Status}
+		// NoBinaryCache: the point is to exercise the new compiler
+		run := sandboxRun{Code: prog.Code, Profile: defaultProfile(), Toolchain: tc, NoBinaryCache: true}
+		if prog.Stdin != "" {
+			run.Stdin = strings.NewReader(prog.Stdin)
+		}
+		res, err := runInSandbox(ctx, run)
+		if res == nil {
+			sr.Error = err.Error()
+		} else {
+			sr.Status, sr.DurationMS = res.Status, res.DurationMS
+			stdout := ""
+			if res.Run != nil {
+				stdout = res.Run.Stdout
+			}
+			switch {
+			case res.Status != prog.Status:
+				sr.Error = fmt.Sprintf("status %s, want %s", res.Status, prog.Status)
+				sr.Output = res.Text()
+			case prog.HasExpected && trimOutput(stdout) != trimOutput(prog.Expected):
+				sr.Error = "unexpected output"
+				sr.Output = stdout
+			default:
+				sr.Passed = true
+			}
+		}
+		allPassed = allPassed && sr.Passed
+		results = append(results, sr)
+	}
+	return results, allPassed
+}
+
+// install unpacks archive into a staging dir under the registry root (so the
+// sandbox backends find it in LANG_DIR, like an installed toolchain), runs
+// the smoke suite against it
+// and, when every program passes, moves it to <root>/<version> and adds it
+// to the manifest. Rejected uploads leave nothing behind.
+func (reg *toolchainRegistry) install(ctx context.Context, version, note string, archive io.Reader) (*Toolchain, []SmokeResult, error) {
+	if !reg.installing.TryLock() {
+		return nil, nil, errors.New("another toolchain upload is in progress")
+	}
+	defer reg.installing.Unlock()
+	tc := &Toolchain{Version: version, Dir: version, Note: note}
+	if err := validateToolchain(tc); err != nil {
+		return nil, nil, err
+	}
+	if _, err := reg.resolve(version); err == nil {
+		return nil, nil, fmt.Errorf("toolchain %q already exists", version)
+	}
+	final := filepath.Join(reg.root, version)
+	if _, err := os.Lstat(final); err == nil {
+		return nil, nil, fmt.Errorf("%s already exists", final)
+	}
+	progs, err := loadSmokePrograms(toolchainSmokeDir())
+	if err != nil {
+		return nil, nil, fmt.Errorf("load smoke programs: %w", err)
+	}
+
+	staging, err := os.MkdirTemp(reg.root, ".staging-"+version+"-")
+	if err != nil {
+		return nil, nil, fmt.Errorf("create staging dir: %w", err)
+	}
+	defer os.RemoveAll(staging)
+	// the sandbox user must be able to read it
+	if err := os.Chmod(staging, 0o755); err != nil {
+		return nil, nil, err
+	}
+	if err := extractToolchainArchive(archive, staging); err != nil {
+		return nil, nil, err
+	}
+	tree, err := toolchainTreeRoot(staging)
+	if err != nil {
+		return nil, nil, err
+	}
+	if tc.Hash, err = hashToolchainDir(tree); err != nil {
+		return nil, nil, err
+	}
+	staged := *tc
+	if staged.Dir, err = filepath.Rel(reg.root, tree); err != nil {
+		return nil, nil, err
+	}
+	results, ok := runSmokePrograms(ctx, &staged, progs)
+	if !ok {
+		return nil, results, ErrSmokeFailed
+	}
+	if err := os.Rename(tree, final); err != nil {
+		return nil, results, fmt.Errorf("move staged toolchain: %w", err)
+	}
+	if err := reg.add(tc); err != nil {
+		_ = os.RemoveAll(final)
+		return nil, results, err
+	}
+	return tc, results, nil
+}
+
+// toolchainTreeRoot finds the compiler in an unpacked upload: at its root,
+// or inside its only top-level directory (tar -czf v2.tgz v2/).
+func toolchainTreeRoot(dir string) (string, error) {
+	if _, err := os.Stat(filepath.Join(dir, "compiler")); err == nil {
+		return dir, nil
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return "", err
+	}
+	if len(entries) == 1 && entries[0].IsDir() {
+		sub := filepath.Join(dir, entries[0].Name())
+		if _, err := os.Stat(filepath.Join(sub, "compiler")); err == nil {
+			return sub, nil
+		}
+	}
+	return "", errors.New("archive has no compiler at its root")
+}
+
+// extractToolchainArchive unpacks a tar or tar.gz into dir. Only regular
+// files and directories with local names are accepted; files are made
+// world-readable (executable when any x bit was set).
+func extractToolchainArchive(r io.Reader, dir string) error {
+	br := bufio.NewReader(r)
+	var src io.Reader = br
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return fmt.Errorf("read gzip: %w", err)
+		}
+		defer gz.Close()
+		src = gz
+	}
+	tr := tar.NewReader(src)
+	var total int64
+	files := 0
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("read archive: %w", err)
+		}
+		name := filepath.Clean(filepath.FromSlash(strings.TrimPrefix(hdr.Name, "./")))
+		if name == "." {
+			continue
+		}
+		if !filepath.IsLocal(name) {
+			return fmt.Errorf("archive entry %q escapes the toolchain dir", hdr.Name)
+		}
+		if files++; files > maxToolchainFiles {
+			return fmt.Errorf("archive has more than %d entries", maxToolchainFiles)
+		}
+		target := filepath.Join(dir, name)
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0o755); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if total += hdr.Size; total > maxToolchainExtractBytes {
+				return fmt.Errorf("archive unpacks to more than %d bytes", maxToolchainExtractBytes)
+			}
+			if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+				return err
+			}
+			perm := os.FileMode(0o644)
+			if hdr.Mode&0o111 != 0 {
+				perm = 0o755
+			}
+			f, err := os.OpenFile(target, os.O_CREATE|os.O_EXCL|os.O_WRONLY, perm)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(f, io.LimitReader(tr, hdr.Size))
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				return fmt.Errorf("extract %s: %w", hdr.Name, err)
+			}
+		default:
+			return fmt.Errorf("archive entry %q: only files and directories are allowed", hdr.Name)
+		}
+	}
+	return nil
+}
+
+func toolchainSmokeDir() string {
+	if appConfig != nil {
+		return appConfig.ToolchainSmokeDir
+	}
+	return ""
+}
+
+// adminUploadToolchainHandler is POST /admin/toolchains/upload, multipart with
+// the tarball in "toolchain", "version", an optional "note" and "activate"
+// (default true). 422 with the smoke results when the suite fails, 409 with
+// the remote backend: the workers would smoke-test a version they lack.
+func adminUploadToolchainHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if _, ok := activeSandbox.(*remoteSandbox); ok {
+		http.Error(w, "toolchain uploads are not supported with SANDBOX_BACKEND=remote: install the version in LANG_DIR on every worker and on the frontend", http.StatusConflict)
+		return
+	}
+	if toolchains == nil {
+		http.Error(w, "toolchain registry not loaded", http.StatusServiceUnavailable)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxToolchainUploadBytes)
+	if err := r.ParseMultipartForm(32 << 20); err != nil {
+		http.Error(w, "invalid upload: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	version := r.FormValue("version")
+	activate := true
+	if v := r.FormValue("activate"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			http.Error(w, "invalid activate value", http.StatusBadRequest)
+			return
+		}
+		activate = b
+	}
+	file, _, err := r.FormFile("toolchain")
+	if err != nil {
+		http.Error(w, "toolchain archive not provided", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+
+	start := time.Now()
+	tc, results, err := toolchains.install(r.Context(), version, r.FormValue("note"), file)
+	resp := struct {
+		Toolchain *Toolchain    `json:"toolchain,omitempty"`
+		Activated bool          `json:"activated"`
+		Previous  string        `json:"previous,omitempty"`
+		Smoke     []SmokeResult `json:"smoke"`
+		Error     string        `json:"error,omitempty"`
+	}{Toolchain: tc, Smoke: results}
+	if resp.Smoke == nil {
+		resp.Smoke = []SmokeResult{}
+	}
+	if err != nil {
+		auditAdminAction(r, "toolchain.upload", version, "", err)
+		logger.Warn("toolchain upload rejected", zap.String("version", version), zap.Error(err))
+		resp.Error = err.Error()
+		status := http.StatusBadRequest
+		if errors.Is(err, ErrSmokeFailed) {
+			status = http.StatusUnprocessableEntity
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		_ = json.NewEncoder(w).Encode(resp)
+		return
+	}
+	auditAdminAction(r, "toolchain.upload", tc.Version, fmt.Sprintf("hash %s, %d smoke programs passed in %s", tc.Hash, len(results), time.Since(start).Round(time.Millisecond)), nil)
+	logger.Info("toolchain installed", zap.String("version", tc.Version), zap.String("hash", tc.Hash))
+	if activate {
+		prev, err := toolchains.activate(tc.Version)
+		auditAdminAction(r, "toolchain.activate", tc.Version, "replaced "+prev, err)
+		if err != nil {
+			resp.Error = "installed but not activated: " + err.Error()
+		} else {
+			resp.Activated, resp.Previous = true, prev
+			logger.Info("toolchain activated", zap.String("version", tc.Version), zap.String("previous", prev))
+		}
+	}
+	if cur, err := toolchains.resolve(tc.Version); err == nil {
+		resp.Toolchain = cur
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+// adminActivateToolchainHandler is POST /admin/toolchains/activate?version=:
+// the atomic switch of the default toolchain.
+func adminActivateToolchainHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if toolchains == nil {
+		http.Error(w, "toolchain registry not loaded", http.StatusServiceUnavailable)
+		return
+	}
+	version := r.FormValue("version")
+	prev, err := toolchains.activate(version)
+	auditAdminAction(r, "toolchain.activate", version, "replaced "+prev, err)
+	writeToolchainSwitch(w, version, prev, err)
+}
+
+// adminRollbackToolchainHandler is POST /admin/toolchains/rollback: switch the
+// default back to the version the last activation replaced.
+func adminRollbackToolchainHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if toolchains == nil {
+		http.Error(w, "toolchain registry not loaded", http.StatusServiceUnavailable)
+		return
+	}
+	to, from, err := toolchains.rollback()
+	auditAdminAction(r, "toolchain.rollback", to, "replaced "+from, err)
+	writeToolchainSwitch(w, to, from, err)
+}
+
+func writeToolchainSwitch(w http.ResponseWriter, version, previous string, err error) {
+	if err != nil {
+		status := http.StatusBadRequest
+		if errors.Is(err, ErrUnknownToolchain) {
+			status = http.StatusNotFound
+		}
+		http.Error(w, "Error: "+err.Error(), status)
+		return
+	}
+	logger.Info("default toolchain switched", zap.String("version", version), zap.String("previous", previous))
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]string{"default": version, "previous": previous})
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type tarEntry struct {
+	name     string
+	typeflag byte
+	mode     int64
+	body     string
+	size     int64 // declared size when body is empty; nothing is written
+}
+
+// tarball builds an archive of entries, gzipped when gz is set. An entry with
+// a declared size and no body ends the archive right after its header.
+func tarball(t *testing.T, gz bool, entries ...tarEntry) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e.name, Typeflag: e.typeflag, Mode: e.mode, Size: int64(len(e.body))}
+		if e.typeflag == 0 {
+			hdr.Typeflag = tar.TypeReg
+		}
+		if e.typeflag == tar.TypeSymlink {
+			hdr.Linkname = "/etc/passwd"
+		}
+		if e.size > 0 {
+			hdr.Size = e.size
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if e.size > 0 {
+			return buf.Bytes()
+		}
+		if _, err := tw.Write([]byte(e.body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !gz {
+		return buf.Bytes()
+	}
+	var zipped bytes.Buffer
+	zw := gzip.NewWriter(&zipped)
+	zw.Write(buf.Bytes())
+	zw.Close()
+	return zipped.Bytes()
+}
+
+func TestExtractToolchainArchive(t *testing.T) {
+	tests := []struct {
+		name    string
+		gz      bool
+		entries []tarEntry
+		want    map[string]os.FileMode // extracted files and their modes
+		wantErr string
+	}{
+		{
+			name:    "files and dirs",
+			entries: []tarEntry{{name: "./", typeflag: tar.TypeDir}, {name: "compiler", mode: 0o700, body: "bin"}, {name: "liblang/std.lang", mode: 0o600, body: "lib"}},
+			want:    map[string]os.FileMode{"compiler": 0o755, "liblang/std.lang": 0o644},
+		},
+		{
+			name:    "gzipped",
+			gz:      true,
+			entries: []tarEntry{{name: "v2/compiler", mode: 0o755, body: "bin"}},
+			want:    map[string]os.FileMode{"v2/compiler": 0o755},
+		},
+		{name: "parent dir", entries: []tarEntry{{name: "../compiler", body: "x"}}, wantErr: "escapes the toolchain dir"},
+		{name: "nested parent dir", entries: []tarEntry{{name: "lib/../../x", body: "x"}}, wantErr: "escapes the toolchain dir"},
+		{name: "absolute path", entries: []tarEntry{{name: "/etc/cron.d/x", body: "x"}}, wantErr: "escapes the toolchain dir"},
+		{name: "symlink", entries: []tarEntry{{name: "passwd", typeflag: tar.TypeSymlink}}, wantErr: "only files and directories are allowed"},
+		{name: "duplicate file", entries: []tarEntry{{name: "compiler", body: "a"}, {name: "./compiler", body: "b"}}, wantErr: "exists"},
+		{name: "too large once unpacked", entries: []tarEntry{{name: "compiler", size: maxToolchainExtractBytes + 1}}, wantErr: "unpacks to more than"},
+		{name: "empty archive"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			err := extractToolchainArchive(bytes.NewReader(tarball(t, tt.gz, tt.entries...)), dir)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			for name, mode := range tt.want {
+				info, err := os.Stat(filepath.Join(dir, name))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if info.Mode().Perm() != mode {
+					t.Errorf("%s mode %v, want %v", name, info.Mode().Perm(), mode)
+				}
+			}
+		})
+	}
+
+	if err := extractToolchainArchive(strings.NewReader(strings.Repeat("garbage!", 100)), t.TempDir()); err == nil {
+		t.Error("garbage accepted as an archive")
+	}
+}
+
+func TestToolchainTreeRoot(t *testing.T) {
+	tests := []struct {
+		name  string
+		files []string
+		want  string
+	}{
+		{name: "compiler at the root", files: []string{"compiler", "liblang/std.lang"}, want: "."},
+		{name: "one top-level dir", files: []string{"v2/compiler"}, want: "v2"},
+		{name: "several top-level dirs", files: []string{"v2/compiler", "v3/compiler"}},
+		{name: "no compiler", files: []string{"v2/readme"}},
+	}
+	for _, tt := range tests {
+		dir := t.TempDir()
+		for _, f := range tt.files {
+			p := filepath.Join(dir, f)
+			os.MkdirAll(filepath.Dir(p), 0o755)
+			os.WriteFile(p, nil, 0o755)
+		}
+		got, err := toolchainTreeRoot(dir)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("%s: found %s, want an error", tt.name, got)
+			}
+			continue
+		}
+		if err != nil || got != filepath.Join(dir, tt.want) {
+			t.Errorf("%s: root %q (%v), want %q", tt.name, got, err, tt.want)
+		}
+	}
+}
+
+func TestAdminUploadToolchainRemote(t *testing.T) {
+	prev := activeSandbox
+	activeSandbox = &remoteSandbox{}
+	t.Cleanup(func() { activeSandbox = prev })
+	rec := httptest.NewRecorder()
+	adminUploadToolchainHandler(rec, httptest.NewRequest(http.MethodPost, "/admin/toolchains/upload", nil))
+	if rec.Code != http.StatusConflict {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusConflict)
+	}
+}
@@ -862,6 +862,11 @@ amdRequire(['vs/editor/editor.main'], function () {
 		wordWrap: 'on',
 	});
 
+	// Compiler diagnostics are stale as soon as the code changes
+	window.editor.onDidChangeModelContent(() => {
+		monaco.editor.setModelMarkers(window.editor.getModel(), 'compiler', []);
+	});
+
 	// Keep track of editor font size so zoom buttons can change it
 	window.editorFontSize = 14;
 
@@ -980,36 +985,290 @@ function highlightActiveExample(key) {
 	}
 }
 
-async function compile(code) {
-	const res = await fetch('/compile', {
+// Compiler version picker, filled from /toolchains; hidden while only one
+// version is offered ("" lets the server use its default).
+const toolchainSelect = document.getElementById('toolchainSelect');
+
+function selectedToolchain() {
+	return toolchainSelect?.value || '';
+}
+
+async function loadToolchains() {
+	if (!toolchainSelect) return;
+	try {
+		const res = await fetch('/toolchains');
+		if (!res.ok) return;
+		const { toolchains } = await res.json();
+		if (!toolchains || toolchains.length < 2) return;
+		toolchainSelect.innerHTML = '';
+		for (const tc of toolchains) {
+			const opt = document.createElement('option');
+			opt.value = tc.version;
+			opt.textContent = tc.default ? `${tc.version} (default)` : tc.version;
+			opt.selected = tc.default;
+			toolchainSelect.appendChild(opt);
+		}
+		toolchainSelect.classList.remove('hidden');
+	} catch (_) {
+		// keep the server default
+	}
+}
+loadToolchains();
+
+// POST to /compile/stream and hand every Server-Sent Event to onEvent(name, data).
+async function compileStream(code, stdin, onEvent, artifacts) {
+	const params = new URLSearchParams({ code });
+	if (stdin) params.set('stdin', stdin);
+	if (artifacts) params.set('artifacts', '1');
+	if (selectedToolchain()) params.set('toolchain', selectedToolchain());
+	// unmodified examples are run by everyone: let the server reuse the result
+	if (!stdin && compilerPageExamples.some((e) => e.code === code)) params.set('cache', '1');
+	const res = await fetch('/compile/stream', {
 		method: 'POST',
-		headers: { 'Content-Type': 'application/x-www-form-urlencoded' },
-		body: new URLSearchParams({ code }),
+		headers: { 'Content-Type': 'application/x-www-form-urlencoded', 'Accept': 'text/event-stream' },
+		body: params,
 	});
 	if (!res.ok) {
 		const t = await res.text();
 		throw new Error(t || 'compile failed');
 	}
-	return res.text();
+	const reader = res.body.getReader();
+	const decoder = new TextDecoder();
+	let buf = '';
+	for (;;) {
+		const { value, done } = await reader.read();
+		if (done) break;
+		buf += decoder.decode(value, { stream: true });
+		let idx;
+		while ((idx = buf.indexOf('\n\n')) >= 0) {
+			const block = buf.slice(0, idx);
+			buf = buf.slice(idx + 2);
+			let event = 'message';
+			let data = '';
+			for (const line of block.split('\n')) {
+				if (line.startsWith('event: ')) event = line.slice(7);
+				else if (line.startsWith('data: ')) data += line.slice(6);
+			}
+			onEvent(event, data ? JSON.parse(data) : null);
+		}
+	}
+}
+
+// Turn the structured /compile result into output text + a short status line.
+function renderResult(result) {
+	const phase = result.status === 'compile_error' ? result.compile : (result.run || result.compile);
+	let text = '';
+	if (phase) {
+		text = phase.stdout || '';
+		if (phase.stderr) text += (text && !text.endsWith('\n') ? '\n' : '') + '[stderr]\n' + phase.stderr;
+	}
+	if (result.error) text += (text ? '\n' : '') + result.error;
+	const labels = {
+		ok: 'done',
+		compile_error: 'compile error',
+		runtime_error: 'runtime error',
+		signaled: 'killed by signal',
+		cpu_limit: 'CPU time limit exceeded',
+		memory_limit: 'memory limit exceeded',
+		output_limit: 'output limit exceeded',
+		timeout: 'timeout',
+		internal_error: 'error',
+	};
+	let status = labels[result.status] || result.status;
+	if (result.run) {
+		status += result.run.signal ? ` (${result.run.signal}` : ` (exit ${result.run.exit_code}`;
+		status += `, ${result.run.duration_ms} ms)`;
+	}
+	return { text, status };
 }
 
 const outputEl = document.getElementById('output');
 const statusEl = document.getElementById('status');
 
+// showDiagnostics turns the result's compiler diagnostics into editor squiggles
+// (a whole line is marked when the compiler gives no column).
+function showDiagnostics(diagnostics) {
+	if (!window.editor || !window.monaco) return;
+	const model = window.editor.getModel();
+	const severities = { error: monaco.MarkerSeverity.Error, warning: monaco.MarkerSeverity.Warning, note: monaco.MarkerSeverity.Info };
+	const markers = (diagnostics || [])
+		.filter((d) => d.file === 'test.lang')
+		.map((d) => {
+			const line = Math.min(Math.max(d.line, 1), model.getLineCount());
+			const startColumn = d.column > 0 ? d.column : model.getLineFirstNonWhitespaceColumn(line) || 1;
+			return {
+				severity: severities[d.severity] || monaco.MarkerSeverity.Error,
+				message: d.message,
+				startLineNumber: line,
+				startColumn,
+				endLineNumber: line,
+				endColumn: d.column > 0 ? d.column + 1 : model.getLineMaxColumn(line),
+			};
+		});
+	monaco.editor.setModelMarkers(model, 'compiler', markers);
+}
+const artifactsPanel = document.getElementById('artifactsPanel');
+
+// renderArtifacts shows the ELF metadata and the download link of a result.
+function renderArtifacts(artifacts) {
+	if (!artifactsPanel) return;
+	if (!artifacts) {
+		artifactsPanel.classList.add('hidden');
+		return;
+	}
+	const hex = (n) => '0x' + Number(n).toString(16);
+	const lines = [];
+	if (artifacts.error) lines.push('error: ' + artifacts.error);
+	for (const f of artifacts.files || []) lines.push(`${f.name}  ${f.size} bytes`);
+	const elf = artifacts.elf;
+	if (elf) {
+		lines.push('', `${elf.class} ${elf.machine} ${elf.type}, entry ${hex(elf.entry)}, ${elf.size} bytes`, '', 'sections:');
+		for (const s of elf.sections) lines.push(`  ${s.name.padEnd(20)} ${hex(s.addr).padEnd(12)} ${String(s.size).padStart(8)} ${s.flags || ''}`);
+		lines.push('', 'symbols:');
+		for (const s of elf.symbols) lines.push(`  ${hex(s.value).padEnd(12)} ${String(s.size).padStart(6)} ${s.type.replace('STT_', '').padEnd(8)} ${s.name}`);
+		if (elf.symbols_truncated) lines.push('  … (full list in out.map)');
+	}
+	document.getElementById('artifactsInfo').textContent = lines.join('\n');
+	const link = document.getElementById('artifactsDownload');
+	link.classList.toggle('hidden', !artifacts.url);
+	if (artifacts.url) link.href = artifacts.url;
+	artifactsPanel.classList.remove('hidden');
+}
+
 document.getElementById('runBtn').addEventListener('click', async () => {
 	try {
 		statusEl.textContent = 'compiling…';
 		outputEl.textContent = '';
 		const code = window.editor ? window.editor.getValue() : '';
-		const out = await compile(code);
-		outputEl.textContent = out;
-		statusEl.textContent = 'done';
+		const stdin = document.getElementById('stdinInput')?.value || '';
+		const artifacts = document.getElementById('artifactsToggle')?.checked;
+		renderArtifacts(null);
+		let result = null;
+		let failure = null;
+		await compileStream(code, stdin, (event, data) => {
+			switch (event) {
+				case 'phase':
+					statusEl.textContent = data.phase === 'run' ? 'running…' : 'compiling…';
+					if (data.phase === 'run') outputEl.textContent = '';
+					break;
+				case 'output':
+					outputEl.textContent += data.data;
+					if (data.truncated) outputEl.textContent += '\n...[truncated]\n';
+					break;
+				case 'result':
+					result = data;
+					break;
+				case 'error':
+					failure = data.error;
+					break;
+			}
+		}, artifacts);
+		if (failure || !result) throw new Error(failure || 'no result received');
+		const { text, status } = renderResult(result);
+		outputEl.textContent = text;
+		statusEl.textContent = result.cache_hit ? `${status} (cached)` : status;
+		renderArtifacts(result.artifacts);
+		showDiagnostics(result.diagnostics);
+	} catch (e) {
+		outputEl.textContent = (e && e.message) || String(e);
+		statusEl.textContent = 'error';
+	}
+});
+
+// Check: compile only through /check, results shown as editor markers.
+document.getElementById('checkBtn')?.addEventListener('click', async () => {
+	try {
+		statusEl.textContent = 'checking…';
+		const code = window.editor ? window.editor.getValue() : '';
+		const params = new URLSearchParams({ code });
+		if (selectedToolchain()) params.set('toolchain', selectedToolchain());
+		const res = await fetch('/check', {
+			method: 'POST',
+			headers: { 'Content-Type': 'application/x-www-form-urlencoded', 'Accept': 'application/json' },
+			body: params,
+		});
+		if (!res.ok) throw new Error((await res.text()) || 'check failed');
+		const result = await res.json();
+		showDiagnostics(result.diagnostics);
+		const n = (result.diagnostics || []).length;
+		statusEl.textContent = result.status === 'ok' ? 'check passed' : `${result.status.replace('_', ' ')} (${n} diagnostic${n === 1 ? '' : 's'})`;
+		if (n) outputEl.textContent = result.diagnostics.map((d) => `${d.file}:${d.line}: ${d.severity}: ${d.message}`).join('\n');
 	} catch (e) {
 		outputEl.textContent = (e && e.message) || String(e);
 		statusEl.textContent = 'error';
 	}
 });
 
+// Interactive session over /session: output is streamed, the input line is
+// forwarded to the program's stdin as it is typed.
+let session = null;
+const sessionInputRow = document.getElementById('sessionInputRow');
+const sessionInput = document.getElementById('sessionInput');
+
+function endSessionUI() {
+	session = null;
+	sessionInputRow?.classList.add('hidden');
+}
+
+document.getElementById('sessionBtn')?.addEventListener('click', () => {
+	if (session) session.close();
+	const code = window.editor ? window.editor.getValue() : '';
+	const proto = location.protocol === 'https:' ? 'wss:' : 'ws:';
+	const ws = new WebSocket(`${proto}//${location.host}/session`);
+	session = ws;
+	outputEl.textContent = '';
+	statusEl.textContent = 'connecting…';
+	ws.onopen = () => {
+		const start = { type: 'start', code };
+		if (selectedToolchain()) start.toolchain = selectedToolchain();
+		ws.send(JSON.stringify(start));
+		sessionInputRow?.classList.remove('hidden');
+		sessionInput?.focus();
+	};
+	ws.onmessage = (ev) => {
+		const msg = JSON.parse(ev.data);
+		switch (msg.type) {
+			case 'phase':
+				statusEl.textContent = msg.phase === 'run' ? 'running (interactive)…' : 'compiling…';
+				if (msg.phase === 'run') outputEl.textContent = '';
+				break;
+			case 'output':
+				outputEl.textContent += msg.data;
+				if (msg.truncated) outputEl.textContent += '\n...[truncated]\n';
+				outputEl.scrollTop = outputEl.scrollHeight;
+				break;
+			case 'result':
+				statusEl.textContent = renderResult(msg.result).status;
+				break;
+			case 'error':
+				outputEl.textContent += (outputEl.textContent ? '\n' : '') + msg.error;
+				statusEl.textContent = 'error';
+				break;
+		}
+	};
+	ws.onclose = () => {
+		if (session === ws) endSessionUI();
+		if (statusEl.textContent === 'connecting…') statusEl.textContent = 'error';
+	};
+});
+
+sessionInput?.addEventListener('keydown', (e) => {
+	if (!session || session.readyState !== WebSocket.OPEN) return;
+	if (e.key === 'Enter') {
+		const line = sessionInput.value + '\n';
+		session.send(JSON.stringify({ type: 'stdin', data: line }));
+		outputEl.textContent += line;
+		sessionInput.value = '';
+	} else if (e.key === 'd' && e.ctrlKey) {
+		e.preventDefault();
+		session.send(JSON.stringify({ type: 'eof' }));
+	}
+});
+
+document.getElementById('sessionStopBtn')?.addEventListener('click', () => {
+	if (session) session.close();
+});
+
 document.getElementById('resetBtn').addEventListener('click', () => {
 	if (window.editor) window.editor.setValue(defaultCode);
 	outputEl.textContent = '';
@@ -23,6 +23,13 @@ function fmtTime(s) {
 	return d.toLocaleString();
 }
 
+function fmtBytes(n) {
+	if (!n) return '0';
+	if (n < 1024) return `${Math.round(n)}B`;
+	if (n < 1024 * 1024) return `${(n / 1024).toFixed(1)}KiB`;
+	return `${(n / 1024 / 1024).toFixed(1)}MiB`;
+}
+
 function fmtDuration(ms) {
 	if (!ms) return '0ms';
 	if (ms < 1000) return `${Math.round(ms)}ms`;
@@ -87,6 +94,15 @@ function render(data) {
 	document.getElementById('successError').textContent = `${fmtNumber(data.success_count)} / ${fmtNumber(data.error_count)}`;
 	document.getElementById('avgCompileTime').textContent = fmtDuration(data.average_compile_time_ms);
 	document.getElementById('failedLogins').textContent = fmtNumber(data.failed_admin_logins?.total);
+	const res = data.resources || {};
+	document.getElementById('memoryPeak').textContent = `${fmtBytes(res.avg_memory_peak_bytes)} / ${fmtBytes(res.max_memory_peak_bytes)}`;
+	document.getElementById('cpuTime').textContent = `${fmtDuration(res.avg_cpu_time_ms)} / ${fmtDuration(res.max_cpu_time_ms)}`;
+	document.getElementById('maxPids').textContent = fmtNumber(res.max_pids_peak);
+	document.getElementById('throttledRuns').textContent = `${fmtNumber(res.throttled_count)} / ${fmtNumber(res.measured)}`;
+	document.getElementById('limitHits').textContent = `${fmtNumber(res.memory_limit_count)} / ${fmtNumber(res.cpu_limit_count)}`;
+	const cache = data.cache || {};
+	document.getElementById('resultCacheHits').textContent = `${fmtNumber(cache.result_hits)} (${Math.round((cache.result_hit_rate || 0) * 100)}%)`;
+	document.getElementById('binaryCacheHits').textContent = `${fmtNumber(cache.binary_hits)} / ${fmtNumber(cache.binary_misses)} (${Math.round((cache.binary_hit_rate || 0) * 100)}%)`;
 	document.getElementById('rangeMeta').textContent = `${fmtTime(data.from)} - ${fmtTime(data.to)}`;
 
 	const total = (data.success_count || 0) + (data.error_count || 0);
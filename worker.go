@@ -0,0 +1,369 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"syscall"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// workerRetryDelay spaces reconnection attempts to an unreachable frontend.
+const workerRetryDelay = 2 * time.Second
+
+// workerClient is the MODE=worker side of the worker protocol: it runs
+// the tasks of a frontend through the local Sandbox backend.
+type workerClient struct {
+	base     string
+	token    string
+	id       string
+	capacity int
+	sb       Sandbox
+	http     *http.Client
+
+	regMu sync.Mutex
+}
+
+// runWorker registers with WORKER_FRONTEND_URL and executes its tasks
+// with sb, WORKER_CAPACITY at a time. It never returns.
+func runWorker(cfg *Config, sb Sandbox) {
+	c := &workerClient{
+		base:     cfg.WorkerFrontendURL,
+		token:    cfg.WorkerToken,
+		id:       cfg.WorkerID,
+		capacity: cfg.WorkerCapacity,
+		sb:       sb,
+		http:     &http.Client{},
+	}
+	c.register()
+	go c.heartbeatLoop()
+	for i := 0; i < c.capacity; i++ {
+		go c.pollLoop()
+	}
+	logger.Info("worker started", zap.String("worker", c.id), zap.String("frontend", c.base), zap.Int("capacity", c.capacity), zap.String("backend", sb.Name()))
+	select {}
+}
+
+func (c *workerClient) newRequest(ctx context.Context, method, path string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.base+path, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	req.Header.Set("X-Worker-ID", c.id)
+	return req, nil
+}
+
+// register announces the worker, retrying until the frontend accepts it.
+func (c *workerClient) register() {
+	c.regMu.Lock()
+	defer c.regMu.Unlock()
+	reg := workerRegistration{ID: c.id, Capacity: c.capacity, Backend: c.sb.Name()}
+	if toolchains != nil {
+		for _, tc := range toolchains.list() {
+			reg.Toolchains = append(reg.Toolchains, workerToolchain{Version: tc.Version, Hash: tc.Hash})
+		}
+	}
+	body, _ := json.Marshal(reg)
+	for {
+		req, err := c.newRequest(context.Background(), http.MethodPost, "/worker/register", bytes.NewReader(body))
+		if err != nil {
+			logger.Fatal("worker register", zap.Error(err))
+		}
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := c.http.Do(req)
+		if err == nil {
+			_, _ = io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusNoContent {
+				logger.Info("worker registered", zap.String("worker", c.id), zap.Int("toolchains", len(reg.Toolchains)))
+				return
+			}
+			err = fmt.Errorf("frontend answered %s", resp.Status)
+		}
+		logger.Warn("worker register failed", zap.String("frontend", c.base), zap.Error(err))
+		time.Sleep(workerRetryDelay)
+	}
+}
+
+// heartbeatLoop keeps the worker alive on the frontend; a 404 means the
+// frontend forgot it (restart or missed heartbeats), so it registers again.
+func (c *workerClient) heartbeatLoop() {
+	ticker := time.NewTicker(workerHeartbeatInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		req, err := c.newRequest(context.Background(), http.MethodPost, "/worker/heartbeat", nil)
+		if err != nil {
+			continue
+		}
+		resp, err := c.http.Do(req)
+		if err != nil {
+			logger.Warn("worker heartbeat failed", zap.Error(err))
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusNotFound {
+			c.register()
+		}
+	}
+}
+
+// pollLoop runs one task at a time; capacity loops run side by side.
+func (c *workerClient) pollLoop() {
+	for {
+		req, err := c.newRequest(context.Background(), http.MethodGet, "/worker/poll", nil)
+		if err != nil {
+			logger.Fatal("worker poll", zap.Error(err))
+		}
+		resp, err := c.http.Do(req)
+		if err != nil {
+			logger.Warn("worker poll failed", zap.Error(err))
+			time.Sleep(workerRetryDelay)
+			continue
+		}
+		var task workerTask
+		switch resp.StatusCode {
+		case http.StatusOK:
+			err = json.NewDecoder(resp.Body).Decode(&task)
+			resp.Body.Close()
+			if err != nil {
+				logger.Warn("worker poll: bad task", zap.Error(err))
+				continue
+			}
+			c.runTask(&task)
+		case http.StatusNoContent:
+			resp.Body.Close()
+		case http.StatusNotFound:
+			resp.Body.Close()
+			c.register()
+		default:
+			resp.Body.Close()
+			logger.Warn("worker poll failed", zap.String("status", resp.Status))
+			time.Sleep(workerRetryDelay)
+		}
+	}
+}
+
+// taskStream writes workerFrames on the request body of the task's stream
+// POST. Once a write fails the frontend is gone and onBroken runs once.
+type taskStream struct {
+	mu       sync.Mutex
+	enc      *json.Encoder
+	broken   bool
+	onBroken func()
+}
+
+func (s *taskStream) send(f workerFrame) {
+	s.mu.Lock()
+	if s.broken {
+		s.mu.Unlock()
+		return
+	}
+	err := s.enc.Encode(f)
+	if err != nil {
+		s.broken = true
+	}
+	onBroken := s.onBroken
+	s.mu.Unlock()
+	if err != nil && onBroken != nil {
+		onBroken()
+	}
+}
+
+func (s *taskStream) setOnBroken(f func()) {
+	s.mu.Lock()
+	s.onBroken = f
+	broken := s.broken
+	s.mu.Unlock()
+	if broken {
+		f()
+	}
+}
+
+// frameWriter turns the sandbox's Stdout/Stderr into frames.
+type frameWriter struct {
+	stream *taskStream
+	typ    string
+}
+
+func (w frameWriter) Write(p []byte) (int, error) {
+	w.stream.send(workerFrame{Type: w.typ, Data: bytes.Clone(p)})
+	return len(p), nil
+}
+
+// runTask executes one task and streams it back. Losing the stream kills
+// the run: nobody is left to read its result.
+func (c *workerClient) runTask(task *workerTask) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	log := logger.With(zap.String("task", task.ID))
+
+	pr, pw := io.Pipe()
+	stream := &taskStream{enc: json.NewEncoder(pw)}
+	streamReq, err := c.newRequest(ctx, http.MethodPost, "/worker/tasks/"+task.ID+"/stream", pr)
+	if err != nil {
+		log.Error("worker stream request", zap.Error(err))
+		return
+	}
+	streamReq.Header.Set("Content-Type", "application/x-ndjson")
+	streamDone := make(chan error, 1)
+	go func() {
+		resp, err := c.http.Do(streamReq)
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusNoContent {
+				err = fmt.Errorf("frontend answered %s", resp.Status)
+			}
+		}
+		if err == nil {
+			err = io.ErrClosedPipe
+		}
+		// unblocks and fails any later send
+		_ = pr.CloseWithError(err)
+		streamDone <- err
+	}()
+	finish := func() {
+		_ = pw.Close()
+		if err := <-streamDone; err != nil && err != io.ErrClosedPipe {
+			log.Warn("worker task stream failed", zap.Error(err))
+		}
+	}
+
+	req := &SandboxRequest{
+		Code:         task.Code,
+		Stdout:       frameWriter{stream, "stdout"},
+		Stderr:       frameWriter{stream, "stderr"},
+		PhaseMarker:  task.PhaseMarker,
+		Profile:      task.Profile,
+		Artifacts:    task.Artifacts,
+		CheckOnly:    task.CheckOnly,
+		CaseTimeouts: task.CaseTimeouts,
+		Timeout:      time.Duration(task.TimeoutMS) * time.Millisecond,
+	}
+	if req.Toolchain, err = workerToolchainFor(task); err != nil {
+		stream.send(workerFrame{Type: "error", Error: err.Error()})
+		finish()
+		return
+	}
+	if task.HasStdin {
+		stdinReq, err := c.newRequest(ctx, http.MethodGet, "/worker/tasks/"+task.ID+"/stdin", nil)
+		if err == nil {
+			var resp *http.Response
+			if resp, err = c.http.Do(stdinReq); err == nil {
+				defer resp.Body.Close()
+				if resp.StatusCode != http.StatusOK {
+					err = fmt.Errorf("stdin: frontend answered %s", resp.Status)
+				}
+				req.Stdin = resp.Body
+			}
+		}
+		if err != nil {
+			stream.send(workerFrame{Type: "error", Error: err.Error()})
+			finish()
+			return
+		}
+	}
+
+	exec, err := c.sb.Prepare(ctx, req)
+	if err != nil {
+		log.Warn("worker prepare failed", zap.Error(err))
+		stream.send(workerFrame{Type: "error", Error: err.Error()})
+		finish()
+		return
+	}
+	started := workerFrame{Type: "started", ContainerID: exec.ID()}
+	if r, ok := exec.(sandboxImageReporter); ok {
+		started.ImageDigest = r.ImageDigest()
+	}
+	stream.send(started)
+	exitC, err := exec.Run(ctx)
+	if err != nil {
+		stream.send(workerFrame{Type: "error", Error: err.Error()})
+	} else {
+		stream.setOnBroken(func() {
+			log.Warn("frontend lost, killing task", zap.String("container_id", exec.ID()))
+			_ = exec.Kill(context.Background(), syscall.SIGKILL)
+		})
+		go c.controlLoop(ctx, task.ID, exec)
+		// the frontend leaves the timeout to the worker (see
+		// remoteTask.EnforcesTimeout): backends that do not time their
+		// steps are killed here
+		var limitC <-chan time.Time
+		if st, ok := exec.(sandboxStepTimer); req.Timeout > 0 && (!ok || !st.EnforcesTimeout()) {
+			timer := time.NewTimer(req.Timeout)
+			defer timer.Stop()
+			limitC = timer.C
+		}
+		var exit SandboxExit
+		select {
+		case exit = <-exitC:
+		case <-limitC:
+			_ = exec.Kill(context.Background(), syscall.SIGKILL)
+			exit = <-exitC
+			exit.Err = fmt.Errorf("%w: exceeded %s (forced SIGKILL)", ErrExecTimeout, req.Timeout)
+		}
+		stream.send(exitFrame(exit))
+	}
+	usage, err := exec.Collect(context.Background())
+	if err != nil {
+		log.Warn("worker collect failed", zap.String("container_id", exec.ID()), zap.Error(err))
+	}
+	stream.send(workerFrame{Type: "usage", Usage: usage})
+	finish()
+	log.Info("worker task finished", zap.String("container_id", exec.ID()))
+}
+
+// controlLoop forwards the frontend's Kill calls until the task is over.
+func (c *workerClient) controlLoop(ctx context.Context, taskID string, exec SandboxExecution) {
+	for ctx.Err() == nil {
+		req, err := c.newRequest(ctx, http.MethodGet, "/worker/tasks/"+taskID+"/control", nil)
+		if err != nil {
+			return
+		}
+		resp, err := c.http.Do(req)
+		if err != nil {
+			if ctx.Err() == nil {
+				time.Sleep(workerRetryDelay)
+			}
+			continue
+		}
+		var ctl workerControl
+		status := resp.StatusCode
+		if status == http.StatusOK {
+			err = json.NewDecoder(resp.Body).Decode(&ctl)
+		}
+		resp.Body.Close()
+		switch {
+		case status == http.StatusNoContent:
+		case status != http.StatusOK || err != nil || ctl.Done:
+			return
+		case ctl.Signal != 0:
+			if err := exec.Kill(ctx, ctl.Signal); err != nil {
+				logger.Warn("worker kill failed", zap.String("task", taskID), zap.Error(err))
+			}
+		}
+	}
+}
+
+// workerToolchainFor finds the local toolchain of a task: by content hash
+// when the frontend sent one, so both sides run the very same compiler.
+func workerToolchainFor(task *workerTask) (*Toolchain, error) {
+	if task.ToolchainHash == "" && task.Toolchain == "" {
+		return nil, nil
+	}
+	if toolchains == nil {
+		return nil, fmt.Errorf("%w %q", ErrUnknownToolchain, task.Toolchain)
+	}
+	for _, tc := range toolchains.list() {
+		if (task.ToolchainHash != "" && tc.Hash == task.ToolchainHash) || (task.ToolchainHash == "" && tc.Version == task.Toolchain) {
+			return &tc, nil
+		}
+	}
+	return nil, fmt.Errorf("%w %q (hash %s) on worker", ErrUnknownToolchain, task.Toolchain, task.ToolchainHash)
+}
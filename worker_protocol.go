@@ -0,0 +1,132 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Worker protocol: execution workers (MODE=worker) connect to a frontend
+// running SANDBOX_BACKEND=remote over plain HTTP (HTTP/2 when the frontend
+// is behind TLS). Every call carries "Authorization: Bearer <WORKER_TOKEN>"
+// and "X-Worker-ID". The worker
+//
+//	POST /worker/register          announces its capacity and toolchains
+//	POST /worker/heartbeat         every workerHeartbeatInterval (404: register again)
+//	GET  /worker/poll              long-polls for a workerTask (204: none yet)
+//	POST /worker/tasks/{id}/stream streams workerFrames as JSON lines: started
+//	                               (or error), stdout/stderr chunks, exit, usage
+//	GET  /worker/tasks/{id}/stdin  reads the program input while it is produced
+//	GET  /worker/tasks/{id}/control long-polls for a signal to send to the run
+//
+// A worker that misses heartbeats for workerDeadAfter is dropped: its
+// queued tasks go to another worker, the running ones end with ErrWorkerLost.
+const (
+	workerHeartbeatInterval = 5 * time.Second
+	workerDeadAfter         = 3 * workerHeartbeatInterval
+	workerPollTimeout       = 25 * time.Second
+	// workerStartTimeout: an assigned task that has not started streaming by
+	// then is handed to another worker
+	workerStartTimeout = 30 * time.Second
+)
+
+// ErrWorkerLost ends a run whose worker died or disconnected mid-job.
+var ErrWorkerLost = errors.New("execution worker lost")
+
+// ErrNoWorker is returned when no live worker has the requested toolchain.
+var ErrNoWorker = errors.New("no execution worker available")
+
+// workerRegistration is sent by POST /worker/register.
+type workerRegistration struct {
+	ID         string            `json:"id"`
+	Capacity   int               `json:"capacity"`
+	Backend    string            `json:"backend"`
+	Toolchains []workerToolchain `json:"toolchains"`
+}
+
+type workerToolchain struct {
+	Version string `json:"version"`
+	Hash    string `json:"hash"`
+}
+
+// workerTask is a SandboxRequest without its streams, as handed out by
+// GET /worker/poll.
+type workerTask struct {
+	ID            string           `json:"id"`
+	Code          string           `json:"code"`
+	HasStdin      bool             `json:"has_stdin"`
+	PhaseMarker   string           `json:"phase_marker"`
+	Profile       *ResourceProfile `json:"profile"`
+	Artifacts     bool             `json:"artifacts,omitempty"`
+	CheckOnly     bool             `json:"check_only,omitempty"`
+	CaseTimeouts  []int            `json:"case_timeouts,omitempty"`
+	Toolchain     string           `json:"toolchain,omitempty"`
+	ToolchainHash string           `json:"toolchain_hash,omitempty"`
+	// TimeoutMS is SandboxRequest.Timeout (the judge budget in judge
+	// mode); the worker stops the run once it is used up.
+	TimeoutMS int64 `json:"timeout_ms,omitempty"`
+}
+
+// workerFrame is one line of a task stream.
+type workerFrame struct {
+	Type        string         `json:"type"` // started, error, stdout, stderr, exit, usage
+	Data        []byte         `json:"data,omitempty"`
+	ContainerID string         `json:"container_id,omitempty"`
+	ImageDigest string         `json:"image_digest,omitempty"`
+	Exit        *SandboxExit   `json:"exit,omitempty"`
+	Usage       *ResourceUsage `json:"usage,omitempty"`
+	Error       string         `json:"error,omitempty"`
+	// TimedOut marks an exit whose Error wraps ErrExecTimeout.
+	TimedOut bool `json:"timed_out,omitempty"`
+}
+
+// exitFrame is the exit frame of a run; SandboxExit.Err travels as Error.
+func exitFrame(exit SandboxExit) workerFrame {
+	f := workerFrame{Type: "exit", Exit: &exit}
+	if exit.Err != nil {
+		f.Error = exit.Err.Error()
+		f.TimedOut = errors.Is(exit.Err, ErrExecTimeout)
+	}
+	return f
+}
+
+// exitErr rebuilds the SandboxExit.Err of an exit frame from workerID.
+func (f workerFrame) exitErr(workerID string) error {
+	switch {
+	case f.Error == "":
+		return nil
+	case f.TimedOut:
+		return fmt.Errorf("%w: %s", ErrExecTimeout, strings.TrimPrefix(f.Error, ErrExecTimeout.Error()+": "))
+	}
+	return fmt.Errorf("worker %s: %s", workerID, f.Error)
+}
+
+// workerControl is the answer of GET /worker/tasks/{id}/control.
+type workerControl struct {
+	Signal syscall.Signal `json:"signal,omitempty"`
+	Done   bool           `json:"done,omitempty"`
+}
+
+// validWorkerToken compares the bearer token of r with WORKER_TOKEN.
+func validWorkerToken(r *http.Request) bool {
+	if appConfig == nil || appConfig.WorkerToken == "" {
+		return false
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(token), []byte(appConfig.WorkerToken)) == 1
+}
+
+// requireWorker guards the /worker/ endpoints.
+func requireWorker(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !validWorkerToken(r) || r.Header.Get("X-Worker-ID") == "" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h(w, r)
+	}
+}